@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"continuity/client/config"
+	"continuity/client/plan"
 	"continuity/common/requests"
 	"continuity/common/responses"
 	"continuity/common/sshimpl"
@@ -12,6 +13,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -201,6 +203,70 @@ func (c *Client) GetPoolStats(hostname string, printJson bool) {
 	}
 }
 
+func (c *Client) ListStickySessions(hostname string, printJson bool) {
+	resp, err := c.httpclient.Get(c.endpoint + "/" + base64.RawURLEncoding.EncodeToString([]byte(hostname)) + "/sessions")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sessionsResponse := responses.StickySessionsResponse{}
+		err = json.Unmarshal(readBody, &sessionsResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !printJson {
+			log.Print(sessionsResponse.String())
+		} else {
+			jsonOutput, err := json.MarshalIndent(sessionsResponse, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(jsonOutput))
+		}
+	}
+}
+
+/*
+FlushStickySessions
+Removes the sticky session with the given key from the pool, or all of them when the key is empty.
+*/
+func (c *Client) FlushStickySessions(hostname string, key string) {
+	path := c.endpoint + "/" + base64.RawURLEncoding.EncodeToString([]byte(hostname)) + "/sessions"
+	if key != "" {
+		path += "?key=" + url.QueryEscape(key)
+	}
+	req, err := http.NewRequest(http.MethodDelete, path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := c.httpclient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		flushResponse := responses.FlushStickySessionsResponse{}
+		err = json.Unmarshal(readBody, &flushResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d sticky sessions flushed from pool %s\n", flushResponse.Flushed, hostname)
+	}
+}
+
 func (c *Client) UpdatePool(request requests.UpdatePoolRequest) {
 	body, err := json.Marshal(request)
 	log.Println("Updating pool with request:", string(body))
@@ -253,6 +319,24 @@ func (c *Client) RemoveServer(pool string, serverId string) {
 	}
 }
 
+/*
+ServerManagedBy
+Returns what manages a server of the pool: a discovery provider, dns for the servers of a dynamic server, or
+empty for the servers added by hand.
+*/
+func (c *Client) ServerManagedBy(pool string, serverId string) (string, error) {
+	poolResponse, err := c.getPool(pool)
+	if err != nil {
+		return "", err
+	}
+	for _, server := range append(poolResponse.ConditionalServers, poolResponse.UnconditionalServers...) {
+		if server.Id.String() == serverId {
+			return server.ManagedBy, nil
+		}
+	}
+	return "", nil
+}
+
 func (c *Client) Transaction(pool string, request requests.TransactionRequest) {
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -305,6 +389,326 @@ func (c *Client) Transaction(pool string, request requests.TransactionRequest) {
 	}
 }
 
+/*
+CurrentPools
+Fetches the configuration of every pool, indexed by hostname.
+*/
+func (c *Client) CurrentPools() (map[string]*responses.PoolResponse, error) {
+	resp, err := c.httpclient.Get(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pools failed, server responded: %d", resp.StatusCode)
+	}
+	poolsResponse := responses.ListPoolResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&poolsResponse); err != nil {
+		return nil, err
+	}
+	pools := map[string]*responses.PoolResponse{}
+	for _, hostname := range poolsResponse.Pools {
+		pool, err := c.getPool(hostname)
+		if err != nil {
+			return nil, err
+		}
+		pools[hostname] = pool
+	}
+	return pools, nil
+}
+
+func (c *Client) getPool(hostname string) (*responses.PoolResponse, error) {
+	resp, err := c.httpclient.Get(c.endpoint + "/" + base64.RawURLEncoding.EncodeToString([]byte(hostname)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting pool %s failed, server responded: %d", hostname, resp.StatusCode)
+	}
+	poolResponse := &responses.PoolResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(poolResponse); err != nil {
+		return nil, err
+	}
+	return poolResponse, nil
+}
+
+/*
+ApplyPlan
+Executes a plan with the existing endpoints: pools are created and updated first, then servers are swapped,
+added and removed, and pools are deleted last, so that traffic keeps flowing while the changes are made.
+A replaced pool is removed and created again with its servers right away, so that it is left without servers as
+briefly as possible. Stops at the first failed request.
+*/
+func (c *Client) ApplyPlan(p *plan.Plan) {
+	for _, change := range p.Changes {
+		switch change.Action {
+		case plan.ActionReplace:
+			c.RemovePool(change.Hostname)
+			c.AddPool(change.Desired.CreateRequest())
+			for _, server := range change.AddServers {
+				c.AddServer(change.Hostname, server.AddRequest())
+			}
+		case plan.ActionCreate:
+			c.AddPool(change.Desired.CreateRequest())
+		case plan.ActionUpdate:
+			if change.Update != nil {
+				c.UpdatePool(*change.Update)
+			}
+		}
+	}
+	for _, change := range p.Changes {
+		for _, transaction := range change.Transactions {
+			c.Transaction(change.Hostname, transaction.Request())
+		}
+		if change.Action != plan.ActionReplace {
+			for _, server := range change.AddServers {
+				c.AddServer(change.Hostname, server.AddRequest())
+			}
+		}
+		for _, server := range change.RemoveServers {
+			c.RemoveServer(change.Hostname, server.Id.String())
+		}
+	}
+	for _, change := range p.Changes {
+		if change.Action == plan.ActionDelete {
+			c.RemovePool(change.Hostname)
+		}
+	}
+}
+
+func (c *Client) ListListeners(printJson bool) {
+	resp, err := c.httpclient.Get(c.configuration.Host + ":" + fmt.Sprint(c.configuration.Port) + "/listeners")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listenersResponse := responses.ListListenersResponse{}
+		err = json.Unmarshal(readBody, &listenersResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if printJson {
+			jsonOutput, err := json.MarshalIndent(listenersResponse, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(jsonOutput))
+			return
+		}
+		log.Println("Configured Listeners:")
+		for _, listener := range listenersResponse.Listeners {
+			log.Printf("   - %s\n", listener)
+		}
+	}
+}
+
+func (c *Client) AddListener(request requests.CreateListenerRequest) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := c.httpclient.Post(c.configuration.Host+":"+fmt.Sprint(c.configuration.Port)+"/listeners", "", bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		log.Printf("Listener %s added successfully\n", request.Name)
+	}
+}
+
+func (c *Client) RemoveListener(name string) {
+	req, err := http.NewRequest(http.MethodDelete, c.configuration.Host+":"+fmt.Sprint(c.configuration.Port)+"/listeners/"+url.PathEscape(name), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := c.httpclient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		log.Printf("Listener %s removed successfully\n", name)
+	}
+}
+
+func (c *Client) Reload() {
+	c.applyConfigChange("/reload", "Configuration reloaded")
+}
+
+func (c *Client) RollbackConfig(version string) {
+	c.applyConfigChange("/config/rollback/"+url.PathEscape(version), "Configuration rolled back to "+version)
+}
+
+/*
+applyConfigChange
+Calls an endpoint changing the running configuration and prints the changes it made.
+*/
+func (c *Client) applyConfigChange(path string, message string) {
+	resp, err := c.httpclient.Post(c.configuration.Host+":"+fmt.Sprint(c.configuration.Port)+path, "", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadResponse := responses.ReloadResponse{}
+		err = json.Unmarshal(readBody, &reloadResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(reloadResponse.Changes) == 0 {
+			log.Println(message + ", no changes")
+		}
+		for _, change := range reloadResponse.Changes {
+			log.Println(message+":", change)
+		}
+	}
+}
+
+func (c *Client) ExportConfig(printJson bool) {
+	format := "yaml"
+	if printJson {
+		format = "json"
+	}
+	resp, err := c.httpclient.Get(c.configuration.Host + ":" + fmt.Sprint(c.configuration.Port) + "/config?format=" + format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(string(readBody))
+	}
+}
+
+func (c *Client) ApplyConfig(data []byte, dryRun bool) {
+	req, err := http.NewRequest(http.MethodPut, c.configuration.Host+":"+fmt.Sprint(c.configuration.Port)+"/config?dry_run="+fmt.Sprint(dryRun), bytes.NewReader(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := c.httpclient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		applyResponse := responses.ReloadResponse{}
+		err = json.Unmarshal(readBody, &applyResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		message := "Configuration applied"
+		if dryRun {
+			message = "Dry run, would apply"
+		}
+		if len(applyResponse.Changes) == 0 {
+			log.Println(message + ", no changes")
+		}
+		for _, change := range applyResponse.Changes {
+			log.Println(message+":", change)
+		}
+	}
+}
+
+func (c *Client) ConfigHistory(printJson bool) {
+	resp, err := c.httpclient.Get(c.configuration.Host + ":" + fmt.Sprint(c.configuration.Port) + "/config/history")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+	} else {
+		readBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		historyResponse := responses.ConfigHistoryResponse{}
+		err = json.Unmarshal(readBody, &historyResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !printJson {
+			fmt.Print(historyResponse.String())
+		} else {
+			jsonOutput, err := json.MarshalIndent(historyResponse, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(jsonOutput))
+		}
+	}
+}
+
+/*
+ValidateConfig
+Asks the server to validate the content of a configuration file, printing every problem found.
+Returns true if the configuration is valid.
+*/
+func (c *Client) ValidateConfig(data []byte, printJson bool) bool {
+	resp, err := c.httpclient.Post(c.configuration.Host+":"+fmt.Sprint(c.configuration.Port)+"/config/validate", "application/yaml", bytes.NewReader(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		handleError(resp)
+		return false
+	}
+	readBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validateResponse := responses.ValidateConfigResponse{}
+	err = json.Unmarshal(readBody, &validateResponse)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printJson {
+		jsonOutput, err := json.MarshalIndent(validateResponse, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(jsonOutput))
+	} else if validateResponse.Valid {
+		log.Println("Configuration is valid")
+	} else {
+		for _, problem := range validateResponse.Errors {
+			log.Println(problem)
+		}
+	}
+	return validateResponse.Valid
+}
+
 func (c *Client) addAuthHeader(req *http.Request) error {
 	timestamp := []byte(fmt.Sprintf("%d", time.Now().Unix()))
 	signature, err := sshimpl.Crypt(&c.configuration.AuthKey, timestamp)
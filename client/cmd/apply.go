@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"continuity/client/plan"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var autoApprove bool
+var applyMigrateSessions bool
+
+var applyCmd = &cobra.Command{
+	Use:   "apply DESIRED_STATE_FILE",
+	Short: "Bring the pools to the state described in a file, printing the plan and asking for confirmation",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		desired, err := plan.ReadDesiredState(args[0])
+		if err != nil {
+			log.Fatalf("Error reading desired state: %v", err)
+		}
+		current, err := c.CurrentPools()
+		if err != nil {
+			log.Fatalf("Error getting current pools: %v", err)
+		}
+		changes := plan.Compute(desired, current)
+		if applyMigrateSessions {
+			changes.MigrateSessions()
+		}
+		fmt.Print(changes)
+		if changes.Empty() {
+			return
+		}
+		if !autoApprove {
+			fmt.Print("\nDo you want to perform these actions? Only 'yes' will be accepted: ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != "yes" {
+				log.Println("Apply cancelled")
+				return
+			}
+		}
+		c.ApplyPlan(changes)
+		log.Println("Apply complete")
+	},
+}
+
+func init() {
+	applyCmd.Flags().BoolVarP(&autoApprove, "auto-approve", "", false, "Apply the plan without asking for confirmation")
+	applyCmd.Flags().BoolVarP(&applyMigrateSessions, "migrate-sessions", "", false, "Move the sticky sessions of the servers replaced by transactions to the new ones")
+}
@@ -59,6 +59,9 @@ func main() {
 
 	rootCmd.AddCommand(poolCmd)
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(listenerCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(applyCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Error executing command: %v", err)
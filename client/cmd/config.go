@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the server configuration file",
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate CONFIG_FILE",
+	Short: "Validate a server configuration file without applying it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatalf("Error reading configuration file: %v", err)
+		}
+		if !c.ValidateConfig(data, printJson) {
+			os.Exit(1)
+		}
+	},
+}
+
+var configHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the previous versions of the server configuration file",
+	Run: func(cmd *cobra.Command, args []string) {
+		c.ConfigHistory(printJson)
+	},
+}
+
+var configRollbackCmd = &cobra.Command{
+	Use:   "rollback VERSION",
+	Short: "Restore a previous version of the server configuration file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c.RollbackConfig(args[0])
+	},
+}
+
+var dryRun bool
+
+var exportConfigCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the whole running configuration, in the configuration file format",
+	Run: func(cmd *cobra.Command, args []string) {
+		c.ExportConfig(printJson)
+	},
+}
+
+var applyConfigCmd = &cobra.Command{
+	Use:   "apply CONFIG_FILE",
+	Short: "Apply a whole configuration, adding, updating and removing pools and servers as needed",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatalf("Error reading configuration file: %v", err)
+		}
+		c.ApplyConfig(data, dryRun)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(validateConfigCmd)
+	configCmd.AddCommand(configHistoryCmd)
+	configCmd.AddCommand(exportConfigCmd)
+	configCmd.AddCommand(applyConfigCmd)
+	configCmd.AddCommand(configRollbackCmd)
+
+	validateConfigCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
+	configHistoryCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
+	exportConfigCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format instead of YAML")
+	applyConfigCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "Only print the changes that would be applied")
+}
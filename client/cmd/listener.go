@@ -0,0 +1,84 @@
+package main
+
+import (
+	"continuity/common/requests"
+
+	"github.com/spf13/cobra"
+)
+
+var listenerAddress string
+var listenerPort int
+var listenerProxyProtocol bool
+var listenerTlsCertificate string
+var listenerTlsKey string
+var listenerH2C bool
+var listenerReadTimeout int64
+var listenerReadHeaderTimeout int64
+var listenerWriteTimeout int64
+var listenerIdleTimeout int64
+var listenerMaxHeaderBytes int
+var listenerMaxRequestBodyBytes int64
+var listenerCmd = &cobra.Command{
+	Use:   "listener",
+	Short: "Manage load balancer frontend listeners",
+}
+
+var listListenersCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all listeners of the load balancer",
+	Run: func(cmd *cobra.Command, args []string) {
+		c.ListListeners(printJson)
+	},
+}
+
+var addListenerCmd = &cobra.Command{
+	Use:   "add LISTENER_NAME",
+	Short: "Start a new listener, pools are reachable on it unless they are bound to other listeners",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c.AddListener(requests.CreateListenerRequest{
+			Name:                args[0],
+			Address:             listenerAddress,
+			Port:                listenerPort,
+			ProxyProtocol:       listenerProxyProtocol,
+			TlsCertificate:      listenerTlsCertificate,
+			TlsKey:              listenerTlsKey,
+			H2C:                 listenerH2C,
+			ReadTimeout:         listenerReadTimeout,
+			ReadHeaderTimeout:   listenerReadHeaderTimeout,
+			WriteTimeout:        listenerWriteTimeout,
+			IdleTimeout:         listenerIdleTimeout,
+			MaxHeaderBytes:      listenerMaxHeaderBytes,
+			MaxRequestBodyBytes: listenerMaxRequestBodyBytes,
+		})
+	},
+}
+
+var removeListenerCmd = &cobra.Command{
+	Use:   "del LISTENER_NAME",
+	Short: "Stop a listener, waiting for its in-flight requests",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c.RemoveListener(args[0])
+	},
+}
+
+func init() {
+	listenerCmd.AddCommand(listListenersCmd)
+	listenerCmd.AddCommand(addListenerCmd)
+	listenerCmd.AddCommand(removeListenerCmd)
+	listListenersCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
+
+	addListenerCmd.Flags().StringVarP(&listenerAddress, "address", "a", "0.0.0.0", "Address the listener binds to")
+	addListenerCmd.Flags().IntVarP(&listenerPort, "port", "p", 80, "Port the listener binds to")
+	addListenerCmd.Flags().BoolVarP(&listenerProxyProtocol, "proxy-protocol", "", false, "Accept the PROXY protocol header from the clients")
+	addListenerCmd.Flags().StringVarP(&listenerTlsCertificate, "tls-certificate", "", "", "TLS certificate file, read by the server")
+	addListenerCmd.Flags().StringVarP(&listenerTlsKey, "tls-key", "", "", "TLS key file, read by the server")
+	addListenerCmd.Flags().BoolVarP(&listenerH2C, "h2c", "", false, "Accept HTTP/2 without TLS")
+	addListenerCmd.Flags().Int64VarP(&listenerReadTimeout, "read-timeout", "", 0, "Read timeout in seconds (0 to disable)")
+	addListenerCmd.Flags().Int64VarP(&listenerReadHeaderTimeout, "read-header-timeout", "", 0, "Read header timeout in seconds (default 10)")
+	addListenerCmd.Flags().Int64VarP(&listenerWriteTimeout, "write-timeout", "", 0, "Write timeout in seconds (0 to disable)")
+	addListenerCmd.Flags().Int64VarP(&listenerIdleTimeout, "idle-timeout", "", 0, "Idle timeout of keep-alive connections in seconds")
+	addListenerCmd.Flags().IntVarP(&listenerMaxHeaderBytes, "max-header-bytes", "", 0, "Maximum size of the request headers in bytes")
+	addListenerCmd.Flags().Int64VarP(&listenerMaxRequestBodyBytes, "max-body-size", "", 0, "Default maximum request body size in bytes of the pools (0 for no limit)")
+}
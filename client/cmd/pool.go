@@ -17,12 +17,28 @@ var stickySessions bool
 var stickyMethod string
 var StickySessionTimeout int64
 var cookieName string
+var stickyHeader string
+var stickySlidingExpiry bool
+var backendProxyProtocol int
+var requestIdHeader string
+var requestIdHeaderUpdate string
+var upgradeGracePeriod int64
+var upgradeIdleTimeout int64
+var upgradeGracePeriodUpdate int64
+var upgradeIdleTimeoutUpdate int64
+var maxRequestBodyBytes int64
+var maxRequestBodyBytesUpdate int64
 var healthCheckIntervalUpdate *int64
 var healthCheckInitialDelayUpdate *int64
 var healthCheckTimeoutUpdate *int64
 var healthCheckNumOkUpdate *uint32
 var healthCheckNumFailUpdate *uint32
+var poolMode string
+var listenPort int
+var poolListeners []string
+var poolListenersUpdate []string
 var printJson bool
+var sessionKey string
 var poolCmd = &cobra.Command{
 	Use:   "pool",
 	Short: "Manage load balancer pools",
@@ -45,6 +61,16 @@ var addPoolCmd = &cobra.Command{
 			StickyMethod:            stickyMethod,
 			StickySessionTimeout:    StickySessionTimeout,
 			StickySessionCookieName: cookieName,
+			StickyHeader:            stickyHeader,
+			StickySlidingExpiry:     stickySlidingExpiry,
+			BackendProxyProtocol:    backendProxyProtocol,
+			RequestIdHeader:         requestIdHeader,
+			UpgradeGracePeriod:      upgradeGracePeriod,
+			UpgradeIdleTimeout:      upgradeIdleTimeout,
+			MaxRequestBodyBytes:     maxRequestBodyBytes,
+			Mode:                    poolMode,
+			ListenPort:              listenPort,
+			Listeners:               poolListeners,
 		})
 	},
 }
@@ -92,6 +118,18 @@ var updatePoolCmd = &cobra.Command{
 	Short: "Update configuration of a specific pool",
 	Run: func(cmd *cobra.Command, args []string) {
 		checkPoolArg(args)
+		var listeners []string
+		if cmd.Flags().Changed("listeners") {
+			// an empty list binds the pool to every listener again
+			listeners = append([]string{}, poolListenersUpdate...)
+		}
+		var upgradeGracePeriod, upgradeIdleTimeout *int64
+		if cmd.Flags().Changed("upgrade-grace-period") {
+			upgradeGracePeriod = &upgradeGracePeriodUpdate
+		}
+		if cmd.Flags().Changed("upgrade-idle-timeout") {
+			upgradeIdleTimeout = &upgradeIdleTimeoutUpdate
+		}
 		c.UpdatePool(requests.UpdatePoolRequest{
 			Hostname:                hostname,
 			HealthCheckInterval:     *healthCheckIntervalUpdate,
@@ -99,10 +137,38 @@ var updatePoolCmd = &cobra.Command{
 			HealthCheckTimeout:      *healthCheckTimeoutUpdate,
 			HealthCheck_numOk:       *healthCheckNumOkUpdate,
 			HealthCheck_numFail:     *healthCheckNumFailUpdate,
+			RequestIdHeader:         requestIdHeaderUpdate,
+			UpgradeGracePeriod:      upgradeGracePeriod,
+			UpgradeIdleTimeout:      upgradeIdleTimeout,
+			MaxRequestBodyBytes:     maxRequestBodyBytesUpdate,
+			Listeners:               listeners,
 		})
 	},
 }
 
+var poolSessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manage the sticky sessions of a pool",
+}
+
+var listSessionsCmd = &cobra.Command{
+	Use:   "list POOL_NAME",
+	Short: "List the sticky sessions of a pool, most recently used first",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkPoolArg(args)
+		c.ListStickySessions(hostname, printJson)
+	},
+}
+
+var flushSessionsCmd = &cobra.Command{
+	Use:   "flush POOL_NAME",
+	Short: "Flush one or all sticky sessions of a pool, their clients are balanced again",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkPoolArg(args)
+		c.FlushStickySessions(hostname, sessionKey)
+	},
+}
+
 func checkPoolArg(args []string) {
 	if len(args) == 0 {
 		if configuration.DefaultPool != "" {
@@ -122,8 +188,13 @@ func init() {
 	poolCmd.AddCommand(poolConfigCmd)
 	poolCmd.AddCommand(poolStatsCmd)
 	poolCmd.AddCommand(updatePoolCmd)
+	poolCmd.AddCommand(poolSessionsCmd)
+	poolSessionsCmd.AddCommand(listSessionsCmd)
+	poolSessionsCmd.AddCommand(flushSessionsCmd)
 	poolConfigCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
 	poolStatsCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
+	listSessionsCmd.Flags().BoolVarP(&printJson, "json", "j", false, "Print output in JSON format")
+	flushSessionsCmd.Flags().StringVarP(&sessionKey, "key", "k", "", "Key of the session to flush: client IP or cookie value (default all)")
 
 	healthCheckInterval = addPoolCmd.Flags().Int64P("health-check-interval", "i", 10, "Health check interval in seconds")
 	healthCheckInitialDelay = addPoolCmd.Flags().Int64P("health-check-initial-delay", "d", 20, "Health check initial delay in seconds")
@@ -131,12 +202,27 @@ func init() {
 	healthCheckNumFail = addPoolCmd.Flags().Uint32P("health-fail", "", 3, "Number of consecutive failed responses required to mark a server unhealthy")
 	healthCheckTimeout = addPoolCmd.Flags().Int64P("health-check-timeout", "t", 5, "Health check timeout in seconds")
 	addPoolCmd.Flags().BoolVarP(&stickySessions, "sticky-sessions", "s", false, "Enable sticky sessions")
-	addPoolCmd.Flags().StringVarP(&stickyMethod, "sticky-method", "", "LBCookie", "Sticky session method (IP, AppCookie, LBCookie)")
+	addPoolCmd.Flags().StringVarP(&stickyMethod, "sticky-method", "", "LBCookie", "Sticky session method (IP, AppCookie, LBCookie, Header)")
 	addPoolCmd.Flags().StringVarP(&cookieName, "cookie-name", "", "", "Cookie name for AppCookie sticky method")
+	addPoolCmd.Flags().StringVarP(&stickyHeader, "sticky-header", "", "", "Request header for Header sticky method, e.g. Authorization or X-Tenant-ID")
+	addPoolCmd.Flags().BoolVarP(&stickySlidingExpiry, "sticky-sliding-expiry", "", false, "Expire sticky sessions after the timeout without requests instead of after their creation")
+	addPoolCmd.Flags().StringVarP(&requestIdHeader, "request-id-header", "", "", "Header used to propagate the request ID (default X-Request-ID)")
+	addPoolCmd.Flags().Int64VarP(&upgradeGracePeriod, "upgrade-grace-period", "", 30, "Seconds upgraded connections (e.g. WebSockets) are kept open after their server is removed")
+	addPoolCmd.Flags().Int64VarP(&upgradeIdleTimeout, "upgrade-idle-timeout", "", 0, "Seconds of inactivity after which upgraded connections are closed (0 to disable)")
+	addPoolCmd.Flags().Int64VarP(&maxRequestBodyBytes, "max-body-size", "", 0, "Maximum request body size in bytes, larger requests get a 413 (0 to use the server default)")
+	addPoolCmd.Flags().IntVarP(&backendProxyProtocol, "backend-proxy-protocol", "", 0, "Send PROXY protocol header to the servers (1 or 2, 0 to disable)")
+	addPoolCmd.Flags().StringVarP(&poolMode, "mode", "", "http", "Pool mode: http, or tcp, udp and tls (SNI passthrough) for layer 4 pools")
+	addPoolCmd.Flags().IntVarP(&listenPort, "listen-port", "", 0, "Port the tcp or udp pool listens on")
+	addPoolCmd.Flags().StringSliceVarP(&poolListeners, "listeners", "", nil, "Listeners the pool is reachable on (default all)")
 
 	healthCheckIntervalUpdate = updatePoolCmd.Flags().Int64P("health-check-interval", "i", 10, "Health check interval in seconds")
 	healthCheckInitialDelayUpdate = updatePoolCmd.Flags().Int64P("health-check-initial-delay", "d", 20, "Health check initial delay in seconds")
 	healthCheckNumOkUpdate = updatePoolCmd.Flags().Uint32P("health-ok", "", 3, "Number of consecutive OK responses required to mark a server healthy")
 	healthCheckNumFailUpdate = updatePoolCmd.Flags().Uint32P("health-fail", "", 3, "Number of consecutive failed responses required to mark a server unhealthy")
 	healthCheckTimeoutUpdate = updatePoolCmd.Flags().Int64P("health-check-timeout", "t", 5, "Health check timeout in seconds")
+	updatePoolCmd.Flags().Int64VarP(&upgradeGracePeriodUpdate, "upgrade-grace-period", "", 0, "Seconds upgraded connections are kept open after their server is removed")
+	updatePoolCmd.Flags().Int64VarP(&upgradeIdleTimeoutUpdate, "upgrade-idle-timeout", "", 0, "Seconds of inactivity after which upgraded connections are closed (0 to disable)")
+	updatePoolCmd.Flags().Int64VarP(&maxRequestBodyBytesUpdate, "max-body-size", "", 0, "Maximum request body size in bytes, larger requests get a 413")
+	updatePoolCmd.Flags().StringVarP(&requestIdHeaderUpdate, "request-id-header", "", "", "Header used to propagate the request ID")
+	updatePoolCmd.Flags().StringSliceVarP(&poolListenersUpdate, "listeners", "", nil, "Listeners the pool is reachable on, empty for all")
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"continuity/common"
 	"continuity/common/requests"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -14,6 +18,10 @@ var serverUUID string
 var serverPort int
 var healthCheckPath string
 var serverCondition string
+var serverProtocol string
+var serverResolve string
+var serverNameserver string
+var migrateSessions bool
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
@@ -31,8 +39,11 @@ var addServerCmd = &cobra.Command{
 		checkPoolParameter()
 		c.AddServer(poolName, requests.AddServerRequest{
 			NewServerAddress: serverAddress,
-			HealthCheckPath:  healthCheckPath,
+			HealthCheckPath:  serverHealthCheck(cmd),
 			Condition:        condition,
+			Protocol:         serverProtocol,
+			Resolve:          serverResolve,
+			Nameserver:       serverNameserver,
 		})
 	},
 }
@@ -41,6 +52,20 @@ var removeServerCmd = &cobra.Command{
 	Short: "Remove a server from a pool",
 	Run: func(cmd *cobra.Command, args []string) {
 		checkPoolParameter()
+		if !autoApprove {
+			managedBy, err := c.ServerManagedBy(poolName, serverUUID)
+			if err != nil {
+				log.Fatalf("Error getting pool %s: %v", poolName, err)
+			}
+			if managedBy != "" {
+				fmt.Printf("Server %s is managed by %s, which may add it back. Remove it anyway? Only 'yes' will be accepted: ", serverUUID, managedBy)
+				answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if strings.TrimSpace(answer) != "yes" {
+					log.Println("Removal cancelled")
+					return
+				}
+			}
+		}
 		c.RemoveServer(poolName, serverUUID)
 	},
 }
@@ -55,12 +80,34 @@ var transactionCmd = &cobra.Command{
 		checkPoolParameter()
 		c.Transaction(poolName, requests.TransactionRequest{
 			NewServerAddress:         serverAddress,
-			NewServerHealthCheckPath: healthCheckPath,
+			NewServerHealthCheckPath: serverHealthCheck(cmd),
 			NewServerCondition:       condition,
 			OldServerId:              serverUUID,
+			NewServerProtocol:        serverProtocol,
+			MigrateSessions:          migrateSessions,
 		})
 	},
 }
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the server configuration file",
+	Run: func(cmd *cobra.Command, args []string) {
+		c.Reload()
+	},
+}
+
+/*
+serverHealthCheck
+Returns the health check of the server to add: servers of layer 4 pools are checked with a connection by
+default, so the /health default only applies to http:// and https:// servers.
+*/
+func serverHealthCheck(cmd *cobra.Command) string {
+	if !cmd.Flags().Changed("health-check") &&
+		(strings.HasPrefix(serverAddress, "tcp://") || strings.HasPrefix(serverAddress, "udp://")) {
+		return ""
+	}
+	return healthCheckPath
+}
 
 func checkPoolParameter() {
 	if poolName == "" {
@@ -76,20 +123,27 @@ func init() {
 	serverCmd.AddCommand(addServerCmd)
 	serverCmd.AddCommand(removeServerCmd)
 	serverCmd.AddCommand(transactionCmd)
+	serverCmd.AddCommand(reloadCmd)
 
 	addServerCmd.Flags().StringVarP(&poolName, "pool", "p", "", "Name of the pool")
-	addServerCmd.Flags().StringVarP(&serverAddress, "address", "a", "", "Address of the server to add. Must include protocol (http:// or https://)")
-	addServerCmd.Flags().StringVarP(&healthCheckPath, "health-check", "c", "/health", "Health check path for the server")
+	addServerCmd.Flags().StringVarP(&serverAddress, "address", "a", "", "Address of the server to add. Must include protocol (http://, https://, or tcp:// and udp:// for layer 4 pools)")
+	addServerCmd.Flags().StringVarP(&healthCheckPath, "health-check", "c", "/health", "Health check path for the server, or a tcp:// or http(s):// URL for layer 4 pools")
 	addServerCmd.Flags().StringVarP(&serverCondition, "condition", "", "", "Condition for adding the server in the format header=value")
+	addServerCmd.Flags().StringVarP(&serverProtocol, "protocol", "", "", "Protocol used to talk to the server (http1, h2c, h2)")
+	addServerCmd.Flags().StringVarP(&serverResolve, "resolve", "", "", "Resolve the host of the address from DNS and add a server per address: a (A/AAAA records) or srv (SRV records, the address has no port)")
+	addServerCmd.Flags().StringVarP(&serverNameserver, "nameserver", "", "", "Nameserver used with --resolve, defaults to the one of /etc/resolv.conf")
 	_ = addPoolCmd.MarkFlagRequired("address")
 
 	removeServerCmd.Flags().StringVarP(&poolName, "pool", "", "", "Name of the pool")
-	removeServerCmd.Flags().StringVarP(&serverUUID, "server", "s", "", "UUID of the server to remove")
+	removeServerCmd.Flags().StringVarP(&serverUUID, "server", "s", "", "UUID of the server or dynamic server to remove")
+	removeServerCmd.Flags().BoolVarP(&autoApprove, "auto-approve", "", false, "Remove a server managed by a discovery provider or DNS without asking for confirmation")
 	_ = removeServerCmd.MarkFlagRequired("server")
 
 	transactionCmd.Flags().StringVarP(&poolName, "pool", "p", "", "Name of the pool")
-	transactionCmd.Flags().StringVarP(&serverAddress, "address", "a", "", "Address of the server to add. Must include protocol (http:// or https://)")
+	transactionCmd.Flags().StringVarP(&serverAddress, "address", "a", "", "Address of the server to add. Must include protocol (http://, https://, or tcp:// and udp:// for layer 4 pools)")
 	transactionCmd.Flags().StringVarP(&healthCheckPath, "health-check", "c", "/health", "Health check path for the server to add")
 	transactionCmd.Flags().StringVarP(&serverUUID, "remove-server", "r", "", "UUID of the server to remove")
+	transactionCmd.Flags().StringVarP(&serverProtocol, "protocol", "", "", "Protocol used to talk to the server to add (http1, h2c, h2)")
+	transactionCmd.Flags().BoolVarP(&migrateSessions, "migrate-sessions", "", false, "Move the sticky sessions of the removed server to the new one")
 	_ = transactionCmd.MarkFlagRequired("address")
 }
@@ -0,0 +1,544 @@
+/*
+Package plan computes the changes needed to bring the pools of a running load balancer to a desired state,
+described in a YAML file, and renders them for review before they are applied through the API.
+*/
+package plan
+
+import (
+	"continuity/common"
+	"continuity/common/requests"
+	"continuity/common/responses"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const DEFAULT_HEALTH_CHECK_PATH = "/health"
+
+const (
+	MODE_HTTP = "http"
+	MODE_TCP  = "tcp"
+	MODE_UDP  = "udp"
+	MODE_TLS  = "tls"
+)
+
+type Action string
+
+const (
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionReplace Action = "replace"
+	ActionDelete  Action = "delete"
+)
+
+type DesiredState struct {
+	Pools []DesiredPool `yaml:"pools"`
+}
+
+type DesiredPool struct {
+	Hostname                string          `yaml:"hostname"`
+	HealthCheckInterval     int64           `yaml:"health_check_interval"`
+	HealthCheckInitialDelay int64           `yaml:"health_check_initial_delay"`
+	HealthCheckTimeout      int64           `yaml:"health_check_timeout"`
+	HealthCheck_numOk       uint32          `yaml:"health_check_num_ok"`
+	HealthCheck_numFail     uint32          `yaml:"health_check_num_fail"`
+	StickySessions          bool            `yaml:"sticky_sessions"`
+	StickyMethod            string          `yaml:"sticky_method"`
+	StickySessionTimeout    int64           `yaml:"sticky_session_timeout"`
+	StickySessionCookieName string          `yaml:"sticky_session_cookie_name"`
+	StickyHeader            string          `yaml:"sticky_header"`
+	StickySlidingExpiry     bool            `yaml:"sticky_sliding_expiry"`
+	BackendProxyProtocol    int             `yaml:"backend_proxy_protocol"`
+	RequestIdHeader         string          `yaml:"request_id_header"`
+	UpgradeGracePeriod      int64           `yaml:"upgrade_grace_period"`
+	UpgradeIdleTimeout      int64           `yaml:"upgrade_idle_timeout"`
+	MaxRequestBodyBytes     int64           `yaml:"max_request_body_bytes"`
+	Mode                    string          `yaml:"mode"`
+	ListenPort              int             `yaml:"listen_port"`
+	Listeners               []string        `yaml:"listeners"`
+	Servers                 []DesiredServer `yaml:"servers"`
+}
+
+type DesiredServer struct {
+	Address         string           `yaml:"address"`
+	HealthCheckPath string           `yaml:"health_check_path"`
+	Condition       common.Condition `yaml:"condition"`
+	Protocol        string           `yaml:"protocol"`
+}
+
+/*
+Transaction
+A server replaced by another one with a zero downtime transaction.
+*/
+type Transaction struct {
+	Old *responses.ServerHostResponse
+	New DesiredServer
+	// MigrateSessions moves the sticky sessions of the old server to the new one
+	MigrateSessions bool
+}
+
+type PoolChange struct {
+	Action   Action
+	Hostname string
+	Desired  *DesiredPool
+	// Reasons lists the changed settings, for updates and replacements
+	Reasons       []string
+	Update        *requests.UpdatePoolRequest
+	AddServers    []DesiredServer
+	RemoveServers []*responses.ServerHostResponse
+	Transactions  []Transaction
+}
+
+type Plan struct {
+	Changes []PoolChange
+}
+
+/*
+ReadDesiredState
+Reads and checks a desired state file.
+*/
+func ReadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	desired := &DesiredState{}
+	if err := yaml.UnmarshalStrict(data, desired); err != nil {
+		return nil, err
+	}
+	if err := desired.validate(); err != nil {
+		return nil, err
+	}
+	return desired, nil
+}
+
+func (d *DesiredState) validate() error {
+	problems := []string{}
+	hostnames := map[string]bool{}
+	for i := range d.Pools {
+		pool := &d.Pools[i]
+		path := fmt.Sprintf("pools[%d] (%s)", i, pool.Hostname)
+		if pool.Hostname == "" {
+			problems = append(problems, path+": hostname is required")
+		} else if hostnames[pool.Hostname] {
+			problems = append(problems, path+": duplicate hostname")
+		}
+		hostnames[pool.Hostname] = true
+		if pool.HealthCheckInterval <= 0 || pool.HealthCheckInitialDelay <= 0 || pool.HealthCheckTimeout <= 0 ||
+			pool.HealthCheck_numOk == 0 || pool.HealthCheck_numFail == 0 {
+			problems = append(problems, path+": health_check_interval, health_check_initial_delay, health_check_timeout, health_check_num_ok and health_check_num_fail must be greater than 0")
+		}
+		pool.Mode = poolMode(pool.Mode)
+		layer4 := pool.Mode == MODE_TCP || pool.Mode == MODE_UDP || pool.Mode == MODE_TLS
+		if !layer4 && pool.Mode != MODE_HTTP {
+			problems = append(problems, path+": mode must be one of http, tcp, udp or tls")
+		} else if pool.Mode == MODE_TLS && pool.ListenPort != 0 {
+			problems = append(problems, path+": listen_port is not applicable to tls pools, they are routed by SNI on the listeners")
+		} else if layer4 && pool.Mode != MODE_TLS && (pool.ListenPort <= 0 || pool.ListenPort > 65535) {
+			problems = append(problems, path+": listen_port must be between 1 and 65535 for "+pool.Mode+" pools")
+		} else if !layer4 && pool.ListenPort != 0 {
+			problems = append(problems, path+": listen_port is only applicable to tcp and udp pools")
+		}
+		servers := map[string]bool{}
+		for j := range pool.Servers {
+			server := &pool.Servers[j]
+			serverPath := fmt.Sprintf("%s.servers[%d] (%s)", path, j, server.Address)
+			parsed, err := url.Parse(server.Address)
+			if layer4 {
+				// layer 4 servers are checked with a connection unless a health check URL is given
+				scheme := pool.Mode
+				if scheme == MODE_TLS {
+					scheme = MODE_TCP
+				}
+				if err != nil || parsed.Scheme != scheme || parsed.Port() == "" {
+					problems = append(problems, serverPath+": address must be "+scheme+"://host:port")
+					continue
+				}
+			} else {
+				if server.HealthCheckPath == "" {
+					server.HealthCheckPath = DEFAULT_HEALTH_CHECK_PATH
+				}
+				if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+					problems = append(problems, serverPath+": address must be an absolute URL starting with http:// or https://")
+					continue
+				}
+			}
+			server.Address = parsed.String()
+			if key := server.key(); servers[key] {
+				problems = append(problems, serverPath+": duplicate server with the same condition")
+			} else {
+				servers[key] = true
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid desired state:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (s DesiredServer) key() string {
+	return serverKey(s.Address, s.Condition)
+}
+
+func serverKey(address string, condition common.Condition) string {
+	return address + " " + condition.Header + "=" + condition.Value
+}
+
+func (s DesiredServer) String() string {
+	description := s.Address
+	if s.Condition != (common.Condition{}) {
+		description += " [" + s.Condition.Header + "=" + s.Condition.Value + "]"
+	}
+	details := []string{}
+	if s.HealthCheckPath != "" {
+		details = append(details, "health check "+s.HealthCheckPath)
+	}
+	if s.Protocol != "" {
+		details = append(details, s.Protocol)
+	}
+	if len(details) > 0 {
+		description += " (" + strings.Join(details, ", ") + ")"
+	}
+	return description
+}
+
+func describeServer(server *responses.ServerHostResponse) string {
+	description := server.Address.String()
+	if server.Condition != (common.Condition{}) {
+		description += " [" + server.Condition.Header + "=" + server.Condition.Value + "]"
+	}
+	return description + " (" + server.Id.String() + ")"
+}
+
+/*
+Compute
+Compares the desired state with the current pools, indexed by hostname, and returns the changes to make.
+Pools missing from the desired state are deleted. Pools are replaced when a setting that can't be updated changes.
+Servers are matched by address and condition; a server replaced by another one with the same condition, or
+whose health check path or protocol changes, is swapped with a transaction.
+*/
+func Compute(desired *DesiredState, current map[string]*responses.PoolResponse) *Plan {
+	plan := &Plan{Changes: []PoolChange{}}
+	for i := range desired.Pools {
+		desiredPool := &desired.Pools[i]
+		currentPool, exists := current[desiredPool.Hostname]
+		if !exists {
+			plan.Changes = append(plan.Changes, PoolChange{
+				Action:     ActionCreate,
+				Hostname:   desiredPool.Hostname,
+				Desired:    desiredPool,
+				AddServers: desiredPool.Servers,
+			})
+			continue
+		}
+		if reasons := replacementReasons(desiredPool, currentPool); len(reasons) > 0 {
+			plan.Changes = append(plan.Changes, PoolChange{
+				Action:     ActionReplace,
+				Hostname:   desiredPool.Hostname,
+				Desired:    desiredPool,
+				Reasons:    reasons,
+				AddServers: desiredPool.Servers,
+			})
+			continue
+		}
+		change := PoolChange{Action: ActionUpdate, Hostname: desiredPool.Hostname, Desired: desiredPool}
+		change.Update, change.Reasons = updateRequest(desiredPool, currentPool)
+		diffServers(&change, desiredPool, currentPool)
+		if change.Update != nil || len(change.AddServers) > 0 || len(change.RemoveServers) > 0 || len(change.Transactions) > 0 {
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+	wanted := map[string]bool{}
+	for _, desiredPool := range desired.Pools {
+		wanted[desiredPool.Hostname] = true
+	}
+	deleted := []string{}
+	for hostname := range current {
+		if !wanted[hostname] {
+			deleted = append(deleted, hostname)
+		}
+	}
+	sort.Strings(deleted)
+	for _, hostname := range deleted {
+		plan.Changes = append(plan.Changes, PoolChange{Action: ActionDelete, Hostname: hostname})
+	}
+	return plan
+}
+
+// poolMode returns the mode of a pool, servers that don't report it only have HTTP pools
+func poolMode(mode string) string {
+	if mode == "" {
+		return MODE_HTTP
+	}
+	return mode
+}
+
+func replacementReasons(desired *DesiredPool, current *responses.PoolResponse) []string {
+	reasons := []string{}
+	if poolMode(desired.Mode) != poolMode(current.Mode) {
+		reasons = append(reasons, fmt.Sprintf("mode: %s -> %s", poolMode(current.Mode), poolMode(desired.Mode)))
+	}
+	if desired.ListenPort != current.ListenPort {
+		reasons = append(reasons, fmt.Sprintf("listen_port: %d -> %d", current.ListenPort, desired.ListenPort))
+	}
+	if desired.BackendProxyProtocol != current.BackendProxyProtocol {
+		reasons = append(reasons, fmt.Sprintf("backend_proxy_protocol: %d -> %d", current.BackendProxyProtocol, desired.BackendProxyProtocol))
+	}
+	return reasons
+}
+
+/*
+updateRequest
+Returns the request updating the settings that differ, or nil if none does.
+Optional settings left out of the desired state are not changed.
+*/
+func updateRequest(desired *DesiredPool, current *responses.PoolResponse) (*requests.UpdatePoolRequest, []string) {
+	request := &requests.UpdatePoolRequest{Hostname: desired.Hostname}
+	reasons := []string{}
+	if uint64(desired.HealthCheckInterval) != current.HealthCheckInterval {
+		request.HealthCheckInterval = desired.HealthCheckInterval
+		reasons = append(reasons, fmt.Sprintf("health_check_interval: %d -> %d", current.HealthCheckInterval, desired.HealthCheckInterval))
+	}
+	if uint64(desired.HealthCheckInitialDelay) != current.HealthCheckInitialDelay {
+		request.HealthCheckInitialDelay = desired.HealthCheckInitialDelay
+		reasons = append(reasons, fmt.Sprintf("health_check_initial_delay: %d -> %d", current.HealthCheckInitialDelay, desired.HealthCheckInitialDelay))
+	}
+	if uint64(desired.HealthCheckTimeout) != current.HealthCheckTimeout {
+		request.HealthCheckTimeout = desired.HealthCheckTimeout
+		reasons = append(reasons, fmt.Sprintf("health_check_timeout: %d -> %d", current.HealthCheckTimeout, desired.HealthCheckTimeout))
+	}
+	if desired.HealthCheck_numOk != current.HealthCheck_numOk {
+		request.HealthCheck_numOk = desired.HealthCheck_numOk
+		reasons = append(reasons, fmt.Sprintf("health_check_num_ok: %d -> %d", current.HealthCheck_numOk, desired.HealthCheck_numOk))
+	}
+	if desired.HealthCheck_numFail != current.HealthCheck_numFail {
+		request.HealthCheck_numFail = desired.HealthCheck_numFail
+		reasons = append(reasons, fmt.Sprintf("health_check_num_fail: %d -> %d", current.HealthCheck_numFail, desired.HealthCheck_numFail))
+	}
+	if desired.RequestIdHeader != "" && desired.RequestIdHeader != current.RequestIdHeader {
+		request.RequestIdHeader = desired.RequestIdHeader
+		reasons = append(reasons, fmt.Sprintf("request_id_header: %s -> %s", current.RequestIdHeader, desired.RequestIdHeader))
+	}
+	if desired.UpgradeGracePeriod != 0 && uint64(desired.UpgradeGracePeriod) != current.UpgradeGracePeriod {
+		request.UpgradeGracePeriod = &desired.UpgradeGracePeriod
+		reasons = append(reasons, fmt.Sprintf("upgrade_grace_period: %d -> %d", current.UpgradeGracePeriod, desired.UpgradeGracePeriod))
+	}
+	// no idle timeout means disabled, as when the pool is created
+	if uint64(desired.UpgradeIdleTimeout) != current.UpgradeIdleTimeout {
+		request.UpgradeIdleTimeout = &desired.UpgradeIdleTimeout
+		reasons = append(reasons, fmt.Sprintf("upgrade_idle_timeout: %d -> %d", current.UpgradeIdleTimeout, desired.UpgradeIdleTimeout))
+	}
+	if desired.MaxRequestBodyBytes != 0 && desired.MaxRequestBodyBytes != current.MaxRequestBodyBytes {
+		request.MaxRequestBodyBytes = desired.MaxRequestBodyBytes
+		reasons = append(reasons, fmt.Sprintf("max_request_body_bytes: %d -> %d", current.MaxRequestBodyBytes, desired.MaxRequestBodyBytes))
+	}
+	// no listeners means every listener
+	listeners := append([]string{}, desired.Listeners...)
+	sort.Strings(listeners)
+	if !slices.Equal(listeners, current.Listeners) {
+		request.Listeners = listeners
+		reasons = append(reasons, fmt.Sprintf("listeners: [%s] -> [%s]", strings.Join(current.Listeners, ","), strings.Join(listeners, ",")))
+	}
+	if stickyReasons := stickyChanges(desired, current); len(stickyReasons) > 0 {
+		request.StickySessions = &desired.StickySessions
+		request.StickyMethod = desired.StickyMethod
+		request.StickySessionTimeout = desired.StickySessionTimeout
+		request.StickySessionCookieName = desired.StickySessionCookieName
+		request.StickyHeader = desired.StickyHeader
+		request.StickySlidingExpiry = desired.StickySlidingExpiry
+		reasons = append(reasons, stickyReasons...)
+	}
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+	return request, reasons
+}
+
+// stickyChanges returns the changed sticky session settings, they are replaced together
+func stickyChanges(desired *DesiredPool, current *responses.PoolResponse) []string {
+	reasons := []string{}
+	if desired.StickySessions != current.StickySessions {
+		reasons = append(reasons, fmt.Sprintf("sticky_sessions: %t -> %t", current.StickySessions, desired.StickySessions))
+	} else if desired.StickySessions {
+		if desired.StickyMethod != current.StickyMethod {
+			reasons = append(reasons, fmt.Sprintf("sticky_method: %s -> %s", current.StickyMethod, desired.StickyMethod))
+		}
+		if uint64(desired.StickySessionTimeout) != current.StickySessionTimeout {
+			reasons = append(reasons, fmt.Sprintf("sticky_session_timeout: %d -> %d", current.StickySessionTimeout, desired.StickySessionTimeout))
+		}
+		if desired.StickyMethod == "AppCookie" && desired.StickySessionCookieName != current.StickyCookieName {
+			reasons = append(reasons, fmt.Sprintf("sticky_session_cookie_name: %s -> %s", current.StickyCookieName, desired.StickySessionCookieName))
+		}
+		if desired.StickyMethod == "Header" && http.CanonicalHeaderKey(desired.StickyHeader) != current.StickyHeader {
+			reasons = append(reasons, fmt.Sprintf("sticky_header: %s -> %s", current.StickyHeader, desired.StickyHeader))
+		}
+		if desired.StickySlidingExpiry != current.StickySlidingExpiry {
+			reasons = append(reasons, fmt.Sprintf("sticky_sliding_expiry: %t -> %t", current.StickySlidingExpiry, desired.StickySlidingExpiry))
+		}
+	}
+	return reasons
+}
+
+func diffServers(change *PoolChange, desired *DesiredPool, current *responses.PoolResponse) {
+	currentServers := map[string]*responses.ServerHostResponse{}
+	removed := []*responses.ServerHostResponse{}
+	for _, server := range append(append([]*responses.ServerHostResponse{}, current.ConditionalServers...), current.UnconditionalServers...) {
+		// servers added by a discovery provider or resolved from DNS are left to it
+		if server.ManagedBy != "" {
+			continue
+		}
+		currentServers[serverKey(server.Address.String(), server.Condition)] = server
+		removed = append(removed, server)
+	}
+	added := []DesiredServer{}
+	kept := map[*responses.ServerHostResponse]bool{}
+	for _, server := range desired.Servers {
+		existing, exists := currentServers[server.key()]
+		if !exists {
+			added = append(added, server)
+			continue
+		}
+		kept[existing] = true
+		if existing.HealthCheckPath != server.HealthCheckPath || existing.Protocol != server.Protocol {
+			change.Transactions = append(change.Transactions, Transaction{Old: existing, New: server})
+		}
+	}
+	remaining := []*responses.ServerHostResponse{}
+	for _, server := range removed {
+		if !kept[server] {
+			remaining = append(remaining, server)
+		}
+	}
+	// a removed server is swapped with an added one having the same condition
+	for _, server := range added {
+		paired := false
+		for i, old := range remaining {
+			if old.Condition == server.Condition {
+				change.Transactions = append(change.Transactions, Transaction{Old: old, New: server})
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			change.AddServers = append(change.AddServers, server)
+		}
+	}
+	change.RemoveServers = remaining
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+/*
+MigrateSessions
+Makes every transaction of the plan move the sticky sessions of the old server to the new one.
+*/
+func (p *Plan) MigrateSessions() {
+	for i := range p.Changes {
+		for j := range p.Changes[i].Transactions {
+			p.Changes[i].Transactions[j].MigrateSessions = true
+		}
+	}
+}
+
+func (p *Plan) String() string {
+	if p.Empty() {
+		return "No changes. The pools match the desired state.\n"
+	}
+	var created, updated, replaced, deleted, addedServers, removedServers, transactions int
+	output := "Continuity will perform the following actions:\n\n"
+	for _, change := range p.Changes {
+		switch change.Action {
+		case ActionCreate:
+			created++
+			output += "  + pool " + change.Hostname + " (create)\n"
+		case ActionUpdate:
+			updated++
+			output += "  ~ pool " + change.Hostname + " (update)\n"
+		case ActionReplace:
+			replaced++
+			output += "-/+ pool " + change.Hostname + " (replace, settings can't be updated in place)\n"
+		case ActionDelete:
+			deleted++
+			output += "  - pool " + change.Hostname + " (delete)\n"
+		}
+		for _, reason := range change.Reasons {
+			output += "      ~ " + reason + "\n"
+		}
+		for _, server := range change.AddServers {
+			addedServers++
+			output += "      + server " + server.String() + "\n"
+		}
+		for _, transaction := range change.Transactions {
+			transactions++
+			kind := "transaction"
+			if transaction.MigrateSessions {
+				kind += ", sticky sessions migrated"
+			}
+			output += "      ~ server " + describeServer(transaction.Old) + " -> " + transaction.New.String() + " (" + kind + ")\n"
+		}
+		for _, server := range change.RemoveServers {
+			removedServers++
+			output += "      - server " + describeServer(server) + "\n"
+		}
+	}
+	output += fmt.Sprintf("\nPlan: %d pools to create, %d to update, %d to replace, %d to delete; "+
+		"%d servers to add, %d to remove, %d transactions.\n",
+		created, updated, replaced, deleted, addedServers, removedServers, transactions)
+	return output
+}
+
+func (d *DesiredPool) CreateRequest() requests.CreatePoolRequest {
+	return requests.CreatePoolRequest{
+		Hostname:                d.Hostname,
+		HealthCheckInterval:     d.HealthCheckInterval,
+		HealthCheckInitialDelay: d.HealthCheckInitialDelay,
+		HealthCheckTimeout:      d.HealthCheckTimeout,
+		HealthCheck_numOk:       d.HealthCheck_numOk,
+		HealthCheck_numFail:     d.HealthCheck_numFail,
+		StickySessions:          d.StickySessions,
+		StickyMethod:            d.StickyMethod,
+		StickySessionTimeout:    d.StickySessionTimeout,
+		StickySessionCookieName: d.StickySessionCookieName,
+		StickyHeader:            d.StickyHeader,
+		StickySlidingExpiry:     d.StickySlidingExpiry,
+		BackendProxyProtocol:    d.BackendProxyProtocol,
+		RequestIdHeader:         d.RequestIdHeader,
+		UpgradeGracePeriod:      d.UpgradeGracePeriod,
+		UpgradeIdleTimeout:      d.UpgradeIdleTimeout,
+		MaxRequestBodyBytes:     d.MaxRequestBodyBytes,
+		Mode:                    d.Mode,
+		ListenPort:              d.ListenPort,
+		Listeners:               d.Listeners,
+	}
+}
+
+func (s DesiredServer) AddRequest() requests.AddServerRequest {
+	return requests.AddServerRequest{
+		NewServerAddress: s.Address,
+		HealthCheckPath:  s.HealthCheckPath,
+		Condition:        s.Condition,
+		Protocol:         s.Protocol,
+	}
+}
+
+func (t Transaction) Request() requests.TransactionRequest {
+	return requests.TransactionRequest{
+		NewServerAddress:         t.New.Address,
+		NewServerCondition:       t.New.Condition,
+		NewServerHealthCheckPath: t.New.HealthCheckPath,
+		OldServerId:              t.Old.Id.String(),
+		NewServerProtocol:        t.New.Protocol,
+		MigrateSessions:          t.MigrateSessions,
+	}
+}
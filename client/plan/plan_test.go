@@ -0,0 +1,274 @@
+package plan
+
+import (
+	"continuity/common"
+	"continuity/common/responses"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func currentServer(address string, condition common.Condition) *responses.ServerHostResponse {
+	parsed, _ := url.Parse(address)
+	return &responses.ServerHostResponse{Id: uuid.New(), Address: parsed, Condition: condition, HealthCheckPath: "/health"}
+}
+
+func currentPool(hostname string, servers ...*responses.ServerHostResponse) *responses.PoolResponse {
+	return &responses.PoolResponse{
+		Hostname:                hostname,
+		HealthCheckInterval:     10,
+		HealthCheckInitialDelay: 5,
+		HealthCheckTimeout:      5,
+		HealthCheck_numOk:       1,
+		HealthCheck_numFail:     1,
+		UnconditionalServers:    servers,
+		ConditionalServers:      []*responses.ServerHostResponse{},
+	}
+}
+
+func desiredPool(hostname string, servers ...DesiredServer) DesiredPool {
+	return DesiredPool{
+		Hostname:                hostname,
+		HealthCheckInterval:     10,
+		HealthCheckInitialDelay: 5,
+		HealthCheckTimeout:      5,
+		HealthCheck_numOk:       1,
+		HealthCheck_numFail:     1,
+		Servers:                 servers,
+	}
+}
+
+func TestReadDesiredState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`pools:
+  - hostname: app.lab
+    health_check_interval: 10
+    health_check_initial_delay: 5
+    health_check_timeout: 5
+    health_check_num_ok: 1
+    health_check_num_fail: 1
+    servers:
+      - address: http://10.0.0.1:8080
+`), 0644))
+	desired, err := ReadDesiredState(path)
+	require.NoError(t, err)
+	require.Len(t, desired.Pools, 1)
+	assert.Equal(t, DEFAULT_HEALTH_CHECK_PATH, desired.Pools[0].Servers[0].HealthCheckPath)
+
+	require.NoError(t, os.WriteFile(path, []byte(`pools:
+  - hostname: app.lab
+    servers:
+      - address: 10.0.0.1:8080
+  - hostname: app.lab
+    health_check_interval: 10
+    health_check_initial_delay: 5
+    health_check_timeout: 5
+    health_check_num_ok: 1
+    health_check_num_fail: 1
+`), 0644))
+	_, err = ReadDesiredState(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pools[0] (app.lab): health_check_interval")
+	assert.Contains(t, err.Error(), "pools[0] (app.lab).servers[0] (10.0.0.1:8080): address must be an absolute URL")
+	assert.Contains(t, err.Error(), "pools[1] (app.lab): duplicate hostname")
+
+	require.NoError(t, os.WriteFile(path, []byte("pools:\n  - hostname: app.lab\n    unknown: 1\n"), 0644))
+	_, err = ReadDesiredState(path)
+	assert.Error(t, err)
+}
+
+func TestCompute(t *testing.T) {
+	kept := currentServer("http://10.0.0.1:8080", common.Condition{})
+	removed := currentServer("http://10.0.0.2:8080", common.Condition{Header: "X-Version", Value: "2"})
+	swapped := currentServer("http://10.0.0.3:8080", common.Condition{})
+	app := currentPool("app.lab", kept, swapped)
+	app.ConditionalServers = []*responses.ServerHostResponse{removed}
+	current := map[string]*responses.PoolResponse{
+		"app.lab":    app,
+		"sticky.lab": currentPool("sticky.lab"),
+		"same.lab":   currentPool("same.lab", currentServer("http://10.0.1.1:8080", common.Condition{})),
+		"old.lab":    currentPool("old.lab"),
+	}
+
+	appDesired := desiredPool("app.lab",
+		DesiredServer{Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"},
+		DesiredServer{Address: "http://10.0.0.4:8080", HealthCheckPath: "/health"},
+		DesiredServer{Address: "http://10.0.0.5:8080", HealthCheckPath: "/health", Condition: common.Condition{Header: "X-Version", Value: "3"}},
+	)
+	appDesired.HealthCheckInterval = 20
+	stickyDesired := desiredPool("sticky.lab")
+	stickyDesired.StickySessions = true
+	stickyDesired.StickyMethod = "LBCookie"
+	stickyDesired.StickySessionTimeout = 60
+	desired := &DesiredState{Pools: []DesiredPool{
+		appDesired,
+		stickyDesired,
+		desiredPool("same.lab", DesiredServer{Address: "http://10.0.1.1:8080", HealthCheckPath: "/health"}),
+		desiredPool("new.lab", DesiredServer{Address: "http://10.0.2.1:8080", HealthCheckPath: "/health"}),
+	}}
+
+	plan := Compute(desired, current)
+	require.Len(t, plan.Changes, 4)
+
+	update := plan.Changes[0]
+	assert.Equal(t, ActionUpdate, update.Action)
+	require.NotNil(t, update.Update)
+	assert.Equal(t, int64(20), update.Update.HealthCheckInterval)
+	assert.Zero(t, update.Update.HealthCheckTimeout)
+	assert.Equal(t, []string{"health_check_interval: 10 -> 20"}, update.Reasons)
+	require.Len(t, update.Transactions, 1)
+	assert.Same(t, swapped, update.Transactions[0].Old)
+	assert.Equal(t, "http://10.0.0.4:8080", update.Transactions[0].New.Address)
+	require.Len(t, update.AddServers, 1)
+	assert.Equal(t, "http://10.0.0.5:8080", update.AddServers[0].Address)
+	assert.Equal(t, []*responses.ServerHostResponse{removed}, update.RemoveServers)
+
+	sticky := plan.Changes[1]
+	assert.Equal(t, ActionUpdate, sticky.Action)
+	assert.Equal(t, []string{"sticky_sessions: false -> true"}, sticky.Reasons)
+	require.NotNil(t, sticky.Update)
+	require.NotNil(t, sticky.Update.StickySessions)
+	assert.True(t, *sticky.Update.StickySessions)
+	assert.Equal(t, "LBCookie", sticky.Update.StickyMethod)
+	assert.Equal(t, int64(60), sticky.Update.StickySessionTimeout)
+	assert.Zero(t, sticky.Update.HealthCheckInterval)
+	assert.Len(t, sticky.AddServers, 0)
+
+	assert.Equal(t, ActionCreate, plan.Changes[2].Action)
+	assert.Equal(t, "new.lab", plan.Changes[2].Hostname)
+	assert.Len(t, plan.Changes[2].AddServers, 1)
+
+	assert.Equal(t, PoolChange{Action: ActionDelete, Hostname: "old.lab"}, plan.Changes[3])
+
+	output := plan.String()
+	assert.Contains(t, output, "  ~ pool app.lab (update)\n")
+	assert.Contains(t, output, "      ~ server http://10.0.0.3:8080 (")
+	assert.Contains(t, output, "  ~ pool sticky.lab (update)\n")
+	assert.Contains(t, output, "  + pool new.lab (create)\n")
+	assert.Contains(t, output, "  - pool old.lab (delete)\n")
+	assert.Contains(t, output, "Plan: 1 pools to create, 2 to update, 0 to replace, 1 to delete; 2 servers to add, 1 to remove, 1 transactions.")
+}
+
+func TestCompute_NoChanges(t *testing.T) {
+	current := map[string]*responses.PoolResponse{
+		"app.lab": currentPool("app.lab", currentServer("http://10.0.0.1:8080", common.Condition{})),
+	}
+	desired := &DesiredState{Pools: []DesiredPool{
+		desiredPool("app.lab", DesiredServer{Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}),
+	}}
+	plan := Compute(desired, current)
+	assert.True(t, plan.Empty())
+	assert.Equal(t, "No changes. The pools match the desired state.\n", plan.String())
+
+	desired.Pools[0].Servers[0].HealthCheckPath = "/ready"
+	plan = Compute(desired, current)
+	require.Len(t, plan.Changes, 1)
+	require.Len(t, plan.Changes[0].Transactions, 1)
+	assert.Equal(t, "/ready", plan.Changes[0].Transactions[0].Request().NewServerHealthCheckPath)
+	assert.False(t, plan.Changes[0].Transactions[0].Request().MigrateSessions)
+
+	plan.MigrateSessions()
+	assert.True(t, plan.Changes[0].Transactions[0].Request().MigrateSessions)
+	assert.Contains(t, plan.String(), "(transaction, sticky sessions migrated)")
+}
+
+func TestCompute_IgnoresManagedServers(t *testing.T) {
+	managed := currentServer("http://10.0.0.2:8080", common.Condition{})
+	managed.ManagedBy = "file"
+	current := map[string]*responses.PoolResponse{
+		"app.lab": currentPool("app.lab", currentServer("http://10.0.0.1:8080", common.Condition{}), managed),
+	}
+	desired := &DesiredState{Pools: []DesiredPool{
+		desiredPool("app.lab", DesiredServer{Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}),
+	}}
+	assert.True(t, Compute(desired, current).Empty())
+}
+
+func TestLayer4Pools(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`pools:
+  - hostname: db.lab
+    health_check_interval: 10
+    health_check_initial_delay: 5
+    health_check_timeout: 5
+    health_check_num_ok: 1
+    health_check_num_fail: 1
+    mode: tcp
+    listen_port: 5433
+    servers:
+      - address: tcp://10.0.0.1:5432
+`), 0644))
+	desired, err := ReadDesiredState(path)
+	require.NoError(t, err)
+	assert.Empty(t, desired.Pools[0].Servers[0].HealthCheckPath)
+
+	current := currentPool("db.lab")
+	current.Mode = "tcp"
+	current.ListenPort = 5432
+	plan := Compute(desired, map[string]*responses.PoolResponse{"db.lab": current})
+	require.Len(t, plan.Changes, 1)
+	assert.Equal(t, ActionReplace, plan.Changes[0].Action)
+	assert.Equal(t, []string{"listen_port: 5432 -> 5433"}, plan.Changes[0].Reasons)
+	assert.Equal(t, "tcp", plan.Changes[0].Desired.CreateRequest().Mode)
+	assert.Contains(t, plan.String(), "      + server tcp://10.0.0.1:5432\n")
+
+	require.NoError(t, os.WriteFile(path, []byte(`pools:
+  - hostname: db.lab
+    health_check_interval: 10
+    health_check_initial_delay: 5
+    health_check_timeout: 5
+    health_check_num_ok: 1
+    health_check_num_fail: 1
+    mode: udp
+    servers:
+      - address: tcp://10.0.0.1:5432
+`), 0644))
+	_, err = ReadDesiredState(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pools[0] (db.lab): listen_port must be between 1 and 65535 for udp pools")
+	assert.Contains(t, err.Error(), "pools[0] (db.lab).servers[0] (tcp://10.0.0.1:5432): address must be udp://host:port")
+
+	require.NoError(t, os.WriteFile(path, []byte(`pools:
+  - hostname: secure.lab
+    health_check_interval: 10
+    health_check_initial_delay: 5
+    health_check_timeout: 5
+    health_check_num_ok: 1
+    health_check_num_fail: 1
+    mode: tls
+    listen_port: 443
+    servers:
+      - address: tcp://10.0.0.1:443
+`), 0644))
+	_, err = ReadDesiredState(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pools[0] (secure.lab): listen_port is not applicable to tls pools")
+	assert.NotContains(t, err.Error(), "servers[0]")
+}
+
+func TestListeners(t *testing.T) {
+	current := currentPool("admin.lab")
+	desired := &DesiredState{Pools: []DesiredPool{desiredPool("admin.lab")}}
+	desired.Pools[0].Listeners = []string{"internal", "vpn"}
+	plan := Compute(desired, map[string]*responses.PoolResponse{"admin.lab": current})
+	require.Len(t, plan.Changes, 1)
+	assert.Equal(t, ActionUpdate, plan.Changes[0].Action)
+	assert.Equal(t, []string{"listeners: [] -> [internal,vpn]"}, plan.Changes[0].Reasons)
+	assert.Equal(t, []string{"internal", "vpn"}, plan.Changes[0].Update.Listeners)
+
+	// leaving the listeners out binds the pool to every listener again
+	current.Listeners = []string{"internal", "vpn"}
+	desired.Pools[0].Listeners = nil
+	plan = Compute(desired, map[string]*responses.PoolResponse{"admin.lab": current})
+	require.Len(t, plan.Changes, 1)
+	assert.NotNil(t, plan.Changes[0].Update.Listeners)
+	assert.Empty(t, plan.Changes[0].Update.Listeners)
+
+	desired.Pools[0].Listeners = []string{"vpn", "internal"}
+	assert.True(t, Compute(desired, map[string]*responses.PoolResponse{"admin.lab": current}).Empty())
+}
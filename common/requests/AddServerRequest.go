@@ -9,7 +9,10 @@ import (
 type AddServerRequest struct {
 	NewServerAddress string           `json:"new_server_address" binding:"required"`
 	Condition        common.Condition `json:"condition"`
-	HealthCheckPath  string           `json:"health_check_path" binding:"required"`
+	HealthCheckPath  string           `json:"health_check_path"`
+	Protocol         string           `json:"protocol"`
+	Resolve          string           `json:"resolve"`
+	Nameserver       string           `json:"nameserver"`
 }
 
 func (req *AddServerRequest) Validate() (*loadbalancer.ServerHost, error) {
@@ -23,5 +26,33 @@ func (req *AddServerRequest) Validate() (*loadbalancer.ServerHost, error) {
 	if err != nil {
 		return nil, err
 	}
-	return loadbalancer.NewServerHost(parsed.String(), req.HealthCheckPath, req.Condition)
+	server, err := loadbalancer.NewServerHost(parsed.String(), req.HealthCheckPath, req.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.SetProtocol(req.Protocol); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+/*
+ValidateDynamic
+Validates a request with a resolve mode, which adds a server whose address is resolved from DNS.
+*/
+func (req *AddServerRequest) ValidateDynamic() (*loadbalancer.DynamicServer, error) {
+	if req.Condition != (common.Condition{}) {
+		err := req.Condition.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	server, err := loadbalancer.NewDynamicServer(req.NewServerAddress, req.Resolve, req.Nameserver, req.HealthCheckPath, req.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.SetProtocol(req.Protocol); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
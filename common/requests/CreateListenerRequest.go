@@ -0,0 +1,47 @@
+package requests
+
+import (
+	"continuity/server/loadbalancer"
+	"errors"
+	"time"
+)
+
+type CreateListenerRequest struct {
+	Name                string `json:"name" binding:"required"`
+	Address             string `json:"address"`
+	Port                int    `json:"port"`
+	ProxyProtocol       bool   `json:"proxy_protocol"`
+	TlsCertificate      string `json:"tls_certificate"`
+	TlsKey              string `json:"tls_key"`
+	H2C                 bool   `json:"h2c"`
+	ReadTimeout         int64  `json:"read_timeout"`
+	ReadHeaderTimeout   int64  `json:"read_header_timeout"`
+	WriteTimeout        int64  `json:"write_timeout"`
+	IdleTimeout         int64  `json:"idle_timeout"`
+	MaxHeaderBytes      int    `json:"max_header_bytes"`
+	MaxRequestBodyBytes int64  `json:"max_request_body_bytes"`
+}
+
+func (req *CreateListenerRequest) Validate() (*loadbalancer.Listener, error) {
+	if req.ReadTimeout < 0 || req.ReadHeaderTimeout < 0 || req.WriteTimeout < 0 || req.IdleTimeout < 0 {
+		return nil, errors.New("timeouts cannot be negative")
+	}
+	if req.MaxHeaderBytes < 0 || req.MaxRequestBodyBytes < 0 {
+		return nil, errors.New("max_header_bytes and max_request_body_bytes cannot be negative")
+	}
+	if (req.TlsCertificate == "") != (req.TlsKey == "") {
+		return nil, errors.New("tls_certificate and tls_key must be set together")
+	}
+	return loadbalancer.NewListener(req.Name, req.Address, req.Port, loadbalancer.ListenerOptions{
+		ProxyProtocol:       req.ProxyProtocol,
+		TlsCertificate:      req.TlsCertificate,
+		TlsKey:              req.TlsKey,
+		H2C:                 req.H2C,
+		ReadTimeout:         time.Duration(req.ReadTimeout * int64(time.Second)),
+		ReadHeaderTimeout:   time.Duration(req.ReadHeaderTimeout * int64(time.Second)),
+		WriteTimeout:        time.Duration(req.WriteTimeout * int64(time.Second)),
+		IdleTimeout:         time.Duration(req.IdleTimeout * int64(time.Second)),
+		MaxHeaderBytes:      req.MaxHeaderBytes,
+		MaxRequestBodyBytes: req.MaxRequestBodyBytes,
+	})
+}
@@ -9,20 +9,36 @@ import (
 )
 
 type CreatePoolRequest struct {
-	Hostname                string `json:"hostname" binding:"required"`
-	HealthCheckInterval     int64  `json:"health_check_interval" binding:"required" validate:"gt=0"`
-	HealthCheckInitialDelay int64  `json:"health_check_initial_delay" binding:"required" validate:"gt=0"`
-	HealthCheckTimeout      int64  `json:"health_check_timeout" binding:"required" validate:"gt=0"`
-	HealthCheck_numOk       uint32 `json:"health_check_num_ok" binding:"required" validate:"gt=0"`
-	HealthCheck_numFail     uint32 `json:"health_check_num_fail" binding:"required" validate:"gt=0"`
-	StickySessions          bool   `json:"sticky_sessions"`
-	StickyMethod            string `json:"sticky_method"`
-	StickySessionTimeout    int64  `json:"sticky_session_timeout"`
-	StickySessionCookieName string `json:"sticky_session_cookie_name"`
+	Hostname                string   `json:"hostname" binding:"required"`
+	HealthCheckInterval     int64    `json:"health_check_interval" binding:"required" validate:"gt=0"`
+	HealthCheckInitialDelay int64    `json:"health_check_initial_delay" binding:"required" validate:"gt=0"`
+	HealthCheckTimeout      int64    `json:"health_check_timeout" binding:"required" validate:"gt=0"`
+	HealthCheck_numOk       uint32   `json:"health_check_num_ok" binding:"required" validate:"gt=0"`
+	HealthCheck_numFail     uint32   `json:"health_check_num_fail" binding:"required" validate:"gt=0"`
+	StickySessions          bool     `json:"sticky_sessions"`
+	StickyMethod            string   `json:"sticky_method"`
+	StickySessionTimeout    int64    `json:"sticky_session_timeout"`
+	StickySessionCookieName string   `json:"sticky_session_cookie_name"`
+	StickyHeader            string   `json:"sticky_header"`
+	StickySlidingExpiry     bool     `json:"sticky_sliding_expiry"`
+	BackendProxyProtocol    int      `json:"backend_proxy_protocol"`
+	RequestIdHeader         string   `json:"request_id_header"`
+	UpgradeGracePeriod      int64    `json:"upgrade_grace_period"`
+	UpgradeIdleTimeout      int64    `json:"upgrade_idle_timeout"`
+	MaxRequestBodyBytes     int64    `json:"max_request_body_bytes"`
+	Mode                    string   `json:"mode"`
+	ListenPort              int      `json:"listen_port"`
+	Listeners               []string `json:"listeners"`
 }
 
 func (req *CreatePoolRequest) Validate() (*loadbalancer.Pool, error) {
 	var pool *loadbalancer.Pool
+	if req.UpgradeGracePeriod < 0 || req.UpgradeIdleTimeout < 0 {
+		return nil, errors.New("upgrade_grace_period and upgrade_idle_timeout cannot be negative")
+	}
+	if req.MaxRequestBodyBytes < 0 {
+		return nil, errors.New("max_request_body_bytes cannot be negative")
+	}
 	if req.StickySessions {
 		if req.StickyMethod == "" {
 			return nil, errors.New("sticky_method is required when sticky_sessions is true")
@@ -41,6 +57,9 @@ func (req *CreatePoolRequest) Validate() (*loadbalancer.Pool, error) {
 		if req.StickySessionTimeout <= 0 {
 			return nil, errors.New("sticky_session_timeout must be greater than 0 when sticky_sessions is true")
 		}
+		if req.StickyHeader != "" && stickyMethod != loadbalancer.StickyMethod_Header {
+			return nil, errors.New("sticky_header is only applicable for Header sticky method")
+		}
 		switch stickyMethod {
 		case loadbalancer.StickyMethod_AppCookie:
 			if req.StickySessionCookieName == "" {
@@ -90,7 +109,28 @@ func (req *CreatePoolRequest) Validate() (*loadbalancer.Pool, error) {
 				req.HealthCheck_numOk,
 				req.HealthCheck_numFail,
 			)
+		case loadbalancer.StickyMethod_Header:
+			if req.StickySessionCookieName != "" {
+				return nil, errors.New("sticky_session_cookie_name is not applicable for Header sticky method")
+			}
+			if req.StickyHeader == "" {
+				return nil, errors.New("sticky_header is required")
+			}
+			pool, err = loadbalancer.NewPoolWithHeaderStickySessions(
+				req.Hostname,
+				time.Duration(req.HealthCheckTimeout*int64(time.Second)),
+				time.Duration(req.HealthCheckInterval*int64(time.Second)),
+				time.Duration(req.HealthCheckInitialDelay*int64(time.Second)),
+				time.Duration(req.StickySessionTimeout*int64(time.Second)),
+				req.HealthCheck_numOk,
+				req.HealthCheck_numFail,
+				req.StickyHeader,
+			)
+			if err != nil {
+				return nil, err
+			}
 		}
+		pool.SetStickySlidingExpiry(req.StickySlidingExpiry)
 	} else {
 		pool = loadbalancer.NewPool(
 			req.Hostname,
@@ -101,5 +141,30 @@ func (req *CreatePoolRequest) Validate() (*loadbalancer.Pool, error) {
 			req.HealthCheck_numFail,
 		)
 	}
+	if req.BackendProxyProtocol != 0 {
+		if err := pool.SetBackendProxyProtocol(req.BackendProxyProtocol); err != nil {
+			return nil, err
+		}
+	}
+	if err := pool.SetRequestIdHeader(req.RequestIdHeader); err != nil {
+		return nil, err
+	}
+	if req.UpgradeGracePeriod != 0 {
+		pool.UpgradeGracePeriod.Store(uint64(req.UpgradeGracePeriod * int64(time.Second)))
+	}
+	pool.UpgradeIdleTimeout.Store(uint64(req.UpgradeIdleTimeout * int64(time.Second)))
+	pool.MaxRequestBodyBytes.Store(req.MaxRequestBodyBytes)
+	mode, err := loadbalancer.GetPoolModeFromString(req.Mode)
+	if err != nil {
+		return nil, errors.New("invalid mode, possible values are: http, tcp, udp, tls")
+	}
+	if mode != loadbalancer.PoolMode_HTTP {
+		if err := pool.SetLayer4(mode, req.ListenPort); err != nil {
+			return nil, err
+		}
+	} else if req.ListenPort != 0 {
+		return nil, errors.New("listen_port is only applicable to tcp and udp pools")
+	}
+	pool.SetListeners(req.Listeners)
 	return pool, nil
 }
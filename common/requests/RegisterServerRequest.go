@@ -0,0 +1,36 @@
+package requests
+
+import (
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"net/url"
+)
+
+type RegisterServerRequest struct {
+	Address         string           `json:"address" binding:"required"`
+	Condition       common.Condition `json:"condition"`
+	HealthCheckPath string           `json:"health_check_path"`
+	Protocol        string           `json:"protocol"`
+}
+
+func (req *RegisterServerRequest) Validate() (*loadbalancer.ServerHost, error) {
+	if req.Condition != (common.Condition{}) {
+		err := req.Condition.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := url.Parse(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	server, err := loadbalancer.NewServerHost(parsed.String(), req.HealthCheckPath, req.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.SetProtocol(req.Protocol); err != nil {
+		return nil, err
+	}
+	server.ManagedBy = loadbalancer.REGISTRATION
+	return server, nil
+}
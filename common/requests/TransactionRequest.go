@@ -3,15 +3,16 @@ package requests
 import (
 	"continuity/common"
 	"continuity/server/loadbalancer"
-	"errors"
 	"net/url"
 )
 
 type TransactionRequest struct {
 	NewServerAddress         string           `json:"new_server_address" binding:"required"`
 	NewServerCondition       common.Condition `json:"new_server_condition"`
-	NewServerHealthCheckPath string           `json:"new_server_health_check_path" binding:"required"`
+	NewServerHealthCheckPath string           `json:"new_server_health_check_path"`
 	OldServerId              string           `json:"old_server_id" binding:"required"`
+	NewServerProtocol        string           `json:"new_server_protocol"`
+	MigrateSessions          bool             `json:"migrate_sessions"`
 }
 
 func (req *TransactionRequest) Validate() (*loadbalancer.ServerHost, error) {
@@ -22,12 +23,16 @@ func (req *TransactionRequest) Validate() (*loadbalancer.ServerHost, error) {
 			return nil, err
 		}
 	}
-	if req.NewServerHealthCheckPath == "" {
-		return nil, errors.New("health_check_path is required")
-	}
 	parsed, err := url.Parse(req.NewServerAddress)
 	if err != nil {
 		return nil, err
 	}
-	return loadbalancer.NewServerHost(parsed.String(), req.NewServerHealthCheckPath, req.NewServerCondition)
+	server, err := loadbalancer.NewServerHost(parsed.String(), req.NewServerHealthCheckPath, req.NewServerCondition)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.SetProtocol(req.NewServerProtocol); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
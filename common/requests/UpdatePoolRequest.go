@@ -1,5 +1,9 @@
 package requests
 
+import (
+	"continuity/server/loadbalancer"
+)
+
 type UpdatePoolRequest struct {
 	Hostname                string `json:"hostname" binding:"required"`
 	HealthCheckInterval     int64  `json:"health_check_interval" validate:"gt=0"`
@@ -7,4 +11,52 @@ type UpdatePoolRequest struct {
 	HealthCheckTimeout      int64  `json:"health_check_timeout" validate:"gt=0"`
 	HealthCheck_numOk       uint32 `json:"health_check_num_ok"`
 	HealthCheck_numFail     uint32 `json:"health_check_num_fail"`
+	RequestIdHeader         string `json:"request_id_header"`
+	// UpgradeGracePeriod and UpgradeIdleTimeout are left unchanged when not set, an idle timeout of 0 disables it
+	UpgradeGracePeriod  *int64 `json:"upgrade_grace_period,omitempty"`
+	UpgradeIdleTimeout  *int64 `json:"upgrade_idle_timeout,omitempty"`
+	MaxRequestBodyBytes int64  `json:"max_request_body_bytes" validate:"gt=0"`
+	// Listeners replaces the listeners of the pool when set, an empty list binds it to every listener
+	Listeners []string `json:"listeners"`
+	// StickySessions replaces the sticky session settings of the pool with the sticky_* fields when set
+	StickySessions          *bool  `json:"sticky_sessions,omitempty"`
+	StickyMethod            string `json:"sticky_method,omitempty"`
+	StickySessionTimeout    int64  `json:"sticky_session_timeout,omitempty"`
+	StickySessionCookieName string `json:"sticky_session_cookie_name,omitempty"`
+	StickyHeader            string `json:"sticky_header,omitempty"`
+	StickySlidingExpiry     bool   `json:"sticky_sliding_expiry,omitempty"`
+}
+
+/*
+StickySettings
+Returns a pool holding the requested sticky session settings, checked as when creating the given pool, or nil if
+they are left unchanged. The session limit and LB cookie options of the given pool are kept.
+*/
+func (req *UpdatePoolRequest) StickySettings(pool *loadbalancer.Pool) (*loadbalancer.Pool, error) {
+	if req.StickySessions == nil {
+		return nil, nil
+	}
+	create := CreatePoolRequest{
+		Hostname:                pool.Hostname,
+		StickySessions:          *req.StickySessions,
+		StickyMethod:            req.StickyMethod,
+		StickySessionTimeout:    req.StickySessionTimeout,
+		StickySessionCookieName: req.StickySessionCookieName,
+		StickyHeader:            req.StickyHeader,
+		StickySlidingExpiry:     req.StickySlidingExpiry,
+		BackendProxyProtocol:    pool.BackendProxyProtocol,
+		Mode:                    pool.Mode.String(),
+		ListenPort:              pool.ListenPort,
+	}
+	settings, err := create.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.SetMaxStickySessions(pool.GetMaxStickySessions()); err != nil {
+		return nil, err
+	}
+	if err := settings.SetLbCookieOptions(pool.GetLbCookieOptions()); err != nil {
+		return nil, err
+	}
+	return settings, nil
 }
@@ -0,0 +1,27 @@
+package responses
+
+import (
+	"fmt"
+	"time"
+)
+
+type ConfigVersion struct {
+	Version string    `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	Size    int64     `json:"size"`
+}
+
+type ConfigHistoryResponse struct {
+	Versions []ConfigVersion `json:"versions"`
+}
+
+func (r ConfigHistoryResponse) String() string {
+	if len(r.Versions) == 0 {
+		return "No previous configuration versions\n"
+	}
+	output := fmt.Sprintf("%-28s %-22s %s\n", "Version", "Saved at", "Size")
+	for _, version := range r.Versions {
+		output += fmt.Sprintf("%-28s %-22s %d\n", version.Version, version.SavedAt.Local().Format(time.DateTime), version.Size)
+	}
+	return output
+}
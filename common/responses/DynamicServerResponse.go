@@ -0,0 +1,59 @@
+package responses
+
+import (
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type DynamicServerResponse struct {
+	Id              uuid.UUID
+	Address         *url.URL
+	Resolve         string
+	Nameserver      string
+	Condition       common.Condition
+	HealthCheckPath string
+	Protocol        string
+	Servers         []string
+	LastError       string
+}
+
+func NewDynamicServerResponse(server *loadbalancer.DynamicServer) *DynamicServerResponse {
+	resp := &DynamicServerResponse{
+		Id:              server.Id,
+		Address:         server.Address,
+		Resolve:         server.Resolve.String(),
+		Nameserver:      server.Nameserver,
+		Condition:       server.Condition,
+		HealthCheckPath: server.HealthCheckPath,
+		Protocol:        server.Protocol,
+		Servers:         []string{},
+		LastError:       server.LastError(),
+	}
+	for _, resolved := range server.GetServers() {
+		resp.Servers = append(resp.Servers, resolved.Address.Host)
+	}
+	return resp
+}
+
+func (dsr *DynamicServerResponse) String() string {
+	resp := "Dynamic server " + dsr.Id.String() + ":\n" +
+		"\t\t\tAddress: " + dsr.Address.String() + "\n" +
+		"\t\t\tResolve: " + dsr.Resolve + "\n" +
+		"\t\t\tCondition: " + dsr.Condition.String() + "\n" +
+		"\t\t\tHealthCheckPath: " + dsr.HealthCheckPath + "\n" +
+		"\t\t\tResolved: " + strings.Join(dsr.Servers, ", ") + "\n"
+	if dsr.Nameserver != "" {
+		resp += "\t\t\tNameserver: " + dsr.Nameserver + "\n"
+	}
+	if dsr.Protocol != "" {
+		resp += "\t\t\tProtocol: " + dsr.Protocol + "\n"
+	}
+	if dsr.LastError != "" {
+		resp += "\t\t\tLastError: " + dsr.LastError + "\n"
+	}
+	return resp
+}
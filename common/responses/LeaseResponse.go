@@ -0,0 +1,10 @@
+package responses
+
+import "time"
+
+type LeaseResponse struct {
+	// LeaseId is also the Id of the registered server
+	LeaseId    string    `json:"lease_id"`
+	TtlSeconds uint64    `json:"ttl_seconds"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
@@ -0,0 +1,62 @@
+package responses
+
+import (
+	"continuity/server/loadbalancer"
+	"fmt"
+	"time"
+)
+
+type ListenerResponse struct {
+	Name                string `json:"name"`
+	Address             string `json:"address"`
+	Port                int    `json:"port"`
+	ListeningOn         string `json:"listening_on"`
+	ProxyProtocol       bool   `json:"proxy_protocol"`
+	Tls                 bool   `json:"tls"`
+	H2C                 bool   `json:"h2c"`
+	ReadTimeout         uint64 `json:"read_timeout"`
+	ReadHeaderTimeout   uint64 `json:"read_header_timeout"`
+	WriteTimeout        uint64 `json:"write_timeout"`
+	IdleTimeout         uint64 `json:"idle_timeout"`
+	MaxHeaderBytes      int    `json:"max_header_bytes"`
+	MaxRequestBodyBytes int64  `json:"max_request_body_bytes"`
+}
+
+type ListListenersResponse struct {
+	Listeners []*ListenerResponse `json:"listeners"`
+}
+
+func NewListenerResponse(listener *loadbalancer.Listener) *ListenerResponse {
+	return &ListenerResponse{
+		Name:                listener.Name,
+		Address:             listener.Address,
+		Port:                listener.Port,
+		ListeningOn:         listener.Addr(),
+		ProxyProtocol:       listener.Options.ProxyProtocol,
+		Tls:                 listener.Options.TlsCertificate != "",
+		H2C:                 listener.Options.H2C,
+		ReadTimeout:         uint64(listener.Options.ReadTimeout / time.Second),
+		ReadHeaderTimeout:   uint64(listener.Options.ReadHeaderTimeout / time.Second),
+		WriteTimeout:        uint64(listener.Options.WriteTimeout / time.Second),
+		IdleTimeout:         uint64(listener.Options.IdleTimeout / time.Second),
+		MaxHeaderBytes:      listener.Options.MaxHeaderBytes,
+		MaxRequestBodyBytes: listener.Options.MaxRequestBodyBytes,
+	}
+}
+
+func (lr *ListenerResponse) String() string {
+	resp := fmt.Sprintf("Listener %s: %s", lr.Name, lr.ListeningOn)
+	if lr.Tls {
+		resp += ", TLS"
+	}
+	if lr.ProxyProtocol {
+		resp += ", PROXY protocol"
+	}
+	if lr.H2C {
+		resp += ", h2c"
+	}
+	if lr.MaxRequestBodyBytes != 0 {
+		resp += fmt.Sprintf(", MaxRequestBodyBytes=%d", lr.MaxRequestBodyBytes)
+	}
+	return resp
+}
@@ -3,26 +3,39 @@ package responses
 import (
 	"continuity/server/loadbalancer"
 	"fmt"
+	"strings"
 	"time"
 )
 
 type PoolResponse struct {
-	Hostname                string                `json:"hostname"`
-	HealthCheckInterval     uint64                `json:"health_check_interval"`
-	HealthCheckInitialDelay uint64                `json:"health_check_initial_delay"`
-	HealthCheckTimeout      uint64                `json:"health_check_timeout"`
-	HealthCheck_numOk       uint32                `json:"health_check_num_ok"`
-	HealthCheck_numFail     uint32                `json:"health_check_num_fail"`
-	ConditionalServers      []*ServerHostResponse `json:"conditional_servers"`
-	UnconditionalServers    []*ServerHostResponse `json:"unconditional_servers"`
-	StickySessions          bool                  `json:"sticky_sessions"`
-	StickyMethod            string                `json:"sticky_method"`
-	StickySessionTimeout    uint64                `json:"sticky_session_timeout"`
-	stickyCookieName        string                `json:"sticky_cookie_name"`
-	requestCounter          uint64                `json:"request_counter"`
+	Hostname                string                   `json:"hostname"`
+	HealthCheckInterval     uint64                   `json:"health_check_interval"`
+	HealthCheckInitialDelay uint64                   `json:"health_check_initial_delay"`
+	HealthCheckTimeout      uint64                   `json:"health_check_timeout"`
+	HealthCheck_numOk       uint32                   `json:"health_check_num_ok"`
+	HealthCheck_numFail     uint32                   `json:"health_check_num_fail"`
+	ConditionalServers      []*ServerHostResponse    `json:"conditional_servers"`
+	UnconditionalServers    []*ServerHostResponse    `json:"unconditional_servers"`
+	DynamicServers          []*DynamicServerResponse `json:"dynamic_servers"`
+	StickySessions          bool                     `json:"sticky_sessions"`
+	StickyMethod            string                   `json:"sticky_method"`
+	StickySessionTimeout    uint64                   `json:"sticky_session_timeout"`
+	StickyCookieName        string                   `json:"sticky_cookie_name"`
+	StickyHeader            string                   `json:"sticky_header"`
+	StickySlidingExpiry     bool                     `json:"sticky_sliding_expiry"`
+	requestCounter          uint64                   `json:"request_counter"`
+	BackendProxyProtocol    int                      `json:"backend_proxy_protocol"`
+	RequestIdHeader         string                   `json:"request_id_header"`
+	UpgradeGracePeriod      uint64                   `json:"upgrade_grace_period"`
+	UpgradeIdleTimeout      uint64                   `json:"upgrade_idle_timeout"`
+	MaxRequestBodyBytes     int64                    `json:"max_request_body_bytes"`
+	Mode                    string                   `json:"mode"`
+	ListenPort              int                      `json:"listen_port"`
+	Listeners               []string                 `json:"listeners"`
 }
 
 func NewPoolResponse(pool *loadbalancer.Pool) *PoolResponse {
+	sticky := pool.GetStickySettings()
 	resp := &PoolResponse{
 		Hostname:                pool.Hostname,
 		HealthCheckInterval:     uint64(time.Duration(pool.HealthCheckInterval.Load()).Seconds()),
@@ -30,11 +43,21 @@ func NewPoolResponse(pool *loadbalancer.Pool) *PoolResponse {
 		HealthCheckTimeout:      uint64(time.Duration(pool.HealthCheckTimeout.Load()).Seconds()),
 		HealthCheck_numOk:       pool.HealthCheck_numOk.Load(),
 		HealthCheck_numFail:     pool.HealthCheck_numFail.Load(),
-		StickySessions:          pool.StickySessions,
-		StickyMethod:            pool.StickyMethod.String(),
-		StickySessionTimeout:    uint64(pool.StickySessionTimeout.Seconds()),
-		stickyCookieName:        pool.GetStickyCookieName(),
+		StickySessions:          sticky.Enabled,
+		StickyMethod:            sticky.Method.String(),
+		StickySessionTimeout:    uint64(sticky.Timeout.Seconds()),
+		StickyCookieName:        sticky.CookieName,
+		StickyHeader:            sticky.HeaderName,
+		StickySlidingExpiry:     sticky.SlidingExpiry,
 		requestCounter:          pool.RequestCounter.Load(),
+		BackendProxyProtocol:    pool.BackendProxyProtocol,
+		RequestIdHeader:         pool.GetRequestIdHeader(),
+		UpgradeGracePeriod:      uint64(time.Duration(pool.UpgradeGracePeriod.Load()).Seconds()),
+		UpgradeIdleTimeout:      uint64(time.Duration(pool.UpgradeIdleTimeout.Load()).Seconds()),
+		MaxRequestBodyBytes:     pool.MaxRequestBodyBytes.Load(),
+		Mode:                    pool.Mode.String(),
+		ListenPort:              pool.ListenPort,
+		Listeners:               pool.GetListeners(),
 	}
 	resp.ConditionalServers = []*ServerHostResponse{}
 	resp.UnconditionalServers = []*ServerHostResponse{}
@@ -44,6 +67,10 @@ func NewPoolResponse(pool *loadbalancer.Pool) *PoolResponse {
 	for _, server := range pool.UnconditionalServers {
 		resp.UnconditionalServers = append(resp.UnconditionalServers, NewServerHostResponse(server))
 	}
+	resp.DynamicServers = []*DynamicServerResponse{}
+	for _, server := range pool.GetDynamicServers() {
+		resp.DynamicServers = append(resp.DynamicServers, NewDynamicServerResponse(server))
+	}
 	return resp
 }
 
@@ -54,18 +81,45 @@ func (pr *PoolResponse) String() string {
 		"\tHealthCheckTimeout=%ds,\n"+
 		"\tHealthCheck_numOk=%d,\n"+
 		"\tHealthCheck_numFail=%d,\n"+
+		"\tRequestIdHeader=%s,\n"+
+		"\tUpgradeGracePeriod=%ds,\n"+
+		"\tUpgradeIdleTimeout=%ds,\n"+
 		"\tStickySessions=%t", pr.Hostname,
 		pr.HealthCheckInterval,
 		pr.HealthCheckInitialDelay,
 		pr.HealthCheckTimeout,
 		pr.HealthCheck_numOk,
 		pr.HealthCheck_numFail,
+		pr.RequestIdHeader,
+		pr.UpgradeGracePeriod,
+		pr.UpgradeIdleTimeout,
 		pr.StickySessions)
 	if pr.StickySessions {
 		resp += fmt.Sprintf(",\n\tStickyMethod=%s,\n\tStickySessionTimeout=%ds,\n\tStickyCookieName=%s",
 			pr.StickyMethod,
 			pr.StickySessionTimeout,
-			pr.stickyCookieName)
+			pr.StickyCookieName)
+		if pr.StickyHeader != "" {
+			resp += fmt.Sprintf(",\n\tStickyHeader=%s", pr.StickyHeader)
+		}
+		if pr.StickySlidingExpiry {
+			resp += ",\n\tStickySlidingExpiry=true"
+		}
+	}
+	if pr.Mode != "" && pr.Mode != loadbalancer.PoolMode_HTTP.String() {
+		resp += fmt.Sprintf(",\n\tMode=%s", pr.Mode)
+	}
+	if pr.ListenPort != 0 {
+		resp += fmt.Sprintf(",\n\tListenPort=%d", pr.ListenPort)
+	}
+	if len(pr.Listeners) > 0 {
+		resp += fmt.Sprintf(",\n\tListeners=%s", strings.Join(pr.Listeners, ","))
+	}
+	if pr.MaxRequestBodyBytes != 0 {
+		resp += fmt.Sprintf(",\n\tMaxRequestBodyBytes=%d", pr.MaxRequestBodyBytes)
+	}
+	if pr.BackendProxyProtocol != 0 {
+		resp += fmt.Sprintf(",\n\tBackendProxyProtocol=v%d", pr.BackendProxyProtocol)
 	}
 	if len(pr.ConditionalServers) > 0 {
 		resp += "\n\tConditional Servers:\n"
@@ -79,6 +133,12 @@ func (pr *PoolResponse) String() string {
 			resp += "\t\t" + server.String() + "\n"
 		}
 	}
+	if len(pr.DynamicServers) > 0 {
+		resp += "\n\tDynamic Servers:\n"
+		for _, server := range pr.DynamicServers {
+			resp += "\t\t" + server.String() + "\n"
+		}
+	}
 	resp += fmt.Sprintf("\tRequestCounter=%d\n", pr.requestCounter)
 	return resp
 }
@@ -16,6 +16,7 @@ func (psr *PoolStatsResponse) String() string {
 		resp += "  TotalRequests: " + fmt.Sprintf("%d", stats.OkResponses+stats.NotOkResponses) + "\n"
 		resp += "  SuccessfulRequests: " + fmt.Sprintf("%d", stats.OkResponses) + "\n"
 		resp += "  FailedRequests: " + fmt.Sprintf("%d", stats.NotOkResponses) + "\n"
+		resp += "  UpgradedConnections: " + fmt.Sprintf("%d", stats.UpgradedConnections) + "\n"
 	}
 	return resp
 }
@@ -0,0 +1,5 @@
+package responses
+
+type ReloadResponse struct {
+	Changes []string `json:"changes"`
+}
@@ -14,6 +14,8 @@ type ServerHostResponse struct {
 	Condition       common.Condition
 	ServerStatus    string
 	HealthCheckPath string
+	Protocol        string
+	ManagedBy       string
 	createdAt       int64
 }
 
@@ -24,14 +26,23 @@ func NewServerHostResponse(server *loadbalancer.ServerHost) *ServerHostResponse
 		Condition:       server.Condition,
 		ServerStatus:    loadbalancer.ServerStatus(server.ServerStatus.Load()).String(),
 		HealthCheckPath: server.HealthCheckPath,
+		Protocol:        server.Protocol,
+		ManagedBy:       server.ManagedBy,
 		createdAt:       server.CreatedAt,
 	}
 }
 
 func (shr *ServerHostResponse) String() string {
-	return "Server " + shr.Id.String() + ":\n" +
+	resp := "Server " + shr.Id.String() + ":\n" +
 		"\t\t\tAddress: " + shr.Address.String() + "\n" +
 		"\t\t\tCondition: " + shr.Condition.String() + "\n" +
 		"\t\t\tServerStatus: " + shr.ServerStatus + "\n" +
 		"\t\t\tHealthCheckPath: " + shr.HealthCheckPath + "\n"
+	if shr.Protocol != "" {
+		resp += "\t\t\tProtocol: " + shr.Protocol + "\n"
+	}
+	if shr.ManagedBy != "" {
+		resp += "\t\t\tManagedBy: " + shr.ManagedBy + "\n"
+	}
+	return resp
 }
@@ -0,0 +1,37 @@
+package responses
+
+import (
+	"fmt"
+	"time"
+)
+
+type StickySession struct {
+	Key           string    `json:"key"`
+	ServerId      string    `json:"server_id"`
+	ServerAddress string    `json:"server_address"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsed      time.Time `json:"last_used"`
+	AgeSeconds    int64     `json:"age_seconds"`
+}
+
+type StickySessionsResponse struct {
+	Sessions    []StickySession `json:"sessions"`
+	MaxSessions int             `json:"max_sessions"`
+}
+
+type FlushStickySessionsResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+func (r StickySessionsResponse) String() string {
+	if len(r.Sessions) == 0 {
+		return "No sticky sessions\n"
+	}
+	output := fmt.Sprintf("%-40s %-30s %-8s %s\n", "Key", "Server", "Age", "Last used")
+	for _, session := range r.Sessions {
+		age := (time.Duration(session.AgeSeconds) * time.Second).String()
+		output += fmt.Sprintf("%-40s %-30s %-8s %s\n", session.Key, session.ServerAddress, age, session.LastUsed.Local().Format(time.DateTime))
+	}
+	output += fmt.Sprintf("%d sessions (max %d)\n", len(r.Sessions), r.MaxSessions)
+	return output
+}
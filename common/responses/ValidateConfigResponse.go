@@ -0,0 +1,6 @@
+package responses
+
+type ValidateConfigResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
@@ -1,17 +1,24 @@
 package api
 
 import (
+	"context"
 	"continuity/common/requests"
 	"continuity/common/responses"
 	"continuity/common/sshimpl"
+	"continuity/server/handoff"
 	"continuity/server/loadbalancer"
 	"continuity/server/version"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,6 +26,30 @@ import (
 )
 
 type saveConfigFunc func(server *ApiServer)
+
+const FORMAT_JSON = "json"
+const FORMAT_YAML = "yaml"
+
+/*
+ConfigManager
+Operations on the configuration file of the server, implemented by the conf package.
+*/
+type ConfigManager interface {
+	// Reload reads the configuration file and applies it to the running load balancer, returning the changes made
+	Reload() ([]string, error)
+	// Validate checks the YAML content of a configuration file, returning every problem found
+	Validate(data []byte) []string
+	// Export returns the running configuration, in the shape of the configuration file, as FORMAT_JSON or FORMAT_YAML
+	Export(format string) ([]byte, error)
+	// Apply applies a complete configuration, in YAML or JSON, with the same semantics as Reload, returning the changes
+	Apply(data []byte, dryRun bool) ([]string, error)
+	// History lists the previous versions of the configuration file, newest first
+	History() ([]responses.ConfigVersion, error)
+	// Rollback restores a previous version of the configuration file, returning the changes made.
+	// The error wraps os.ErrNotExist if the version doesn't exist
+	Rollback(version string) ([]string, error)
+}
+
 type ApiServer struct {
 	Address            string
 	Port               int
@@ -27,6 +58,12 @@ type ApiServer struct {
 	transactions       map[uuid.UUID]*Transaction
 	transactionsMutex  sync.RWMutex
 	AuthorizedKeyspath *string
+	ConfigManager      ConfigManager
+	server             *http.Server
+	readOnly           atomic.Bool
+	leases             map[uuid.UUID]time.Time
+	leasesMutex        sync.Mutex
+	stopLeaseSweeper   context.CancelFunc
 }
 
 type Transaction struct {
@@ -52,12 +89,18 @@ func NewApiServer(address string,
 		transactions:       make(map[uuid.UUID]*Transaction),
 		transactionsMutex:  sync.RWMutex{},
 		AuthorizedKeyspath: authorizedKeyspath,
+		leases:             make(map[uuid.UUID]time.Time),
 	}
 }
 
-func (api *ApiServer) Start() {
+/*
+Start
+Binds the API address and serves requests in background.
+*/
+func (api *ApiServer) Start() error {
 	router := gin.Default()
 	router.Use(api.authMiddleware())
+	router.Use(api.readOnlyMiddleware())
 	// Define API routes
 	router.GET("/version", api.GetVersion)
 	router.GET("/pools", api.GetPools)
@@ -65,18 +108,206 @@ func (api *ApiServer) Start() {
 	router.DELETE("/pools/:hostname", api.DeletePool)
 	router.GET("/pools/:hostname", api.GetPoolConfig)
 	router.GET("/pools/:hostname/stats", api.GetPoolStats)
+	router.GET("/pools/:hostname/sessions", api.GetStickySessions)
+	router.DELETE("/pools/:hostname/sessions", api.FlushStickySessions)
 	router.POST("/pools/:hostname", api.UpdatePool)
 	router.POST("/pools/:hostname/server", api.AddServer)
 	router.DELETE("/pools/:hostname/:server", api.RemoveServer)
 	router.POST("/pools/:hostname/transaction", api.AddTransaction)
 	router.GET("/pools/transaction/:transaction", api.GetTransaction)
+	router.GET("/listeners", api.GetListeners)
+	router.POST("/listeners", api.CreateListener)
+	router.DELETE("/listeners/:name", api.DeleteListener)
+	router.POST("/reload", api.Reload)
+	router.GET("/config", api.ExportConfig)
+	router.PUT("/config", api.ApplyConfig)
+	router.POST("/config/validate", api.ValidateConfig)
+	router.GET("/config/history", api.GetConfigHistory)
+	router.POST("/config/rollback/:version", api.RollbackConfig)
+	router.POST("/pools/:hostname/register", api.RegisterServer)
+	router.PUT("/leases/:id", api.RenewLease)
+	router.DELETE("/leases/:id", api.ReleaseLease)
 
 	addr := api.Address + ":" + fmt.Sprint(api.Port)
 	log.Println("Starting API server on", addr)
-	if err := router.Run(addr); err != nil {
-		log.Fatal("Failed to start API server:", err)
+	listener, err := handoff.Listen(addr)
+	if err != nil {
+		return err
+	}
+	api.server = &http.Server{Handler: router}
+	go func() {
+		if err := api.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("API server stopped: ", err)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	api.stopLeaseSweeper = cancel
+	go api.runLeaseSweeper(ctx)
+	return nil
+}
+
+/*
+Shutdown
+Stops the API server and waits for running transactions to complete, until the context expires.
+*/
+func (api *ApiServer) Shutdown(ctx context.Context) error {
+	if api.stopLeaseSweeper != nil {
+		api.stopLeaseSweeper()
+	}
+	if api.server != nil {
+		if err := api.server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return api.WaitTransactions(ctx)
+}
+
+/*
+WaitTransactions
+Waits until every transaction is completed or the context expires.
+*/
+func (api *ApiServer) WaitTransactions(ctx context.Context) error {
+	for {
+		running := 0
+		api.transactionsMutex.RLock()
+		for _, tx := range api.transactions {
+			if !tx.Completed {
+				running++
+			}
+		}
+		api.transactionsMutex.RUnlock()
+		if running == 0 {
+			return nil
+		}
+		log.Println("Waiting for", running, "running transactions")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d transactions still running: %w", running, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+/*
+SetReadOnly
+While read only, requests changing the configuration are rejected with 503, e.g. during a restart.
+*/
+func (api *ApiServer) SetReadOnly(readOnly bool) {
+	api.readOnly.Store(readOnly)
+}
+
+func (api *ApiServer) readOnlyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if api.readOnly.Load() && c.Request.Method != http.MethodGet {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is restarting, retry later"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (api *ApiServer) Reload(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration reload is not available"})
+		return
+	}
+	changes, err := api.ConfigManager.Reload()
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, responses.ReloadResponse{Changes: changes})
+}
+
+func (api *ApiServer) ExportConfig(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration export is not available"})
+		return
+	}
+	format := context.Query("format")
+	if format == "" {
+		format = FORMAT_JSON
+		if strings.Contains(context.GetHeader("Accept"), "yaml") {
+			format = FORMAT_YAML
+		}
+	}
+	if format != FORMAT_JSON && format != FORMAT_YAML {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or yaml"})
+		return
+	}
+	data, err := api.ConfigManager.Export(format)
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	context.Data(http.StatusOK, "application/"+format, data)
+}
 
+func (api *ApiServer) ApplyConfig(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration apply is not available"})
+		return
+	}
+	dryRun, err := strconv.ParseBool(context.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid dry_run value"})
+		return
+	}
+	data, err := io.ReadAll(context.Request.Body)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	changes, err := api.ConfigManager.Apply(data, dryRun)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, responses.ReloadResponse{Changes: changes})
+}
+
+func (api *ApiServer) ValidateConfig(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration validation is not available"})
+		return
+	}
+	data, err := io.ReadAll(context.Request.Body)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	problems := api.ConfigManager.Validate(data)
+	context.JSON(http.StatusOK, responses.ValidateConfigResponse{Valid: len(problems) == 0, Errors: problems})
+}
+
+func (api *ApiServer) GetConfigHistory(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration history is not available"})
+		return
+	}
+	versions, err := api.ConfigManager.History()
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, responses.ConfigHistoryResponse{Versions: versions})
+}
+
+func (api *ApiServer) RollbackConfig(context *gin.Context) {
+	if api.ConfigManager == nil {
+		context.JSON(http.StatusNotImplemented, gin.H{"error": "configuration rollback is not available"})
+		return
+	}
+	changes, err := api.ConfigManager.Rollback(context.Param("version"))
+	if errors.Is(err, os.ErrNotExist) {
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, responses.ReloadResponse{Changes: changes})
 }
 
 func (api *ApiServer) GetVersion(context *gin.Context) {
@@ -187,6 +418,11 @@ func (api *ApiServer) UpdatePool(context *gin.Context) {
 	pool.HealthCheckInterval.Store(serverPool.HealthCheckInterval.Load())
 	pool.HealthCheckInitialDelay.Store(serverPool.HealthCheckInitialDelay.Load())
 	pool.HealthCheckTimeout.Store(serverPool.HealthCheckTimeout.Load())
+	_ = pool.SetRequestIdHeader(serverPool.GetRequestIdHeader())
+	pool.UpgradeGracePeriod.Store(serverPool.UpgradeGracePeriod.Load())
+	pool.UpgradeIdleTimeout.Store(serverPool.UpgradeIdleTimeout.Load())
+	pool.MaxRequestBodyBytes.Store(serverPool.MaxRequestBodyBytes.Load())
+	pool.SetListeners(serverPool.GetListeners())
 
 	if req.HealthCheck_numFail != 0 {
 		pool.HealthCheck_numFail.Store(req.HealthCheck_numFail)
@@ -204,12 +440,89 @@ func (api *ApiServer) UpdatePool(context *gin.Context) {
 		pool.HealthCheckTimeout.Store(uint64(req.HealthCheckTimeout * int64(time.Second)))
 
 	}
+	if (req.UpgradeGracePeriod != nil && *req.UpgradeGracePeriod < 0) || (req.UpgradeIdleTimeout != nil && *req.UpgradeIdleTimeout < 0) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "upgrade_grace_period and upgrade_idle_timeout cannot be negative"})
+		return
+	}
+	if req.UpgradeGracePeriod != nil {
+		pool.UpgradeGracePeriod.Store(uint64(*req.UpgradeGracePeriod * int64(time.Second)))
+	}
+	if req.UpgradeIdleTimeout != nil {
+		pool.UpgradeIdleTimeout.Store(uint64(*req.UpgradeIdleTimeout * int64(time.Second)))
+	}
+	if req.MaxRequestBodyBytes < 0 {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "max_request_body_bytes cannot be negative"})
+		return
+	}
+	if req.MaxRequestBodyBytes != 0 {
+		pool.MaxRequestBodyBytes.Store(req.MaxRequestBodyBytes)
+	}
+	if req.RequestIdHeader != "" {
+		if err := pool.SetRequestIdHeader(req.RequestIdHeader); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Listeners != nil {
+		pool.SetListeners(req.Listeners)
+	}
+	sticky, err := req.StickySettings(serverPool)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	err = api.LoadBalancer.UpdatePool(pool)
 	if err != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if sticky != nil {
+		serverPool.UpdateStickySessions(sticky)
+	}
+	api.saveConfig <- true
+}
+
+func (api *ApiServer) GetListeners(context *gin.Context) {
+	listeners := api.LoadBalancer.GetListeners()
+	response := responses.ListListenersResponse{Listeners: make([]*responses.ListenerResponse, 0, len(listeners))}
+	for _, listener := range listeners {
+		response.Listeners = append(response.Listeners, responses.NewListenerResponse(listener))
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+func (api *ApiServer) CreateListener(context *gin.Context) {
+	var req requests.CreateListenerRequest
+	err := context.ShouldBindJSON(&req)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	listener, err := req.Validate()
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := api.LoadBalancer.AddListener(listener); err != nil {
+		context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	api.saveConfig <- true
+	context.JSON(http.StatusOK, responses.NewListenerResponse(listener))
+}
+
+func (api *ApiServer) DeleteListener(context *gin.Context) {
+	// in-flight requests of the listener are waited for while the API client waits
+	err := api.LoadBalancer.RemoveListener(context.Request.Context(), context.Param("name"))
+	if errors.Is(err, loadbalancer.ErrListenerNotFound) {
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	api.saveConfig <- true
 }
 
@@ -230,11 +543,29 @@ func (api *ApiServer) AddServer(context *gin.Context) {
 		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Resolve != "" {
+		dynamicServer, err := req.ValidateDynamic()
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := pool.ValidateDynamicServer(dynamicServer); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pool.AddDynamicServer(dynamicServer)
+		api.saveConfig <- true
+		return
+	}
 	server, err := req.Validate()
 	if err != nil {
 		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := pool.ValidateServer(server); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	pool.AddServer(server)
 	api.saveConfig <- true
 }
@@ -259,8 +590,11 @@ func (api *ApiServer) RemoveServer(context *gin.Context) {
 	}
 	_, err = pool.RemoveServer(serverUUID)
 	if err != nil {
-		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		return
+		// the Id can be the one of a dynamic server, which removes the servers it resolved
+		if _, dynamicErr := pool.RemoveDynamicServer(serverUUID); dynamicErr != nil {
+			context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 	}
 	api.saveConfig <- true
 }
@@ -288,6 +622,10 @@ func (api *ApiServer) AddTransaction(context *gin.Context) {
 		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := pool.ValidateServer(server); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	serverUUID, err := uuid.Parse(req.OldServerId)
 	if err != nil {
 		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid old server ID"})
@@ -309,7 +647,7 @@ func (api *ApiServer) AddTransaction(context *gin.Context) {
 		Error:       nil,
 	}
 	go func() {
-		err = pool.Transaction(server, serverUUID)
+		err = pool.Transaction(server, serverUUID, req.MigrateSessions)
 		api.transactionsMutex.Lock()
 		defer api.transactionsMutex.Unlock()
 		tx := api.transactions[txUUID]
@@ -395,7 +733,7 @@ func (api *ApiServer) verifyAuth(context *gin.Context) bool {
 
 func (api *ApiServer) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if api.AuthorizedKeyspath != nil && *api.AuthorizedKeyspath != "" && !api.verifyAuth(c) {
+		if api.AuthorizedKeyspath != nil && *api.AuthorizedKeyspath != "" && !registrationRoutes[c.FullPath()] && !api.verifyAuth(c) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			c.Abort()
 			return
@@ -403,3 +741,55 @@ func (api *ApiServer) authMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func (api *ApiServer) GetStickySessions(context *gin.Context) {
+	hostname, err := base64.RawURLEncoding.DecodeString(context.Param(("hostname")))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid hostname encoding"})
+		return
+	}
+	pool, err := api.LoadBalancer.GetPool(string(hostname))
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	resp := responses.StickySessionsResponse{Sessions: []responses.StickySession{}, MaxSessions: pool.GetMaxStickySessions()}
+	for _, session := range pool.GetStickySessions() {
+		resp.Sessions = append(resp.Sessions, responses.StickySession{
+			Key:           session.Key,
+			ServerId:      session.ServerHost.Id.String(),
+			ServerAddress: session.ServerHost.Address.String(),
+			CreatedAt:     session.CreatedAt,
+			LastUsed:      session.LastUsed,
+			AgeSeconds:    int64(time.Since(session.CreatedAt) / time.Second),
+		})
+	}
+	context.JSON(http.StatusOK, resp)
+}
+
+/*
+FlushStickySessions
+Removes the sticky session of the key query parameter, or every sticky session of the pool without it.
+*/
+func (api *ApiServer) FlushStickySessions(context *gin.Context) {
+	hostname, err := base64.RawURLEncoding.DecodeString(context.Param(("hostname")))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid hostname encoding"})
+		return
+	}
+	pool, err := api.LoadBalancer.GetPool(string(hostname))
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	key, single := context.GetQuery("key")
+	if !single {
+		context.JSON(http.StatusOK, responses.FlushStickySessionsResponse{Flushed: pool.FlushStickySessions()})
+		return
+	}
+	if err := pool.FlushStickySession(key); err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, responses.FlushStickySessionsResponse{Flushed: 1})
+}
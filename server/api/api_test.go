@@ -2,6 +2,9 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"continuity/common"
+	"continuity/common/responses"
 	"continuity/common/sshimpl"
 	"continuity/server/loadbalancer"
 	"crypto/ed25519"
@@ -9,8 +12,10 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -18,23 +23,27 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
 )
 
-func fakeLoadBalancer(address string, port int) (*loadbalancer.LoadBalancer, error) {
+func fakeLoadBalancer(listeners []*loadbalancer.Listener) (*loadbalancer.LoadBalancer, error) {
 	log.Println("Executing fakeLoadBalancer")
-	return &loadbalancer.LoadBalancer{
-		BindAddress: address,
-		BindPort:    port,
-		Pools:       make(map[string]*loadbalancer.Pool),
-	}, nil
+	lb := &loadbalancer.LoadBalancer{
+		Listeners: make(map[string]*loadbalancer.Listener),
+		Pools:     make(map[string]*loadbalancer.Pool),
+	}
+	for _, listener := range listeners {
+		lb.Listeners[listener.Name] = listener
+	}
+	return lb, nil
 }
 
 func setupTestServer() *ApiServer {
 	log.Println("Executing setupTestServer")
 	gin.SetMode(gin.TestMode)
-	lb, _ := fakeLoadBalancer("127.0.0.1", 8080)
+	lb, _ := fakeLoadBalancer([]*loadbalancer.Listener{{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1", Port: 8080}})
 	fakeSaveChan := make(chan bool, 10) //large enough to avoid blocking in tests
 	return NewApiServer("127.0.0.1", 8080, lb, fakeSaveChan, nil)
 }
@@ -51,7 +60,7 @@ func setupTestServerWithAuth(t *testing.T, keytype string) (*ApiServer, string,
 	assert.NoError(t, err)
 
 	gin.SetMode(gin.TestMode)
-	lb, _ := fakeLoadBalancer("127.0.0.1", 8080)
+	lb, _ := fakeLoadBalancer([]*loadbalancer.Listener{{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1", Port: 8080}})
 	fakeSaveChan := make(chan bool, 10)
 	api := NewApiServer("127.0.0.1", 8080, lb, fakeSaveChan, &authorizedKeysPath)
 
@@ -153,10 +162,10 @@ func TestCreatePool_Success(t *testing.T) {
 	assert.Equal(t, uint64(1), pool.HealthCheckTimeout.Load()/uint64(time.Second))
 	assert.Equal(t, uint32(1), pool.HealthCheck_numOk.Load())
 	assert.Equal(t, uint32(1), pool.HealthCheck_numFail.Load())
-	assert.True(t, pool.StickySessions)
-	assert.Equal(t, loadbalancer.StickyMethod_AppCookie, pool.StickyMethod)
+	assert.True(t, pool.GetStickySettings().Enabled)
+	assert.Equal(t, loadbalancer.StickyMethod_AppCookie, pool.GetStickySettings().Method)
 	assert.Equal(t, "testcookie", pool.GetStickyCookieName())
-	assert.Equal(t, 10, int(pool.StickySessionTimeout.Seconds()))
+	assert.Equal(t, 10, int(pool.GetStickySettings().Timeout.Seconds()))
 }
 
 func TestDeletePool_NotFound(t *testing.T) {
@@ -279,6 +288,65 @@ func TestUpdatePool_Success(t *testing.T) {
 	assert.Equal(t, uint64(3), p.HealthCheckInterval.Load()/uint64(time.Second))
 }
 
+func TestUpdatePool_UpgradeTimeouts(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	p := loadbalancer.NewPool("test", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	p.UpgradeIdleTimeout.Store(uint64(time.Minute))
+	api.LoadBalancer.AddPool(p)
+	router := gin.Default()
+	router.POST("/pools/:hostname", api.UpdatePool)
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("test"))
+
+	w := performRequest(router, "POST", path, []byte(`{"hostname":"test","upgrade_idle_timeout":-1}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, uint64(time.Minute), p.UpgradeIdleTimeout.Load())
+
+	// not set leaves it unchanged, 0 disables it
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"test","health_check_interval":3}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(time.Minute), p.UpgradeIdleTimeout.Load())
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"test","upgrade_idle_timeout":0}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(0), p.UpgradeIdleTimeout.Load())
+}
+
+func TestUpdatePool_StickySessions(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	p := loadbalancer.NewPool("test", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	api.LoadBalancer.AddPool(p)
+	server, _ := loadbalancer.NewServerHost("http://127.0.0.1:8081", "/health", common.Condition{})
+	p.AddServer(server)
+	router := gin.Default()
+	router.POST("/pools/:hostname", api.UpdatePool)
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("test"))
+
+	w := performRequest(router, "POST", path, []byte(`{"hostname":"test","sticky_sessions":true,"sticky_method":"Header"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, p.GetStickySettings().Enabled)
+
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"test","sticky_sessions":true,"sticky_method":"Header",`+
+		`"sticky_header":"x-tenant-id","sticky_session_timeout":60,"sticky_sliding_expiry":true}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	sticky := p.GetStickySettings()
+	assert.True(t, sticky.Enabled)
+	assert.Equal(t, loadbalancer.StickyMethod_Header, sticky.Method)
+	assert.Equal(t, "X-Tenant-Id", sticky.HeaderName)
+	assert.Equal(t, time.Minute, sticky.Timeout)
+	assert.True(t, sticky.SlidingExpiry)
+	assert.Len(t, p.GetServers(), 1)
+
+	// not set leaves them unchanged
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"test","health_check_interval":3}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, sticky, p.GetStickySettings())
+
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"test","sticky_sessions":false}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, p.GetStickySettings().Enabled)
+}
+
 func TestAddServer_PoolNotFound(t *testing.T) {
 	log.Println("Executing ", t.Name())
 	api := setupTestServer()
@@ -320,6 +388,87 @@ func TestAddServer_Success(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestCreatePool_Layer4(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.POST("/pools", api.CreatePool)
+	router.POST("/pools/:hostname/server", api.AddServer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	body := fmt.Sprintf(`{"hostname":"db","health_check_interval":1,"health_check_initial_delay":1,"health_check_timeout":1,`+
+		`"health_check_num_ok":1,"health_check_num_fail":1,"mode":"tcp","listen_port":%d}`, port)
+	w := performRequest(router, "POST", "/pools", []byte(body))
+	assert.Equal(t, http.StatusOK, w.Code)
+	pool, err := api.LoadBalancer.GetPool("db")
+	assert.NoError(t, err)
+	defer api.LoadBalancer.RemovePool("db")
+	assert.Equal(t, loadbalancer.PoolMode_TCP, pool.Mode)
+
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("db")) + "/server"
+	w = performRequest(router, "POST", path, []byte(`{"new_server_address":"http://127.0.0.1:8080","health_check_path":"/check"}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequest(router, "POST", path, []byte(`{"new_server_address":"tcp://127.0.0.1:5432"}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, pool.UnconditionalServers, 1)
+
+	w = performRequest(router, "POST", "/pools", []byte(`{"hostname":"web","health_check_interval":1,"health_check_initial_delay":1,`+
+		`"health_check_timeout":1,"health_check_num_ok":1,"health_check_num_fail":1,"listen_port":8081}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListeners(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.GET("/listeners", api.GetListeners)
+	router.POST("/listeners", api.CreateListener)
+	router.DELETE("/listeners/:name", api.DeleteListener)
+	router.POST("/pools", api.CreatePool)
+	router.POST("/pools/:hostname", api.UpdatePool)
+
+	w := performRequest(router, "POST", "/listeners", []byte(`{"name":"internal","address":"127.0.0.1","max_header_bytes":-1}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequest(router, "POST", "/listeners", []byte(`{"name":"internal","address":"127.0.0.1"}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "POST", "/listeners", []byte(`{"name":"internal","address":"127.0.0.1"}`))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequest(router, "GET", "/listeners", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listeners responses.ListListenersResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listeners))
+	assert.Len(t, listeners.Listeners, 2)
+	assert.Equal(t, loadbalancer.DEFAULT_LISTENER, listeners.Listeners[0].Name)
+	assert.Equal(t, "internal", listeners.Listeners[1].Name)
+
+	w = performRequest(router, "POST", "/pools", []byte(`{"hostname":"admin","health_check_interval":1,"health_check_initial_delay":1,`+
+		`"health_check_timeout":1,"health_check_num_ok":1,"health_check_num_fail":1,"listeners":["internal"]}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	pool, err := api.LoadBalancer.GetPool("admin")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internal"}, pool.GetListeners())
+
+	w = performRequest(router, "DELETE", "/listeners/internal", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	// updating other settings keeps the listeners of the pool
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("admin"))
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"admin","health_check_interval":3}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"internal"}, pool.GetListeners())
+	w = performRequest(router, "POST", path, []byte(`{"hostname":"admin","listeners":[]}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, pool.GetListeners())
+
+	w = performRequest(router, "DELETE", "/listeners/internal", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "DELETE", "/listeners/internal", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func TestRemoveServer_NotFoundPool(t *testing.T) {
 	log.Println("Executing ", t.Name())
 	api := setupTestServer()
@@ -438,3 +587,329 @@ func TestAuthMiddleware_Success(t *testing.T) {
 		})
 	}
 }
+
+func TestReadOnly_RejectsChanges(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.Use(api.readOnlyMiddleware())
+	router.GET("/pools", api.GetPools)
+	router.POST("/pools", api.CreatePool)
+
+	api.SetReadOnly(true)
+	w := performRequest(router, "POST", "/pools", []byte(`{}`))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = performRequest(router, "GET", "/pools", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	api.SetReadOnly(false)
+	w = performRequest(router, "POST", "/pools", []byte(`{}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWaitTransactions(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	tx := &Transaction{CreatedAdt: time.Now()}
+	api.transactions[uuid.New()] = tx
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, api.WaitTransactions(ctx))
+
+	api.transactionsMutex.Lock()
+	tx.Completed = true
+	api.transactionsMutex.Unlock()
+	assert.NoError(t, api.WaitTransactions(context.Background()))
+}
+
+type fakeConfigManager struct {
+	changes []string
+	err     error
+}
+
+func (m *fakeConfigManager) Reload() ([]string, error) {
+	return m.changes, m.err
+}
+
+func (m *fakeConfigManager) Export(format string) ([]byte, error) {
+	return []byte(format), m.err
+}
+
+func (m *fakeConfigManager) Apply(data []byte, dryRun bool) ([]string, error) {
+	if dryRun {
+		return []string{"dry run: " + string(data)}, m.err
+	}
+	return []string{string(data)}, m.err
+}
+
+func (m *fakeConfigManager) History() ([]responses.ConfigVersion, error) {
+	return []responses.ConfigVersion{{Version: "20261019-083506.000000000", Size: 42}}, m.err
+}
+
+func (m *fakeConfigManager) Rollback(version string) ([]string, error) {
+	if version != "20261019-083506.000000000" {
+		return nil, fmt.Errorf("configuration version %s: %w", version, os.ErrNotExist)
+	}
+	return m.changes, m.err
+}
+
+func (m *fakeConfigManager) Validate(data []byte) []string {
+	if string(data) == "valid" {
+		return nil
+	}
+	return []string{"pools[0]: hostname is required"}
+}
+
+func TestReload(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.POST("/reload", api.Reload)
+
+	w := performRequest(router, "POST", "/reload", nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{err: errors.New("invalid configuration")}
+	w = performRequest(router, "POST", "/reload", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{changes: []string{"pool app.lab: added"}}
+	w = performRequest(router, "POST", "/reload", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response responses.ReloadResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"pool app.lab: added"}, response.Changes)
+}
+
+func TestValidateConfig(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.POST("/config/validate", api.ValidateConfig)
+
+	w := performRequest(router, "POST", "/config/validate", []byte("valid"))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{}
+	w = performRequest(router, "POST", "/config/validate", []byte("valid"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response responses.ValidateConfigResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, response.Valid)
+
+	w = performRequest(router, "POST", "/config/validate", []byte("pools: [{}]"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	response = responses.ValidateConfigResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.False(t, response.Valid)
+	assert.Equal(t, []string{"pools[0]: hostname is required"}, response.Errors)
+}
+
+func TestConfigHistoryAndRollback(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	router := gin.Default()
+	router.GET("/config/history", api.GetConfigHistory)
+	router.POST("/config/rollback/:version", api.RollbackConfig)
+
+	w := performRequest(router, "GET", "/config/history", nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{changes: []string{"pool app.lab: removed"}}
+	w = performRequest(router, "GET", "/config/history", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history responses.ConfigHistoryResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history.Versions, 1)
+
+	w = performRequest(router, "POST", "/config/rollback/20261019-083506.000000000", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response responses.ReloadResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"pool app.lab: removed"}, response.Changes)
+
+	w = performRequest(router, "POST", "/config/rollback/20200101-000000.000000000", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{err: errors.New("invalid configuration")}
+	w = performRequest(router, "POST", "/config/rollback/20261019-083506.000000000", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExportAndApplyConfig(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	api.ConfigManager = &fakeConfigManager{}
+	router := gin.Default()
+	router.GET("/config", api.ExportConfig)
+	router.PUT("/config", api.ApplyConfig)
+
+	w := performRequest(router, "GET", "/config", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "json", w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	w = performRequest(router, "GET", "/config?format=yaml", nil)
+	assert.Equal(t, "yaml", w.Body.String())
+	req, _ := http.NewRequest("GET", "/config", nil)
+	req.Header.Set("Accept", "application/yaml")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "yaml", w.Body.String())
+	w = performRequest(router, "GET", "/config?format=xml", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "PUT", "/config?dry_run=true", []byte("pools: []"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response responses.ReloadResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"dry run: pools: []"}, response.Changes)
+	w = performRequest(router, "PUT", "/config", []byte("pools: []"))
+	response = responses.ReloadResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"pools: []"}, response.Changes)
+	w = performRequest(router, "PUT", "/config?dry_run=maybe", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	api.ConfigManager = &fakeConfigManager{err: errors.New("invalid configuration")}
+	w = performRequest(router, "PUT", "/config", []byte("pools: [{}]"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func performRegistrationRequest(r http.Handler, method, path string, token string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegisterServer(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api, _, _ := setupTestServerWithAuth(t, "ed25519")
+	p := loadbalancer.NewPool("test", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	assert.NoError(t, p.SetRegistration("0123456789abcdef", 20*time.Second))
+	api.LoadBalancer.AddPool(p)
+	other := loadbalancer.NewPool("other", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	assert.NoError(t, other.SetRegistration("fedcba9876543210", 0))
+	api.LoadBalancer.AddPool(other)
+
+	router := gin.Default()
+	router.Use(api.authMiddleware())
+	router.POST("/pools/:hostname/register", api.RegisterServer)
+	router.PUT("/leases/:id", api.RenewLease)
+	router.DELETE("/leases/:id", api.ReleaseLease)
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("test")) + "/register"
+	body := []byte(`{"address":"http://127.0.0.1:8080","health_check_path":"/health"}`)
+
+	// the token of another pool, or no token, is rejected
+	w := performRegistrationRequest(router, "POST", path, "fedcba9876543210", body)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequest(router, "POST", path, body)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, p.GetServers())
+
+	w = performRegistrationRequest(router, "POST", path, "0123456789abcdef", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var lease responses.LeaseResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &lease))
+	assert.Equal(t, uint64(20), lease.TtlSeconds)
+	servers := p.GetServers()
+	assert.Len(t, servers, 1)
+	assert.Equal(t, lease.LeaseId, servers[0].Id.String())
+	assert.Equal(t, loadbalancer.REGISTRATION, servers[0].ManagedBy)
+
+	// registering again renews the same lease
+	w = performRegistrationRequest(router, "POST", path, "0123456789abcdef", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var again responses.LeaseResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &again))
+	assert.Equal(t, lease.LeaseId, again.LeaseId)
+	assert.Len(t, p.GetServers(), 1)
+
+	w = performRegistrationRequest(router, "PUT", "/leases/"+lease.LeaseId, "fedcba9876543210", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRegistrationRequest(router, "PUT", "/leases/"+lease.LeaseId, "0123456789abcdef", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRegistrationRequest(router, "PUT", "/leases/"+uuid.New().String(), "0123456789abcdef", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRegistrationRequest(router, "DELETE", "/leases/"+lease.LeaseId, "0123456789abcdef", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint32(loadbalancer.Draining), servers[0].ServerStatus.Load())
+	w = performRegistrationRequest(router, "PUT", "/leases/"+lease.LeaseId, "0123456789abcdef", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSweepLeases(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	p := loadbalancer.NewPool("test", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	assert.NoError(t, p.SetRegistration("0123456789abcdef", 10*time.Second))
+	api.LoadBalancer.AddPool(p)
+	// a registered server saved to the configuration file, loaded after a restart
+	server, err := loadbalancer.NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	assert.NoError(t, err)
+	server.ManagedBy = loadbalancer.REGISTRATION
+	p.AddServer(server)
+	static, err := loadbalancer.NewServerHost("http://127.0.0.2:8080", "/health", common.Condition{})
+	assert.NoError(t, err)
+	p.AddServer(static)
+
+	now := time.Now()
+	api.sweepLeases(now)
+	assert.Equal(t, now.Add(10*time.Second), api.leases[server.Id])
+	api.sweepLeases(now.Add(10 * time.Second))
+	assert.Len(t, p.GetServers(), 2)
+
+	api.sweepLeases(now.Add(11 * time.Second))
+	assert.Equal(t, []*loadbalancer.ServerHost{static}, p.GetServers())
+	assert.Empty(t, api.leases)
+}
+
+func TestStickySessions(t *testing.T) {
+	log.Println("Executing ", t.Name())
+	api := setupTestServer()
+	p := loadbalancer.NewPoolWithIPStickySessions("test", 5*time.Second, 10*time.Second, 2*time.Second, time.Minute, 3, 1)
+	server, err := loadbalancer.NewServerHost("http://127.0.0.1:8081", "/health", common.Condition{})
+	assert.NoError(t, err)
+	server.ServerStatus.Store(uint32(loadbalancer.Healthy))
+	p.AddServer(server)
+	api.LoadBalancer.AddPool(p)
+	for _, clientIP := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = clientIP
+		_, err := p.ChooseServer(req)
+		assert.NoError(t, err)
+	}
+
+	router := gin.Default()
+	router.GET("/pools/:hostname/sessions", api.GetStickySessions)
+	router.DELETE("/pools/:hostname/sessions", api.FlushStickySessions)
+	path := "/pools/" + base64.RawURLEncoding.EncodeToString([]byte("test")) + "/sessions"
+
+	w := performRequest(router, "GET", "/pools/"+base64.RawURLEncoding.EncodeToString([]byte("missing"))+"/sessions", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(router, "GET", path, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var sessions responses.StickySessionsResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	assert.Equal(t, loadbalancer.DEFAULT_MAX_STICKY_SESSIONS, sessions.MaxSessions)
+	if assert.Len(t, sessions.Sessions, 2) {
+		assert.Equal(t, "10.0.0.2", sessions.Sessions[0].Key)
+		assert.Equal(t, server.Id.String(), sessions.Sessions[0].ServerId)
+		assert.Equal(t, "http://127.0.0.1:8081", sessions.Sessions[0].ServerAddress)
+	}
+
+	w = performRequest(router, "DELETE", path+"?key=10.0.0.9", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(router, "DELETE", path+"?key=10.0.0.1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"flushed": 1}`, w.Body.String())
+	w = performRequest(router, "DELETE", path, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"flushed": 1}`, w.Body.String())
+	assert.Empty(t, p.GetStickySessions())
+}
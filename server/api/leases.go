@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"continuity/common/requests"
+	"continuity/common/responses"
+	"continuity/server/loadbalancer"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// LEASE_SWEEP_INTERVAL is how often expired leases are looked for
+const LEASE_SWEEP_INTERVAL = time.Second
+
+/*
+registrationRoutes
+The routes used by the servers registering themselves. They are authenticated with the registration token of
+the pool instead of the authorized keys.
+*/
+var registrationRoutes = map[string]bool{
+	"/pools/:hostname/register": true,
+	"/leases/:id":               true,
+}
+
+/*
+RegisterServer
+Adds the server of the request to the pool with a lease, which must be renewed with a heartbeat before its TTL
+lapses. The lease has the Id of the server, so that it's kept across restarts.
+Registering again a server with the same address and condition renews its lease.
+*/
+func (api *ApiServer) RegisterServer(context *gin.Context) {
+	hostname, err := base64.RawURLEncoding.DecodeString(context.Param(("hostname")))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid hostname encoding"})
+		return
+	}
+	pool, err := api.LoadBalancer.GetPool(string(hostname))
+	// unknown pools are unauthorized too, the token doesn't tell which pools exist
+	if err != nil || !pool.CheckRegistrationToken(bearerToken(context)) {
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	var req requests.RegisterServerRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	server, err := req.Validate()
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := pool.ValidateServer(server); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	api.leasesMutex.Lock()
+	defer api.leasesMutex.Unlock()
+	for _, registered := range pool.GetServers() {
+		if registered.ManagedBy != loadbalancer.REGISTRATION ||
+			registered.ServerStatus.Load() == uint32(loadbalancer.Draining) ||
+			registered.Address.String() != server.Address.String() || registered.Condition != server.Condition {
+			continue
+		}
+		if registered.HealthCheckPath == server.HealthCheckPath && registered.Protocol == server.Protocol {
+			context.JSON(http.StatusOK, api.renewLease(pool, registered.Id))
+			return
+		}
+		// registered again with other settings, e.g. after a restart of the server
+		_, _ = pool.RemoveServer(registered.Id)
+		delete(api.leases, registered.Id)
+	}
+	pool.AddServer(server)
+	log.Printf("Pool %s - Server %s registered\n", pool.Hostname, server.Address.String())
+	context.JSON(http.StatusOK, api.renewLease(pool, server.Id))
+	api.saveConfig <- true
+}
+
+/*
+RenewLease
+Heartbeat of a registered server, its lease expires after the TTL of the pool again.
+*/
+func (api *ApiServer) RenewLease(context *gin.Context) {
+	pool, server, ok := api.leaseServer(context)
+	if !ok {
+		return
+	}
+	api.leasesMutex.Lock()
+	defer api.leasesMutex.Unlock()
+	context.JSON(http.StatusOK, api.renewLease(pool, server.Id))
+}
+
+/*
+ReleaseLease
+Unregisters a server on a clean shutdown, the server is drained from the pool.
+*/
+func (api *ApiServer) ReleaseLease(context *gin.Context) {
+	pool, server, ok := api.leaseServer(context)
+	if !ok {
+		return
+	}
+	api.leasesMutex.Lock()
+	delete(api.leases, server.Id)
+	api.leasesMutex.Unlock()
+	if _, err := pool.DrainServer(server.Id); err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"error": "lease not found"})
+		return
+	}
+	log.Printf("Pool %s - Server %s unregistered\n", pool.Hostname, server.Address.String())
+	api.saveConfig <- true
+}
+
+/*
+leaseServer
+Returns the registered server of the lease in the request, after checking the registration token of its pool.
+The response is written when it fails.
+*/
+func (api *ApiServer) leaseServer(context *gin.Context) (*loadbalancer.Pool, *loadbalancer.ServerHost, bool) {
+	leaseId, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid lease ID"})
+		return nil, nil, false
+	}
+	for _, pool := range api.LoadBalancer.GetPools() {
+		for _, server := range pool.GetServers() {
+			if server.Id != leaseId || server.ManagedBy != loadbalancer.REGISTRATION ||
+				server.ServerStatus.Load() == uint32(loadbalancer.Draining) {
+				continue
+			}
+			if !pool.CheckRegistrationToken(bearerToken(context)) {
+				context.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+				return nil, nil, false
+			}
+			return pool, server, true
+		}
+	}
+	// the server expired or was removed, it has to register again
+	context.JSON(http.StatusNotFound, gin.H{"error": "lease not found"})
+	return nil, nil, false
+}
+
+/*
+renewLease
+Sets the expiry of the lease of a server of the pool, leasesMutex must be held.
+*/
+func (api *ApiServer) renewLease(pool *loadbalancer.Pool, serverId uuid.UUID) responses.LeaseResponse {
+	ttl := pool.GetLeaseTtl()
+	expiresAt := time.Now().Add(ttl)
+	api.leases[serverId] = expiresAt
+	return responses.LeaseResponse{
+		LeaseId:    serverId.String(),
+		TtlSeconds: uint64(ttl / time.Second),
+		ExpiresAt:  expiresAt,
+	}
+}
+
+func (api *ApiServer) runLeaseSweeper(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(LEASE_SWEEP_INTERVAL):
+		}
+		api.sweepLeases(time.Now())
+	}
+}
+
+/*
+sweepLeases
+Removes the registered servers whose lease expired. Registered servers without a lease, loaded from the
+configuration file after a restart, get one with a full TTL.
+*/
+func (api *ApiServer) sweepLeases(now time.Time) {
+	api.leasesMutex.Lock()
+	registered := map[uuid.UUID]bool{}
+	removed := false
+	for _, pool := range api.LoadBalancer.GetPools() {
+		for _, server := range pool.GetServers() {
+			if server.ManagedBy != loadbalancer.REGISTRATION || server.ServerStatus.Load() == uint32(loadbalancer.Draining) {
+				continue
+			}
+			registered[server.Id] = true
+			expiresAt, exists := api.leases[server.Id]
+			if !exists {
+				api.leases[server.Id] = now.Add(pool.GetLeaseTtl())
+				continue
+			}
+			if now.After(expiresAt) {
+				if _, err := pool.RemoveServer(server.Id); err == nil {
+					log.Printf("Pool %s - Server %s removed, its lease expired\n", pool.Hostname, server.Address.String())
+					removed = true
+				}
+				delete(api.leases, server.Id)
+			}
+		}
+	}
+	for id := range api.leases {
+		if !registered[id] {
+			delete(api.leases, id)
+		}
+	}
+	api.leasesMutex.Unlock()
+	if removed {
+		api.saveConfig <- true
+	}
+}
+
+func bearerToken(context *gin.Context) string {
+	token, found := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"continuity/server/api"
 	"continuity/server/conf"
+	"continuity/server/handoff"
+	"continuity/server/loadbalancer"
 	"continuity/server/version"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	configFilePath := flag.String("config", "config.yaml", "Path to configuration file")
 	sampleConfig := flag.Bool("sample-config", false, "Generate a sample configuration file")
 	versionFlag := flag.Bool("version", false, "Prints the server version")
+	shutdownTimeout := flag.Duration("shutdown-timeout", loadbalancer.DEFAULT_SHUTDOWN_TIMEOUT, "Time allowed to in-flight requests and transactions to complete on shutdown or when a listener is replaced")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration file and exit")
+	watchConfig := flag.Duration("watch-config", 0, "Reload the configuration file when it changes, checking at the given interval (disabled if 0)")
 	flag.Parse()
 
 	if *versionFlag {
@@ -25,12 +36,116 @@ func main() {
 		return
 	}
 
+	if *checkConfig {
+		problems := conf.ValidateConfigFile(*configFilePath)
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		if problems != nil {
+			log.Fatalf("Configuration file %s is not valid", *configFilePath)
+		}
+		log.Printf("Configuration file %s is valid", *configFilePath)
+		return
+	}
+
 	lb, api, err := conf.LoadConfig(*configFilePath)
 
 	if err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 
 	}
-	log.Println("Started load balancer on", lb.BindAddress, ":", lb.BindPort)
-	api.Start()
+	lb.SetShutdownTimeout(*shutdownTimeout)
+	for _, listener := range lb.GetListeners() {
+		log.Println("Started load balancer listener", listener.Name, "on", listener.Addr())
+	}
+	if err := api.Start(); err != nil {
+		log.Fatalf("Failed to start API server: %v", err)
+	}
+	handoff.Ready()
+	if *watchConfig > 0 {
+		conf.WatchConfig(*configFilePath, lb, api, *watchConfig)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Println("Received", sig, "reloading configuration")
+			if _, err := conf.ReloadConfig(*configFilePath, lb, api); err != nil {
+				log.Println("Error reloading configuration, the running configuration is kept:", err)
+			}
+			continue
+		}
+		// after a restart the configuration belongs to the new process
+		saveConfig := true
+		if sig == syscall.SIGUSR2 {
+			if err := restart(*configFilePath, lb, api, *shutdownTimeout); err != nil {
+				log.Println("Restart failed, the server keeps running:", err)
+				continue
+			}
+			saveConfig = false
+		}
+		log.Println("Received", sig, "shutting down")
+		shutdown(*configFilePath, lb, api, *shutdownTimeout, saveConfig)
+		return
+	}
+}
+
+/*
+restart
+Hands the listeners over to a new process running the same binary. The API is read only while the new process
+starts, so that it loads the latest configuration. On success the current process must shut down.
+*/
+func restart(configPath string, lb *loadbalancer.LoadBalancer, api *api.ApiServer, timeout time.Duration) error {
+	log.Println("Restarting server")
+	api.SetReadOnly(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := api.WaitTransactions(ctx); err != nil {
+		api.SetReadOnly(false)
+		return err
+	}
+	if err := conf.StopAutoSaveConfig(configPath, lb, api); err != nil {
+		conf.ResumeAutoSaveConfig()
+		api.SetReadOnly(false)
+		return err
+	}
+	// the new process restores the sticky sessions on start
+	if err := conf.SaveStickySessions(configPath, lb); err != nil {
+		log.Println("Error saving sticky sessions:", err)
+	}
+	process, err := handoff.Restart(timeout)
+	if err != nil {
+		conf.ResumeAutoSaveConfig()
+		api.SetReadOnly(false)
+		return err
+	}
+	log.Println("New server process", process.Pid, "is ready")
+	return nil
+}
+
+/*
+shutdown
+Stops the discovery providers and the API waiting for running transactions, drains in-flight requests and saves
+the configuration and the sticky sessions.
+*/
+func shutdown(configPath string, lb *loadbalancer.LoadBalancer, api *api.ApiServer, timeout time.Duration, saveConfig bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conf.StopDiscovery()
+	if err := api.Shutdown(ctx); err != nil {
+		log.Println("Error stopping API server:", err)
+	}
+	if err := lb.Shutdown(ctx); err != nil {
+		log.Println("Error stopping load balancer:", err)
+	}
+	if saveConfig {
+		if err := conf.StopAutoSaveConfig(configPath, lb, api); err != nil {
+			log.Println("Error saving configuration:", err)
+		}
+		if err := conf.SaveStickySessions(configPath, lb); err != nil {
+			log.Println("Error saving sticky sessions:", err)
+		}
+	}
+	log.Println("Server stopped")
 }
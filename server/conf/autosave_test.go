@@ -9,7 +9,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -20,9 +20,11 @@ import (
 func TestAutoSaveServersAndReloadConfig(t *testing.T) {
 	fmt.Println("Executing TestAutoSaveServersAndReloadConfig")
 	loadbalancer.NewLoadBalancer = fakeLoadBalancer
-	defer os.Remove(ConfigPath)
+	configPath := ConfigPath
+	ConfigPath = filepath.Join(t.TempDir(), "config.yaml")
+	t.Cleanup(func() { ConfigPath = configPath })
 	gin.SetMode(gin.TestMode)
-	lb, _ := loadbalancer.NewLoadBalancer("127.0.0.1", 8080)
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
 	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, SaveConfigChan, nil)
 
 	//Create pool request
@@ -4,9 +4,13 @@ import (
 	"continuity/common"
 	"continuity/server/api"
 	"continuity/server/loadbalancer"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,165 +20,635 @@ import (
 var ConfigPath = "config.yaml"
 var SaveConfigChan = make(chan bool, 10)
 var autosaveStarted = false
+var autosaveStopped = false
+var saveMutex sync.Mutex
+var lastConfigHash [sha256.Size]byte
 
 type Configuration struct {
-	Address           string
-	Port              int
-	ManagenentAddress string
-	ManagementPort    int
-	Pools             []PoolConfig
-	AuthorizedKeys    *string `yaml:"authorizedkeys,omitempty"`
+	Address                  string           `yaml:"address,omitempty" json:"address,omitempty"`
+	Port                     int              `yaml:"port,omitempty" json:"port,omitempty"`
+	ManagenentAddress        string           `json:"managenentaddress"`
+	ManagementPort           int              `json:"managementport"`
+	Pools                    []PoolConfig     `json:"pools"`
+	AuthorizedKeys           *string          `yaml:"authorizedkeys,omitempty" json:"authorizedkeys,omitempty"`
+	TrustedProxies           []string         `yaml:"trustedproxies,omitempty" json:"trustedproxies,omitempty"`
+	ProxyProtocol            bool             `yaml:"proxyprotocol,omitempty" json:"proxyprotocol,omitempty"`
+	TlsCertificate           string           `yaml:"tlscertificate,omitempty" json:"tlscertificate,omitempty"`
+	TlsKey                   string           `yaml:"tlskey,omitempty" json:"tlskey,omitempty"`
+	H2C                      bool             `yaml:"h2c,omitempty" json:"h2c,omitempty"`
+	ReadTimeoutSeconds       uint64           `yaml:"readtimeoutseconds,omitempty" json:"readtimeoutseconds,omitempty"`
+	ReadHeaderTimeoutSeconds uint64           `yaml:"readheadertimeoutseconds,omitempty" json:"readheadertimeoutseconds,omitempty"`
+	WriteTimeoutSeconds      uint64           `yaml:"writetimeoutseconds,omitempty" json:"writetimeoutseconds,omitempty"`
+	IdleTimeoutSeconds       uint64           `yaml:"idletimeoutseconds,omitempty" json:"idletimeoutseconds,omitempty"`
+	MaxHeaderBytes           int              `yaml:"maxheaderbytes,omitempty" json:"maxheaderbytes,omitempty"`
+	MaxRequestBodyBytes      int64            `yaml:"maxrequestbodybytes,omitempty" json:"maxrequestbodybytes,omitempty"`
+	Listeners                []ListenerConfig `yaml:"listeners,omitempty" json:"listeners,omitempty"`
+	HistorySize              int              `yaml:"historysize,omitempty" json:"historysize,omitempty"`
+	Discovery                *DiscoveryConfig `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+}
+
+/*
+ListenerConfig
+A frontend listener of a configuration with several of them. A configuration with a single listener can use the
+top-level address, port and listener settings instead.
+*/
+type ListenerConfig struct {
+	Name                     string `json:"name"`
+	Address                  string `json:"address"`
+	Port                     int    `json:"port"`
+	ProxyProtocol            bool   `yaml:"proxyprotocol,omitempty" json:"proxyprotocol,omitempty"`
+	TlsCertificate           string `yaml:"tlscertificate,omitempty" json:"tlscertificate,omitempty"`
+	TlsKey                   string `yaml:"tlskey,omitempty" json:"tlskey,omitempty"`
+	H2C                      bool   `yaml:"h2c,omitempty" json:"h2c,omitempty"`
+	ReadTimeoutSeconds       uint64 `yaml:"readtimeoutseconds,omitempty" json:"readtimeoutseconds,omitempty"`
+	ReadHeaderTimeoutSeconds uint64 `yaml:"readheadertimeoutseconds,omitempty" json:"readheadertimeoutseconds,omitempty"`
+	WriteTimeoutSeconds      uint64 `yaml:"writetimeoutseconds,omitempty" json:"writetimeoutseconds,omitempty"`
+	IdleTimeoutSeconds       uint64 `yaml:"idletimeoutseconds,omitempty" json:"idletimeoutseconds,omitempty"`
+	MaxHeaderBytes           int    `yaml:"maxheaderbytes,omitempty" json:"maxheaderbytes,omitempty"`
+	MaxRequestBodyBytes      int64  `yaml:"maxrequestbodybytes,omitempty" json:"maxrequestbodybytes,omitempty"`
 }
 
 type PoolConfig struct {
-	Hostname                       string
-	HealthCheckIntervalSeconds     uint64
-	HealthCheckInitialDelaySeconds uint64
-	HealthCheckTimeoutSeconds      uint64
-	HealthCheck_numOk              uint32
-	HealthCheck_numFail            uint32
-	ConditionalServers             []*ServerHostConfig
-	UnconditionalServers           []*ServerHostConfig
-	StickySessions                 bool
-	StickyMethod                   string
-	StickySessionTimeoutSeconds    uint32
-	stickyCookieName               string
+	Hostname                       string              `json:"hostname"`
+	HealthCheckIntervalSeconds     uint64              `json:"healthcheckintervalseconds"`
+	HealthCheckInitialDelaySeconds uint64              `json:"healthcheckinitialdelayseconds"`
+	HealthCheckTimeoutSeconds      uint64              `json:"healthchecktimeoutseconds"`
+	HealthCheck_numOk              uint32              `json:"healthcheck_numok"`
+	HealthCheck_numFail            uint32              `json:"healthcheck_numfail"`
+	ConditionalServers             []*ServerHostConfig `json:"conditionalservers"`
+	UnconditionalServers           []*ServerHostConfig `json:"unconditionalservers"`
+	StickySessions                 bool                `json:"stickysessions"`
+	StickyMethod                   string              `json:"stickymethod"`
+	StickySessionTimeoutSeconds    uint32              `json:"stickysessiontimeoutseconds"`
+	StickyCookieName               string              `yaml:"stickycookiename,omitempty" json:"stickycookiename,omitempty"`
+	StickyHeader                   string              `yaml:"stickyheader,omitempty" json:"stickyheader,omitempty"`
+	StickySlidingExpiry            bool                `yaml:"stickyslidingexpiry,omitempty" json:"stickyslidingexpiry,omitempty"`
+	MaxStickySessions              int                 `yaml:"maxstickysessions,omitempty" json:"maxstickysessions,omitempty"`
+	StickyCookie                   *StickyCookieConfig `yaml:"stickycookie,omitempty" json:"stickycookie,omitempty"`
+	BackendProxyProtocol           int                 `yaml:"backendproxyprotocol,omitempty" json:"backendproxyprotocol,omitempty"`
+	RequestIdHeader                string              `yaml:"requestidheader,omitempty" json:"requestidheader,omitempty"`
+	UpgradeGracePeriodSeconds      uint64              `yaml:"upgradegraceperiodseconds,omitempty" json:"upgradegraceperiodseconds,omitempty"`
+	UpgradeIdleTimeoutSeconds      uint64              `yaml:"upgradeidletimeoutseconds,omitempty" json:"upgradeidletimeoutseconds,omitempty"`
+	Transport                      *TransportConfig    `yaml:"transport,omitempty" json:"transport,omitempty"`
+	MaxRequestBodyBytes            int64               `yaml:"maxrequestbodybytes,omitempty" json:"maxrequestbodybytes,omitempty"`
+	Mode                           string              `yaml:"mode,omitempty" json:"mode,omitempty"`
+	ListenPort                     int                 `yaml:"listenport,omitempty" json:"listenport,omitempty"`
+	Listeners                      []string            `yaml:"listeners,omitempty" json:"listeners,omitempty"`
+	RegistrationToken              string              `yaml:"registrationtoken,omitempty" json:"registrationtoken,omitempty"`
+	LeaseTtlSeconds                uint64              `yaml:"leasettlseconds,omitempty" json:"leasettlseconds,omitempty"`
 }
 
-type ServerHostConfig struct {
-	Id              uuid.UUID
-	Address         string
-	Condition       common.Condition
-	HealthCheckPath string
+type TransportConfig struct {
+	DialTimeoutSeconds           uint64 `yaml:"dialtimeoutseconds,omitempty" json:"dialtimeoutseconds,omitempty"`
+	TLSHandshakeTimeoutSeconds   uint64 `yaml:"tlshandshaketimeoutseconds,omitempty" json:"tlshandshaketimeoutseconds,omitempty"`
+	ResponseHeaderTimeoutSeconds uint64 `yaml:"responseheadertimeoutseconds,omitempty" json:"responseheadertimeoutseconds,omitempty"`
+	IdleConnTimeoutSeconds       uint64 `yaml:"idleconntimeoutseconds,omitempty" json:"idleconntimeoutseconds,omitempty"`
+	MaxIdleConns                 int    `yaml:"maxidleconns,omitempty" json:"maxidleconns,omitempty"`
+	MaxIdleConnsPerHost          int    `yaml:"maxidleconnsperhost,omitempty" json:"maxidleconnsperhost,omitempty"`
+	CaFile                       string `yaml:"cafile,omitempty" json:"cafile,omitempty"`
+	ClientCertificate            string `yaml:"clientcertificate,omitempty" json:"clientcertificate,omitempty"`
+	ClientKey                    string `yaml:"clientkey,omitempty" json:"clientkey,omitempty"`
+	ServerName                   string `yaml:"servername,omitempty" json:"servername,omitempty"`
+	InsecureSkipVerify           bool   `yaml:"insecureskipverify,omitempty" json:"insecureskipverify,omitempty"`
 }
 
-func LoadConfig(path string) (*loadbalancer.LoadBalancer, *api.ApiServer, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, nil, err
+/*
+StickyCookieConfig
+The cookie of the LBCookie sticky method. The secret is generated, and saved, when not set.
+HttpOnly defaults to true and SameSite to Lax.
+*/
+type StickyCookieConfig struct {
+	Secret   string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	Opaque   bool   `yaml:"opaque,omitempty" json:"opaque,omitempty"`
+	Path     string `yaml:"path,omitempty" json:"path,omitempty"`
+	Domain   string `yaml:"domain,omitempty" json:"domain,omitempty"`
+	Secure   bool   `yaml:"secure,omitempty" json:"secure,omitempty"`
+	HttpOnly *bool  `yaml:"httponly,omitempty" json:"httponly,omitempty"`
+	SameSite string `yaml:"samesite,omitempty" json:"samesite,omitempty"`
+}
+
+func (cookieConf *StickyCookieConfig) options() loadbalancer.LbCookieOptions {
+	options := loadbalancer.DefaultLbCookieOptions()
+	options.Secret = cookieConf.Secret
+	options.Opaque = cookieConf.Opaque
+	if cookieConf.Path != "" {
+		options.Path = cookieConf.Path
 	}
-	defer func() { _ = file.Close() }()
+	options.Domain = cookieConf.Domain
+	options.Secure = cookieConf.Secure
+	if cookieConf.HttpOnly != nil {
+		options.HttpOnly = *cookieConf.HttpOnly
+	}
+	if cookieConf.SameSite != "" {
+		options.SameSite = cookieConf.SameSite
+	}
+	return options
+}
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return nil, nil, err
+func newStickyCookieConfig(options loadbalancer.LbCookieOptions) *StickyCookieConfig {
+	defaults := loadbalancer.DefaultLbCookieOptions()
+	cookieConf := &StickyCookieConfig{
+		Secret: options.Secret,
+		Opaque: options.Opaque,
+		Domain: options.Domain,
+		Secure: options.Secure,
+	}
+	if options.Path != defaults.Path {
+		cookieConf.Path = options.Path
+	}
+	if options.HttpOnly != defaults.HttpOnly {
+		cookieConf.HttpOnly = &options.HttpOnly
+	}
+	if options.SameSite != defaults.SameSite {
+		cookieConf.SameSite = options.SameSite
 	}
-	configuration := &Configuration{}
-	err = yaml.Unmarshal(data, configuration)
+	return cookieConf
+}
+
+type ServerHostConfig struct {
+	Id              uuid.UUID        `json:"id"`
+	Address         string           `json:"address"`
+	Condition       common.Condition `json:"condition"`
+	HealthCheckPath string           `json:"healthcheckpath"`
+	Protocol        string           `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	ManagedBy       string           `yaml:"managedby,omitempty" json:"managedby,omitempty"`
+	Resolve         string           `yaml:"resolve,omitempty" json:"resolve,omitempty"`
+	Nameserver      string           `yaml:"nameserver,omitempty" json:"nameserver,omitempty"`
+}
+
+func LoadConfig(path string) (*loadbalancer.LoadBalancer, *api.ApiServer, error) {
+	configuration, err := readConfiguration(path)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// nothing is started until the whole configuration is known to be valid
+	if problems := configuration.Validate(); problems != nil {
+		return nil, nil, invalidConfigurationError(problems)
+	}
 	if configuration.AuthorizedKeys != nil {
-		if _, err := os.Stat(*configuration.AuthorizedKeys); os.IsNotExist(err) {
-			return nil, nil, fmt.Errorf("authorized keys file does not exist: %s", *configuration.AuthorizedKeys)
-		} else {
-			fmt.Printf("Using authorized keys file: %s\n", *configuration.AuthorizedKeys)
-		}
+		fmt.Printf("Using authorized keys file: %s\n", *configuration.AuthorizedKeys)
 	} else {
 		fmt.Println("Warning: No authorized keys file specified, API server will not use authentication")
 	}
 
-	lb, err := loadbalancer.NewLoadBalancer(configuration.Address, configuration.Port)
+	saveMutex.Lock()
+	historySize = configuration.HistorySize
+	restartSettings = nil
+	saveMutex.Unlock()
+
+	listeners := []*loadbalancer.Listener{}
+	for _, listenerConf := range configuration.listenerConfigs() {
+		listener, err := newListener(listenerConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	lb, err := loadbalancer.NewLoadBalancer(listeners)
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(configuration.TrustedProxies) > 0 {
+		if err := lb.SetTrustedProxies(configuration.TrustedProxies); err != nil {
+			return nil, nil, err
+		}
+	}
 	for _, poolConf := range configuration.Pools {
-		var pool *loadbalancer.Pool
-		if poolConf.StickySessions {
-			stickyMethod, err := loadbalancer.GetStickyMethodFromString(poolConf.StickyMethod)
+		pool, err := newPool(poolConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		servers, err := newServerHosts(poolConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, serverHost := range servers {
+			pool.AddServer(serverHost)
+		}
+		dynamicServers, err := newDynamicServers(poolConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dynamicServer := range dynamicServers {
+			pool.AddDynamicServer(dynamicServer)
+		}
+		err = lb.AddPool(pool)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	restoreStickySessions(path, lb)
+	apiServer := api.NewApiServer(configuration.ManagenentAddress,
+		configuration.ManagementPort,
+		lb,
+		SaveConfigChan,
+		configuration.AuthorizedKeys)
+	apiServer.ConfigManager = &fileConfigManager{path: path, lb: lb, api: apiServer}
+	if err := startDiscovery(configuration.Discovery, lb); err != nil {
+		return nil, nil, err
+	}
+	StartAutoSaveConfig(path, lb, apiServer)
+	return lb, apiServer, nil
+}
+
+/*
+readConfiguration
+Reads and parses the configuration file, remembering its hash to detect external changes.
+Environment variables are interpolated and the CONTINUITY_* overrides applied, see parseConfigFile.
+*/
+func readConfiguration(path string) (*Configuration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	configuration, fromEnv, err := parseConfigFile(data)
+	if err != nil {
+		return nil, err
+	}
+	saveMutex.Lock()
+	lastConfigHash = sha256.Sum256(data)
+	configTemplate = nil
+	if fromEnv {
+		configTemplate = data
+	}
+	saveMutex.Unlock()
+	return configuration, nil
+}
+
+/*
+listenerConfigs
+Returns the listeners of the configuration, the top-level settings being the default listener when the
+listeners list is not used.
+*/
+func (configuration *Configuration) listenerConfigs() []ListenerConfig {
+	if len(configuration.Listeners) > 0 {
+		return configuration.Listeners
+	}
+	return []ListenerConfig{{
+		Name:                     loadbalancer.DEFAULT_LISTENER,
+		Address:                  configuration.Address,
+		Port:                     configuration.Port,
+		ProxyProtocol:            configuration.ProxyProtocol,
+		TlsCertificate:           configuration.TlsCertificate,
+		TlsKey:                   configuration.TlsKey,
+		H2C:                      configuration.H2C,
+		ReadTimeoutSeconds:       configuration.ReadTimeoutSeconds,
+		ReadHeaderTimeoutSeconds: configuration.ReadHeaderTimeoutSeconds,
+		WriteTimeoutSeconds:      configuration.WriteTimeoutSeconds,
+		IdleTimeoutSeconds:       configuration.IdleTimeoutSeconds,
+		MaxHeaderBytes:           configuration.MaxHeaderBytes,
+		MaxRequestBodyBytes:      configuration.MaxRequestBodyBytes,
+	}}
+}
+
+/*
+usesTopLevelListener
+Returns whether any of the top-level listener settings is set.
+*/
+func (configuration *Configuration) usesTopLevelListener() bool {
+	return configuration.Address != "" || configuration.Port != 0 || configuration.ProxyProtocol ||
+		configuration.TlsCertificate != "" || configuration.TlsKey != "" || configuration.H2C ||
+		configuration.ReadTimeoutSeconds != 0 || configuration.ReadHeaderTimeoutSeconds != 0 ||
+		configuration.WriteTimeoutSeconds != 0 || configuration.IdleTimeoutSeconds != 0 ||
+		configuration.MaxHeaderBytes != 0 || configuration.MaxRequestBodyBytes != 0
+}
+
+func (listenerConf ListenerConfig) options() loadbalancer.ListenerOptions {
+	return loadbalancer.ListenerOptions{
+		ProxyProtocol:       listenerConf.ProxyProtocol,
+		TlsCertificate:      listenerConf.TlsCertificate,
+		TlsKey:              listenerConf.TlsKey,
+		H2C:                 listenerConf.H2C,
+		ReadTimeout:         time.Second * time.Duration(listenerConf.ReadTimeoutSeconds),
+		ReadHeaderTimeout:   time.Second * time.Duration(listenerConf.ReadHeaderTimeoutSeconds),
+		WriteTimeout:        time.Second * time.Duration(listenerConf.WriteTimeoutSeconds),
+		IdleTimeout:         time.Second * time.Duration(listenerConf.IdleTimeoutSeconds),
+		MaxHeaderBytes:      listenerConf.MaxHeaderBytes,
+		MaxRequestBodyBytes: listenerConf.MaxRequestBodyBytes,
+	}
+}
+
+func newListener(listenerConf ListenerConfig) (*loadbalancer.Listener, error) {
+	return loadbalancer.NewListener(listenerConf.Name, listenerConf.Address, listenerConf.Port, listenerConf.options())
+}
+
+func newListenerConfig(listener *loadbalancer.Listener) ListenerConfig {
+	return ListenerConfig{
+		Name:                     listener.Name,
+		Address:                  listener.Address,
+		Port:                     listener.Port,
+		ProxyProtocol:            listener.Options.ProxyProtocol,
+		TlsCertificate:           listener.Options.TlsCertificate,
+		TlsKey:                   listener.Options.TlsKey,
+		H2C:                      listener.Options.H2C,
+		ReadTimeoutSeconds:       uint64(listener.Options.ReadTimeout / time.Second),
+		ReadHeaderTimeoutSeconds: uint64(listener.Options.ReadHeaderTimeout / time.Second),
+		WriteTimeoutSeconds:      uint64(listener.Options.WriteTimeout / time.Second),
+		IdleTimeoutSeconds:       uint64(listener.Options.IdleTimeout / time.Second),
+		MaxHeaderBytes:           listener.Options.MaxHeaderBytes,
+		MaxRequestBodyBytes:      listener.Options.MaxRequestBodyBytes,
+	}
+}
+
+/*
+newPool
+Creates a pool, without servers, from its configuration.
+*/
+func newPool(poolConf PoolConfig) (*loadbalancer.Pool, error) {
+	var pool *loadbalancer.Pool
+	if poolConf.StickySessions {
+		stickyMethod, err := loadbalancer.GetStickyMethodFromString(poolConf.StickyMethod)
+		if err != nil {
+			return nil, err
+		}
+		switch stickyMethod {
+		case loadbalancer.StickyMethod_AppCookie:
+			pool, err = loadbalancer.NewPoolWithStickySessionCustomCookie(
+				poolConf.Hostname,
+				time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
+				time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
+				poolConf.HealthCheck_numOk,
+				poolConf.HealthCheck_numFail,
+				poolConf.StickyCookieName,
+			)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
-			switch stickyMethod {
-			case loadbalancer.StickyMethod_AppCookie:
-				pool, err = loadbalancer.NewPoolWithStickySessionCustomCookie(
-					poolConf.Hostname,
-					time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
-					time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
-					poolConf.HealthCheck_numOk,
-					poolConf.HealthCheck_numFail,
-					poolConf.stickyCookieName,
-				)
-				if err != nil {
-					return nil, nil, err
-				}
-				break
-			case loadbalancer.StickyMethod_IP:
-				pool = loadbalancer.NewPoolWithIPStickySessions(
-					poolConf.Hostname,
-					time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
-					time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
-					poolConf.HealthCheck_numOk,
-					poolConf.HealthCheck_numFail,
-				)
-				break
-			default:
-				pool = loadbalancer.NewPoolWithStickySession(
-					poolConf.Hostname,
-					time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
-					time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
-					time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
-					poolConf.HealthCheck_numOk,
-					poolConf.HealthCheck_numFail,
-				)
+			break
+		case loadbalancer.StickyMethod_IP:
+			pool = loadbalancer.NewPoolWithIPStickySessions(
+				poolConf.Hostname,
+				time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
+				time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
+				poolConf.HealthCheck_numOk,
+				poolConf.HealthCheck_numFail,
+			)
+			break
+		case loadbalancer.StickyMethod_Header:
+			pool, err = loadbalancer.NewPoolWithHeaderStickySessions(
+				poolConf.Hostname,
+				time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
+				time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
+				time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
+				poolConf.HealthCheck_numOk,
+				poolConf.HealthCheck_numFail,
+				poolConf.StickyHeader,
+			)
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			pool = loadbalancer.NewPool(
+		default:
+			pool = loadbalancer.NewPoolWithStickySession(
 				poolConf.Hostname,
 				time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
 				time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
 				time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
+				time.Second*time.Duration(poolConf.StickySessionTimeoutSeconds),
 				poolConf.HealthCheck_numOk,
 				poolConf.HealthCheck_numFail,
 			)
+			if poolConf.StickyCookie != nil {
+				if err := pool.SetLbCookieOptions(poolConf.StickyCookie.options()); err != nil {
+					return nil, err
+				}
+			}
 		}
+	} else {
+		pool = loadbalancer.NewPool(
+			poolConf.Hostname,
+			time.Second*time.Duration(poolConf.HealthCheckTimeoutSeconds),
+			time.Second*time.Duration(poolConf.HealthCheckIntervalSeconds),
+			time.Second*time.Duration(poolConf.HealthCheckInitialDelaySeconds),
+			poolConf.HealthCheck_numOk,
+			poolConf.HealthCheck_numFail,
+		)
+	}
+	sticky := pool.GetStickySettings()
+	if poolConf.StickyCookie != nil && (!sticky.Enabled || sticky.Method != loadbalancer.StickyMethod_LBCookie) {
+		return nil, errors.New("stickycookie is only applicable to the LBCookie sticky method")
+	}
+	if poolConf.StickyHeader != "" && (!sticky.Enabled || sticky.Method != loadbalancer.StickyMethod_Header) {
+		return nil, errors.New("stickyheader is only applicable to the Header sticky method")
+	}
+	pool.SetStickySlidingExpiry(poolConf.StickySessions && poolConf.StickySlidingExpiry)
 
-		for _, serverConf := range poolConf.ConditionalServers {
-			serverHost, err := loadbalancer.NewServerHost(serverConf.Address, serverConf.HealthCheckPath, serverConf.Condition)
-			serverHost.Id = serverConf.Id
-			if err != nil {
-				return nil, nil, err
-			}
-			pool.AddServer(serverHost)
+	if poolConf.BackendProxyProtocol != 0 {
+		if err := pool.SetBackendProxyProtocol(poolConf.BackendProxyProtocol); err != nil {
+			return nil, err
 		}
-		for _, serverConf := range poolConf.UnconditionalServers {
-			serverHost, err := loadbalancer.NewServerHost(serverConf.Address, serverConf.HealthCheckPath, common.Condition{})
-			serverHost.Id = serverConf.Id
-			if err != nil {
-				return nil, nil, err
-			}
-			pool.AddServer(serverHost)
+	}
+	if poolConf.RequestIdHeader != "" {
+		if err := pool.SetRequestIdHeader(poolConf.RequestIdHeader); err != nil {
+			return nil, err
 		}
-		err = lb.AddPool(pool)
+	}
+	if poolConf.UpgradeGracePeriodSeconds != 0 {
+		pool.UpgradeGracePeriod.Store(uint64(time.Second) * poolConf.UpgradeGracePeriodSeconds)
+	}
+	pool.UpgradeIdleTimeout.Store(uint64(time.Second) * poolConf.UpgradeIdleTimeoutSeconds)
+	if poolConf.MaxRequestBodyBytes < 0 {
+		return nil, errors.New("maxrequestbodybytes cannot be negative")
+	}
+	pool.MaxRequestBodyBytes.Store(poolConf.MaxRequestBodyBytes)
+	if poolConf.Transport != nil {
+		if err := pool.SetTransportOptions(loadbalancer.TransportOptions{
+			DialTimeout:           time.Second * time.Duration(poolConf.Transport.DialTimeoutSeconds),
+			TLSHandshakeTimeout:   time.Second * time.Duration(poolConf.Transport.TLSHandshakeTimeoutSeconds),
+			ResponseHeaderTimeout: time.Second * time.Duration(poolConf.Transport.ResponseHeaderTimeoutSeconds),
+			IdleConnTimeout:       time.Second * time.Duration(poolConf.Transport.IdleConnTimeoutSeconds),
+			MaxIdleConns:          poolConf.Transport.MaxIdleConns,
+			MaxIdleConnsPerHost:   poolConf.Transport.MaxIdleConnsPerHost,
+			CaFile:                poolConf.Transport.CaFile,
+			ClientCertificate:     poolConf.Transport.ClientCertificate,
+			ClientKey:             poolConf.Transport.ClientKey,
+			ServerName:            poolConf.Transport.ServerName,
+			InsecureSkipVerify:    poolConf.Transport.InsecureSkipVerify,
+		}); err != nil {
+			return nil, fmt.Errorf("transport: %w", err)
+		}
+	}
+	mode, err := loadbalancer.GetPoolModeFromString(poolConf.Mode)
+	if err != nil {
+		return nil, errors.New("mode must be one of http, tcp, udp or tls")
+	}
+	if mode != loadbalancer.PoolMode_HTTP {
+		if err := pool.SetLayer4(mode, poolConf.ListenPort); err != nil {
+			return nil, err
+		}
+	} else if poolConf.ListenPort != 0 {
+		return nil, errors.New("listenport is only applicable to tcp and udp pools")
+	}
+	pool.SetListeners(poolConf.Listeners)
+	if err := pool.SetMaxStickySessions(poolConf.MaxStickySessions); err != nil {
+		return nil, err
+	}
+	if err := pool.SetRegistration(poolConf.RegistrationToken, time.Second*time.Duration(poolConf.LeaseTtlSeconds)); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+/*
+newServerHosts
+Creates the servers of a pool from its configuration, except the dynamic ones, see newDynamicServers.
+*/
+func newServerHosts(poolConf PoolConfig) ([]*loadbalancer.ServerHost, error) {
+	servers := []*loadbalancer.ServerHost{}
+	for _, serverConf := range poolConf.ConditionalServers {
+		if serverConf.Resolve != "" {
+			continue
+		}
+		serverHost, err := newServerHost(serverConf, serverConf.Condition)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
+		servers = append(servers, serverHost)
 	}
-	apiServer := api.NewApiServer(configuration.ManagenentAddress,
-		configuration.ManagementPort,
-		lb,
-		SaveConfigChan,
-		configuration.AuthorizedKeys)
-	StartAutoSaveConfig(path, lb, apiServer)
-	return lb, apiServer, nil
+	for _, serverConf := range poolConf.UnconditionalServers {
+		if serverConf.Resolve != "" {
+			continue
+		}
+		serverHost, err := newServerHost(serverConf, common.Condition{})
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, serverHost)
+	}
+	return servers, nil
+}
+
+/*
+newDynamicServers
+Creates the servers of a pool whose address is resolved from DNS, the ones with a resolve setting.
+*/
+func newDynamicServers(poolConf PoolConfig) ([]*loadbalancer.DynamicServer, error) {
+	dynamicServers := []*loadbalancer.DynamicServer{}
+	for _, serverConf := range poolConf.ConditionalServers {
+		if serverConf.Resolve == "" {
+			continue
+		}
+		dynamicServer, err := newDynamicServer(serverConf, serverConf.Condition)
+		if err != nil {
+			return nil, err
+		}
+		dynamicServers = append(dynamicServers, dynamicServer)
+	}
+	for _, serverConf := range poolConf.UnconditionalServers {
+		if serverConf.Resolve == "" {
+			continue
+		}
+		dynamicServer, err := newDynamicServer(serverConf, common.Condition{})
+		if err != nil {
+			return nil, err
+		}
+		dynamicServers = append(dynamicServers, dynamicServer)
+	}
+	return dynamicServers, nil
+}
+
+func newDynamicServer(serverConf *ServerHostConfig, condition common.Condition) (*loadbalancer.DynamicServer, error) {
+	dynamicServer, err := loadbalancer.NewDynamicServer(serverConf.Address,
+		serverConf.Resolve,
+		serverConf.Nameserver,
+		serverConf.HealthCheckPath,
+		condition)
+	if err != nil {
+		return nil, err
+	}
+	if serverConf.Id != uuid.Nil {
+		dynamicServer.Id = serverConf.Id
+	}
+	if err := dynamicServer.SetProtocol(serverConf.Protocol); err != nil {
+		return nil, err
+	}
+	return dynamicServer, nil
+}
+
+func newServerHost(serverConf *ServerHostConfig, condition common.Condition) (*loadbalancer.ServerHost, error) {
+	serverHost, err := loadbalancer.NewServerHost(serverConf.Address, serverConf.HealthCheckPath, condition)
+	if err != nil {
+		return nil, err
+	}
+	// servers added by hand to the file have no Id yet, they keep the generated one
+	if serverConf.Id != uuid.Nil {
+		serverHost.Id = serverConf.Id
+	}
+	if err := serverHost.SetProtocol(serverConf.Protocol); err != nil {
+		return nil, err
+	}
+	// servers added by a discovery provider are saved so that it takes them over after a restart
+	serverHost.ManagedBy = serverConf.ManagedBy
+	return serverHost, nil
 }
 
 func SaveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) error {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	return saveConfig(path, lb, api)
+}
+
+func saveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) error {
+	data, err := yaml.Marshal(runningConfiguration(lb, api))
+	if err != nil {
+		return err
+	}
+	if configTemplate != nil {
+		// the file is a template, the values coming from the environment are saved as their references
+		if data, err = templateConfiguration(data, configTemplate); err != nil {
+			return err
+		}
+		if err := writeConfigFile(path, data); err != nil {
+			return err
+		}
+		configTemplate = data
+		return nil
+	}
+	return writeConfigFile(path, data)
+}
+
+/*
+runningConfiguration
+Returns the configuration of the running load balancer, as it's saved to the configuration file.
+Settings changed in the file that need a restart are kept, so that they are applied on the next start.
+Must be called holding saveMutex.
+*/
+func runningConfiguration(lb *loadbalancer.LoadBalancer, api *api.ApiServer) *Configuration {
 	configuration := &Configuration{
-		Address:           lb.BindAddress,
-		Port:              lb.BindPort,
 		ManagenentAddress: api.Address,
 		ManagementPort:    api.Port,
 		Pools:             []PoolConfig{},
 		AuthorizedKeys:    api.AuthorizedKeyspath,
+		TrustedProxies:    lb.GetTrustedProxies(),
+		HistorySize:       historySize,
+		Discovery:         discoverySettings,
 	}
-	for _, pool := range lb.GetPools() {
+	listeners := lb.GetListeners()
+	if len(listeners) == 1 && listeners[0].Name == loadbalancer.DEFAULT_LISTENER {
+		// a single default listener keeps the top-level form of the configuration file
+		configuration.setTopLevelListener(newListenerConfig(listeners[0]))
+	} else {
+		for _, listener := range listeners {
+			configuration.Listeners = append(configuration.Listeners, newListenerConfig(listener))
+		}
+	}
+	pools := lb.GetPools()
+	// a stable order avoids spurious history versions when nothing changed
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Hostname < pools[j].Hostname
+	})
+	for _, pool := range pools {
 		poolConf := PoolConfig{
 			Hostname:                       pool.Hostname,
 			HealthCheckIntervalSeconds:     pool.HealthCheckInterval.Load() / uint64(time.Second),
@@ -184,48 +658,113 @@ func SaveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer)
 			HealthCheck_numFail:            uint32(pool.HealthCheck_numFail.Load()),
 			ConditionalServers:             []*ServerHostConfig{},
 			UnconditionalServers:           []*ServerHostConfig{},
-			StickySessions:                 pool.StickySessions,
+			StickySessions:                 pool.GetStickySettings().Enabled,
+			BackendProxyProtocol:           pool.GetBackendProxyProtocol(),
+			UpgradeGracePeriodSeconds:      pool.UpgradeGracePeriod.Load() / uint64(time.Second),
+			UpgradeIdleTimeoutSeconds:      pool.UpgradeIdleTimeout.Load() / uint64(time.Second),
+			MaxRequestBodyBytes:            pool.MaxRequestBodyBytes.Load(),
+		}
+		if sticky := pool.GetStickySettings(); sticky.Enabled {
+			poolConf.StickyMethod = sticky.Method.String()
+			poolConf.StickySessionTimeoutSeconds = uint32(sticky.Timeout.Seconds())
+			poolConf.StickyCookieName = sticky.CookieName
+			poolConf.StickyHeader = sticky.HeaderName
+			poolConf.StickySlidingExpiry = sticky.SlidingExpiry
+			if pool.GetMaxStickySessions() != loadbalancer.DEFAULT_MAX_STICKY_SESSIONS {
+				poolConf.MaxStickySessions = pool.GetMaxStickySessions()
+			}
+			// the secret is saved even when generated, cookies of the clients stay valid after a restart
+			if sticky.Method == loadbalancer.StickyMethod_LBCookie {
+				poolConf.StickyCookie = newStickyCookieConfig(pool.GetLbCookieOptions())
+			}
+		}
+		if transport := pool.GetTransportOptions(); transport != (loadbalancer.TransportOptions{}) {
+			poolConf.Transport = &TransportConfig{
+				DialTimeoutSeconds:           uint64(transport.DialTimeout / time.Second),
+				TLSHandshakeTimeoutSeconds:   uint64(transport.TLSHandshakeTimeout / time.Second),
+				ResponseHeaderTimeoutSeconds: uint64(transport.ResponseHeaderTimeout / time.Second),
+				IdleConnTimeoutSeconds:       uint64(transport.IdleConnTimeout / time.Second),
+				MaxIdleConns:                 transport.MaxIdleConns,
+				MaxIdleConnsPerHost:          transport.MaxIdleConnsPerHost,
+				CaFile:                       transport.CaFile,
+				ClientCertificate:            transport.ClientCertificate,
+				ClientKey:                    transport.ClientKey,
+				ServerName:                   transport.ServerName,
+				InsecureSkipVerify:           transport.InsecureSkipVerify,
+			}
+		}
+		if pool.IsLayer4() {
+			poolConf.Mode = pool.Mode.String()
+			poolConf.ListenPort = pool.ListenPort
 		}
-		if pool.StickySessions {
-			poolConf.StickyMethod = pool.StickyMethod.String()
-			poolConf.StickySessionTimeoutSeconds = uint32(pool.StickySessionTimeout.Seconds())
-			poolConf.stickyCookieName = pool.GetStickyCookieName()
+		if listeners := pool.GetListeners(); len(listeners) > 0 {
+			poolConf.Listeners = listeners
 		}
-		for _, server := range pool.ConditionalServers {
+		if pool.GetRequestIdHeader() != loadbalancer.DEFAULT_REQUEST_ID_HEADER {
+			poolConf.RequestIdHeader = pool.GetRequestIdHeader()
+		}
+		if token := pool.GetRegistrationToken(); token != "" {
+			poolConf.RegistrationToken = token
+			if pool.GetLeaseTtl() != loadbalancer.DEFAULT_LEASE_TTL {
+				poolConf.LeaseTtlSeconds = uint64(pool.GetLeaseTtl() / time.Second)
+			}
+		}
+		for _, server := range pool.GetServers() {
+			// the servers of a dynamic server are resolved again on start, draining servers are being removed
+			if server.ManagedBy == loadbalancer.DNS || server.ServerStatus.Load() == uint32(loadbalancer.Draining) {
+				continue
+			}
 			serverConf := &ServerHostConfig{
 				Id:              server.Id,
 				Address:         server.Address.String(),
 				Condition:       server.Condition,
 				HealthCheckPath: server.HealthCheckPath,
+				Protocol:        server.Protocol,
+				ManagedBy:       server.ManagedBy,
+			}
+			if server.Condition != (common.Condition{}) {
+				poolConf.ConditionalServers = append(poolConf.ConditionalServers, serverConf)
+			} else {
+				poolConf.UnconditionalServers = append(poolConf.UnconditionalServers, serverConf)
 			}
-			poolConf.ConditionalServers = append(poolConf.ConditionalServers, serverConf)
 		}
-		for _, server := range pool.UnconditionalServers {
+		for _, dynamicServer := range pool.GetDynamicServers() {
 			serverConf := &ServerHostConfig{
-				Id:              server.Id,
-				Address:         server.Address.String(),
-				HealthCheckPath: server.HealthCheckPath,
+				Id:              dynamicServer.Id,
+				Address:         dynamicServer.Address.String(),
+				Condition:       dynamicServer.Condition,
+				HealthCheckPath: dynamicServer.HealthCheckPath,
+				Protocol:        dynamicServer.Protocol,
+				Resolve:         dynamicServer.Resolve.String(),
+				Nameserver:      dynamicServer.Nameserver,
+			}
+			if dynamicServer.Condition != (common.Condition{}) {
+				poolConf.ConditionalServers = append(poolConf.ConditionalServers, serverConf)
+			} else {
+				poolConf.UnconditionalServers = append(poolConf.UnconditionalServers, serverConf)
 			}
-			poolConf.UnconditionalServers = append(poolConf.UnconditionalServers, serverConf)
 		}
 		configuration.Pools = append(configuration.Pools, poolConf)
 	}
-	data, err := yaml.Marshal(configuration)
-	if err != nil {
-		return err
-	}
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+	if restartSettings != nil {
+		configuration.copyRestartSettings(restartSettings)
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			fmt.Println("Error closing file:", err)
-		}
-	}(file)
-	_, err = file.Write(data)
-	return err
+	return configuration
+}
+
+func (configuration *Configuration) setTopLevelListener(listenerConf ListenerConfig) {
+	configuration.Address = listenerConf.Address
+	configuration.Port = listenerConf.Port
+	configuration.ProxyProtocol = listenerConf.ProxyProtocol
+	configuration.TlsCertificate = listenerConf.TlsCertificate
+	configuration.TlsKey = listenerConf.TlsKey
+	configuration.H2C = listenerConf.H2C
+	configuration.ReadTimeoutSeconds = listenerConf.ReadTimeoutSeconds
+	configuration.ReadHeaderTimeoutSeconds = listenerConf.ReadHeaderTimeoutSeconds
+	configuration.WriteTimeoutSeconds = listenerConf.WriteTimeoutSeconds
+	configuration.IdleTimeoutSeconds = listenerConf.IdleTimeoutSeconds
+	configuration.MaxHeaderBytes = listenerConf.MaxHeaderBytes
+	configuration.MaxRequestBodyBytes = listenerConf.MaxRequestBodyBytes
 }
 
 func CreateSampleConfig(path string) error {
@@ -254,6 +793,36 @@ func CreateSampleConfig(path string) error {
 	return err
 }
 
+/*
+StopAutoSaveConfig
+Saves the configuration a last time, including pending changes, and stops the auto save.
+Used before the server stops so that no change is lost or half written.
+*/
+func StopAutoSaveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) error {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+drain:
+	for {
+		select {
+		case <-SaveConfigChan:
+		default:
+			break drain
+		}
+	}
+	autosaveStopped = true
+	return saveConfig(path, lb, api)
+}
+
+/*
+ResumeAutoSaveConfig
+Restarts the auto save stopped by StopAutoSaveConfig, e.g. when a restart fails and the server keeps running.
+*/
+func ResumeAutoSaveConfig() {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	autosaveStopped = false
+}
+
 func StartAutoSaveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) {
 	if autosaveStarted {
 		return
@@ -262,10 +831,14 @@ func StartAutoSaveConfig(path string, lb *loadbalancer.LoadBalancer, api *api.Ap
 	go func() {
 		for {
 			<-SaveConfigChan
-			err := SaveConfig(path, lb, api)
-			if err != nil {
-				fmt.Println("Error saving configuration:", err)
+			saveMutex.Lock()
+			if !autosaveStopped {
+				err := saveConfig(path, lb, api)
+				if err != nil {
+					fmt.Println("Error saving configuration:", err)
+				}
 			}
+			saveMutex.Unlock()
 		}
 	}()
 }
@@ -4,6 +4,8 @@ import (
 	"continuity/common"
 	"continuity/server/api"
 	"continuity/server/loadbalancer"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -12,12 +14,19 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func fakeLoadBalancer(address string, port int) (*loadbalancer.LoadBalancer, error) {
-	return &loadbalancer.LoadBalancer{
-		BindAddress: address,
-		BindPort:    port,
-		Pools:       make(map[string]*loadbalancer.Pool),
-	}, nil
+func fakeLoadBalancer(listeners []*loadbalancer.Listener) (*loadbalancer.LoadBalancer, error) {
+	lb := &loadbalancer.LoadBalancer{
+		Listeners: make(map[string]*loadbalancer.Listener),
+		Pools:     make(map[string]*loadbalancer.Pool),
+	}
+	for _, listener := range listeners {
+		lb.Listeners[listener.Name] = listener
+	}
+	return lb, nil
+}
+
+func defaultListener(port int, options loadbalancer.ListenerOptions) []*loadbalancer.Listener {
+	return []*loadbalancer.Listener{{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1", Port: port, Options: options}}
 }
 
 func TestCreateSampleConfig(t *testing.T) {
@@ -44,7 +53,7 @@ func TestSaveAndLoadBaseConfig(t *testing.T) {
 	tmp := filepath.Join(os.TempDir(), "test_config.yaml")
 	defer os.Remove(tmp)
 	fakeChannel := make(chan bool, 10)
-	lb, _ := loadbalancer.NewLoadBalancer("127.0.0.1", 8080)
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
 	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, fakeChannel, nil)
 
 	err := SaveConfig(tmp, lb, apiServer)
@@ -64,7 +73,7 @@ func TestSaveAndLoadConfigWithPool(t *testing.T) {
 	tmp := filepath.Join(os.TempDir(), "test_config_with_pool.yaml")
 	defer os.Remove(tmp)
 
-	lb, _ := loadbalancer.NewLoadBalancer("127.0.0.1", 8080)
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
 	pool := loadbalancer.NewPool(
 		"test.example.com",
 		5*time.Second,  // HealthCheckTimeoutSeconds
@@ -101,7 +110,7 @@ func TestSaveAndLoadConfigWithConditionalAndUnconditionalServers(t *testing.T) {
 	tmp := filepath.Join(os.TempDir(), "test_config_with_servers.yaml")
 	defer os.Remove(tmp)
 
-	lb, _ := loadbalancer.NewLoadBalancer("127.0.0.1", 8080)
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
 	pool := loadbalancer.NewPool(
 		"test.example.com",
 		5*time.Second,  // HealthCheckTimeoutSeconds
@@ -142,3 +151,182 @@ func TestSaveAndLoadConfigWithConditionalAndUnconditionalServers(t *testing.T) {
 	require.Equal(t, cond.Header, pool2.ConditionalServers[0].Condition.Header)
 	require.Equal(t, cond.Value, pool2.ConditionalServers[0].Condition.Value)
 }
+
+func TestSaveAndLoadConfigWithPoolTransport(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(os.TempDir(), "test_config_with_transport.yaml")
+	defer os.Remove(tmp)
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	pool := loadbalancer.NewPool("test.example.com", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	options := loadbalancer.TransportOptions{
+		DialTimeout:           2 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       60 * time.Second,
+		MaxIdleConnsPerHost:   50,
+		ServerName:            "backend.internal",
+		InsecureSkipVerify:    true,
+	}
+	require.NoError(t, pool.SetTransportOptions(options))
+	require.NoError(t, lb.AddPool(pool))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	require.Equal(t, options, lb2.Pools["test.example.com"].TransportOptions)
+}
+
+func TestSaveAndLoadConfigWithRegistration(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(os.TempDir(), "test_config_with_registration.yaml")
+	defer os.Remove(tmp)
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	pool := loadbalancer.NewPool("test.example.com", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	require.NoError(t, pool.SetRegistration("0123456789abcdef", time.Minute))
+	registered, err := loadbalancer.NewServerHost("http://10.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	registered.ManagedBy = loadbalancer.REGISTRATION
+	pool.AddServer(registered)
+	require.NoError(t, lb.AddPool(pool))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	loaded := lb2.Pools["test.example.com"]
+	require.True(t, loaded.CheckRegistrationToken("0123456789abcdef"))
+	require.Equal(t, time.Minute, loaded.GetLeaseTtl())
+	// the lease Id is the server Id, it's kept across restarts
+	require.Len(t, loaded.GetServers(), 1)
+	require.Equal(t, registered.Id, loaded.GetServers()[0].Id)
+	require.Equal(t, loadbalancer.REGISTRATION, loaded.GetServers()[0].ManagedBy)
+}
+
+func TestSaveAndLoadConfigWithListenerLimits(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(os.TempDir(), "test_config_with_limits.yaml")
+	defer os.Remove(tmp)
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{
+		ReadTimeout:         30 * time.Second,
+		ReadHeaderTimeout:   5 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		MaxHeaderBytes:      16384,
+		MaxRequestBodyBytes: 1 << 20,
+	}))
+	pool := loadbalancer.NewPool("test.example.com", 5*time.Second, 10*time.Second, 2*time.Second, 3, 1)
+	pool.MaxRequestBodyBytes.Store(10 << 20)
+	require.NoError(t, lb.AddPool(pool))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	require.Equal(t, lb.Listeners[loadbalancer.DEFAULT_LISTENER].Options, lb2.Listeners[loadbalancer.DEFAULT_LISTENER].Options)
+	require.Equal(t, int64(10<<20), lb2.Pools["test.example.com"].MaxRequestBodyBytes.Load())
+}
+
+func TestSaveAndLoadConfigWithAppCookieStickySessions(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "test_config_with_app_cookie.yaml")
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	pool, err := loadbalancer.NewPoolWithStickySessionCustomCookie("test.example.com",
+		5*time.Second, 10*time.Second, 2*time.Second, time.Minute, 3, 1, "JSESSIONID")
+	require.NoError(t, err)
+	require.NoError(t, pool.SetMaxStickySessions(500))
+	require.NoError(t, lb.AddPool(pool))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	pool2, err := lb2.GetPool("test.example.com")
+	require.NoError(t, err)
+	require.Equal(t, loadbalancer.StickyMethod_AppCookie, pool2.GetStickySettings().Method)
+	require.Equal(t, "JSESSIONID", pool2.GetStickyCookieName())
+	require.Equal(t, 500, pool2.GetMaxStickySessions())
+}
+
+func TestSaveAndRestoreStickySessions(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "test_config_with_sessions.yaml")
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	pool := loadbalancer.NewPoolWithIPStickySessions("test.example.com",
+		5*time.Second, 10*time.Second, 2*time.Second, time.Hour, 3, 1)
+	server, err := loadbalancer.NewServerHost("http://10.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	server.ServerStatus.Store(uint32(loadbalancer.Healthy))
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.168.1.10:4321"
+	_, err = pool.ChooseServer(req)
+	require.NoError(t, err)
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+
+	require.NoError(t, SaveStickySessions(tmp, lb))
+	info, err := os.Stat(stickySessionsPath(tmp))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	sessions := lb2.Pools["test.example.com"].GetStickySessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, "192.168.1.10", sessions[0].Key)
+	require.Equal(t, server.Id, sessions[0].ServerHost.Id)
+
+	// without sessions the file is removed
+	pool.FlushStickySessions()
+	require.NoError(t, SaveStickySessions(tmp, lb))
+	_, err = os.Stat(stickySessionsPath(tmp))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSaveAndLoadConfigWithStickyCookie(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "test_config_with_sticky_cookie.yaml")
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	generated := loadbalancer.NewPoolWithStickySession("generated.example.com",
+		5*time.Second, 10*time.Second, 2*time.Second, time.Minute, 3, 1)
+	require.NoError(t, lb.AddPool(generated))
+	configured := loadbalancer.NewPoolWithStickySession("configured.example.com",
+		5*time.Second, 10*time.Second, 2*time.Second, time.Minute, 3, 1)
+	options := loadbalancer.LbCookieOptions{Secret: "0123456789abcdef", Opaque: true, Path: "/app", Secure: true, SameSite: "Strict"}
+	require.NoError(t, configured.SetLbCookieOptions(options))
+	require.NoError(t, lb.AddPool(configured))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	// the generated secret is saved, so that the cookies of the clients stay valid
+	require.Equal(t, generated.GetLbCookieOptions(), lb2.Pools["generated.example.com"].GetLbCookieOptions())
+	require.Equal(t, options, lb2.Pools["configured.example.com"].GetLbCookieOptions())
+}
+
+func TestSaveAndLoadConfigWithStickyHeader(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "test_config_with_sticky_header.yaml")
+
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	pool, err := loadbalancer.NewPoolWithHeaderStickySessions("tenants.example.com",
+		5*time.Second, 10*time.Second, 2*time.Second, time.Minute, 3, 1, "X-Tenant-ID")
+	require.NoError(t, err)
+	pool.SetStickySlidingExpiry(true)
+	require.NoError(t, lb.AddPool(pool))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+
+	lb2, _, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	loaded := lb2.Pools["tenants.example.com"]
+	require.Equal(t, loadbalancer.StickyMethod_Header, loaded.GetStickySettings().Method)
+	require.Equal(t, "X-Tenant-Id", loaded.GetStickyHeaderName())
+	require.True(t, loaded.GetStickySettings().SlidingExpiry)
+}
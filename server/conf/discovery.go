@@ -0,0 +1,137 @@
+package conf
+
+import (
+	"context"
+	"continuity/server/discovery"
+	"continuity/server/loadbalancer"
+	"time"
+)
+
+// discoverySettings is the discovery section the providers were started with, see runningConfiguration
+var discoverySettings *DiscoveryConfig
+var stopDiscovery context.CancelFunc
+
+/*
+DiscoveryConfig
+The providers adding and removing servers of the pools from an external source.
+*/
+type DiscoveryConfig struct {
+	Docker *DockerDiscoveryConfig `yaml:"docker,omitempty" json:"docker,omitempty"`
+	File   *FileDiscoveryConfig   `yaml:"file,omitempty" json:"file,omitempty"`
+}
+
+/*
+DockerDiscoveryConfig
+Adds the containers of a Docker Engine to the pools of their continuity.pool label. The section being present
+enables the provider, host defaults to unix:///var/run/docker.sock.
+*/
+type DockerDiscoveryConfig struct {
+	Host                   string `yaml:"host,omitempty" json:"host,omitempty"`
+	Network                string `yaml:"network,omitempty" json:"network,omitempty"`
+	RefreshIntervalSeconds uint64 `yaml:"refreshintervalseconds,omitempty" json:"refreshintervalseconds,omitempty"`
+}
+
+/*
+FileDiscoveryConfig
+Adds the servers declared by the YAML and JSON files of a directory to their pools.
+*/
+type FileDiscoveryConfig struct {
+	Directory              string `yaml:"directory" json:"directory"`
+	RefreshIntervalSeconds uint64 `yaml:"refreshintervalseconds,omitempty" json:"refreshintervalseconds,omitempty"`
+}
+
+func (fileConf *FileDiscoveryConfig) newProvider(lb *loadbalancer.LoadBalancer) (*discovery.FileProvider, error) {
+	return discovery.NewFileProvider(lb,
+		fileConf.Directory,
+		time.Second*time.Duration(fileConf.RefreshIntervalSeconds),
+		SaveConfigChan)
+}
+
+func (dockerConf *DockerDiscoveryConfig) newProvider(lb *loadbalancer.LoadBalancer) (*discovery.DockerProvider, error) {
+	return discovery.NewDockerProvider(lb,
+		dockerConf.Host,
+		dockerConf.Network,
+		time.Second*time.Duration(dockerConf.RefreshIntervalSeconds),
+		SaveConfigChan)
+}
+
+/*
+validateDiscovery
+Checks the discovery section, reporting problems like Validate.
+*/
+func (configuration *Configuration) validateDiscovery(report func(path string, format string, args ...any)) {
+	if configuration.Discovery == nil {
+		return
+	}
+	if dockerConf := configuration.Discovery.Docker; dockerConf != nil {
+		if _, err := dockerConf.newProvider(nil); err != nil {
+			report("discovery.docker.host", "%v", err)
+		}
+	}
+	if fileConf := configuration.Discovery.File; fileConf != nil {
+		if _, err := fileConf.newProvider(nil); err != nil {
+			report("discovery.file.directory", "%v", err)
+		}
+	}
+}
+
+/*
+startDiscovery
+Starts the discovery providers of the configuration, they run until StopDiscovery is called.
+*/
+func startDiscovery(discoveryConf *DiscoveryConfig, lb *loadbalancer.LoadBalancer) error {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	discoverySettings = discoveryConf
+	if discoveryConf == nil {
+		return nil
+	}
+	providers := []interface{ Run(ctx context.Context) }{}
+	if discoveryConf.Docker != nil {
+		provider, err := discoveryConf.Docker.newProvider(lb)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+	if discoveryConf.File != nil {
+		provider, err := discoveryConf.File.newProvider(lb)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopDiscovery = cancel
+	for _, provider := range providers {
+		go provider.Run(ctx)
+	}
+	return nil
+}
+
+/*
+StopDiscovery
+Stops the discovery providers, the servers they added stay in their pools.
+*/
+func StopDiscovery() {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	if stopDiscovery != nil {
+		stopDiscovery()
+		stopDiscovery = nil
+	}
+}
+
+func equalDiscovery(a, b *DiscoveryConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equalOptional(a.Docker, b.Docker) && equalOptional(a.File, b.File)
+}
+
+func equalOptional[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
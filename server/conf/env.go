@@ -0,0 +1,325 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const ENV_PREFIX = "CONTINUITY_"
+
+// configTemplate is the configuration file when it uses environment variables, nil otherwise
+var configTemplate []byte
+
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+type envOverride struct {
+	name string
+	// key is the setting of the configuration file that is overridden
+	key   string
+	apply func(configuration *Configuration, value string) error
+}
+
+/*
+envOverrides
+Settings of the configuration file that can be set with CONTINUITY_* environment variables.
+*/
+var envOverrides = []envOverride{
+	{"ADDRESS", "address", func(configuration *Configuration, value string) error {
+		if err := configuration.checkTopLevelListener(); err != nil {
+			return err
+		}
+		configuration.Address = value
+		return nil
+	}},
+	{"PORT", "port", func(configuration *Configuration, value string) error {
+		if err := configuration.checkTopLevelListener(); err != nil {
+			return err
+		}
+		return parsePort(value, &configuration.Port)
+	}},
+	{"MANAGEMENT_ADDRESS", "managenentaddress", func(configuration *Configuration, value string) error {
+		configuration.ManagenentAddress = value
+		return nil
+	}},
+	{"MANAGEMENT_PORT", "managementport", func(configuration *Configuration, value string) error {
+		return parsePort(value, &configuration.ManagementPort)
+	}},
+	{"AUTHORIZED_KEYS", "authorizedkeys", func(configuration *Configuration, value string) error {
+		configuration.AuthorizedKeys = &value
+		return nil
+	}},
+	{"TRUSTED_PROXIES", "trustedproxies", func(configuration *Configuration, value string) error {
+		configuration.TrustedProxies = []string{}
+		for _, proxy := range strings.Split(value, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				configuration.TrustedProxies = append(configuration.TrustedProxies, proxy)
+			}
+		}
+		return nil
+	}},
+	{"TLS_CERTIFICATE", "tlscertificate", func(configuration *Configuration, value string) error {
+		if err := configuration.checkTopLevelListener(); err != nil {
+			return err
+		}
+		configuration.TlsCertificate = value
+		return nil
+	}},
+	{"TLS_KEY", "tlskey", func(configuration *Configuration, value string) error {
+		if err := configuration.checkTopLevelListener(); err != nil {
+			return err
+		}
+		configuration.TlsKey = value
+		return nil
+	}},
+	{"POOLS", "pools", func(configuration *Configuration, value string) error {
+		pools := []PoolConfig{}
+		if err := yaml.Unmarshal([]byte(value), &pools); err != nil {
+			return err
+		}
+		configuration.Pools = pools
+		return nil
+	}},
+}
+
+/*
+checkTopLevelListener
+The listener overrides set the top-level listener settings, which can't be used with a listeners list.
+*/
+func (configuration *Configuration) checkTopLevelListener() error {
+	if len(configuration.Listeners) > 0 {
+		return errors.New("can't be used with a listeners list")
+	}
+	return nil
+}
+
+func parsePort(value string, port *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	*port = parsed
+	return nil
+}
+
+/*
+lookupEnv
+Returns the value of an environment variable, or the content of the file named by NAME_FILE, so that secrets
+mounted as files can be used. Setting both is an error.
+*/
+func lookupEnv(name string) (string, bool, error) {
+	value, set := os.LookupEnv(name)
+	file, fileSet := os.LookupEnv(name + "_FILE")
+	if !fileSet || file == "" {
+		return value, set, nil
+	}
+	if set {
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+/*
+interpolateEnv
+Replaces ${VAR} and ${VAR:-default} with the value of the environment variable, or of the file named by VAR_FILE.
+The default is used if the variable is unset or empty, and $$ is an escaped $. A variable unset without a
+default is an error. Returns whether anything was replaced.
+*/
+func interpolateEnv(data []byte) ([]byte, bool, error) {
+	var err error
+	interpolated := false
+	result := envReference.ReplaceAllStringFunc(string(data), func(reference string) string {
+		if reference == "$$" {
+			return "$"
+		}
+		interpolated = true
+		match := envReference.FindStringSubmatch(reference)
+		value, set, lookupErr := lookupEnv(match[1])
+		if lookupErr != nil {
+			if err == nil {
+				err = lookupErr
+			}
+			return ""
+		}
+		if match[2] != "" && value == "" {
+			return match[3]
+		}
+		if !set && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", match[1])
+		}
+		return value
+	})
+	return []byte(result), interpolated, err
+}
+
+/*
+applyEnvOverrides
+Overrides the configuration with the CONTINUITY_* environment variables that are set and not empty.
+Returns whether anything was overridden.
+*/
+func (configuration *Configuration) applyEnvOverrides() (bool, error) {
+	overridden := false
+	for _, override := range envOverrides {
+		name := ENV_PREFIX + override.name
+		value, _, err := lookupEnv(name)
+		if err != nil {
+			return false, err
+		}
+		if value == "" {
+			continue
+		}
+		if err := override.apply(configuration, value); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+		overridden = true
+	}
+	return overridden, nil
+}
+
+/*
+parseConfigFile
+Parses the content of a configuration file, with the environment variables interpolated and the CONTINUITY_*
+overrides applied. Returns whether the configuration depends on the environment.
+*/
+func parseConfigFile(data []byte) (*Configuration, bool, error) {
+	expanded, interpolated, err := interpolateEnv(data)
+	if err != nil {
+		return nil, false, err
+	}
+	configuration := &Configuration{}
+	if err := yaml.Unmarshal(expanded, configuration); err != nil {
+		return nil, false, err
+	}
+	overridden, err := configuration.applyEnvOverrides()
+	if err != nil {
+		return nil, false, err
+	}
+	return configuration, interpolated || overridden, nil
+}
+
+/*
+templateConfiguration
+Returns the marshalled running configuration with the values that come from the environment replaced by their
+references in the template, so that saving it keeps the configuration file a template. The settings overridden
+with CONTINUITY_* variables keep the value of the template, and any other $ is escaped.
+*/
+func templateConfiguration(running []byte, template []byte) ([]byte, error) {
+	var runningTree, templateTree, expandedTree yaml.MapSlice
+	if err := yaml.Unmarshal(running, &runningTree); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(template, &templateTree); err != nil {
+		return nil, err
+	}
+	expanded, _, err := interpolateEnv(template)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(expanded, &expandedTree); err != nil {
+		return nil, err
+	}
+	result := restoreReferences(runningTree, templateTree, expandedTree).(yaml.MapSlice)
+	for _, override := range envOverrides {
+		value, _, err := lookupEnv(ENV_PREFIX + override.name)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			continue
+		}
+		templateValue, inTemplate := mapValue(templateTree, override.key)
+		updated := yaml.MapSlice{}
+		for _, item := range result {
+			if item.Key != override.key {
+				updated = append(updated, item)
+			} else if inTemplate {
+				updated = append(updated, yaml.MapItem{Key: item.Key, Value: templateValue})
+			}
+		}
+		result = updated
+	}
+	return yaml.Marshal(result)
+}
+
+/*
+restoreReferences
+Walks the running configuration along the template and its interpolated version, returning the running values with
+the template ones where the template has references and the interpolated value is the running one. Items of lists
+are matched by value, or by their hostname, name, id or address.
+*/
+func restoreReferences(running interface{}, template interface{}, expanded interface{}) interface{} {
+	if reference, ok := template.(string); ok && strings.Contains(reference, "$") && reflect.DeepEqual(expanded, running) {
+		return reference
+	}
+	switch value := running.(type) {
+	case yaml.MapSlice:
+		templateMap, _ := template.(yaml.MapSlice)
+		expandedMap, _ := expanded.(yaml.MapSlice)
+		restored := yaml.MapSlice{}
+		for _, item := range value {
+			templateValue, _ := mapValue(templateMap, item.Key)
+			expandedValue, _ := mapValue(expandedMap, item.Key)
+			restored = append(restored, yaml.MapItem{Key: item.Key, Value: restoreReferences(item.Value, templateValue, expandedValue)})
+		}
+		return restored
+	case []interface{}:
+		templateList, _ := template.([]interface{})
+		expandedList, _ := expanded.([]interface{})
+		if len(templateList) != len(expandedList) {
+			templateList, expandedList = nil, nil
+		}
+		matched := map[int]bool{}
+		restored := []interface{}{}
+		for _, item := range value {
+			var templateItem, expandedItem interface{}
+			for i, candidate := range expandedList {
+				if !matched[i] && sameListItem(item, candidate) {
+					matched[i] = true
+					templateItem, expandedItem = templateList[i], candidate
+					break
+				}
+			}
+			restored = append(restored, restoreReferences(item, templateItem, expandedItem))
+		}
+		return restored
+	case string:
+		return strings.ReplaceAll(value, "$", "$$")
+	default:
+		return running
+	}
+}
+
+func sameListItem(running interface{}, candidate interface{}) bool {
+	runningMap, isMap := running.(yaml.MapSlice)
+	candidateMap, candidateIsMap := candidate.(yaml.MapSlice)
+	if !isMap || !candidateIsMap {
+		return reflect.DeepEqual(running, candidate)
+	}
+	for _, key := range []string{"hostname", "name", "id", "address"} {
+		runningValue, runningSet := mapValue(runningMap, key)
+		candidateValue, candidateSet := mapValue(candidateMap, key)
+		if runningSet && candidateSet {
+			return reflect.DeepEqual(runningValue, candidateValue)
+		}
+	}
+	return false
+}
+
+func mapValue(slice yaml.MapSlice, key interface{}) (interface{}, bool) {
+	for _, item := range slice {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,126 @@
+package conf
+
+import (
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("from-file\n"), 0600))
+	t.Setenv("CONTINUITY_TEST_HOST", "10.0.0.1")
+	t.Setenv("CONTINUITY_TEST_EMPTY", "")
+	t.Setenv("CONTINUITY_TEST_SECRET_FILE", secret)
+
+	data, interpolated, err := interpolateEnv([]byte("a: ${CONTINUITY_TEST_HOST}\nb: ${CONTINUITY_TEST_EMPTY:-fallback}\n" +
+		"c: ${CONTINUITY_TEST_UNSET:-8080}\nd: ${CONTINUITY_TEST_SECRET}\ne: $$HOME $HOME\n"))
+	require.NoError(t, err)
+	assert.True(t, interpolated)
+	assert.Equal(t, "a: 10.0.0.1\nb: fallback\nc: 8080\nd: from-file\ne: $HOME $HOME\n", string(data))
+
+	data, interpolated, err = interpolateEnv([]byte("price: $$5\n"))
+	require.NoError(t, err)
+	assert.False(t, interpolated)
+	assert.Equal(t, "price: $5\n", string(data))
+
+	_, _, err = interpolateEnv([]byte("a: ${CONTINUITY_TEST_UNSET}\n"))
+	assert.EqualError(t, err, "environment variable CONTINUITY_TEST_UNSET is not set")
+
+	t.Setenv("CONTINUITY_TEST_SECRET", "value")
+	_, _, err = interpolateEnv([]byte("a: ${CONTINUITY_TEST_SECRET}\n"))
+	assert.EqualError(t, err, "both CONTINUITY_TEST_SECRET and CONTINUITY_TEST_SECRET_FILE are set")
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	pools := filepath.Join(t.TempDir(), "pools.yaml")
+	require.NoError(t, os.WriteFile(pools, []byte("- hostname: env.lab\n  healthcheckintervalseconds: 10\n"), 0600))
+	t.Setenv("CONTINUITY_ADDRESS", "0.0.0.0")
+	t.Setenv("CONTINUITY_PORT", "9080")
+	t.Setenv("CONTINUITY_MANAGEMENT_PORT", "9090")
+	t.Setenv("CONTINUITY_MANAGEMENT_ADDRESS", "")
+	t.Setenv("CONTINUITY_AUTHORIZED_KEYS", "/run/secrets/authorized_keys")
+	t.Setenv("CONTINUITY_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.0.1")
+	t.Setenv("CONTINUITY_POOLS_FILE", pools)
+
+	configuration := &Configuration{Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("file.lab")}}
+	overridden, err := configuration.applyEnvOverrides()
+	require.NoError(t, err)
+	assert.True(t, overridden)
+	assert.Equal(t, "0.0.0.0", configuration.Address)
+	assert.Equal(t, 9080, configuration.Port)
+	assert.Equal(t, "127.0.0.1", configuration.ManagenentAddress)
+	assert.Equal(t, 9090, configuration.ManagementPort)
+	assert.Equal(t, "/run/secrets/authorized_keys", *configuration.AuthorizedKeys)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.1"}, configuration.TrustedProxies)
+	require.Len(t, configuration.Pools, 1)
+	assert.Equal(t, "env.lab", configuration.Pools[0].Hostname)
+	assert.Equal(t, uint64(10), configuration.Pools[0].HealthCheckIntervalSeconds)
+
+	t.Setenv("CONTINUITY_PORT", "http")
+	_, err = configuration.applyEnvOverrides()
+	assert.EqualError(t, err, `CONTINUITY_PORT: invalid port "http"`)
+}
+
+func TestLoadConfigFromEnv_SavesTemplate(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	template := []byte("address: 127.0.0.1\nport: ${CONTINUITY_TEST_PORT:-8080}\nmanagenentaddress: 127.0.0.1\nmanagementport: 8090\n" +
+		"pools:\n- hostname: ${CONTINUITY_TEST_POOL}\n  healthcheckintervalseconds: 10\n  healthchecktimeoutseconds: 5\n")
+	require.NoError(t, os.WriteFile(tmp, template, 0644))
+	t.Setenv("CONTINUITY_TEST_POOL", "app.lab")
+	t.Setenv("CONTINUITY_MANAGEMENT_PORT", "9090")
+
+	assert.Nil(t, ValidateConfigFile(tmp))
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, 8080, lb.Listeners[loadbalancer.DEFAULT_LISTENER].Port)
+	assert.Equal(t, 9090, apiServer.Port)
+	pool, err := lb.GetPool("app.lab")
+	require.NoError(t, err)
+
+	// running changes are saved, the values coming from the environment are kept as references
+	pool.HealthCheckInterval.Store(uint64(20 * time.Second))
+	added := loadbalancer.NewPool("new.lab", 5*time.Second, 10*time.Second, 5*time.Second, 1, 1)
+	server, err := loadbalancer.NewServerHost("http://127.0.0.1:8081", "/status?$", common.Condition{})
+	require.NoError(t, err)
+	added.AddServer(server)
+	require.NoError(t, lb.AddPool(added))
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	data, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "port: ${CONTINUITY_TEST_PORT:-8080}\n")
+	assert.Contains(t, string(data), "managementport: 8090\n")
+	assert.Contains(t, string(data), "- hostname: ${CONTINUITY_TEST_POOL}\n  healthcheckintervalseconds: 20\n")
+	assert.Contains(t, string(data), "healthcheckpath: /status?$$\n")
+
+	t.Setenv("CONTINUITY_TEST_POOL", "other.lab")
+	saved, err := readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, 9090, saved.ManagementPort)
+	require.Len(t, saved.Pools, 2)
+	assert.Equal(t, "other.lab", saved.Pools[0].Hostname)
+	assert.Equal(t, uint64(20), saved.Pools[0].HealthCheckIntervalSeconds)
+	assert.Equal(t, "new.lab", saved.Pools[1].Hostname)
+	require.Len(t, saved.Pools[1].UnconditionalServers, 1)
+	assert.Equal(t, "/status?$", saved.Pools[1].UnconditionalServers[0].HealthCheckPath)
+
+	// a plain file is saved again
+	configuration := &Configuration{Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090}
+	writeConfiguration(t, tmp, configuration)
+	t.Setenv("CONTINUITY_MANAGEMENT_PORT", "")
+	lb, apiServer, err = LoadConfig(tmp)
+	require.NoError(t, err)
+	require.NoError(t, lb.AddPool(loadbalancer.NewPool("new.lab", 5*time.Second, 10*time.Second, 5*time.Second, 1, 1)))
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saved, err = readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Len(t, saved.Pools, 1)
+}
@@ -0,0 +1,204 @@
+package conf
+
+import (
+	"bytes"
+	"continuity/common/responses"
+	"continuity/server/api"
+	"continuity/server/loadbalancer"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_HISTORY_SIZE = 10
+const HISTORY_VERSION_FORMAT = "20060102-150405.000000000"
+
+// historySize is the historysize setting of the configuration file, see keptVersions
+var historySize int
+
+/*
+keptVersions
+Number of previous versions of the configuration file kept: DEFAULT_HISTORY_SIZE if not set, none if negative.
+*/
+func keptVersions() int {
+	if historySize == 0 {
+		return DEFAULT_HISTORY_SIZE
+	}
+	return max(historySize, 0)
+}
+
+func historyDir(path string) string {
+	return path + ".history"
+}
+
+/*
+writeConfigFile
+Replaces the configuration file without ever leaving it half written: the content is written to a temporary
+file in the same directory, synced to disk and renamed over the old file. The previous content is kept in
+the history. Must be called holding saveMutex.
+*/
+func writeConfigFile(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if previous, err := os.ReadFile(path); err == nil {
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if !bytes.Equal(previous, data) {
+			if err := backupConfig(path, previous, mode); err != nil {
+				log.Println("Error saving configuration history:", err)
+			}
+		}
+	}
+	if err := writeFileAtomic(path, data, mode); err != nil {
+		return err
+	}
+	lastConfigHash = sha256.Sum256(data)
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	cleanup := func() {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+	}
+	if _, err := file.Write(data); err != nil {
+		cleanup()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		cleanup()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	// the rename itself is durable only once the directory is synced
+	if dirFile, err := os.Open(dir); err == nil {
+		_ = dirFile.Sync()
+		_ = dirFile.Close()
+	}
+	return nil
+}
+
+func backupConfig(path string, data []byte, mode os.FileMode) error {
+	kept := keptVersions()
+	if kept == 0 {
+		return nil
+	}
+	dir := historyDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	version := time.Now().UTC().Format(HISTORY_VERSION_FORMAT)
+	if err := writeFileAtomic(filepath.Join(dir, version+".yaml"), data, mode); err != nil {
+		return err
+	}
+	versions, err := historyVersions(path)
+	if err != nil {
+		return err
+	}
+	for _, old := range versions[min(kept, len(versions)):] {
+		_ = os.Remove(filepath.Join(dir, old.Version+".yaml"))
+	}
+	return nil
+}
+
+/*
+historyVersions
+Lists the previous versions of the configuration file, newest first.
+*/
+func historyVersions(path string) ([]responses.ConfigVersion, error) {
+	entries, err := os.ReadDir(historyDir(path))
+	if os.IsNotExist(err) {
+		return []responses.ConfigVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []responses.ConfigVersion{}
+	for _, entry := range entries {
+		version, found := strings.CutSuffix(entry.Name(), ".yaml")
+		if !found || entry.IsDir() {
+			continue
+		}
+		savedAt, err := time.Parse(HISTORY_VERSION_FORMAT, version)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, responses.ConfigVersion{Version: version, SavedAt: savedAt, Size: info.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+/*
+ConfigHistory
+Lists the previous versions of the configuration file, newest first.
+*/
+func ConfigHistory(path string) ([]responses.ConfigVersion, error) {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	return historyVersions(path)
+}
+
+/*
+RollbackConfig
+Restores a previous version of the configuration file: it's applied to the running load balancer, as on reload,
+and written back as the current configuration file. The replaced file is kept in the history in turn.
+Returns os.ErrNotExist if the version doesn't exist.
+*/
+func RollbackConfig(path string, version string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) ([]string, error) {
+	// the version is parsed so that it can't point outside the history directory
+	if _, err := time.Parse(HISTORY_VERSION_FORMAT, version); err != nil {
+		return nil, fmt.Errorf("configuration version %s: %w", version, os.ErrNotExist)
+	}
+	data, err := os.ReadFile(filepath.Join(historyDir(path), version+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("configuration version %s: %w", version, err)
+	}
+	configuration, fromEnv, err := parseConfigFile(data)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := applyConfiguration(configuration, lb, api, false)
+	if err != nil {
+		return nil, err
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	if err := writeConfigFile(path, data); err != nil {
+		return changes, err
+	}
+	configTemplate = nil
+	if fromEnv {
+		configTemplate = data
+	}
+	log.Println("Configuration rolled back to version", version)
+	return changes, nil
+}
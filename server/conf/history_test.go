@@ -0,0 +1,105 @@
+package conf
+
+import (
+	"continuity/server/api"
+	"continuity/server/loadbalancer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func saveTestPool(t *testing.T, path string, lb *loadbalancer.LoadBalancer, apiServer *api.ApiServer, hostname string) {
+	require.NoError(t, lb.AddPool(loadbalancer.NewPool(hostname, time.Second, time.Second, 0, 1, 1)))
+	require.NoError(t, SaveConfig(path, lb, apiServer))
+}
+
+func TestSaveConfig_KeepsHistory(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "config.yaml")
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	historySize = 2
+	defer func() { historySize = 0 }()
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	// saving the same content doesn't add a version
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	versions, err := ConfigHistory(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	first, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	saveTestPool(t, tmp, lb, apiServer, "a.lab")
+	saveTestPool(t, tmp, lb, apiServer, "b.lab")
+	saveTestPool(t, tmp, lb, apiServer, "c.lab")
+
+	versions, err = ConfigHistory(tmp)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Greater(t, versions[0].Version, versions[1].Version)
+	oldest, err := os.ReadFile(filepath.Join(historyDir(tmp), versions[1].Version+".yaml"))
+	require.NoError(t, err)
+	assert.NotEqual(t, first, oldest)
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestSaveConfig_HistoryDisabled(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	historySize = -1
+	defer func() { historySize = 0 }()
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saveTestPool(t, tmp, lb, apiServer, "a.lab")
+	_, err := os.Stat(historyDir(tmp))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRollbackConfig(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	lb, _ := loadbalancer.NewLoadBalancer(defaultListener(8080, loadbalancer.ListenerOptions{}))
+	apiServer := api.NewApiServer("127.0.0.1", 8090, lb, make(chan bool, 10), nil)
+	saveTestPool(t, tmp, lb, apiServer, "a.lab")
+	previous, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	saveTestPool(t, tmp, lb, apiServer, "b.lab")
+
+	versions, err := ConfigHistory(tmp)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+
+	changes, err := RollbackConfig(tmp, versions[0].Version, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pool b.lab: removed"}, changes)
+	_, err = lb.GetPool("b.lab")
+	assert.Error(t, err)
+	current, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, previous, current)
+
+	// the replaced configuration can be restored in turn
+	versions, err = ConfigHistory(tmp)
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestRollbackConfig_UnknownVersion(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	_, err := RollbackConfig(tmp, "../../etc/passwd", nil, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = RollbackConfig(tmp, time.Now().UTC().Format(HISTORY_VERSION_FORMAT), nil, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
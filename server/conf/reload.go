@@ -0,0 +1,548 @@
+package conf
+
+import (
+	"context"
+	"continuity/common/responses"
+	"continuity/server/api"
+	"continuity/server/loadbalancer"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+var reloadMutex sync.Mutex
+
+// replacements are the servers being added by the transactions a reload started, by Id of the server they replace
+var replacements = map[uuid.UUID]*loadbalancer.ServerHost{}
+var replacementsMutex sync.Mutex
+
+// restartSettings holds the settings applied by a reload that need a restart, see runningConfiguration
+var restartSettings *Configuration
+
+type fileConfigManager struct {
+	path string
+	lb   *loadbalancer.LoadBalancer
+	api  *api.ApiServer
+}
+
+func (m *fileConfigManager) Reload() ([]string, error) {
+	return ReloadConfig(m.path, m.lb, m.api)
+}
+
+func (m *fileConfigManager) Validate(data []byte) []string {
+	return ValidateConfig(data)
+}
+
+func (m *fileConfigManager) Export(format string) ([]byte, error) {
+	configuration := ExportConfig(m.lb, m.api)
+	if format == api.FORMAT_JSON {
+		return json.MarshalIndent(configuration, "", "  ")
+	}
+	return yaml.Marshal(configuration)
+}
+
+func (m *fileConfigManager) Apply(data []byte, dryRun bool) ([]string, error) {
+	return ApplyConfig(data, m.lb, m.api, dryRun)
+}
+
+func (m *fileConfigManager) History() ([]responses.ConfigVersion, error) {
+	return ConfigHistory(m.path)
+}
+
+func (m *fileConfigManager) Rollback(version string) ([]string, error) {
+	return RollbackConfig(m.path, version, m.lb, m.api)
+}
+
+type poolCandidate struct {
+	pool           *loadbalancer.Pool
+	servers        []*loadbalancer.ServerHost
+	dynamicServers []*loadbalancer.DynamicServer
+}
+
+/*
+addServers
+Adds the servers to the candidate pool, before it's added to the load balancer.
+*/
+func (candidate poolCandidate) addServers() {
+	for _, server := range candidate.servers {
+		candidate.pool.AddServer(server)
+	}
+	for _, dynamicServer := range candidate.dynamicServers {
+		candidate.pool.AddDynamicServer(dynamicServer)
+	}
+}
+
+/*
+ReloadConfig
+Reads the configuration file again and applies the differences to the running load balancer.
+It returns the list of applied changes. If the file is invalid nothing is changed.
+*/
+func ReloadConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer) ([]string, error) {
+	configuration, err := readConfiguration(path)
+	if err != nil {
+		return nil, err
+	}
+	return applyConfiguration(configuration, lb, api, false)
+}
+
+/*
+applyConfiguration
+Diffs the configuration against the running load balancer and applies it:
+pools and servers are added and removed, settings of existing pools are updated in place.
+Listeners are added, removed or restarted with their new settings. Unchanged servers keep their health
+state and sticky sessions, changed ones are replaced with a transaction. Management API settings can't be changed while running, they are reported as
+requiring a restart.
+With dryRun the changes are only computed and returned.
+*/
+func applyConfiguration(configuration *Configuration, lb *loadbalancer.LoadBalancer, api *api.ApiServer, dryRun bool) ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// everything is validated and built before touching the load balancer, so an invalid configuration changes nothing
+	if problems := configuration.Validate(); problems != nil {
+		return nil, invalidConfigurationError(problems)
+	}
+	candidates := []poolCandidate{}
+	hostnames := map[string]bool{}
+	for _, poolConf := range configuration.Pools {
+		hostnames[poolConf.Hostname] = true
+		pool, err := newPool(poolConf)
+		if err != nil {
+			return nil, err
+		}
+		servers, err := newServerHosts(poolConf)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolConf.Hostname, err)
+		}
+		dynamicServers, err := newDynamicServers(poolConf)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolConf.Hostname, err)
+		}
+		candidates = append(candidates, poolCandidate{pool: pool, servers: servers, dynamicServers: dynamicServers})
+	}
+	listeners := []*loadbalancer.Listener{}
+	listenerNames := map[string]bool{}
+	for _, listenerConf := range configuration.listenerConfigs() {
+		listener, err := newListener(listenerConf)
+		if err != nil {
+			return nil, err
+		}
+		listenerNames[listener.Name] = true
+		listeners = append(listeners, listener)
+	}
+
+	changes := restartRequiredChanges(configuration, lb, api)
+	if !dryRun {
+		saveMutex.Lock()
+		restartSettings = nil
+		if len(changes) > 0 {
+			restartSettings = configuration
+		}
+		historySize = configuration.HistorySize
+		saveMutex.Unlock()
+	}
+	if !slices.Equal(configuration.TrustedProxies, lb.GetTrustedProxies()) {
+		if !dryRun {
+			if err := lb.SetTrustedProxies(configuration.TrustedProxies); err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, "trusted proxies updated")
+	}
+	// listeners are added before the pools that use them and removed after the pools that used them
+	for _, listener := range listeners {
+		existing, err := lb.GetListener(listener.Name)
+		if err != nil {
+			if !dryRun {
+				if err := lb.AddListener(listener); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "listener "+listener.Name+": added")
+			continue
+		}
+		if !existing.SameSettings(listener) {
+			if !dryRun {
+				if err := lb.ReplaceListener(listener); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "listener "+listener.Name+": recreated, settings changed")
+		}
+	}
+	// removed pools go first, so that their listen ports can be used by the added ones
+	for _, pool := range lb.GetPools() {
+		if !hostnames[pool.Hostname] {
+			if !dryRun {
+				if err := lb.RemovePool(pool.Hostname); err != nil {
+					continue
+				}
+			}
+			changes = append(changes, "pool "+pool.Hostname+": removed")
+		}
+	}
+	for _, candidate := range candidates {
+		hostname := candidate.pool.Hostname
+		existing, err := lb.GetPool(hostname)
+		if err != nil {
+			if !dryRun {
+				candidate.addServers()
+				if err := lb.AddPool(candidate.pool); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "pool "+hostname+": added")
+			continue
+		}
+		// the pool is kept, so that its servers keep their health state and sticky sessions
+		if existing.Mode != candidate.pool.Mode || existing.ListenPort != candidate.pool.ListenPort {
+			if !dryRun {
+				if err := lb.UpdateLayer4(candidate.pool); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "pool "+hostname+": layer 4 listener restarted, mode or listen port changed")
+		}
+		if existing.GetBackendProxyProtocol() != candidate.pool.GetBackendProxyProtocol() ||
+			existing.GetTransportOptions() != candidate.pool.GetTransportOptions() {
+			if !dryRun {
+				if err := existing.UpdateTransport(candidate.pool.GetTransportOptions(), candidate.pool.GetBackendProxyProtocol()); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "pool "+hostname+": backend transport updated")
+		}
+		changes = append(changes, reconcilePool(lb, existing, candidate, dryRun)...)
+	}
+	for _, listener := range lb.GetListeners() {
+		if !listenerNames[listener.Name] {
+			if !dryRun {
+				if err := lb.RemoveListener(context.Background(), listener.Name); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, "listener "+listener.Name+": removed")
+		}
+	}
+	if !dryRun {
+		for _, change := range changes {
+			log.Println("Configuration change:", change)
+		}
+	}
+	return changes, nil
+}
+
+func restartRequiredChanges(configuration *Configuration, lb *loadbalancer.LoadBalancer, api *api.ApiServer) []string {
+	changes := []string{}
+	if configuration.ManagenentAddress != api.Address || configuration.ManagementPort != api.Port {
+		changes = append(changes, "management API address changed, a restart is required to apply it")
+	}
+	if !equalOptionalString(configuration.AuthorizedKeys, api.AuthorizedKeyspath) {
+		changes = append(changes, "authorized keys file changed, a restart is required to apply it")
+	}
+	saveMutex.Lock()
+	running := discoverySettings
+	saveMutex.Unlock()
+	if !equalDiscovery(configuration.Discovery, running) {
+		changes = append(changes, "discovery settings changed, a restart is required to apply them")
+	}
+	return changes
+}
+
+/*
+copyRestartSettings
+Copies the settings that can't be changed while running: management API, authorized keys and discovery.
+*/
+func (configuration *Configuration) copyRestartSettings(from *Configuration) {
+	configuration.ManagenentAddress = from.ManagenentAddress
+	configuration.ManagementPort = from.ManagementPort
+	configuration.AuthorizedKeys = from.AuthorizedKeys
+	configuration.Discovery = from.Discovery
+}
+
+func equalOptionalString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+/*
+reconcilePool
+Updates the settings of an existing pool and adds, removes or replaces its servers.
+Servers are matched by Id; servers without an Id in the file are matched by address and condition.
+Servers managed by a discovery provider are left to it.
+*/
+func reconcilePool(lb *loadbalancer.LoadBalancer, existing *loadbalancer.Pool, candidate poolCandidate, dryRun bool) []string {
+	changes := []string{}
+	prefix := "pool " + existing.Hostname + ": "
+	settings := candidate.pool
+	if poolSettingsChanged(existing, settings) {
+		if !dryRun {
+			_ = lb.UpdatePool(settings)
+		}
+		changes = append(changes, prefix+"settings updated")
+	}
+	if existing.GetStickySettings() != settings.GetStickySettings() ||
+		existing.GetMaxStickySessions() != settings.GetMaxStickySessions() ||
+		existing.LbCookieChanged(settings) {
+		if !dryRun {
+			existing.UpdateStickySessions(settings)
+		}
+		changes = append(changes, prefix+"sticky sessions updated")
+	}
+
+	replacementsMutex.Lock()
+	replacing := map[uuid.UUID]bool{}
+	pending := map[*loadbalancer.ServerHost]bool{}
+	for id, server := range replacements {
+		replacing[id] = true
+		pending[server] = true
+	}
+	replacementsMutex.Unlock()
+	current := []*loadbalancer.ServerHost{}
+	for _, server := range existing.GetServers() {
+		// the new server of a running transaction is left to it
+		if server.ManagedBy == "" && !pending[server] {
+			current = append(current, server)
+		}
+	}
+	servers := []*loadbalancer.ServerHost{}
+	for _, server := range candidate.servers {
+		if server.ManagedBy == "" {
+			servers = append(servers, server)
+		}
+	}
+	configuredIds := map[uuid.UUID]bool{}
+	for _, server := range servers {
+		configuredIds[server.Id] = true
+	}
+	kept := map[*loadbalancer.ServerHost]bool{}
+	for _, server := range servers {
+		match := findServer(current, server, configuredIds, kept)
+		switch {
+		case match == nil:
+			if !dryRun {
+				existing.AddServer(server)
+			}
+			changes = append(changes, prefix+"server "+server.Address.String()+" added")
+		case sameServer(match, server) || replacing[match.Id]:
+			kept[match] = true
+		default:
+			kept[match] = true
+			if !dryRun {
+				replaceServer(existing, match, server)
+			}
+			changes = append(changes, prefix+"server "+server.Address.String()+" replacing")
+		}
+	}
+	for _, server := range current {
+		if !kept[server] {
+			if !dryRun {
+				_, _ = existing.RemoveServer(server.Id)
+			}
+			changes = append(changes, prefix+"server "+server.Address.String()+" removed")
+		}
+	}
+	return append(changes, reconcileDynamicServers(existing, candidate.dynamicServers, dryRun)...)
+}
+
+/*
+replaceServer
+Replaces a server with a transaction, like the API: the current server is removed once the new one is healthy
+and its sticky sessions are moved to it. Both are in the pool until then, the new one gets its own Id.
+*/
+func replaceServer(pool *loadbalancer.Pool, current *loadbalancer.ServerHost, server *loadbalancer.ServerHost) {
+	server.Id = uuid.New()
+	replacementsMutex.Lock()
+	replacements[current.Id] = server
+	replacementsMutex.Unlock()
+	go func() {
+		err := pool.Transaction(server, current.Id, true)
+		replacementsMutex.Lock()
+		delete(replacements, current.Id)
+		replacementsMutex.Unlock()
+		if err != nil {
+			log.Printf("Pool %s - Error replacing server %s: %v\n", pool.Hostname, current.Address.String(), err)
+			return
+		}
+		select {
+		case SaveConfigChan <- true:
+		default:
+		}
+	}()
+}
+
+/*
+reconcileDynamicServers
+Adds, removes or replaces the dynamic servers of an existing pool, matched like in reconcilePool.
+Unchanged dynamic servers keep the servers they resolved.
+*/
+func reconcileDynamicServers(existing *loadbalancer.Pool, dynamicServers []*loadbalancer.DynamicServer, dryRun bool) []string {
+	changes := []string{}
+	prefix := "pool " + existing.Hostname + ": "
+	current := existing.GetDynamicServers()
+	configuredIds := map[uuid.UUID]bool{}
+	for _, dynamicServer := range dynamicServers {
+		configuredIds[dynamicServer.Id] = true
+	}
+	kept := map[*loadbalancer.DynamicServer]bool{}
+	for _, dynamicServer := range dynamicServers {
+		var match *loadbalancer.DynamicServer
+		for _, candidate := range current {
+			if candidate.Id == dynamicServer.Id {
+				match = candidate
+				break
+			}
+		}
+		for _, candidate := range current {
+			if match == nil && !kept[candidate] && !configuredIds[candidate.Id] &&
+				candidate.Address.String() == dynamicServer.Address.String() && candidate.Condition == dynamicServer.Condition {
+				dynamicServer.Id = candidate.Id
+				match = candidate
+			}
+		}
+		switch {
+		case match == nil:
+			if !dryRun {
+				existing.AddDynamicServer(dynamicServer)
+			}
+			changes = append(changes, prefix+"dynamic server "+dynamicServer.Address.String()+" added")
+		case sameDynamicServer(match, dynamicServer):
+			kept[match] = true
+		default:
+			kept[match] = true
+			if !dryRun {
+				_, _ = existing.RemoveDynamicServer(match.Id)
+				existing.AddDynamicServer(dynamicServer)
+			}
+			changes = append(changes, prefix+"dynamic server "+dynamicServer.Address.String()+" replaced")
+		}
+	}
+	for _, dynamicServer := range current {
+		if !kept[dynamicServer] {
+			if !dryRun {
+				_, _ = existing.RemoveDynamicServer(dynamicServer.Id)
+			}
+			changes = append(changes, prefix+"dynamic server "+dynamicServer.Address.String()+" removed")
+		}
+	}
+	return changes
+}
+
+func poolSettingsChanged(existing, settings *loadbalancer.Pool) bool {
+	return existing.HealthCheckInterval.Load() != settings.HealthCheckInterval.Load() ||
+		existing.HealthCheckInitialDelay.Load() != settings.HealthCheckInitialDelay.Load() ||
+		existing.HealthCheckTimeout.Load() != settings.HealthCheckTimeout.Load() ||
+		existing.HealthCheck_numOk.Load() != settings.HealthCheck_numOk.Load() ||
+		existing.HealthCheck_numFail.Load() != settings.HealthCheck_numFail.Load() ||
+		existing.GetRequestIdHeader() != settings.GetRequestIdHeader() ||
+		existing.UpgradeGracePeriod.Load() != settings.UpgradeGracePeriod.Load() ||
+		existing.UpgradeIdleTimeout.Load() != settings.UpgradeIdleTimeout.Load() ||
+		existing.MaxRequestBodyBytes.Load() != settings.MaxRequestBodyBytes.Load() ||
+		existing.GetRegistrationToken() != settings.GetRegistrationToken() ||
+		existing.GetLeaseTtl() != settings.GetLeaseTtl() ||
+		!slices.Equal(existing.GetListeners(), settings.GetListeners())
+}
+
+func findServer(current []*loadbalancer.ServerHost, server *loadbalancer.ServerHost,
+	configuredIds map[uuid.UUID]bool, kept map[*loadbalancer.ServerHost]bool) *loadbalancer.ServerHost {
+	for _, candidate := range current {
+		if candidate.Id == server.Id {
+			return candidate
+		}
+	}
+	for _, candidate := range current {
+		if !kept[candidate] && !configuredIds[candidate.Id] &&
+			candidate.Address.String() == server.Address.String() && candidate.Condition == server.Condition {
+			// the server keeps its current Id
+			server.Id = candidate.Id
+			return candidate
+		}
+	}
+	return nil
+}
+
+func sameDynamicServer(a, b *loadbalancer.DynamicServer) bool {
+	return a.Address.String() == b.Address.String() &&
+		a.Resolve == b.Resolve &&
+		a.Nameserver == b.Nameserver &&
+		a.Condition == b.Condition &&
+		a.Protocol == b.Protocol &&
+		a.HealthCheckPath == b.HealthCheckPath
+}
+
+func sameServer(a, b *loadbalancer.ServerHost) bool {
+	return a.Address.String() == b.Address.String() &&
+		a.Condition == b.Condition &&
+		a.Protocol == b.Protocol &&
+		a.HealthCheckPath == b.HealthCheckPath
+}
+
+/*
+WatchConfig
+Polls the configuration file and reloads it when its content changes.
+Changes written by the load balancer itself are ignored.
+*/
+func WatchConfig(path string, lb *loadbalancer.LoadBalancer, api *api.ApiServer, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			hash := sha256.Sum256(data)
+			saveMutex.Lock()
+			changed := hash != lastConfigHash
+			saveMutex.Unlock()
+			if !changed {
+				continue
+			}
+			log.Println("Configuration file changed, reloading")
+			if _, err := ReloadConfig(path, lb, api); err != nil {
+				// the hash is remembered by readConfiguration, the file is not reloaded until it changes again
+				log.Println("Error reloading configuration:", err)
+			}
+		}
+	}()
+}
+
+/*
+ExportConfig
+Returns the configuration of the running load balancer, in the shape of the configuration file.
+*/
+func ExportConfig(lb *loadbalancer.LoadBalancer, api *api.ApiServer) *Configuration {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	return runningConfiguration(lb, api)
+}
+
+/*
+ApplyConfig
+Applies a complete configuration, in YAML or JSON, to the running load balancer with the same semantics as a
+reload, and saves it to the configuration file. With dryRun the changes are only computed and returned.
+*/
+func ApplyConfig(data []byte, lb *loadbalancer.LoadBalancer, api *api.ApiServer, dryRun bool) ([]string, error) {
+	configuration := &Configuration{}
+	// JSON is valid YAML, and the JSON keys are the same as the YAML ones
+	if err := yaml.Unmarshal(data, configuration); err != nil {
+		return nil, err
+	}
+	changes, err := applyConfiguration(configuration, lb, api, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun && len(changes) > 0 {
+		SaveConfigChan <- true
+	}
+	return changes, nil
+}
@@ -0,0 +1,484 @@
+package conf
+
+import (
+	"context"
+	"continuity/common"
+	"continuity/server/discovery"
+	"continuity/server/loadbalancer"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func writeConfiguration(t *testing.T, path string, configuration *Configuration) {
+	data, err := yaml.Marshal(configuration)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func reloadTestPool(hostname string, servers ...*ServerHostConfig) PoolConfig {
+	return PoolConfig{
+		Hostname:                   hostname,
+		HealthCheckIntervalSeconds: 10,
+		HealthCheckTimeoutSeconds:  5,
+		HealthCheck_numOk:          1,
+		HealthCheck_numFail:        1,
+		UnconditionalServers:       servers,
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	kept := &ServerHostConfig{Id: uuid.New(), Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}
+	removed := &ServerHostConfig{Id: uuid.New(), Address: "http://10.0.0.2:8080", HealthCheckPath: "/health"}
+	configuration := &Configuration{
+		Address:           "127.0.0.1",
+		Port:              8080,
+		ManagenentAddress: "127.0.0.1",
+		ManagementPort:    8090,
+		Pools: []PoolConfig{
+			reloadTestPool("app.lab", kept, removed),
+			reloadTestPool("old.lab"),
+		},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	pool, err := lb.GetPool("app.lab")
+	require.NoError(t, err)
+	keptServer := pool.UnconditionalServers[0]
+	keptServer.SetHealty()
+
+	added := &ServerHostConfig{Address: "http://10.0.0.3:8080", HealthCheckPath: "/health"}
+	appPool := reloadTestPool("app.lab", kept, added)
+	appPool.HealthCheckIntervalSeconds = 20
+	appPool.RequestIdHeader = "X-Trace-Id"
+	configuration.Pools = []PoolConfig{appPool, reloadTestPool("new.lab")}
+	configuration.ManagementPort = 9091
+	writeConfiguration(t, tmp, configuration)
+
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Contains(t, changes, "management API address changed, a restart is required to apply it")
+	assert.Contains(t, changes, "pool app.lab: settings updated")
+	assert.Contains(t, changes, "pool app.lab: server http://10.0.0.3:8080 added")
+	assert.Contains(t, changes, "pool app.lab: server http://10.0.0.2:8080 removed")
+	assert.Contains(t, changes, "pool new.lab: added")
+	assert.Contains(t, changes, "pool old.lab: removed")
+
+	// the management API keeps running on the old port
+	assert.Equal(t, 8090, apiServer.Port)
+	same, err := lb.GetPool("app.lab")
+	require.NoError(t, err)
+	assert.Same(t, pool, same)
+	assert.Equal(t, uint64(20*time.Second), pool.HealthCheckInterval.Load())
+	assert.Equal(t, "X-Trace-Id", pool.GetRequestIdHeader())
+	require.Len(t, pool.UnconditionalServers, 2)
+	assert.Same(t, keptServer, pool.UnconditionalServers[0])
+	assert.Equal(t, uint32(loadbalancer.Healthy), keptServer.ServerStatus.Load())
+	assert.Equal(t, "http://10.0.0.3:8080", pool.UnconditionalServers[1].Address.String())
+	_, err = lb.GetPool("old.lab")
+	assert.Error(t, err)
+
+	// reloading the same file changes nothing, the server without Id is matched by address
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"management API address changed, a restart is required to apply it"}, changes)
+}
+
+func TestReloadConfig_ReplacesChangedServerAndUpdatesStickySessions(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	server := &ServerHostConfig{Id: uuid.New(), Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab", server)},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	pool, _ := lb.GetPool("app.lab")
+	previous := pool.UnconditionalServers[0]
+
+	server.HealthCheckPath = "/ready"
+	configuration.Pools[0].StickySessions = true
+	configuration.Pools[0].StickyMethod = "LBCookie"
+	configuration.Pools[0].StickySessionTimeoutSeconds = 60
+	writeConfiguration(t, tmp, configuration)
+
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"pool app.lab: sticky sessions updated",
+		"pool app.lab: server http://10.0.0.1:8080 replacing",
+	}, changes)
+	assert.True(t, pool.GetStickySettings().Enabled)
+	assert.Equal(t, loadbalancer.StickyMethod_LBCookie, pool.GetStickySettings().Method)
+	// the previous server serves until the new one is healthy
+	require.Eventually(t, func() bool { return len(pool.GetServers()) == 2 }, time.Second, 10*time.Millisecond)
+	servers := pool.GetServers()
+	assert.Same(t, previous, servers[0])
+	replacement := servers[1]
+	assert.NotEqual(t, previous.Id, replacement.Id)
+	assert.Equal(t, "/ready", replacement.HealthCheckPath)
+
+	// a reload during the transaction doesn't start another one
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.Len(t, pool.GetServers(), 2)
+
+	replacement.SetHealty()
+	assert.Eventually(t, func() bool {
+		servers := pool.GetServers()
+		return len(servers) == 1 && servers[0] == replacement
+	}, 2*time.Second, 20*time.Millisecond)
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestReloadConfig_StickySessionsUnderLoad(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	server := &ServerHostConfig{Id: uuid.New(), Address: backend.URL, HealthCheckPath: "/"}
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab", server)},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	pool, _ := lb.GetPool("app.lab")
+	pool.UnconditionalServers[0].SetHealty()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest("GET", "http://app.lab/", nil)
+				req.Header.Set("X-Tenant-ID", "acme")
+				lb.ServeRequest(httptest.NewRecorder(), req)
+			}
+		}()
+	}
+	methods := []string{"IP", "LBCookie", "Header", "AppCookie"}
+	for i := 0; i < 22; i++ {
+		poolConf := reloadTestPool("app.lab", server)
+		poolConf.StickySessions = i%5 != 4
+		poolConf.StickyMethod = methods[i%len(methods)]
+		poolConf.StickySessionTimeoutSeconds = uint32(60 + i)
+		poolConf.StickySlidingExpiry = i%2 == 0
+		poolConf.StickyCookieName = "JSESSIONID"
+		poolConf.StickyHeader = "X-Tenant-ID"
+		if !poolConf.StickySessions || poolConf.StickyMethod != "Header" {
+			poolConf.StickyHeader = ""
+		}
+		configuration.Pools = []PoolConfig{poolConf}
+		writeConfiguration(t, tmp, configuration)
+		_, err := ReloadConfig(tmp, lb, apiServer)
+		require.NoError(t, err)
+	}
+	close(stop)
+	wg.Wait()
+	sticky := pool.GetStickySettings()
+	assert.Equal(t, loadbalancer.StickyMethod_LBCookie, sticky.Method)
+	assert.Equal(t, 81*time.Second, sticky.Timeout)
+}
+
+func TestReloadConfig_Layer4Pool(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	listenPort := func() int {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+	db := reloadTestPool("db.lab", &ServerHostConfig{Address: "tcp://10.0.0.1:5432"})
+	db.Mode = "tcp"
+	db.ListenPort = listenPort()
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{db},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	defer lb.RemovePool("db.lab")
+	pool, err := lb.GetPool("db.lab")
+	require.NoError(t, err)
+	assert.Equal(t, loadbalancer.PoolMode_TCP, pool.Mode)
+	server := pool.UnconditionalServers[0]
+	server.SetHealty()
+
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saved, err := readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", saved.Pools[0].Mode)
+	assert.Equal(t, db.ListenPort, saved.Pools[0].ListenPort)
+	assert.Empty(t, saved.Pools[0].UnconditionalServers[0].HealthCheckPath)
+
+	saved.Pools[0].ListenPort = listenPort()
+	writeConfiguration(t, tmp, saved)
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pool db.lab: layer 4 listener restarted, mode or listen port changed"}, changes)
+	same, err := lb.GetPool("db.lab")
+	require.NoError(t, err)
+	assert.Same(t, pool, same)
+	assert.Equal(t, saved.Pools[0].ListenPort, pool.ListenPort)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(pool.ListenPort)))
+	require.NoError(t, err)
+	_ = conn.Close()
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(db.ListenPort)))
+	assert.Error(t, err)
+
+	// the transport of the servers is rebuilt in place
+	saved.Pools[0].BackendProxyProtocol = 2
+	writeConfiguration(t, tmp, saved)
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pool db.lab: backend transport updated"}, changes)
+	assert.Equal(t, 2, pool.GetBackendProxyProtocol())
+	require.Len(t, pool.GetServers(), 1)
+	assert.Same(t, server, pool.GetServers()[0])
+	assert.Equal(t, uint32(loadbalancer.Healthy), server.ServerStatus.Load())
+}
+
+func TestReloadConfig_Listeners(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab")},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	defer lb.Shutdown(context.Background())
+
+	// the single listener moves to a list, listeners are started without a restart
+	admin := reloadTestPool("admin.lab")
+	admin.Listeners = []string{"internal"}
+	configuration = &Configuration{
+		ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Listeners: []ListenerConfig{
+			{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1"},
+			{Name: "internal", Address: "127.0.0.1"},
+		},
+		Pools: []PoolConfig{reloadTestPool("app.lab"), admin},
+	}
+	writeConfiguration(t, tmp, configuration)
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"listener default: recreated, settings changed",
+		"listener internal: added",
+		"pool admin.lab: added",
+	}, changes)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saved, err := readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Zero(t, saved.Port)
+	assert.Equal(t, configuration.Listeners, saved.Listeners)
+	assert.Equal(t, []string{"internal"}, saved.Pools[0].Listeners)
+
+	// a listener used by a pool is removed after the pool stops using it
+	configuration.Listeners = configuration.Listeners[:1]
+	configuration.Pools = []PoolConfig{reloadTestPool("app.lab"), reloadTestPool("admin.lab")}
+	writeConfiguration(t, tmp, configuration)
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"pool admin.lab: settings updated",
+		"listener internal: removed",
+	}, changes)
+	assert.Len(t, lb.GetListeners(), 1)
+
+	// a single default listener is saved with the top-level settings
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saved, err = readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, saved.Listeners)
+	assert.Equal(t, "127.0.0.1", saved.Address)
+}
+
+func TestReloadConfig_DiscoveryManagedServers(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	static := &ServerHostConfig{Id: uuid.New(), Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}
+	managed := &ServerHostConfig{Id: uuid.New(), Address: "http://172.17.0.2:80", HealthCheckPath: "/health", ManagedBy: discovery.DOCKER}
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools:     []PoolConfig{reloadTestPool("app.lab", static, managed)},
+		Discovery: &DiscoveryConfig{Docker: &DockerDiscoveryConfig{Host: "tcp://127.0.0.1:1"}},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	t.Cleanup(StopDiscovery)
+	pool, _ := lb.GetPool("app.lab")
+	require.Len(t, pool.UnconditionalServers, 2)
+	assert.Equal(t, discovery.DOCKER, pool.UnconditionalServers[1].ManagedBy)
+
+	saveMutex.Lock()
+	saved := runningConfiguration(lb, apiServer)
+	saveMutex.Unlock()
+	assert.Equal(t, discovery.DOCKER, saved.Pools[0].UnconditionalServers[1].ManagedBy)
+	assert.Equal(t, configuration.Discovery, saved.Discovery)
+
+	// servers of the provider are left to it, whatever the file says
+	configuration.Pools = []PoolConfig{reloadTestPool("app.lab", static)}
+	configuration.Discovery.Docker.Network = "backend"
+	writeConfiguration(t, tmp, configuration)
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"discovery settings changed, a restart is required to apply them"}, changes)
+	require.Len(t, pool.UnconditionalServers, 2)
+	assert.Equal(t, managed.Id, pool.UnconditionalServers[1].Id)
+}
+
+func TestReloadConfig_DynamicServers(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	dynamic := &ServerHostConfig{Id: uuid.New(), Address: "http://app.internal:8080", HealthCheckPath: "/health", Resolve: "a", Nameserver: "127.0.0.1:1"}
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab", dynamic)},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+	pool, _ := lb.GetPool("app.lab")
+	require.Len(t, pool.GetDynamicServers(), 1)
+	assert.Equal(t, dynamic.Id, pool.GetDynamicServers()[0].Id)
+
+	// the resolved servers are not saved, the dynamic server is
+	resolved, err := loadbalancer.NewServerHost("http://10.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	resolved.ManagedBy = loadbalancer.DNS
+	pool.AddServer(resolved)
+	saveMutex.Lock()
+	saved := runningConfiguration(lb, apiServer)
+	saveMutex.Unlock()
+	assert.Equal(t, []*ServerHostConfig{dynamic}, saved.Pools[0].UnconditionalServers)
+
+	unchanged := *dynamic
+	unchanged.Id = uuid.Nil
+	configuration.Pools = []PoolConfig{reloadTestPool("app.lab", &unchanged)}
+	writeConfiguration(t, tmp, configuration)
+	changes, err := ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.Equal(t, dynamic.Id, pool.GetDynamicServers()[0].Id)
+
+	changed := *dynamic
+	changed.HealthCheckPath = "/ready"
+	configuration.Pools = []PoolConfig{reloadTestPool("app.lab", &changed)}
+	writeConfiguration(t, tmp, configuration)
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pool app.lab: dynamic server http://app.internal:8080 replaced"}, changes)
+	require.Len(t, pool.GetDynamicServers(), 1)
+	assert.Equal(t, "/ready", pool.GetDynamicServers()[0].HealthCheckPath)
+
+	configuration.Pools = []PoolConfig{reloadTestPool("app.lab")}
+	writeConfiguration(t, tmp, configuration)
+	changes, err = ReloadConfig(tmp, lb, apiServer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pool app.lab: dynamic server http://app.internal:8080 removed"}, changes)
+	assert.Empty(t, pool.GetDynamicServers())
+}
+
+func TestReloadConfig_InvalidConfigurationChangesNothing(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab")},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+
+	configuration.Pools = []PoolConfig{
+		reloadTestPool("new.lab"),
+		reloadTestPool("broken.lab", &ServerHostConfig{Address: "://broken"}),
+	}
+	writeConfiguration(t, tmp, configuration)
+	_, err = ReloadConfig(tmp, lb, apiServer)
+	require.Error(t, err)
+	_, err = lb.GetPool("app.lab")
+	assert.NoError(t, err)
+	_, err = lb.GetPool("new.lab")
+	assert.Error(t, err)
+}
+
+func TestApplyConfig_DryRunAndExport(t *testing.T) {
+	loadbalancer.NewLoadBalancer = fakeLoadBalancer
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	configuration := &Configuration{
+		Address: "127.0.0.1", Port: 8080, ManagenentAddress: "127.0.0.1", ManagementPort: 8090,
+		Pools: []PoolConfig{reloadTestPool("app.lab")},
+	}
+	writeConfiguration(t, tmp, configuration)
+	lb, apiServer, err := LoadConfig(tmp)
+	require.NoError(t, err)
+
+	exported := ExportConfig(lb, apiServer)
+	require.Len(t, exported.Pools, 1)
+	exported.Pools = append(exported.Pools, reloadTestPool("new.lab",
+		&ServerHostConfig{Address: "http://10.0.0.1:8080", HealthCheckPath: "/health"}))
+	exported.ManagementPort = 9091
+	data, err := json.Marshal(exported)
+	require.NoError(t, err)
+
+	changes, err := ApplyConfig(data, lb, apiServer, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"management API address changed, a restart is required to apply it",
+		"pool new.lab: added",
+	}, changes)
+	_, err = lb.GetPool("new.lab")
+	assert.Error(t, err)
+	assert.Equal(t, 8090, ExportConfig(lb, apiServer).ManagementPort)
+
+	changes, err = ApplyConfig(data, lb, apiServer, false)
+	require.NoError(t, err)
+	assert.Len(t, changes, 2)
+	_, err = lb.GetPool("new.lab")
+	assert.NoError(t, err)
+	// the management API keeps running on the old port, the new one is saved to be used on restart
+	assert.Equal(t, 8090, apiServer.Port)
+	assert.Equal(t, 9091, ExportConfig(lb, apiServer).ManagementPort)
+	require.NoError(t, SaveConfig(tmp, lb, apiServer))
+	saved, err := readConfiguration(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, 9091, saved.ManagementPort)
+	require.Len(t, saved.Pools, 2)
+	assert.NotEqual(t, uuid.Nil, saved.Pools[1].UnconditionalServers[0].Id)
+}
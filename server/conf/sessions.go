@@ -0,0 +1,87 @@
+package conf
+
+import (
+	"continuity/server/loadbalancer"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+stickySessionsFile
+The sticky sessions of the pools saved on shutdown and restored on start, so that clients keep their server
+across restarts.
+*/
+type stickySessionsFile struct {
+	SavedAt time.Time                               `json:"saved_at"`
+	Pools   map[string][]loadbalancer.StoredSession `json:"pools"`
+}
+
+func stickySessionsPath(path string) string {
+	return path + ".sessions"
+}
+
+/*
+SaveStickySessions
+Saves the sticky sessions of the pools next to the configuration file. The file is removed when there are none.
+It's only readable by the owner as it holds client addresses and cookie values.
+*/
+func SaveStickySessions(path string, lb *loadbalancer.LoadBalancer) error {
+	sessions := stickySessionsFile{SavedAt: time.Now(), Pools: map[string][]loadbalancer.StoredSession{}}
+	count := 0
+	for _, pool := range lb.GetPools() {
+		if !pool.GetStickySettings().Enabled {
+			continue
+		}
+		if stored := pool.ExportStickySessions(); len(stored) > 0 {
+			sessions.Pools[pool.Hostname] = stored
+			count += len(stored)
+		}
+	}
+	if count == 0 {
+		if err := os.Remove(stickySessionsPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(stickySessionsPath(path), data, 0600); err != nil {
+		return err
+	}
+	log.Printf("%d sticky sessions saved to %s\n", count, stickySessionsPath(path))
+	return nil
+}
+
+/*
+restoreStickySessions
+Restores the sticky sessions saved by SaveStickySessions. Sessions of pools or servers that no longer exist are
+skipped, a missing or unreadable file only means that clients are balanced again.
+*/
+func restoreStickySessions(path string, lb *loadbalancer.LoadBalancer) {
+	data, err := os.ReadFile(stickySessionsPath(path))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error reading sticky sessions:", err)
+		}
+		return
+	}
+	var sessions stickySessionsFile
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		log.Println("Error reading sticky sessions:", err)
+		return
+	}
+	for hostname, stored := range sessions.Pools {
+		pool, err := lb.GetPool(hostname)
+		if err != nil {
+			continue
+		}
+		if restored := pool.RestoreStickySessions(stored); restored > 0 {
+			log.Printf("Pool %s - %d sticky sessions restored\n", hostname, restored)
+		}
+	}
+}
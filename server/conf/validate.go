@@ -0,0 +1,283 @@
+package conf
+
+import (
+	"continuity/common"
+	"continuity/server/discovery"
+	"continuity/server/loadbalancer"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ValidateConfigFile
+Reads and fully validates a configuration file without starting anything, with the environment variables
+interpolated and the CONTINUITY_* overrides applied.
+It returns every problem found, each prefixed with its path in the file, or nil if the file is valid.
+*/
+func ValidateConfigFile(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	configuration, _, err := parseConfigFile(data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return configuration.Validate()
+}
+
+/*
+ValidateConfig
+Parses and fully validates the YAML content of a configuration file.
+*/
+func ValidateConfig(data []byte) []string {
+	configuration := &Configuration{}
+	if err := yaml.Unmarshal(data, configuration); err != nil {
+		return []string{err.Error()}
+	}
+	return configuration.Validate()
+}
+
+/*
+Validate
+Checks the whole configuration, returning every problem found, or nil if it's valid.
+*/
+func (configuration *Configuration) Validate() []string {
+	problems := []string{}
+	report := func(path string, format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if configuration.ManagementPort < 0 || configuration.ManagementPort > 65535 {
+		report("managementport", "must be between 0 and 65535")
+	}
+	if configuration.AuthorizedKeys != nil {
+		if _, err := os.Stat(*configuration.AuthorizedKeys); err != nil {
+			report("authorizedkeys", "authorized keys file does not exist: %s", *configuration.AuthorizedKeys)
+		}
+	}
+	for i, proxy := range configuration.TrustedProxies {
+		if err := (&loadbalancer.LoadBalancer{}).SetTrustedProxies([]string{proxy}); err != nil {
+			report(fmt.Sprintf("trustedproxies[%d]", i), "%v", err)
+		}
+	}
+	configuration.validateDiscovery(report)
+	listeners := configuration.listenerConfigs()
+	if len(configuration.Listeners) > 0 && configuration.usesTopLevelListener() {
+		report("listeners", "can't be used together with the top-level address, port and listener settings")
+	}
+	listenerNames := map[string]string{}
+	bindAddresses := map[string]string{}
+	for i, listenerConf := range listeners {
+		// the top-level settings keep their own paths
+		listenerPath := ""
+		if len(configuration.Listeners) > 0 {
+			listenerPath = fmt.Sprintf("listeners[%d]", i)
+			if listenerConf.Name != "" {
+				listenerPath += " (" + listenerConf.Name + ")"
+			}
+			listenerPath += "."
+		}
+		if listenerConf.Name == "" {
+			report(listenerPath+"name", "is required")
+		} else if previous, exists := listenerNames[listenerConf.Name]; exists {
+			report(listenerPath+"name", "duplicate name, already used by %s", strings.TrimSuffix(previous, "."))
+		} else {
+			listenerNames[listenerConf.Name] = listenerPath
+		}
+		if listenerConf.Port < 0 || listenerConf.Port > 65535 {
+			report(listenerPath+"port", "must be between 0 and 65535")
+		} else if listenerConf.Port != 0 {
+			bindAddress := net.JoinHostPort(listenerConf.Address, strconv.Itoa(listenerConf.Port))
+			if previous, exists := bindAddresses[bindAddress]; exists {
+				report(listenerPath+"port", "%s already used by %s", bindAddress, strings.TrimSuffix(previous, "."))
+			} else {
+				bindAddresses[bindAddress] = listenerPath
+			}
+		}
+		if listenerConf.TlsCertificate != "" || listenerConf.TlsKey != "" {
+			if _, err := tls.LoadX509KeyPair(listenerConf.TlsCertificate, listenerConf.TlsKey); err != nil {
+				report(listenerPath+"tlscertificate", "error loading TLS certificate: %v", err)
+			}
+		}
+		if listenerConf.MaxHeaderBytes < 0 {
+			report(listenerPath+"maxheaderbytes", "cannot be negative")
+		}
+		if listenerConf.MaxRequestBodyBytes < 0 {
+			report(listenerPath+"maxrequestbodybytes", "cannot be negative")
+		}
+	}
+
+	hostnames := map[string]string{}
+	listenPorts := map[string]string{}
+	serverIds := map[uuid.UUID]string{}
+	for i, poolConf := range configuration.Pools {
+		poolPath := fmt.Sprintf("pools[%d]", i)
+		if poolConf.Hostname != "" {
+			poolPath += " (" + poolConf.Hostname + ")"
+		}
+		if poolConf.Hostname == "" {
+			report(poolPath, "hostname is required")
+		} else if previous, exists := hostnames[poolConf.Hostname]; exists {
+			report(poolPath, "duplicate hostname, already used by %s", previous)
+		} else {
+			hostnames[poolConf.Hostname] = poolPath
+		}
+		for _, name := range poolConf.Listeners {
+			if _, exists := listenerNames[name]; !exists {
+				report(poolPath+".listeners", "listener %s does not exist", name)
+			}
+		}
+		if poolConf.HealthCheckIntervalSeconds == 0 {
+			report(poolPath+".healthcheckintervalseconds", "must be greater than 0")
+		}
+		if poolConf.HealthCheckTimeoutSeconds == 0 {
+			report(poolPath+".healthchecktimeoutseconds", "must be greater than 0")
+		}
+		stickyValid := true
+		if poolConf.StickySessions {
+			stickyMethod, err := loadbalancer.GetStickyMethodFromString(poolConf.StickyMethod)
+			if err != nil {
+				report(poolPath+".stickymethod", "must be one of IP, AppCookie, LBCookie or Header")
+				stickyValid = false
+			}
+			if poolConf.StickySessionTimeoutSeconds == 0 {
+				report(poolPath+".stickysessiontimeoutseconds", "must be greater than 0 when sticky sessions are enabled")
+			}
+			if stickyMethod == loadbalancer.StickyMethod_AppCookie && poolConf.StickyCookieName == "" {
+				report(poolPath+".stickycookiename", "is required with the AppCookie sticky method")
+				stickyValid = false
+			}
+			if stickyMethod == loadbalancer.StickyMethod_Header && poolConf.StickyHeader == "" {
+				report(poolPath+".stickyheader", "is required with the Header sticky method")
+				stickyValid = false
+			}
+		}
+		if poolConf.MaxStickySessions < 0 {
+			report(poolPath+".maxstickysessions", "cannot be negative")
+			stickyValid = false
+		}
+		// the remaining settings are checked by building the pool
+		var pool *loadbalancer.Pool
+		if stickyValid {
+			var err error
+			if pool, err = newPool(poolConf); err != nil {
+				report(poolPath, "%v", err)
+				pool = nil
+			}
+		}
+		// TLS pools have no listen port, they are reached through the listeners
+		if pool != nil && pool.IsLayer4() && pool.ListenPort != 0 {
+			listenPort := fmt.Sprintf("%d/%s", pool.ListenPort, pool.Mode)
+			if previous, exists := listenPorts[listenPort]; exists {
+				report(poolPath+".listenport", "%s already used by %s", listenPort, previous)
+			} else {
+				listenPorts[listenPort] = poolPath
+			}
+			for _, listenerConf := range listeners {
+				if pool.Mode == loadbalancer.PoolMode_TCP && pool.ListenPort == listenerConf.Port {
+					report(poolPath+".listenport", "already used by the HTTP listener %s", listenerConf.Name)
+				}
+			}
+			if pool.Mode == loadbalancer.PoolMode_TCP && pool.ListenPort == configuration.ManagementPort &&
+				configuration.ManagenentAddress == configuration.layer4Address(pool) {
+				report(poolPath+".listenport", "already used by the management API")
+			}
+		}
+
+		validateServers := func(kind string, servers []*ServerHostConfig, conditional bool) {
+			for j, serverConf := range servers {
+				serverPath := fmt.Sprintf("%s.%s[%d]", poolPath, kind, j)
+				if serverConf == nil {
+					report(serverPath, "empty server")
+					continue
+				}
+				if serverConf.Address != "" {
+					serverPath += " (" + serverConf.Address + ")"
+				}
+				if conditional && serverConf.Condition == (common.Condition{}) {
+					report(serverPath, "conditional server without a condition")
+				}
+				layer4 := pool != nil && pool.IsLayer4()
+				if address, err := url.Parse(serverConf.Address); err != nil {
+					report(serverPath+".address", "%v", err)
+				} else if !layer4 && ((address.Scheme != "http" && address.Scheme != "https") || address.Host == "") {
+					report(serverPath+".address", "must be an absolute URL starting with http:// or https://")
+				} else if serverConf.Resolve != "" {
+					if dynamicServer, err := newDynamicServer(serverConf, serverConf.Condition); err != nil {
+						report(serverPath, "%v", err)
+					} else if pool != nil {
+						if err := pool.ValidateDynamicServer(dynamicServer); err != nil {
+							report(serverPath, "%v", err)
+						}
+					}
+				} else if server, err := newServerHost(serverConf, serverConf.Condition); err != nil {
+					report(serverPath, "%v", err)
+				} else if pool != nil {
+					if err := pool.ValidateServer(server); err != nil {
+						report(serverPath, "%v", err)
+					}
+				}
+				if serverConf.Nameserver != "" && serverConf.Resolve == "" {
+					report(serverPath+".nameserver", "only applicable to servers with a resolve setting")
+				}
+				if serverConf.ManagedBy != "" && serverConf.ManagedBy != discovery.DOCKER && serverConf.ManagedBy != discovery.FILE &&
+					serverConf.ManagedBy != loadbalancer.REGISTRATION {
+					report(serverPath+".managedby", "unknown discovery provider %s", serverConf.ManagedBy)
+				}
+				if serverConf.Id == uuid.Nil {
+					continue
+				}
+				if previous, exists := serverIds[serverConf.Id]; exists {
+					report(serverPath, "duplicate id %s, already used by %s", serverConf.Id, previous)
+				} else {
+					serverIds[serverConf.Id] = serverPath
+				}
+			}
+		}
+		validateServers("conditionalservers", poolConf.ConditionalServers, true)
+		validateServers("unconditionalservers", poolConf.UnconditionalServers, false)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+/*
+layer4Address
+Returns the address a layer 4 pool listens on, as chosen by the load balancer: the address of its first listener,
+otherwise of the default listener or of the first listener by name.
+*/
+func (configuration *Configuration) layer4Address(pool *loadbalancer.Pool) string {
+	listeners := map[string]string{}
+	first := ""
+	for _, listenerConf := range configuration.listenerConfigs() {
+		listeners[listenerConf.Name] = listenerConf.Address
+		if first == "" || listenerConf.Name < first {
+			first = listenerConf.Name
+		}
+	}
+	for _, name := range pool.GetListeners() {
+		if address, exists := listeners[name]; exists {
+			return address
+		}
+	}
+	if address, exists := listeners[loadbalancer.DEFAULT_LISTENER]; exists {
+		return address
+	}
+	return listeners[first]
+}
+
+func invalidConfigurationError(problems []string) error {
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
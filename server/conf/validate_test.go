@@ -0,0 +1,387 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `address: 0.0.0.0
+port: 80
+managenentaddress: 127.0.0.1
+managementport: 8090
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  healthcheck_numok: 1
+  healthcheck_numfail: 1
+  stickysessions: true
+  stickymethod: AppCookie
+  stickysessiontimeoutseconds: 60
+  stickycookiename: JSESSIONID
+  unconditionalservers:
+  - id: 6f1c2f0a-6d7e-4f55-9a5b-1b1e5c2f0a11
+    address: http://10.0.0.1:8080
+    healthcheckpath: /health
+`
+
+func TestValidateConfig_Valid(t *testing.T) {
+	assert.Nil(t, ValidateConfig([]byte(validConfig)))
+}
+
+func TestValidateConfig_ReportsEveryProblem(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+authorizedkeys: /does/not/exist
+trustedproxies: [not-an-ip]
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 0
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: AppCookie
+  stickysessiontimeoutseconds: 60
+  unconditionalservers:
+  - id: 6f1c2f0a-6d7e-4f55-9a5b-1b1e5c2f0a11
+    address: 10.0.0.1:8080
+  - id: 6f1c2f0a-6d7e-4f55-9a5b-1b1e5c2f0a11
+    address: http://10.0.0.2:8080
+    protocol: h2
+  conditionalservers:
+  - address: http://10.0.0.3:8080
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 0
+  backendproxyprotocol: 3
+`))
+	expected := []string{
+		"authorizedkeys: ",
+		"trustedproxies[0]: ",
+		"pools[0] (app.lab).healthcheckintervalseconds: ",
+		"pools[0] (app.lab).stickycookiename: ",
+		"pools[0] (app.lab).conditionalservers[0] (http://10.0.0.3:8080): conditional server without a condition",
+		"pools[0] (app.lab).unconditionalservers[0] (10.0.0.1:8080).address: ",
+		"pools[0] (app.lab).unconditionalservers[1] (http://10.0.0.2:8080): ",
+		"pools[0] (app.lab).unconditionalservers[1] (http://10.0.0.2:8080): duplicate id",
+		"pools[1] (app.lab): duplicate hostname",
+		"pools[1] (app.lab).healthchecktimeoutseconds: ",
+		"pools[1] (app.lab): backend PROXY protocol",
+	}
+	require.Len(t, problems, len(expected), problems)
+	for _, prefix := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.HasPrefix(problem, prefix) {
+				found = true
+			}
+		}
+		assert.True(t, found, "missing %q in %v", prefix, problems)
+	}
+}
+
+func TestValidateConfig_Listeners(t *testing.T) {
+	problems := ValidateConfig([]byte(`port: 80
+listeners:
+- name: public
+  address: 0.0.0.0
+  port: 80
+- name: public
+  address: 0.0.0.0
+  port: 80
+- address: 127.0.0.1
+  port: 70000
+  maxheaderbytes: -1
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  listeners: [internal]
+`))
+	assert.ElementsMatch(t, []string{
+		"listeners: can't be used together with the top-level address, port and listener settings",
+		"listeners[1] (public).name: duplicate name, already used by listeners[0] (public)",
+		"listeners[1] (public).port: 0.0.0.0:80 already used by listeners[0] (public)",
+		"listeners[2].name: is required",
+		"listeners[2].port: must be between 0 and 65535",
+		"listeners[2].maxheaderbytes: cannot be negative",
+		"pools[0] (app.lab).listeners: listener internal does not exist",
+	}, problems)
+
+	assert.Nil(t, ValidateConfig([]byte(`listeners:
+- name: public
+  address: 0.0.0.0
+  port: 80
+- name: internal
+  address: 10.0.0.1
+  port: 8080
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  listeners: [internal]
+`)))
+}
+
+func TestValidateConfig_InvalidYaml(t *testing.T) {
+	problems := ValidateConfig([]byte("pools: {"))
+	assert.Len(t, problems, 1)
+}
+
+func TestLoadConfig_InvalidConfigStartsNothing(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(tmp, []byte("port: 80\npools:\n- hostname: app.lab\n"), 0644))
+	lb, apiServer, err := LoadConfig(tmp)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pools[0] (app.lab).healthcheckintervalseconds")
+	assert.Nil(t, lb)
+	assert.Nil(t, apiServer)
+}
+
+func TestValidateConfig_Layer4Pools(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+pools:
+- hostname: db.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tcp
+  listenport: 5432
+  unconditionalservers:
+  - address: tcp://10.0.0.1:5432
+  - address: http://10.0.0.2:5432
+- hostname: db2.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tcp
+  listenport: 5432
+- hostname: dns.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: udp
+  listenport: 5432
+  unconditionalservers:
+  - address: udp://10.0.0.1:53
+- hostname: api.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tcp
+  listenport: 8090
+- hostname: web.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  listenport: 8081
+  unconditionalservers:
+  - address: tcp://10.0.0.1:8080
+    healthcheckpath: /health
+- hostname: secure.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tls
+  unconditionalservers:
+  - address: tcp://10.0.0.1:443
+- hostname: secure2.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tls
+  listenport: 443
+`))
+	expected := []string{
+		"pools[0] (db.lab).unconditionalservers[1] (http://10.0.0.2:5432): servers of tcp pools must have a tcp:// address",
+		"pools[1] (db2.lab).listenport: 5432/tcp already used by pools[0] (db.lab)",
+		"pools[3] (api.lab).listenport: already used by the management API",
+		"pools[4] (web.lab): listenport is only applicable to tcp and udp pools",
+		"pools[4] (web.lab).unconditionalservers[0] (tcp://10.0.0.1:8080).address: ",
+		"pools[6] (secure2.lab): tls pools are routed by SNI on the listeners, they have no listen port",
+	}
+	require.Len(t, problems, len(expected), problems)
+	for i, prefix := range expected {
+		assert.True(t, strings.HasPrefix(problems[i], prefix), "%q does not start with %q", problems[i], prefix)
+	}
+}
+
+func TestValidateConfig_Discovery(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+discovery:
+  docker:
+    host: ftp://docker.lab
+  file:
+    directory: /nonexistent/continuity.d
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  unconditionalservers:
+  - address: http://172.17.0.2:80
+    healthcheckpath: /health
+    managedby: docker
+  - address: http://172.17.0.4:80
+    healthcheckpath: /health
+    managedby: file
+  - address: http://172.17.0.3:80
+    healthcheckpath: /health
+    managedby: consul
+`))
+	assert.Equal(t, []string{
+		"discovery.docker.host: docker host must be unix:///path/to/docker.sock or tcp://host:port",
+		"discovery.file.directory: stat /nonexistent/continuity.d: no such file or directory",
+		"pools[0] (app.lab).unconditionalservers[2] (http://172.17.0.3:80).managedby: unknown discovery provider consul",
+	}, problems)
+}
+
+func TestValidateConfig_DynamicServers(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  unconditionalservers:
+  - address: http://app.internal:8080
+    healthcheckpath: /health
+    resolve: a
+    nameserver: 10.0.0.53
+  - address: http://_http._tcp.app.internal:8080
+    healthcheckpath: /health
+    resolve: srv
+  - address: http://10.0.0.1:8080
+    healthcheckpath: /health
+    nameserver: 10.0.0.53
+- hostname: db.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  mode: tcp
+  listenport: 5432
+  unconditionalservers:
+  - address: http://db.internal:5432
+    resolve: a
+`))
+	assert.Equal(t, []string{
+		"pools[0] (app.lab).unconditionalservers[1] (http://_http._tcp.app.internal:8080): the ports of srv servers come from the SRV records, the address cannot have one",
+		"pools[0] (app.lab).unconditionalservers[2] (http://10.0.0.1:8080).nameserver: only applicable to servers with a resolve setting",
+		"pools[1] (db.lab).unconditionalservers[0] (http://db.internal:5432): servers of tcp pools must have a tcp:// address",
+	}, problems)
+}
+
+func TestValidateConfig_Registration(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  registrationtoken: 0123456789abcdef
+  leasettlseconds: 15
+  unconditionalservers:
+  - address: http://10.0.0.1:8080
+    healthcheckpath: /health
+    managedby: registration
+- hostname: short.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  registrationtoken: secret
+- hostname: ttl.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  leasettlseconds: 15
+`))
+	assert.Equal(t, []string{
+		"pools[1] (short.lab): registration token must be at least 16 characters",
+		"pools[2] (ttl.lab): lease ttl is only applicable with a registration token",
+	}, problems)
+}
+
+func TestValidateConfig_StickyCookie(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: LBCookie
+  stickysessiontimeoutseconds: 60
+  stickycookie:
+    opaque: true
+    secure: true
+    samesite: None
+- hostname: short.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: LBCookie
+  stickysessiontimeoutseconds: 60
+  stickycookie:
+    secret: secret
+- hostname: insecure.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: LBCookie
+  stickysessiontimeoutseconds: 60
+  stickycookie:
+    samesite: None
+- hostname: ip.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: IP
+  stickysessiontimeoutseconds: 60
+  stickycookie:
+    secure: true
+`))
+	assert.Equal(t, []string{
+		"pools[1] (short.lab): sticky cookie secret must be at least 16 characters",
+		"pools[2] (insecure.lab): sticky cookie samesite None requires secure",
+		"pools[3] (ip.lab): stickycookie is only applicable to the LBCookie sticky method",
+	}, problems)
+}
+
+func TestValidateConfig_StickyHeader(t *testing.T) {
+	problems := ValidateConfig([]byte(`address: 0.0.0.0
+port: 80
+managenentaddress: 0.0.0.0
+managementport: 8090
+pools:
+- hostname: app.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: Header
+  stickysessiontimeoutseconds: 60
+  stickyheader: X-Tenant-ID
+  stickyslidingexpiry: true
+- hostname: missing.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: Header
+  stickysessiontimeoutseconds: 60
+- hostname: ip.lab
+  healthcheckintervalseconds: 10
+  healthchecktimeoutseconds: 5
+  stickysessions: true
+  stickymethod: IP
+  stickysessiontimeoutseconds: 60
+  stickyheader: X-Tenant-ID
+`))
+	assert.Equal(t, []string{
+		"pools[1] (missing.lab).stickyheader: is required with the Header sticky method",
+		"pools[2] (ip.lab): stickyheader is only applicable to the Header sticky method",
+	}, problems)
+}
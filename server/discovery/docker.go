@@ -0,0 +1,517 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DOCKER is the ManagedBy value of the servers added by the Docker provider
+const DOCKER = "docker"
+
+const DEFAULT_DOCKER_HOST = "unix:///var/run/docker.sock"
+const DEFAULT_DOCKER_REFRESH_INTERVAL = 30 * time.Second
+const DEFAULT_DOCKER_HEALTH_CHECK_PATH = "/health"
+
+// container labels read by the Docker provider
+const (
+	LABEL_POOL        = "continuity.pool"
+	LABEL_PORT        = "continuity.port"
+	LABEL_HEALTHCHECK = "continuity.healthcheck"
+	LABEL_NETWORK     = "continuity.network"
+)
+
+/*
+DockerProvider
+Adds and removes the servers of the pools from the labels of the containers of a Docker Engine:
+a running container with a continuity.pool label is a server of that pool, until the container is removed.
+Stopped containers keep their server, which is marked down by the health checks; when a container is restarted
+or its address changes, the server is replaced through a pool transaction.
+*/
+type DockerProvider struct {
+	lb              *loadbalancer.LoadBalancer
+	client          *http.Client
+	baseURL         string
+	host            string
+	network         string
+	refreshInterval time.Duration
+	saveConfig      chan bool
+	containers      map[string]*dockerContainer
+	ignored         map[string]string
+	containersMutex sync.Mutex
+}
+
+/*
+dockerContainer
+A container known to the provider and its server. While a transaction replaces the server, next is the new one.
+*/
+type dockerContainer struct {
+	pool      string
+	server    *loadbalancer.ServerHost
+	next      *loadbalancer.ServerHost
+	startedAt string
+}
+
+type dockerContainerSummary struct {
+	Id     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	State  string            `json:"State"`
+	Labels map[string]string `json:"Labels"`
+}
+
+type dockerContainerDetails struct {
+	Id    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running   bool   `json:"Running"`
+		StartedAt string `json:"StartedAt"`
+	} `json:"State"`
+	Config struct {
+		Labels       map[string]string   `json:"Labels"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+/*
+NewDockerProvider
+Creates a provider for the Docker Engine at host, unix:///path/to/docker.sock or tcp://host:port.
+network is the network whose address is used when containers have several, the refresh interval is the
+maximum time between two full synchronizations. Changes are notified on saveConfig.
+*/
+func NewDockerProvider(lb *loadbalancer.LoadBalancer, host string, network string, refreshInterval time.Duration, saveConfig chan bool) (*DockerProvider, error) {
+	if host == "" {
+		host = DEFAULT_DOCKER_HOST
+	}
+	if refreshInterval == 0 {
+		refreshInterval = DEFAULT_DOCKER_REFRESH_INTERVAL
+	}
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s: %w", host, err)
+	}
+	client := &http.Client{}
+	baseURL := ""
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		baseURL = "http://docker"
+	case "tcp", "http":
+		baseURL = "http://" + hostURL.Host
+	default:
+		return nil, errors.New("docker host must be unix:///path/to/docker.sock or tcp://host:port")
+	}
+	provider := newDockerProvider(lb, client, baseURL, network, refreshInterval, saveConfig)
+	provider.host = host
+	return provider, nil
+}
+
+func newDockerProvider(lb *loadbalancer.LoadBalancer, client *http.Client, baseURL string, network string, refreshInterval time.Duration, saveConfig chan bool) *DockerProvider {
+	return &DockerProvider{
+		lb:              lb,
+		client:          client,
+		baseURL:         baseURL,
+		host:            baseURL,
+		network:         network,
+		refreshInterval: refreshInterval,
+		saveConfig:      saveConfig,
+		containers:      map[string]*dockerContainer{},
+		ignored:         map[string]string{},
+	}
+}
+
+/*
+Run
+Synchronizes the pools with the containers on every container event, and at least every refresh interval,
+until the context is cancelled.
+*/
+func (d *DockerProvider) Run(ctx context.Context) {
+	log.Println("Starting docker discovery on", d.host)
+	for {
+		if err := d.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Docker discovery - Error synchronizing containers:", err)
+		}
+		watchCtx, cancel := context.WithTimeout(ctx, d.refreshInterval)
+		if err := d.watch(watchCtx); err != nil && watchCtx.Err() == nil {
+			log.Println("Docker discovery - Error watching events:", err)
+			// the daemon is not reachable, retry at the next refresh
+			<-watchCtx.Done()
+		}
+		cancel()
+		if ctx.Err() != nil {
+			log.Println("Stopped docker discovery")
+			return
+		}
+	}
+}
+
+/*
+watch
+Reads the container events and synchronizes on each one, until the stream ends or the context expires.
+*/
+func (d *DockerProvider) watch(ctx context.Context) error {
+	resp, err := d.get(ctx, "/events?filters="+url.QueryEscape(`{"type":["container"],"label":["`+LABEL_POOL+`"]}`))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if err := d.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Docker discovery - Error synchronizing containers:", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (d *DockerProvider) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("docker API responded %s to %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (d *DockerProvider) getJSON(ctx context.Context, path string, value any) error {
+	resp, err := d.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+/*
+Sync
+Lists the labelled containers and adds, replaces and removes servers so that the pools match them.
+Servers managed by the provider that match no container, e.g. saved before a restart, are removed.
+*/
+func (d *DockerProvider) Sync(ctx context.Context) error {
+	summaries := []dockerContainerSummary{}
+	filters := url.QueryEscape(`{"label":["` + LABEL_POOL + `"]}`)
+	if err := d.getJSON(ctx, "/containers/json?all=1&filters="+filters, &summaries); err != nil {
+		return err
+	}
+	details := map[string]*dockerContainerDetails{}
+	for _, summary := range summaries {
+		if summary.State != "running" {
+			continue
+		}
+		container := &dockerContainerDetails{}
+		if err := d.getJSON(ctx, "/containers/"+summary.Id+"/json", container); err != nil {
+			return err
+		}
+		details[summary.Id] = container
+	}
+
+	d.containersMutex.Lock()
+	defer d.containersMutex.Unlock()
+	changed := false
+	kept := map[uuid.UUID]bool{}
+	existing := map[string]bool{}
+	for _, summary := range summaries {
+		existing[summary.Id] = true
+		container, running := details[summary.Id]
+		if !running {
+			// the server of a stopped container stays, so that a restart replaces it with a transaction
+			if tracked, exists := d.containers[summary.Id]; exists {
+				kept[tracked.server.Id] = true
+			}
+			continue
+		}
+		if d.syncContainer(container, kept) {
+			changed = true
+		}
+	}
+	for id, tracked := range d.containers {
+		if !existing[id] && tracked.next == nil {
+			delete(d.containers, id)
+		}
+	}
+	for id := range d.ignored {
+		if _, running := details[id]; !running {
+			delete(d.ignored, id)
+		}
+	}
+	for _, pool := range d.lb.GetPools() {
+		for _, server := range managedServers(pool, DOCKER) {
+			if !kept[server.Id] {
+				if _, err := pool.RemoveServer(server.Id); err == nil {
+					log.Printf("Docker discovery - Server %s removed from pool %s\n", server.Address.String(), pool.Hostname)
+					changed = true
+				}
+			}
+		}
+	}
+	if changed {
+		d.notifySave()
+	}
+	return nil
+}
+
+/*
+syncContainer
+Adds or replaces the server of a running container, the servers to keep are added to kept.
+Returns whether the pools changed. Must be called holding containersMutex.
+*/
+func (d *DockerProvider) syncContainer(container *dockerContainerDetails, kept map[uuid.UUID]bool) bool {
+	name := strings.TrimPrefix(container.Name, "/")
+	tracked := d.containers[container.Id]
+	if tracked != nil && tracked.next != nil {
+		// a transaction is running, its result is applied when it completes
+		kept[tracked.server.Id] = true
+		kept[tracked.next.Id] = true
+		return false
+	}
+	hostname, server, err := d.desiredServer(container)
+	if err != nil {
+		d.ignore(container.Id, name, err.Error())
+		return false
+	}
+	pool, err := d.lb.GetPool(hostname)
+	if err != nil {
+		d.ignore(container.Id, name, "pool "+hostname+" does not exist")
+		return false
+	}
+	if err := pool.ValidateServer(server); err != nil {
+		d.ignore(container.Id, name, err.Error())
+		return false
+	}
+	delete(d.ignored, container.Id)
+
+	var current *loadbalancer.ServerHost
+	if tracked != nil && tracked.pool == hostname {
+		current = findServer(pool, func(s *loadbalancer.ServerHost) bool { return s.Id == tracked.server.Id })
+	}
+	if current == nil && tracked == nil {
+		// servers saved before a restart are taken over by address
+		current = findServer(pool, func(s *loadbalancer.ServerHost) bool {
+			return s.ManagedBy == DOCKER && !kept[s.Id] && sameServer(s, server)
+		})
+		if current != nil {
+			tracked = &dockerContainer{pool: hostname, server: current, startedAt: container.State.StartedAt}
+			d.containers[container.Id] = tracked
+		}
+	}
+	switch {
+	case current == nil:
+		pool.AddServer(server)
+		d.containers[container.Id] = &dockerContainer{pool: hostname, server: server, startedAt: container.State.StartedAt}
+		kept[server.Id] = true
+		log.Printf("Docker discovery - Container %s added to pool %s as %s\n", name, hostname, server.Address.String())
+		return true
+	case sameServer(current, server) && tracked.startedAt == container.State.StartedAt:
+		kept[current.Id] = true
+		return false
+	default:
+		kept[current.Id] = true
+		kept[server.Id] = true
+		tracked.next = server
+		log.Printf("Docker discovery - Container %s restarted, replacing %s with %s in pool %s\n",
+			name, current.Address.String(), server.Address.String(), hostname)
+		go d.replace(pool, container.Id, name, current, server, container.State.StartedAt)
+		return false
+	}
+}
+
+/*
+replace
+Replaces the server of a restarted container with a pool transaction. If the new server doesn't become healthy
+the old one is kept and the replacement is tried again on the next synchronization.
+*/
+func (d *DockerProvider) replace(pool *loadbalancer.Pool, id string, name string, current *loadbalancer.ServerHost, server *loadbalancer.ServerHost, startedAt string) {
+	err := pool.Transaction(server, current.Id, false)
+	d.containersMutex.Lock()
+	defer d.containersMutex.Unlock()
+	tracked, exists := d.containers[id]
+	if !exists {
+		tracked = &dockerContainer{pool: pool.Hostname, server: current}
+		d.containers[id] = tracked
+	}
+	tracked.next = nil
+	if err != nil {
+		log.Printf("Docker discovery - Container %s: %v\n", name, err)
+		return
+	}
+	tracked.server = server
+	tracked.startedAt = startedAt
+	log.Printf("Docker discovery - Container %s replaced in pool %s\n", name, pool.Hostname)
+	d.notifySave()
+}
+
+/*
+desiredServer
+Returns the pool hostname and the server of a container from its labels. The continuity.pool label is the
+hostname of the pool, optionally prefixed by the scheme of the server address (http by default):
+https://app.lab makes https://ip:port servers.
+*/
+func (d *DockerProvider) desiredServer(container *dockerContainerDetails) (string, *loadbalancer.ServerHost, error) {
+	labels := container.Config.Labels
+	hostname := labels[LABEL_POOL]
+	scheme := "http"
+	if before, after, found := strings.Cut(hostname, "://"); found {
+		scheme = before
+		hostname = after
+	}
+	if hostname == "" {
+		return "", nil, errors.New(LABEL_POOL + " label is empty")
+	}
+	ip, err := d.containerIP(container)
+	if err != nil {
+		return "", nil, err
+	}
+	port, err := containerPort(container, scheme)
+	if err != nil {
+		return "", nil, err
+	}
+	healthCheck := labels[LABEL_HEALTHCHECK]
+	if healthCheck == "" && (scheme == "http" || scheme == "https") {
+		healthCheck = DEFAULT_DOCKER_HEALTH_CHECK_PATH
+	}
+	server, err := loadbalancer.NewServerHost(scheme+"://"+net.JoinHostPort(ip, port), healthCheck, common.Condition{})
+	if err != nil {
+		return "", nil, err
+	}
+	server.ManagedBy = DOCKER
+	return hostname, server, nil
+}
+
+/*
+containerIP
+Returns the address of the container on the network of its continuity.network label, or of the provider,
+otherwise on its first network by name.
+*/
+func (d *DockerProvider) containerIP(container *dockerContainerDetails) (string, error) {
+	networks := container.NetworkSettings.Networks
+	network := container.Config.Labels[LABEL_NETWORK]
+	if network == "" {
+		network = d.network
+	}
+	if network != "" {
+		if settings, exists := networks[network]; exists && settings.IPAddress != "" {
+			return settings.IPAddress, nil
+		}
+		if container.Config.Labels[LABEL_NETWORK] != "" {
+			return "", fmt.Errorf("container has no address on network %s", network)
+		}
+	}
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", errors.New("container has no network address")
+}
+
+/*
+containerPort
+Returns the port of the continuity.port label, otherwise the single port exposed by the container image,
+otherwise 80 for http and 443 for https.
+*/
+func containerPort(container *dockerContainerDetails, scheme string) (string, error) {
+	if port := container.Config.Labels[LABEL_PORT]; port != "" {
+		if value, err := strconv.Atoi(port); err != nil || value <= 0 || value > 65535 {
+			return "", fmt.Errorf("invalid %s label %s", LABEL_PORT, port)
+		}
+		return port, nil
+	}
+	if len(container.Config.ExposedPorts) == 1 {
+		for exposed := range container.Config.ExposedPorts {
+			port, _, _ := strings.Cut(exposed, "/")
+			return port, nil
+		}
+	}
+	switch scheme {
+	case "http":
+		return "80", nil
+	case "https":
+		return "443", nil
+	}
+	return "", fmt.Errorf("%s label is required", LABEL_PORT)
+}
+
+/*
+ignore
+Logs why a container is not added to a pool, once until the reason changes. Must be called holding containersMutex.
+*/
+func (d *DockerProvider) ignore(id string, name string, reason string) {
+	if d.ignored[id] != reason {
+		d.ignored[id] = reason
+		log.Printf("Docker discovery - Container %s ignored: %s\n", name, reason)
+	}
+}
+
+func (d *DockerProvider) notifySave() {
+	if d.saveConfig == nil {
+		return
+	}
+	select {
+	case d.saveConfig <- true:
+	default:
+	}
+}
+
+/*
+managedServers
+Returns the servers of the pool added by the given provider.
+*/
+func managedServers(pool *loadbalancer.Pool, provider string) []*loadbalancer.ServerHost {
+	servers := []*loadbalancer.ServerHost{}
+	for _, server := range pool.GetServers() {
+		if server.ManagedBy == provider {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func findServer(pool *loadbalancer.Pool, match func(*loadbalancer.ServerHost) bool) *loadbalancer.ServerHost {
+	for _, server := range pool.GetServers() {
+		if match(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+func sameServer(a, b *loadbalancer.ServerHost) bool {
+	return a.Address.String() == b.Address.String() && a.HealthCheckPath == b.HealthCheckPath
+}
@@ -0,0 +1,232 @@
+package discovery
+
+import (
+	"context"
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+fakeDocker
+A Docker Engine API serving a list of containers that tests can change.
+*/
+type fakeDocker struct {
+	containers []*dockerContainerDetails
+	mutex      sync.Mutex
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case r.URL.Path == "/containers/json":
+		summaries := []dockerContainerSummary{}
+		for _, container := range f.containers {
+			state := "exited"
+			if container.State.Running {
+				state = "running"
+			}
+			summaries = append(summaries, dockerContainerSummary{
+				Id:     container.Id,
+				Names:  []string{container.Name},
+				State:  state,
+				Labels: container.Config.Labels,
+			})
+		}
+		_ = json.NewEncoder(w).Encode(summaries)
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		for _, container := range f.containers {
+			if container.Id == id {
+				_ = json.NewEncoder(w).Encode(container)
+				return
+			}
+		}
+		http.Error(w, "no such container", http.StatusNotFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeDocker) set(containers ...*dockerContainerDetails) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.containers = containers
+}
+
+func fakeContainer(id string, ip string, startedAt string, labels map[string]string) *dockerContainerDetails {
+	container := &dockerContainerDetails{Id: id, Name: "/" + id}
+	container.State.Running = true
+	container.State.StartedAt = startedAt
+	container.Config.Labels = labels
+	container.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{"bridge": {IPAddress: ip}}
+	return container
+}
+
+func backendPort(t *testing.T) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+	address, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	return address.Port()
+}
+
+func newTestProvider(t *testing.T) (*DockerProvider, *fakeDocker, *loadbalancer.Pool) {
+	lb, err := loadbalancer.NewLoadBalancer([]*loadbalancer.Listener{{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lb.Shutdown(context.Background()) })
+	pool := loadbalancer.NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	require.NoError(t, lb.AddPool(pool))
+	docker := &fakeDocker{}
+	server := httptest.NewServer(docker)
+	t.Cleanup(server.Close)
+	return newDockerProvider(lb, server.Client(), server.URL, "", time.Minute, nil), docker, pool
+}
+
+func TestDockerProvider_Sync(t *testing.T) {
+	provider, docker, pool := newTestProvider(t)
+	port := backendPort(t)
+	web := fakeContainer("web-1", "127.0.0.1", "2026-01-01T10:00:00Z", map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: port})
+	other := fakeContainer("other-1", "127.0.0.2", "2026-01-01T10:00:00Z", map[string]string{LABEL_POOL: "other.lab"})
+	docker.set(web, other)
+	require.NoError(t, provider.Sync(context.Background()))
+
+	servers := pool.GetServers()
+	require.Len(t, servers, 1)
+	assert.Equal(t, "http://127.0.0.1:"+port, servers[0].Address.String())
+	assert.Equal(t, DEFAULT_DOCKER_HEALTH_CHECK_PATH, servers[0].HealthCheckPath)
+	assert.Equal(t, DOCKER, servers[0].ManagedBy)
+	assert.Equal(t, map[string]string{"other-1": "pool other.lab does not exist"}, provider.ignored)
+	id := servers[0].Id
+
+	// nothing changed
+	require.NoError(t, provider.Sync(context.Background()))
+	require.Len(t, pool.GetServers(), 1)
+	assert.Equal(t, id, pool.GetServers()[0].Id)
+
+	// a stopped container keeps its server
+	web.State.Running = false
+	require.NoError(t, provider.Sync(context.Background()))
+	require.Len(t, pool.GetServers(), 1)
+
+	// a removed container loses it
+	docker.set(other)
+	require.NoError(t, provider.Sync(context.Background()))
+	assert.Empty(t, pool.GetServers())
+	assert.Empty(t, provider.containers)
+}
+
+func TestDockerProvider_RestartUsesTransaction(t *testing.T) {
+	provider, docker, pool := newTestProvider(t)
+	port := backendPort(t)
+	web := fakeContainer("web-1", "127.0.0.1", "2026-01-01T10:00:00Z", map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: "1"})
+	docker.set(web)
+	require.NoError(t, provider.Sync(context.Background()))
+	require.Len(t, pool.GetServers(), 1)
+	old := pool.GetServers()[0]
+
+	restarted := fakeContainer("web-1", "127.0.0.1", "2026-01-01T11:00:00Z", map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: port})
+	docker.set(restarted)
+	require.NoError(t, provider.Sync(context.Background()))
+	provider.containersMutex.Lock()
+	next := provider.containers["web-1"].next
+	provider.containersMutex.Unlock()
+	require.NotNil(t, next)
+	// a running transaction is not started again, and its servers are kept
+	require.NoError(t, provider.Sync(context.Background()))
+	provider.containersMutex.Lock()
+	assert.Same(t, next, provider.containers["web-1"].next)
+	provider.containersMutex.Unlock()
+	assert.True(t, pool.CheckServerUUID(old.Id))
+
+	assert.Eventually(t, func() bool {
+		servers := pool.GetServers()
+		return len(servers) == 1 && servers[0].Id != old.Id &&
+			servers[0].ServerStatus.Load() == uint32(loadbalancer.Healthy)
+	}, 5*time.Second, 50*time.Millisecond)
+	provider.containersMutex.Lock()
+	assert.Equal(t, "2026-01-01T11:00:00Z", provider.containers["web-1"].startedAt)
+	assert.Nil(t, provider.containers["web-1"].next)
+	provider.containersMutex.Unlock()
+	require.NoError(t, provider.Sync(context.Background()))
+	assert.Len(t, pool.GetServers(), 1)
+}
+
+func TestDockerProvider_TakesOverSavedServers(t *testing.T) {
+	provider, docker, pool := newTestProvider(t)
+	docker.set(fakeContainer("web-1", "127.0.0.1", "2026-01-01T10:00:00Z", map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: "8080"}))
+	saved, err := loadbalancer.NewServerHost("http://127.0.0.1:8080", DEFAULT_DOCKER_HEALTH_CHECK_PATH, common.Condition{})
+	require.NoError(t, err)
+	saved.ManagedBy = DOCKER
+	stale, err := loadbalancer.NewServerHost("http://127.0.0.9:8080", DEFAULT_DOCKER_HEALTH_CHECK_PATH, common.Condition{})
+	require.NoError(t, err)
+	stale.ManagedBy = DOCKER
+	static, err := loadbalancer.NewServerHost("http://127.0.0.10:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	for _, server := range []*loadbalancer.ServerHost{saved, stale, static} {
+		pool.AddServer(server)
+	}
+
+	require.NoError(t, provider.Sync(context.Background()))
+	servers := pool.GetServers()
+	require.Len(t, servers, 2)
+	assert.Equal(t, saved.Id, servers[0].Id)
+	assert.Equal(t, static.Id, servers[1].Id)
+}
+
+func TestDesiredServer(t *testing.T) {
+	provider := newDockerProvider(nil, nil, "", "backend", time.Minute, nil)
+	testCases := []struct {
+		labels       map[string]string
+		exposedPorts []string
+		hostname     string
+		address      string
+		healthCheck  string
+		err          string
+	}{
+		{map[string]string{LABEL_POOL: "app.lab"}, nil, "app.lab", "http://10.0.0.2:80", "/health", ""},
+		{map[string]string{LABEL_POOL: "https://app.lab", LABEL_HEALTHCHECK: "/ready"}, nil, "app.lab", "https://10.0.0.2:443", "/ready", ""},
+		{map[string]string{LABEL_POOL: "app.lab"}, []string{"3000/tcp"}, "app.lab", "http://10.0.0.2:3000", "/health", ""},
+		{map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: "8080"}, []string{"3000/tcp"}, "app.lab", "http://10.0.0.2:8080", "/health", ""},
+		{map[string]string{LABEL_POOL: "app.lab", LABEL_NETWORK: "bridge"}, nil, "app.lab", "http://10.0.0.1:80", "/health", ""},
+		{map[string]string{LABEL_POOL: "tcp://db.lab", LABEL_PORT: "5432"}, nil, "db.lab", "tcp://10.0.0.2:5432", "", ""},
+		{map[string]string{LABEL_POOL: "tcp://db.lab"}, nil, "", "", "", "continuity.port label is required"},
+		{map[string]string{LABEL_POOL: "app.lab", LABEL_PORT: "http"}, nil, "", "", "", "invalid continuity.port label http"},
+		{map[string]string{LABEL_POOL: "app.lab", LABEL_NETWORK: "missing"}, nil, "", "", "", "container has no address on network missing"},
+		{map[string]string{LABEL_POOL: "http://"}, nil, "", "", "", "continuity.pool label is empty"},
+	}
+	for _, tc := range testCases {
+		container := fakeContainer("web-1", "10.0.0.1", "", tc.labels)
+		container.NetworkSettings.Networks["backend"] = struct {
+			IPAddress string `json:"IPAddress"`
+		}{IPAddress: "10.0.0.2"}
+		container.Config.ExposedPorts = map[string]struct{}{}
+		for _, port := range tc.exposedPorts {
+			container.Config.ExposedPorts[port] = struct{}{}
+		}
+		hostname, server, err := provider.desiredServer(container)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "%v", tc.labels)
+			continue
+		}
+		require.NoError(t, err, "%v", tc.labels)
+		assert.Equal(t, tc.hostname, hostname)
+		assert.Equal(t, tc.address, server.Address.String())
+		assert.Equal(t, tc.healthCheck, server.HealthCheckPath)
+	}
+}
@@ -0,0 +1,377 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+// FILE is the ManagedBy value of the servers added by the file provider
+const FILE = "file"
+
+const DEFAULT_FILE_REFRESH_INTERVAL = 5 * time.Second
+const DEFAULT_FILE_HEALTH_CHECK_PATH = "/health"
+
+/*
+FileProvider
+Adds and removes the servers of the pools from the files of a directory. Each .yaml, .yml or .json file declares
+servers for a pool, the directory is read again every refresh interval. Servers removed from the files are
+drained, new ones start pending and changed ones are replaced with a transaction.
+A file that can't be read or parsed keeps the servers it declared before, so that a partially written file
+doesn't remove them.
+*/
+type FileProvider struct {
+	lb              *loadbalancer.LoadBalancer
+	directory       string
+	refreshInterval time.Duration
+	saveConfig      chan bool
+	files           map[string]*loadedFile
+	ignored         map[string]string
+	// replacing holds the new servers of the running transactions, by Id of the server they replace
+	replacing map[uuid.UUID]*loadbalancer.ServerHost
+	mutex     sync.Mutex
+}
+
+/*
+serversFile
+The content of a file of the directory.
+*/
+type serversFile struct {
+	Pool    string        `yaml:"pool" json:"pool"`
+	Servers []*fileServer `yaml:"servers" json:"servers"`
+}
+
+/*
+loadedFile
+The servers of a file, as of its last valid content.
+*/
+type loadedFile struct {
+	content []byte
+	pool    string
+	servers []*loadbalancer.ServerHost
+}
+
+type fileServer struct {
+	Address         string           `yaml:"address" json:"address"`
+	HealthCheckPath *string          `yaml:"healthcheckpath" json:"healthcheckpath"`
+	Condition       common.Condition `yaml:"condition" json:"condition"`
+	Protocol        string           `yaml:"protocol" json:"protocol"`
+}
+
+/*
+NewFileProvider
+Creates a provider for the files of the directory, which must exist. Changes are notified on saveConfig.
+*/
+func NewFileProvider(lb *loadbalancer.LoadBalancer, directory string, refreshInterval time.Duration, saveConfig chan bool) (*FileProvider, error) {
+	if directory == "" {
+		return nil, errors.New("directory is required")
+	}
+	info, err := os.Stat(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	if refreshInterval == 0 {
+		refreshInterval = DEFAULT_FILE_REFRESH_INTERVAL
+	}
+	return &FileProvider{
+		lb:              lb,
+		directory:       directory,
+		refreshInterval: refreshInterval,
+		saveConfig:      saveConfig,
+		files:           map[string]*loadedFile{},
+		ignored:         map[string]string{},
+		replacing:       map[uuid.UUID]*loadbalancer.ServerHost{},
+	}, nil
+}
+
+/*
+Run
+Synchronizes the pools with the files every refresh interval, until the context is cancelled.
+*/
+func (f *FileProvider) Run(ctx context.Context) {
+	log.Println("Starting file discovery on", f.directory)
+	for {
+		if err := f.Sync(); err != nil {
+			log.Println("File discovery - Error reading the directory:", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped file discovery")
+			return
+		case <-time.After(f.refreshInterval):
+		}
+	}
+}
+
+/*
+Sync
+Reads the files and adds, replaces and drains servers so that the pools match them.
+Servers managed by the provider that match no file, e.g. saved before a restart, are drained.
+*/
+func (f *FileProvider) Sync() error {
+	entries, err := os.ReadDir(f.directory)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	existing := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		extension := filepath.Ext(name)
+		// editors and configuration management tools write temporary files next to the real ones
+		if entry.IsDir() || strings.HasPrefix(name, ".") || (extension != ".yaml" && extension != ".yml" && extension != ".json") {
+			continue
+		}
+		existing[name] = true
+		if err := f.loadFile(name); err != nil {
+			f.ignore(name, err.Error())
+			continue
+		}
+		if f.ignored[name] != "" {
+			delete(f.ignored, name)
+			log.Printf("File discovery - File %s loaded\n", name)
+		}
+	}
+	for name := range f.files {
+		if !existing[name] {
+			delete(f.files, name)
+		}
+	}
+	for name := range f.ignored {
+		if !existing[name] {
+			delete(f.ignored, name)
+		}
+	}
+
+	desired := map[string][]*loadbalancer.ServerHost{}
+	names := []string{}
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		loaded := f.files[name]
+		desired[loaded.pool] = append(desired[loaded.pool], loaded.servers...)
+	}
+
+	changed := false
+	for _, pool := range f.lb.GetPools() {
+		if f.syncPool(pool, desired[pool.Hostname]) {
+			changed = true
+		}
+	}
+	if changed {
+		f.notifySave()
+	}
+	return nil
+}
+
+/*
+syncPool
+Adds the desired servers missing from the pool, replaces the ones whose settings changed with a transaction and
+drains the others. Returns whether the pool changed.
+*/
+func (f *FileProvider) syncPool(pool *loadbalancer.Pool, desired []*loadbalancer.ServerHost) bool {
+	pending := map[*loadbalancer.ServerHost]bool{}
+	for _, server := range f.replacing {
+		pending[server] = true
+	}
+	current := []*loadbalancer.ServerHost{}
+	for _, server := range managedServers(pool, FILE) {
+		// the new server of a running transaction is left to it
+		if server.ServerStatus.Load() != uint32(loadbalancer.Draining) && !pending[server] {
+			current = append(current, server)
+		}
+	}
+	changed := false
+	kept := map[*loadbalancer.ServerHost]bool{}
+	declared := map[string]bool{}
+	for _, server := range desired {
+		// a server declared by several files is added once
+		key := server.Address.String() + " " + server.Condition.String()
+		if declared[key] {
+			continue
+		}
+		declared[key] = true
+		var match *loadbalancer.ServerHost
+		for _, candidate := range current {
+			if !kept[candidate] && candidate.Address.String() == server.Address.String() && candidate.Condition == server.Condition {
+				match = candidate
+				break
+			}
+		}
+		if match != nil {
+			kept[match] = true
+			if (sameServer(match, server) && match.Protocol == server.Protocol) || f.replacing[match.Id] != nil {
+				continue
+			}
+		}
+		// the servers of a file are templates, a server removed from the pool can't be added again
+		added, err := loadbalancer.NewServerHost(server.Address.String(), server.HealthCheckPath, server.Condition)
+		if err == nil {
+			err = added.SetProtocol(server.Protocol)
+		}
+		if err != nil {
+			log.Printf("File discovery - Error adding server %s to pool %s: %v\n", server.Address.String(), pool.Hostname, err)
+			continue
+		}
+		added.ManagedBy = FILE
+		if match != nil {
+			// the previous server keeps serving until the new one is healthy
+			f.replacing[match.Id] = added
+			go f.replace(pool, match, added)
+			log.Printf("File discovery - Server %s of pool %s changed, replacing it\n", server.Address.String(), pool.Hostname)
+			continue
+		}
+		pool.AddServer(added)
+		log.Printf("File discovery - Server %s added to pool %s\n", server.Address.String(), pool.Hostname)
+		changed = true
+	}
+	for _, server := range current {
+		if kept[server] {
+			continue
+		}
+		if _, err := pool.DrainServer(server.Id); err == nil {
+			log.Printf("File discovery - Server %s draining from pool %s\n", server.Address.String(), pool.Hostname)
+			changed = true
+		}
+	}
+	return changed
+}
+
+/*
+replace
+Replaces a server whose settings changed with a transaction, its sticky sessions are moved to the new server.
+*/
+func (f *FileProvider) replace(pool *loadbalancer.Pool, current *loadbalancer.ServerHost, server *loadbalancer.ServerHost) {
+	err := pool.Transaction(server, current.Id, true)
+	f.mutex.Lock()
+	delete(f.replacing, current.Id)
+	f.mutex.Unlock()
+	if err != nil {
+		log.Printf("File discovery - Error replacing server %s of pool %s: %v\n", current.Address.String(), pool.Hostname, err)
+		return
+	}
+	log.Printf("File discovery - Server %s of pool %s replaced\n", server.Address.String(), pool.Hostname)
+	f.notifySave()
+}
+
+/*
+desiredServers
+Returns the servers declared by a file, checked against its pool.
+*/
+func (f *FileProvider) desiredServers(file *serversFile) ([]*loadbalancer.ServerHost, error) {
+	if file.Pool == "" {
+		return nil, errors.New("pool is required")
+	}
+	pool, err := f.lb.GetPool(file.Pool)
+	if err != nil {
+		return nil, errors.New("pool " + file.Pool + " does not exist")
+	}
+	servers := []*loadbalancer.ServerHost{}
+	for i, declared := range file.Servers {
+		if declared == nil || declared.Address == "" {
+			return nil, fmt.Errorf("servers[%d]: address is required", i)
+		}
+		healthCheckPath := ""
+		if declared.HealthCheckPath != nil {
+			healthCheckPath = *declared.HealthCheckPath
+		} else if !pool.IsLayer4() {
+			healthCheckPath = DEFAULT_FILE_HEALTH_CHECK_PATH
+		}
+		if declared.Condition != (common.Condition{}) {
+			if err := declared.Condition.Validate(); err != nil {
+				return nil, fmt.Errorf("servers[%d]: %w", i, err)
+			}
+		}
+		server, err := loadbalancer.NewServerHost(declared.Address, healthCheckPath, declared.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if err := server.SetProtocol(declared.Protocol); err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if err := pool.ValidateServer(server); err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		server.ManagedBy = FILE
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+/*
+loadFile
+Reads a file of the directory and creates its servers, unless its content didn't change.
+On error the servers of the previous content are kept.
+*/
+func (f *FileProvider) loadFile(name string) error {
+	data, err := os.ReadFile(filepath.Join(f.directory, name))
+	if err != nil {
+		return err
+	}
+	if loaded, exists := f.files[name]; exists && bytes.Equal(loaded.content, data) {
+		return nil
+	}
+	content, err := parseServersFile(name, data)
+	if err != nil {
+		return err
+	}
+	servers, err := f.desiredServers(content)
+	if err != nil {
+		return err
+	}
+	f.files[name] = &loadedFile{content: data, pool: content.Pool, servers: servers}
+	return nil
+}
+
+func parseServersFile(name string, data []byte) (*serversFile, error) {
+	content := &serversFile{}
+	var err error
+	if filepath.Ext(name) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(content)
+	} else {
+		err = yaml.UnmarshalStrict(data, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func (f *FileProvider) ignore(name string, reason string) {
+	if f.ignored[name] != reason {
+		f.ignored[name] = reason
+		log.Printf("File discovery - File %s ignored: %s\n", name, reason)
+	}
+}
+
+func (f *FileProvider) notifySave() {
+	if f.saveConfig == nil {
+		return
+	}
+	select {
+	case f.saveConfig <- true:
+	default:
+	}
+}
@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"context"
+	"continuity/common"
+	"continuity/server/loadbalancer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFileProvider(t *testing.T) (*FileProvider, string, *loadbalancer.Pool) {
+	lb, err := loadbalancer.NewLoadBalancer([]*loadbalancer.Listener{{Name: loadbalancer.DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lb.Shutdown(context.Background()) })
+	pool := loadbalancer.NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	require.NoError(t, lb.AddPool(pool))
+	directory := t.TempDir()
+	provider, err := NewFileProvider(lb, directory, time.Minute, nil)
+	require.NoError(t, err)
+	return provider, directory, pool
+}
+
+func writeServersFile(t *testing.T, directory string, name string, content string) {
+	require.NoError(t, os.WriteFile(filepath.Join(directory, name), []byte(content), 0644))
+}
+
+func TestFileProvider_Sync(t *testing.T) {
+	provider, directory, pool := newTestFileProvider(t)
+	writeServersFile(t, directory, "web.yaml", `
+pool: app.lab
+servers:
+  - address: http://127.0.0.1:8080
+  - address: http://127.0.0.2:8080
+    healthcheckpath: /ready
+`)
+	writeServersFile(t, directory, "other.json", `{"pool": "other.lab", "servers": [{"address": "http://127.0.0.3:8080"}]}`)
+	writeServersFile(t, directory, ".web.yaml.swp", "not yaml")
+	require.NoError(t, provider.Sync())
+
+	servers := pool.GetServers()
+	require.Len(t, servers, 2)
+	assert.Equal(t, "http://127.0.0.1:8080", servers[0].Address.String())
+	assert.Equal(t, DEFAULT_FILE_HEALTH_CHECK_PATH, servers[0].HealthCheckPath)
+	assert.Equal(t, "/ready", servers[1].HealthCheckPath)
+	for _, server := range servers {
+		assert.Equal(t, FILE, server.ManagedBy)
+		assert.Equal(t, uint32(loadbalancer.Pending), server.ServerStatus.Load())
+	}
+	assert.Equal(t, map[string]string{"other.json": "pool other.lab does not exist"}, provider.ignored)
+	kept := servers[0]
+
+	// nothing changed
+	require.NoError(t, provider.Sync())
+	require.Len(t, pool.GetServers(), 2)
+	assert.Equal(t, kept.Id, pool.GetServers()[0].Id)
+
+	// a server removed by hand is added again
+	_, err := pool.RemoveServer(servers[1].Id)
+	require.NoError(t, err)
+	require.NoError(t, provider.Sync())
+	require.Len(t, pool.GetServers(), 2)
+	assert.NotEqual(t, servers[1].Id, pool.GetServers()[1].Id)
+	assert.Equal(t, uint32(loadbalancer.Pending), pool.GetServers()[1].ServerStatus.Load())
+
+	// a broken file keeps the servers it declared
+	writeServersFile(t, directory, "web.yaml", "pool: app.lab\nservers:\n  - adress: http://127.0.0.1:8080\n")
+	require.NoError(t, provider.Sync())
+	assert.Len(t, pool.GetServers(), 2)
+	assert.Contains(t, provider.ignored, "web.yaml")
+
+	// a server removed from the file is drained, then removed
+	writeServersFile(t, directory, "web.yaml", "pool: app.lab\nservers:\n  - address: http://127.0.0.1:8080\n")
+	require.NoError(t, provider.Sync())
+	assert.NotContains(t, provider.ignored, "web.yaml")
+	assert.Eventually(t, func() bool { return len(pool.GetServers()) == 1 }, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, kept.Id, pool.GetServers()[0].Id)
+
+	// removing the file drains its servers
+	require.NoError(t, os.Remove(filepath.Join(directory, "web.yaml")))
+	require.NoError(t, provider.Sync())
+	assert.Eventually(t, func() bool { return len(pool.GetServers()) == 0 }, 2*time.Second, 20*time.Millisecond)
+	assert.Empty(t, provider.files)
+}
+
+func TestFileProvider_ReplacesChangedServer(t *testing.T) {
+	provider, directory, pool := newTestFileProvider(t)
+	address := "http://127.0.0.1:" + backendPort(t)
+	writeServersFile(t, directory, "web.yaml", "pool: app.lab\nservers:\n  - address: "+address+"\n")
+	require.NoError(t, provider.Sync())
+	require.Len(t, pool.GetServers(), 1)
+	previous := pool.GetServers()[0]
+	previous.SetHealty()
+
+	writeServersFile(t, directory, "web.yaml", "pool: app.lab\nservers:\n  - address: "+address+"\n    healthcheckpath: /ready\n")
+	require.NoError(t, provider.Sync())
+	// a running transaction is not started again, the previous server keeps serving
+	require.NoError(t, provider.Sync())
+	provider.mutex.Lock()
+	assert.Len(t, provider.replacing, 1)
+	provider.mutex.Unlock()
+	assert.Equal(t, uint32(loadbalancer.Healthy), previous.ServerStatus.Load())
+
+	assert.Eventually(t, func() bool {
+		servers := pool.GetServers()
+		return len(servers) == 1 && servers[0].Id != previous.Id && servers[0].HealthCheckPath == "/ready" &&
+			servers[0].ServerStatus.Load() == uint32(loadbalancer.Healthy)
+	}, 5*time.Second, 50*time.Millisecond)
+	replacement := pool.GetServers()[0]
+	assert.Eventually(t, func() bool {
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+		return len(provider.replacing) == 0
+	}, time.Second, 20*time.Millisecond)
+	require.NoError(t, provider.Sync())
+	require.Len(t, pool.GetServers(), 1)
+	assert.Same(t, replacement, pool.GetServers()[0])
+}
+
+func TestFileProvider_TakesOverSavedServers(t *testing.T) {
+	provider, directory, pool := newTestFileProvider(t)
+	writeServersFile(t, directory, "web.yml", "pool: app.lab\nservers:\n  - address: http://127.0.0.1:8080\n")
+	saved, err := loadbalancer.NewServerHost("http://127.0.0.1:8080", DEFAULT_FILE_HEALTH_CHECK_PATH, common.Condition{})
+	require.NoError(t, err)
+	saved.ManagedBy = FILE
+	stale, err := loadbalancer.NewServerHost("http://127.0.0.9:8080", DEFAULT_FILE_HEALTH_CHECK_PATH, common.Condition{})
+	require.NoError(t, err)
+	stale.ManagedBy = FILE
+	static, err := loadbalancer.NewServerHost("http://127.0.0.10:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	for _, server := range []*loadbalancer.ServerHost{saved, stale, static} {
+		pool.AddServer(server)
+	}
+
+	require.NoError(t, provider.Sync())
+	assert.Eventually(t, func() bool { return len(pool.GetServers()) == 2 }, 2*time.Second, 20*time.Millisecond)
+	servers := pool.GetServers()
+	assert.Equal(t, saved.Id, servers[0].Id)
+	assert.Equal(t, static.Id, servers[1].Id)
+}
+
+func TestNewFileProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "servers.yaml")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	_, err := NewFileProvider(nil, "", 0, nil)
+	assert.EqualError(t, err, "directory is required")
+	_, err = NewFileProvider(nil, file, 0, nil)
+	assert.EqualError(t, err, file+" is not a directory")
+	_, err = NewFileProvider(nil, filepath.Join(t.TempDir(), "missing"), 0, nil)
+	assert.Error(t, err)
+	provider, err := NewFileProvider(nil, filepath.Dir(file), 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, DEFAULT_FILE_REFRESH_INTERVAL, provider.refreshInterval)
+}
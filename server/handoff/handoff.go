@@ -0,0 +1,301 @@
+/*
+Package handoff passes the listening sockets from an old to a new server process, for zero-downtime restarts.
+The old process starts the new one handing over the sockets as inherited file descriptors, waits until the new
+process reports it is ready and then shuts down gracefully: the sockets are never closed, so no connection is
+refused during the restart.
+*/
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ENV_INHERITED_LISTENERS = "CONTINUITY_INHERITED_LISTENERS"
+const ENV_READY_FD = "CONTINUITY_HANDOFF_READY_FD"
+
+// ENV_NOTIFY_SOCKET is set by systemd for Type=notify services
+const ENV_NOTIFY_SOCKET = "NOTIFY_SOCKET"
+
+// UDP_PREFIX distinguishes UDP sockets from TCP listeners bound to the same address
+const UDP_PREFIX = "udp:"
+
+// socket is a TCP listener or a UDP socket that can be handed over
+type socket interface {
+	File() (*os.File, error)
+}
+
+var listeners = map[string]socket{}
+var listenersMutex sync.Mutex
+
+/*
+Listen
+Returns a TCP listener on the address, taking it over from the parent process if it was inherited.
+The listener is remembered to be passed to the next process on Restart.
+*/
+func Listen(address string) (net.Listener, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	var listener net.Listener
+	var err error
+	if fd, ok := inheritedListeners()[address]; ok {
+		file := os.NewFile(uintptr(fd), address)
+		listener, err = net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using inherited listener for %s: %w", address, err)
+		}
+		log.Println("Using listener inherited from previous process for", address)
+	} else {
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		listeners[address] = tcpListener
+	}
+	return listener, nil
+}
+
+/*
+Share
+Returns a new listener on the socket of a TCP listener, which keeps accepting connections once that listener is
+closed. The new listener is remembered to be passed to the next process on Restart instead.
+*/
+func Share(address string, listener *net.TCPListener) (net.Listener, error) {
+	file, err := listener.File()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := net.FileListener(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	if tcpListener, ok := shared.(*net.TCPListener); ok {
+		listeners[address] = tcpListener
+	}
+	return shared, nil
+}
+
+/*
+ListenPacket
+Returns a UDP socket bound to the address, taking it over from the parent process if it was inherited.
+The socket is remembered to be passed to the next process on Restart.
+*/
+func ListenPacket(address string) (*net.UDPConn, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	var conn *net.UDPConn
+	if fd, ok := inheritedListeners()[UDP_PREFIX+address]; ok {
+		file := os.NewFile(uintptr(fd), address)
+		packetConn, err := net.FilePacketConn(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using inherited socket for %s: %w", address, err)
+		}
+		udpConn, isUDP := packetConn.(*net.UDPConn)
+		if !isUDP {
+			_ = packetConn.Close()
+			return nil, fmt.Errorf("inherited socket for %s is not a UDP socket", address)
+		}
+		conn = udpConn
+		log.Println("Using UDP socket inherited from previous process for", address)
+	} else {
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listeners[UDP_PREFIX+address] = conn
+	return conn, nil
+}
+
+/*
+Forget
+Stops handing over the TCP listener on the address, which the caller has closed.
+*/
+func Forget(address string) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	delete(listeners, address)
+}
+
+/*
+ForgetPacket
+Stops handing over the UDP socket on the address, which the caller has closed.
+*/
+func ForgetPacket(address string) {
+	Forget(UDP_PREFIX + address)
+}
+
+func inheritedListeners() map[string]int {
+	inherited := map[string]int{}
+	for _, entry := range strings.Split(os.Getenv(ENV_INHERITED_LISTENERS), ",") {
+		address, fd, found := strings.Cut(entry, "=")
+		if !found {
+			continue
+		}
+		if parsed, err := strconv.Atoi(fd); err == nil {
+			inherited[address] = parsed
+		}
+	}
+	return inherited
+}
+
+/*
+Ready
+Tells the parent process, if any, that this process is serving and the parent can shut down.
+systemd is told first that this process is the main one of the service, so that it doesn't restart the service
+when the parent exits.
+*/
+func Ready() {
+	notifySystemd(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	value := os.Getenv(ENV_READY_FD)
+	if value == "" {
+		return
+	}
+	_ = os.Unsetenv(ENV_READY_FD)
+	_ = os.Unsetenv(ENV_INHERITED_LISTENERS)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "handoff-ready")
+	_, _ = pipe.Write([]byte{1})
+	_ = pipe.Close()
+}
+
+/*
+Restart
+Starts a new copy of the current executable, with the same arguments, handing over every listener.
+It returns once the new process is ready; if it fails to start, exits or doesn't get ready within the timeout
+it is killed and an error is returned, so the current process can keep serving.
+*/
+func Restart(timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = readyReader.Close() }()
+
+	listenersMutex.Lock()
+	addresses := make([]string, 0, len(listeners))
+	for address := range listeners {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	files := make([]*os.File, 0, len(addresses)+1)
+	inherited := make([]string, 0, len(addresses))
+	closeFiles := func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}
+	for i, address := range addresses {
+		// File returns a duplicate of the socket, the listener keeps accepting connections
+		file, err := listeners[address].File()
+		if err != nil {
+			listenersMutex.Unlock()
+			closeFiles()
+			_ = readyWriter.Close()
+			return nil, fmt.Errorf("error handing over listener %s: %w", address, err)
+		}
+		files = append(files, file)
+		// ExtraFiles are numbered from 3 in the new process
+		inherited = append(inherited, address+"="+strconv.Itoa(3+i))
+	}
+	listenersMutex.Unlock()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(ENV_INHERITED_LISTENERS, ENV_READY_FD),
+		ENV_INHERITED_LISTENERS+"="+strings.Join(inherited, ","),
+		ENV_READY_FD+"="+strconv.Itoa(3+len(files)-1),
+	)
+	err = cmd.Start()
+	// the new process has its own copies, the ready pipe must be closed here to detect its exit
+	closeFiles()
+	if err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	_ = readyReader.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1)
+	if _, err := readyReader.Read(buffer); err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errors.New("new process did not get ready in time")
+		}
+		return nil, errors.New("new process exited before getting ready")
+	}
+	return cmd.Process, nil
+}
+
+/*
+notifySystemd
+Sends a state to systemd when running as a Type=notify service. The new process of a restart is not the main
+process of the service, NotifyAccess=all is required for its notifications to be accepted.
+*/
+func notifySystemd(state string) {
+	socket := os.Getenv(ENV_NOTIFY_SOCKET)
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Println("Error notifying systemd:", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("Error notifying systemd:", err)
+	}
+}
+
+func environWithout(names ...string) []string {
+	environ := []string{}
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		excluded := false
+		for _, excludedName := range names {
+			if name == excludedName {
+				excluded = true
+			}
+		}
+		if !excluded {
+			environ = append(environ, entry)
+		}
+	}
+	return environ
+}
@@ -0,0 +1,109 @@
+package handoff
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen_InheritedListener(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer original.Close()
+	file, err := original.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+
+	address := original.Addr().String()
+	t.Setenv(ENV_INHERITED_LISTENERS, "127.0.0.1:1=1000,"+address+"="+strconv.Itoa(int(file.Fd())))
+	listener, err := Listen(address)
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, address, listener.Addr().String())
+
+	go func() {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	_ = conn.Close()
+	// the socket is kept to be handed over to the next process
+	assert.Contains(t, listeners, address)
+}
+
+func TestListenPacket_InheritedSocket(t *testing.T) {
+	original, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer original.Close()
+	file, err := original.File()
+	require.NoError(t, err)
+	defer file.Close()
+
+	address := original.LocalAddr().String()
+	t.Setenv(ENV_INHERITED_LISTENERS, address+"=1000,"+UDP_PREFIX+address+"="+strconv.Itoa(int(file.Fd())))
+	conn, err := ListenPacket(address)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, address, conn.LocalAddr().String())
+
+	client, err := net.Dial("udp", address)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 16)
+	n, _, err := conn.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buffer[:n]))
+	assert.Contains(t, listeners, UDP_PREFIX+address)
+
+	ForgetPacket(address)
+	assert.NotContains(t, listeners, UDP_PREFIX+address)
+}
+
+func TestReady_NotifiesParent(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	defer reader.Close()
+	t.Setenv(ENV_READY_FD, strconv.Itoa(int(writer.Fd())))
+
+	Ready()
+	buffer := make([]byte, 1)
+	n, err := reader.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, os.Getenv(ENV_READY_FD))
+}
+
+func TestReady_NotifiesSystemd(t *testing.T) {
+	dir, err := os.MkdirTemp("", "notify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	address := &net.UnixAddr{Name: filepath.Join(dir, "notify.sock"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv(ENV_NOTIFY_SOCKET, address.Name)
+	t.Setenv(ENV_READY_FD, "")
+
+	Ready()
+	buffer := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1\nMAINPID="+strconv.Itoa(os.Getpid()), string(buffer[:n]))
+}
+
+func TestReady_NoParent(t *testing.T) {
+	t.Setenv(ENV_READY_FD, "")
+	Ready()
+}
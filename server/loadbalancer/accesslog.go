@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+responseRecorder
+Keeps track of the status code and size of a response for the access log.
+Unwrap lets the reverse proxy reach the Flusher / Hijacker of the underlying ResponseWriter.
+*/
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+func logAccess(pool *Pool, server *ServerHost, req *http.Request, rr *responseRecorder, start time.Time) {
+	backend := "-"
+	if server != nil {
+		backend = server.Address.String()
+	}
+	log.Printf("Pool %s - %s \"%s %s %s\" %d %d %s -> %s request_id=%s\n",
+		pool.Hostname,
+		getHostFromRequest(req),
+		req.Method,
+		req.RequestURI,
+		req.Proto,
+		rr.status,
+		rr.size,
+		time.Since(start).Round(time.Millisecond),
+		backend,
+		getRequestId(req))
+}
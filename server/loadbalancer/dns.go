@@ -0,0 +1,258 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const DEFAULT_DNS_TIMEOUT = 5 * time.Second
+
+// DEFAULT_NAMESERVER is used when /etc/resolv.conf has no nameserver
+const DEFAULT_NAMESERVER = "127.0.0.1:53"
+
+const DNS_UDP_BUFFER_SIZE = 4096
+
+/*
+dnsRecord
+An address resolved from DNS, with the TTL of the records it was resolved from.
+*/
+type dnsRecord struct {
+	ip  net.IP
+	ttl time.Duration
+}
+
+/*
+dnsTarget
+A target of an SRV record, with the TTL of the records it was resolved from.
+*/
+type dnsTarget struct {
+	host string
+	port uint16
+	ttl  time.Duration
+}
+
+/*
+dnsResolver
+A minimal DNS client querying a single nameserver. The resolver of the standard library hides the TTLs of the
+records, which are needed to know when to resolve again.
+*/
+type dnsResolver struct {
+	nameserver string
+	timeout    time.Duration
+}
+
+/*
+newDnsResolver
+Creates a resolver querying the given nameserver, host or host:port. An empty nameserver uses the first
+nameserver of /etc/resolv.conf.
+*/
+func newDnsResolver(nameserver string) (*dnsResolver, error) {
+	if nameserver == "" {
+		nameserver = systemNameserver()
+	}
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(strings.Trim(nameserver, "[]"), "53")
+	}
+	if _, port, err := net.SplitHostPort(nameserver); err != nil || port == "" {
+		return nil, fmt.Errorf("invalid nameserver %s", nameserver)
+	}
+	return &dnsResolver{nameserver: nameserver, timeout: DEFAULT_DNS_TIMEOUT}, nil
+}
+
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return DEFAULT_NAMESERVER
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return DEFAULT_NAMESERVER
+}
+
+/*
+lookupIP
+Returns the A and AAAA records of the name. A name without records is an error.
+*/
+func (r *dnsResolver) lookupIP(ctx context.Context, name string) ([]dnsRecord, error) {
+	records := []dnsRecord{}
+	for _, recordType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, _, err := r.query(ctx, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		for _, answer := range answers {
+			if ip := resourceIP(answer); ip != nil {
+				records = append(records, dnsRecord{ip: ip, ttl: resourceTTL(answer)})
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no A or AAAA records found for %s", name)
+	}
+	return records, nil
+}
+
+/*
+lookupSRV
+Returns the SRV records of the name with the lowest priority, the others are only used by clients when all of
+them are unreachable. The addresses of the targets sent along the answer are returned too.
+*/
+func (r *dnsResolver) lookupSRV(ctx context.Context, name string) ([]dnsTarget, map[string][]dnsRecord, error) {
+	answers, additionals, err := r.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := []dnsTarget{}
+	lowest := uint16(0)
+	for _, answer := range answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		if len(targets) == 0 || srv.Priority < lowest {
+			targets = targets[:0]
+			lowest = srv.Priority
+		}
+		if srv.Priority == lowest {
+			targets = append(targets, dnsTarget{host: srv.Target.String(), port: srv.Port, ttl: resourceTTL(answer)})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("no SRV records found for %s", name)
+	}
+	addresses := map[string][]dnsRecord{}
+	for _, additional := range additionals {
+		if ip := resourceIP(additional); ip != nil {
+			host := additional.Header.Name.String()
+			addresses[host] = append(addresses[host], dnsRecord{ip: ip, ttl: resourceTTL(additional)})
+		}
+	}
+	return targets, addresses, nil
+}
+
+/*
+query
+Sends a query to the nameserver over UDP, and again over TCP when the answer is truncated.
+A name that doesn't exist has no answers.
+*/
+func (r *dnsResolver) query(ctx context.Context, name string, recordType dnsmessage.Type) ([]dnsmessage.Resource, []dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	queryName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: queryName, Type: recordType, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	response, err := r.exchange(ctx, "udp", packed)
+	if err == nil && response.Header.Truncated {
+		response, err = r.exchange(ctx, "tcp", packed)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Header.ID != id || !response.Header.Response {
+		return nil, nil, errors.New("invalid answer from nameserver " + r.nameserver)
+	}
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("nameserver %s answered %s for %s", r.nameserver, response.Header.RCode, name)
+	}
+	answers := []dnsmessage.Resource{}
+	for _, answer := range response.Answers {
+		// answers can start with the CNAME records leading to the name having the records
+		if answer.Header.Type == recordType {
+			answers = append(answers, answer)
+		}
+	}
+	return answers, response.Additionals, nil
+}
+
+func (r *dnsResolver) exchange(ctx context.Context, network string, packed []byte) (*dnsmessage.Message, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, r.nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	var buffer []byte
+	if network == "tcp" {
+		// messages over TCP are prefixed with their length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buffer = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buffer = make([]byte, DNS_UDP_BUFFER_SIZE)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		buffer = buffer[:n]
+	}
+	response := &dnsmessage.Message{}
+	if err := response.Unpack(buffer); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func resourceIP(resource dnsmessage.Resource) net.IP {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:])
+	}
+	return nil
+}
+
+func resourceTTL(resource dnsmessage.Resource) time.Duration {
+	return time.Duration(resource.Header.TTL) * time.Second
+}
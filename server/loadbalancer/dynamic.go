@@ -0,0 +1,388 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/common"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ResolveMode_A ResolveMode = iota
+	ResolveMode_SRV
+)
+
+type ResolveMode int
+
+var ResolveModeName = map[ResolveMode]string{
+	ResolveMode_A:   "a",
+	ResolveMode_SRV: "srv",
+}
+
+func (m ResolveMode) String() string {
+	return ResolveModeName[m]
+}
+
+func GetResolveModeFromString(mode string) (ResolveMode, error) {
+	for k, v := range ResolveModeName {
+		if v == mode {
+			return k, nil
+		}
+	}
+	return -1, errors.New("No ResolveMode exists for value " + mode)
+}
+
+// DNS is the ManagedBy of the servers resolved by a dynamic server
+const DNS = "dns"
+
+// DNS_MIN_REFRESH and DNS_MAX_REFRESH bound the TTL of the records, names are resolved again when it expires
+const DNS_MIN_REFRESH = time.Second
+const DNS_MAX_REFRESH = 5 * time.Minute
+
+// DNS_RETRY_INTERVAL is the delay before resolving again after an error, the servers are kept meanwhile
+const DNS_RETRY_INTERVAL = 5 * time.Second
+
+/*
+DynamicServer
+A server whose address is a DNS name. The name is resolved while the pool is in the load balancer, and a
+server is added to the pool for each address, with its own health state. Servers are added and removed when the
+records change, and the name is resolved again when their TTL expires.
+With ResolveMode_A the A and AAAA records of the host are resolved, the port comes from the address.
+With ResolveMode_SRV the host is an SRV name, e.g. _http._tcp.app.internal, the ports come from the records.
+*/
+type DynamicServer struct {
+	Id              uuid.UUID
+	Address         *url.URL
+	Resolve         ResolveMode
+	Nameserver      string
+	Condition       common.Condition
+	HealthCheckPath string
+	Protocol        string
+	CreatedAt       int64
+	resolver        *dnsResolver
+	port            string
+	servers         map[string]*ServerHost
+	lastError       string
+	mutex           sync.Mutex
+	cancel          context.CancelFunc
+	done            chan struct{}
+}
+
+/*
+NewDynamicServer
+Creates a dynamic server resolving the host of the address with the given mode ("a" or "srv").
+An empty nameserver uses the first nameserver of /etc/resolv.conf.
+*/
+func NewDynamicServer(address string, resolve string, nameserver string, healthCheckPath string, condition common.Condition) (*DynamicServer, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := GetResolveModeFromString(resolve)
+	if err != nil {
+		return nil, errors.New("resolve must be a or srv")
+	}
+	if parsed.Hostname() == "" {
+		return nil, errors.New("address of a dynamic server must have a hostname to resolve")
+	}
+	if net.ParseIP(parsed.Hostname()) != nil {
+		return nil, fmt.Errorf("%s is an IP address, there is nothing to resolve", parsed.Hostname())
+	}
+	port := parsed.Port()
+	if mode == ResolveMode_SRV && port != "" {
+		return nil, errors.New("the ports of srv servers come from the SRV records, the address cannot have one")
+	}
+	if mode == ResolveMode_A && port == "" {
+		switch parsed.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return nil, fmt.Errorf("a port is required to resolve %s", address)
+		}
+	}
+	resolver, err := newDnsResolver(nameserver)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamicServer{
+		Id:              uuid.New(),
+		Address:         parsed,
+		Resolve:         mode,
+		Nameserver:      nameserver,
+		Condition:       condition,
+		HealthCheckPath: healthCheckPath,
+		CreatedAt:       time.Now().Unix(),
+		resolver:        resolver,
+		port:            port,
+		servers:         map[string]*ServerHost{},
+	}, nil
+}
+
+/*
+SetProtocol
+Sets the protocol of the resolved servers, see ServerHost.SetProtocol.
+*/
+func (ds *DynamicServer) SetProtocol(protocol string) error {
+	if err := validateProtocol(protocol, ds.Address.Scheme); err != nil {
+		return err
+	}
+	ds.Protocol = protocol
+	return nil
+}
+
+/*
+GetServers
+Returns the servers resolved from the name, sorted by address.
+*/
+func (ds *DynamicServer) GetServers() []*ServerHost {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	addresses := []string{}
+	for address := range ds.servers {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	servers := []*ServerHost{}
+	for _, address := range addresses {
+		servers = append(servers, ds.servers[address])
+	}
+	return servers
+}
+
+/*
+LastError
+Returns the error of the last resolution, empty if it succeeded.
+*/
+func (ds *DynamicServer) LastError() string {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.lastError
+}
+
+/*
+newServer
+Creates the server of one resolved address, host:port.
+*/
+func (ds *DynamicServer) newServer(hostPort string) (*ServerHost, error) {
+	address := *ds.Address
+	address.Host = hostPort
+	server, err := NewServerHost(address.String(), ds.HealthCheckPath, ds.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.SetProtocol(ds.Protocol); err != nil {
+		return nil, err
+	}
+	server.ManagedBy = DNS
+	return server, nil
+}
+
+func (ds *DynamicServer) start(p *Pool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ds.cancel = cancel
+	ds.done = make(chan struct{})
+	go ds.run(ctx, p, ds.done)
+}
+
+/*
+stop
+Stops resolving the name and waits for a resolution in progress, the servers stay in the pool.
+*/
+func (ds *DynamicServer) stop() {
+	if ds.cancel == nil {
+		return
+	}
+	ds.cancel()
+	<-ds.done
+	ds.cancel = nil
+}
+
+func (ds *DynamicServer) run(ctx context.Context, p *Pool, done chan struct{}) {
+	defer close(done)
+	for {
+		refresh := ds.refresh(ctx, p)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refresh):
+		}
+	}
+}
+
+/*
+refresh
+Resolves the name and syncs the servers of the pool with the addresses.
+Returns the delay before the next resolution: the lowest TTL of the records, or DNS_RETRY_INTERVAL after an error.
+*/
+func (ds *DynamicServer) refresh(ctx context.Context, p *Pool) time.Duration {
+	addresses, ttl, err := ds.resolve(ctx)
+	if ctx.Err() != nil {
+		return 0
+	}
+	if err != nil {
+		ds.mutex.Lock()
+		ds.lastError = err.Error()
+		ds.mutex.Unlock()
+		log.Printf("Pool %s - Error resolving %s, servers are kept until it succeeds: %v\n", p.Hostname, ds.Address.Hostname(), err)
+		return DNS_RETRY_INTERVAL
+	}
+	ds.sync(p, addresses)
+	return min(max(ttl, DNS_MIN_REFRESH), DNS_MAX_REFRESH)
+}
+
+/*
+resolve
+Returns the host:port addresses the name resolves to, and the lowest TTL of the records.
+*/
+func (ds *DynamicServer) resolve(ctx context.Context) ([]string, time.Duration, error) {
+	addresses := []string{}
+	ttl := DNS_MAX_REFRESH
+	add := func(records []dnsRecord, port string) {
+		for _, record := range records {
+			address := net.JoinHostPort(record.ip.String(), port)
+			if !slices.Contains(addresses, address) {
+				addresses = append(addresses, address)
+			}
+			ttl = min(ttl, record.ttl)
+		}
+	}
+	if ds.Resolve == ResolveMode_A {
+		records, err := ds.resolver.lookupIP(ctx, ds.Address.Hostname())
+		if err != nil {
+			return nil, 0, err
+		}
+		add(records, ds.port)
+		return addresses, ttl, nil
+	}
+	targets, additionals, err := ds.resolver.lookupSRV(ctx, ds.Address.Hostname())
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, target := range targets {
+		ttl = min(ttl, target.ttl)
+		records, ok := additionals[target.host]
+		if !ok {
+			records, err = ds.resolver.lookupIP(ctx, target.host)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		add(records, fmt.Sprint(target.port))
+	}
+	return addresses, ttl, nil
+}
+
+/*
+sync
+Adds a server to the pool for each new address and removes the servers of the addresses that are gone.
+Servers removed from the pool by hand are added again.
+*/
+func (ds *DynamicServer) sync(p *Pool, addresses []string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.lastError = ""
+	for address, server := range ds.servers {
+		if !slices.Contains(addresses, address) {
+			_, _ = p.RemoveServer(server.Id)
+			delete(ds.servers, address)
+			log.Printf("Pool %s - Server %s removed, %s no longer resolves to it\n", p.Hostname, server.Address.String(), ds.Address.Hostname())
+		}
+	}
+	for _, address := range addresses {
+		if server, exists := ds.servers[address]; exists && p.CheckServerUUID(server.Id) {
+			continue
+		}
+		server, err := ds.newServer(address)
+		if err != nil {
+			log.Printf("Pool %s - Error adding server %s resolved from %s: %v\n", p.Hostname, address, ds.Address.Hostname(), err)
+			continue
+		}
+		p.AddServer(server)
+		ds.servers[address] = server
+		log.Printf("Pool %s - Server %s added, resolved from %s\n", p.Hostname, server.Address.String(), ds.Address.Hostname())
+	}
+}
+
+/*
+ValidateDynamicServer
+Checks that the servers resolved by the dynamic server can be added to the pool, see ValidateServer.
+*/
+func (p *Pool) ValidateDynamicServer(ds *DynamicServer) error {
+	port := ds.port
+	if port == "" {
+		port = "0"
+	}
+	server, err := ds.newServer(net.JoinHostPort(ds.Address.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return p.ValidateServer(server)
+}
+
+/*
+AddDynamicServer
+Adds a dynamic server to the pool, its name is resolved while the pool is in the load balancer.
+*/
+func (p *Pool) AddDynamicServer(ds *DynamicServer) {
+	p.dynamicMutex.Lock()
+	defer p.dynamicMutex.Unlock()
+	p.dynamicServers = append(p.dynamicServers, ds)
+	if p.dynamicRunning {
+		ds.start(p)
+	}
+}
+
+/*
+RemoveDynamicServer
+Removes a dynamic server and the servers it resolved from the pool.
+*/
+func (p *Pool) RemoveDynamicServer(id uuid.UUID) (*DynamicServer, error) {
+	p.dynamicMutex.Lock()
+	index := slices.IndexFunc(p.dynamicServers, func(ds *DynamicServer) bool { return ds.Id == id })
+	if index == -1 {
+		p.dynamicMutex.Unlock()
+		return nil, errors.New("dynamic server not found in pool")
+	}
+	ds := p.dynamicServers[index]
+	p.dynamicServers = slices.Delete(p.dynamicServers, index, index+1)
+	ds.stop()
+	p.dynamicMutex.Unlock()
+	for _, server := range ds.GetServers() {
+		_, _ = p.RemoveServer(server.Id)
+	}
+	return ds, nil
+}
+
+func (p *Pool) GetDynamicServers() []*DynamicServer {
+	p.dynamicMutex.Lock()
+	defer p.dynamicMutex.Unlock()
+	return slices.Clone(p.dynamicServers)
+}
+
+func (p *Pool) startDynamicServers() {
+	p.dynamicMutex.Lock()
+	defer p.dynamicMutex.Unlock()
+	p.dynamicRunning = true
+	for _, ds := range p.dynamicServers {
+		ds.start(p)
+	}
+}
+
+func (p *Pool) stopDynamicServers() {
+	p.dynamicMutex.Lock()
+	defer p.dynamicMutex.Unlock()
+	p.dynamicRunning = false
+	for _, ds := range p.dynamicServers {
+		ds.stop()
+	}
+}
@@ -0,0 +1,205 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/common"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+dnsStub
+A nameserver answering with records that tests can change.
+*/
+type dnsStub struct {
+	address     string
+	records     []dnsmessage.Resource
+	additionals []dnsmessage.Resource
+	rcode       dnsmessage.RCode
+	mutex       sync.Mutex
+}
+
+func newDnsStub(t *testing.T) *dnsStub {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	stub := &dnsStub{address: conn.LocalAddr().String()}
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			answer := stub.answer(query)
+			response, err := answer.Pack()
+			require.NoError(t, err)
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+	return stub
+}
+
+func (s *dnsStub) answer(query dnsmessage.Message) dnsmessage.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	question := query.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RCode: s.rcode},
+		Questions: query.Questions,
+	}
+	for _, record := range s.records {
+		if record.Header.Name == question.Name && record.Header.Type == question.Type {
+			response.Answers = append(response.Answers, record)
+		}
+	}
+	if question.Type == dnsmessage.TypeSRV {
+		response.Additionals = s.additionals
+	}
+	return response
+}
+
+func (s *dnsStub) set(records ...dnsmessage.Resource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+	s.rcode = dnsmessage.RCodeSuccess
+}
+
+func (s *dnsStub) fail() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rcode = dnsmessage.RCodeServerFailure
+}
+
+func dnsHeader(name string, recordType dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: recordType, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func aRecord(name string, ip string, ttl uint32) dnsmessage.Resource {
+	body := &dnsmessage.AResource{}
+	copy(body.A[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: dnsHeader(name, dnsmessage.TypeA, ttl), Body: body}
+}
+
+func aaaaRecord(name string, ip string, ttl uint32) dnsmessage.Resource {
+	body := &dnsmessage.AAAAResource{}
+	copy(body.AAAA[:], net.ParseIP(ip))
+	return dnsmessage.Resource{Header: dnsHeader(name, dnsmessage.TypeAAAA, ttl), Body: body}
+}
+
+func srvRecord(name string, priority uint16, port uint16, target string, ttl uint32) dnsmessage.Resource {
+	body := &dnsmessage.SRVResource{Priority: priority, Weight: 10, Port: port, Target: dnsmessage.MustNewName(target)}
+	return dnsmessage.Resource{Header: dnsHeader(name, dnsmessage.TypeSRV, ttl), Body: body}
+}
+
+func serverAddresses(servers []*ServerHost) []string {
+	addresses := []string{}
+	for _, server := range servers {
+		addresses = append(addresses, server.Address.String())
+	}
+	return addresses
+}
+
+func TestDynamicServer_FollowsRecords(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.set(aRecord("app.internal.", "127.0.0.1", 1), aRecord("app.internal.", "127.0.0.2", 1))
+	lb, err := NewLoadBalancer([]*Listener{{Name: DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lb.Shutdown(context.Background()) })
+	pool := NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	ds, err := NewDynamicServer("http://app.internal:8080", "a", stub.address, "/health", common.Condition{})
+	require.NoError(t, err)
+	require.NoError(t, pool.ValidateDynamicServer(ds))
+	pool.AddDynamicServer(ds)
+	// nothing is resolved until the pool is in the load balancer
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, pool.GetServers())
+
+	require.NoError(t, lb.AddPool(pool))
+	assert.Eventually(t, func() bool { return len(pool.GetServers()) == 2 }, 2*time.Second, 20*time.Millisecond)
+	assert.ElementsMatch(t, []string{"http://127.0.0.1:8080", "http://127.0.0.2:8080"}, serverAddresses(pool.GetServers()))
+	for _, server := range pool.GetServers() {
+		assert.Equal(t, DNS, server.ManagedBy)
+		assert.Equal(t, uint32(Pending), server.ServerStatus.Load())
+	}
+	kept := ds.GetServers()[1]
+
+	// the records are resolved again when their TTL expires
+	stub.set(aRecord("app.internal.", "127.0.0.2", 1))
+	assert.Eventually(t, func() bool { return len(pool.GetServers()) == 1 }, 3*time.Second, 20*time.Millisecond)
+	assert.Equal(t, kept.Id, pool.GetServers()[0].Id)
+
+	// servers are kept while the name can't be resolved
+	stub.fail()
+	assert.Eventually(t, func() bool { return ds.LastError() != "" }, 3*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{"http://127.0.0.2:8080"}, serverAddresses(pool.GetServers()))
+
+	_, err = pool.RemoveDynamicServer(ds.Id)
+	require.NoError(t, err)
+	assert.Empty(t, pool.GetServers())
+	assert.Empty(t, pool.GetDynamicServers())
+}
+
+func TestDynamicServer_ResolvesSRV(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.set(
+		srvRecord("_http._tcp.app.internal.", 10, 8080, "web-1.app.internal.", 30),
+		srvRecord("_http._tcp.app.internal.", 10, 8081, "web-2.app.internal.", 60),
+		srvRecord("_http._tcp.app.internal.", 20, 8080, "backup.app.internal.", 60),
+		aRecord("web-2.app.internal.", "10.0.0.2", 20),
+		aaaaRecord("web-2.app.internal.", "fd00::2", 60),
+	)
+	stub.mutex.Lock()
+	stub.additionals = []dnsmessage.Resource{aRecord("web-1.app.internal.", "10.0.0.1", 60)}
+	stub.mutex.Unlock()
+	ds, err := NewDynamicServer("http://_http._tcp.app.internal", "srv", stub.address, "/health", common.Condition{})
+	require.NoError(t, err)
+
+	addresses, ttl, err := ds.resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8081", "[fd00::2]:8081"}, addresses)
+	assert.Equal(t, 20*time.Second, ttl)
+
+	stub.set()
+	_, _, err = ds.resolve(context.Background())
+	assert.EqualError(t, err, "no SRV records found for _http._tcp.app.internal")
+}
+
+func TestNewDynamicServer(t *testing.T) {
+	testCases := []struct {
+		address string
+		resolve string
+		port    string
+		err     string
+	}{
+		{"http://app.internal", "a", "80", ""},
+		{"https://app.internal", "a", "443", ""},
+		{"tcp://db.internal:5432", "a", "5432", ""},
+		{"http://_http._tcp.app.internal", "srv", "", ""},
+		{"tcp://db.internal", "a", "", "a port is required to resolve tcp://db.internal"},
+		{"http://_http._tcp.app.internal:80", "srv", "", "the ports of srv servers come from the SRV records, the address cannot have one"},
+		{"http://10.0.0.1:8080", "a", "", "10.0.0.1 is an IP address, there is nothing to resolve"},
+		{"http://app.internal", "aaaa", "", "resolve must be a or srv"},
+	}
+	for _, tc := range testCases {
+		ds, err := NewDynamicServer(tc.address, tc.resolve, "127.0.0.1", "/health", common.Condition{})
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.address)
+			continue
+		}
+		require.NoError(t, err, tc.address)
+		assert.Equal(t, tc.port, ds.port, tc.address)
+		assert.Equal(t, "127.0.0.1:53", ds.resolver.nameserver)
+	}
+}
@@ -0,0 +1,194 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPContextKey struct{}
+
+/*
+SetTrustedProxies
+Sets the list of proxies (CIDRs or plain IPs) allowed to tell the load balancer the real client address
+via X-Forwarded-For / Forwarded headers. Requests coming from any other peer have those headers stripped.
+*/
+func (lb *LoadBalancer) SetTrustedProxies(proxies []string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		ipNet, err := parseCIDR(proxy)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	lb.trustedProxiesMutex.Lock()
+	defer lb.trustedProxiesMutex.Unlock()
+	lb.TrustedProxies = proxies
+	lb.trustedProxies = nets
+	return nil
+}
+
+func (lb *LoadBalancer) GetTrustedProxies() []string {
+	lb.trustedProxiesMutex.RLock()
+	defer lb.trustedProxiesMutex.RUnlock()
+	return lb.TrustedProxies
+}
+
+func parseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.New("invalid trusted proxy address: " + value)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, errors.New("invalid trusted proxy CIDR: " + value)
+	}
+	return ipNet, nil
+}
+
+func (lb *LoadBalancer) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	lb.trustedProxiesMutex.RLock()
+	defer lb.trustedProxiesMutex.RUnlock()
+	for _, ipNet := range lb.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+resolveClientIP
+Returns the address of the real client and whether the directly connected peer is a trusted proxy.
+The forwarding chain is walked from right to left, skipping trusted proxies: the first untrusted
+address is the client.
+*/
+func (lb *LoadBalancer) resolveClientIP(req *http.Request) (string, bool) {
+	peer := remoteHost(req.RemoteAddr)
+	peerIP := net.ParseIP(peer)
+	if !lb.isTrustedProxy(peerIP) {
+		return peer, false
+	}
+	var chain []string
+	if forwarded := req.Header.Values("Forwarded"); len(forwarded) > 0 {
+		chain = parseForwardedFor(forwarded)
+	} else {
+		for _, value := range req.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(entry))
+			}
+		}
+	}
+	client := peerIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(stripPort(chain[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !lb.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client.String(), true
+}
+
+func parseForwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(val, "\""))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// stripPort removes the optional port (and IPv6 brackets) from a forwarded node value.
+func stripPort(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.Index(node, ":")]
+	}
+	return node
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+/*
+setForwardedHeaders
+Sets X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and the RFC 7239 Forwarded header on the request sent
+to the backend. Incoming values are kept only if the peer is a trusted proxy.
+X-Forwarded-For is appended by the reverse proxy itself.
+*/
+func setForwardedHeaders(req *http.Request, clientIP string, trusted bool) {
+	if !trusted {
+		for _, header := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "Forwarded"} {
+			req.Header.Del(header)
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	req.Header.Set("X-Real-IP", clientIP)
+
+	element := "for=" + forwardedNode(remoteHost(req.RemoteAddr)) +
+		";host=" + forwardedValue(req.Host) +
+		";proto=" + proto
+	if existing := strings.Join(req.Header.Values("Forwarded"), ", "); existing != "" {
+		element = existing + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+func forwardedNode(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "\"[" + ip.String() + "]\""
+	}
+	return forwardedValue(host)
+}
+
+func forwardedValue(value string) string {
+	if strings.ContainsAny(value, ":[]\",; ") {
+		return "\"" + strings.ReplaceAll(value, "\"", "\\\"") + "\""
+	}
+	return value
+}
+
+func withClientIP(req *http.Request, clientIP string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientIPContextKey{}, clientIP))
+}
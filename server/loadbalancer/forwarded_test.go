@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClientIP_UntrustedPeerIgnoresHeaders(t *testing.T) {
+	lb := &LoadBalancer{}
+	require.NoError(t, lb.SetTrustedProxies([]string{"10.0.0.0/8"}))
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "192.168.1.20:51234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	ip, trusted := lb.resolveClientIP(req)
+	assert.False(t, trusted)
+	assert.Equal(t, "192.168.1.20", ip)
+}
+
+func TestResolveClientIP_IPv6RemoteAddr(t *testing.T) {
+	lb := &LoadBalancer{}
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "[2001:db8::1]:443"
+
+	ip, _ := lb.resolveClientIP(req)
+	assert.Equal(t, "2001:db8::1", ip)
+	assert.Equal(t, "2001:db8::1", getHostFromRequest(req))
+}
+
+func TestResolveClientIP_TrustedChain(t *testing.T) {
+	lb := &LoadBalancer{}
+	require.NoError(t, lb.SetTrustedProxies([]string{"10.0.0.0/8", "172.16.0.1"}))
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 172.16.0.1")
+
+	ip, trusted := lb.resolveClientIP(req)
+	assert.True(t, trusted)
+	assert.Equal(t, "1.2.3.4", ip)
+}
+
+func TestResolveClientIP_ForwardedHeader(t *testing.T) {
+	lb := &LoadBalancer{}
+	require.NoError(t, lb.SetTrustedProxies([]string{"10.0.0.2"}))
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set("Forwarded", `for="[2001:db8::7]:4711";proto=https`)
+
+	ip, _ := lb.resolveClientIP(req)
+	assert.Equal(t, "2001:db8::7", ip)
+}
+
+func TestSetTrustedProxies_Invalid(t *testing.T) {
+	lb := &LoadBalancer{}
+	assert.Error(t, lb.SetTrustedProxies([]string{"not-an-ip"}))
+	assert.Error(t, lb.SetTrustedProxies([]string{"10.0.0.0/99"}))
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "[2001:db8::1]:5555"
+	req.Header.Set("X-Forwarded-Host", "evil.lab")
+	req.Header.Set("Forwarded", "for=6.6.6.6")
+
+	setForwardedHeaders(req, "2001:db8::1", false)
+
+	assert.Equal(t, "http", req.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "app.lab", req.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "2001:db8::1", req.Header.Get("X-Real-IP"))
+	assert.Equal(t, `for="[2001:db8::1]";host=app.lab;proto=http`, req.Header.Get("Forwarded"))
+}
+
+func TestSetForwardedHeaders_TrustedAppends(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.RemoteAddr = "10.0.0.2:5555"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=1.2.3.4;proto=https")
+
+	setForwardedHeaders(req, "1.2.3.4", true)
+
+	assert.Equal(t, "https", req.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=1.2.3.4;proto=https, for=10.0.0.2;host=app.lab;proto=http", req.Header.Get("Forwarded"))
+}
@@ -0,0 +1,529 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/common"
+	"continuity/server/handoff"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PoolMode_HTTP PoolMode = iota
+	PoolMode_TCP
+	PoolMode_UDP
+	PoolMode_TLS
+)
+
+type PoolMode int
+
+var PoolModeName = map[PoolMode]string{
+	PoolMode_HTTP: "http",
+	PoolMode_TCP:  "tcp",
+	PoolMode_UDP:  "udp",
+	PoolMode_TLS:  "tls",
+}
+
+func (m PoolMode) String() string {
+	return PoolModeName[m]
+}
+
+/*
+GetPoolModeFromString
+Returns the pool mode with the given name, an empty name is an HTTP pool.
+*/
+func GetPoolModeFromString(mode string) (PoolMode, error) {
+	if mode == "" {
+		return PoolMode_HTTP, nil
+	}
+	for k, v := range PoolModeName {
+		if v == mode {
+			return k, nil
+		}
+	}
+	return -1, errors.New("No PoolMode exists for value " + mode)
+}
+
+const DEFAULT_LAYER4_DIAL_TIMEOUT = 10 * time.Second
+
+// DEFAULT_UDP_SESSION_TIMEOUT closes idle UDP sessions of pools without an upgrade idle timeout
+const DEFAULT_UDP_SESSION_TIMEOUT = 60 * time.Second
+
+const UDP_BUFFER_SIZE = 65535
+
+/*
+layer4Listener
+Accepts the TCP connections or UDP datagrams of a layer 4 pool on its own port.
+Connections to a server (for UDP, the socket of a client session) are tracked as upgraded connections of
+the server, so they are closed after the grace period when the server is removed and after the idle timeout.
+*/
+type layer4Listener struct {
+	address     string
+	listener    net.Listener
+	packetConn  *net.UDPConn
+	sessions    map[string]*udpSession
+	sessionsMux sync.Mutex
+	connections sync.WaitGroup
+	closed      atomic.Bool
+}
+
+type udpSession struct {
+	client     *net.UDPAddr
+	backend    net.Conn
+	server     *ServerHost
+	lastActive atomic.Int64
+}
+
+/*
+SetLayer4
+Makes the pool balance raw TCP streams or UDP datagrams received on its own listen port, instead of HTTP
+requests routed by hostname: the hostname is then only the name of the pool. TLS pools have no listen port,
+the listeners forward them the TLS connections whose SNI is the hostname, without decrypting them (see
+passthrough.go). Only IP sticky sessions and, for TCP and TLS, the backend PROXY protocol apply. It must be
+called once the other settings of the pool are set and before the pool is added to the load balancer.
+*/
+func (p *Pool) SetLayer4(mode PoolMode, listenPort int) error {
+	if mode != PoolMode_TCP && mode != PoolMode_UDP && mode != PoolMode_TLS {
+		return errors.New("layer 4 pool mode must be tcp, udp or tls")
+	}
+	if mode == PoolMode_TLS && listenPort != 0 {
+		return errors.New("tls pools are routed by SNI on the listeners, they have no listen port")
+	}
+	if mode != PoolMode_TLS && (listenPort <= 0 || listenPort > 65535) {
+		return errors.New("listen port must be between 1 and 65535")
+	}
+	if settings := p.stickySettings(); settings.Enabled && settings.Method != StickyMethod_IP {
+		return errors.New("only the IP sticky method is supported by " + mode.String() + " pools")
+	}
+	if mode == PoolMode_UDP && p.BackendProxyProtocol != 0 {
+		return errors.New("backend PROXY protocol is not supported by udp pools")
+	}
+	p.Mode = mode
+	p.ListenPort = listenPort
+	return nil
+}
+
+func (p *Pool) IsLayer4() bool {
+	return p.Mode != PoolMode_HTTP
+}
+
+/*
+serverScheme
+Returns the address scheme of the servers of a layer 4 pool, TLS connections are forwarded over TCP.
+*/
+func (p *Pool) serverScheme() string {
+	if p.Mode == PoolMode_TLS {
+		return PoolModeName[PoolMode_TCP]
+	}
+	return p.Mode.String()
+}
+
+/*
+ValidateServer
+Checks that a server can be added to the pool: servers of layer 4 pools have a tcp:// or udp:// address,
+matching the pool mode (tcp:// for TLS pools), with a port and no condition or protocol. Their health check is empty (a TCP connection,
+or for UDP a datagram that must not be refused) or a tcp://, http:// or https:// URL.
+*/
+func (p *Pool) ValidateServer(server *ServerHost) error {
+	scheme := server.Address.Scheme
+	if !p.IsLayer4() {
+		if scheme == PoolModeName[PoolMode_TCP] || scheme == PoolModeName[PoolMode_UDP] {
+			return errors.New(scheme + ":// servers can only be added to layer 4 pools")
+		}
+		if server.HealthCheckPath == "" {
+			return errors.New("health check path is required")
+		}
+		return nil
+	}
+	if scheme != p.serverScheme() {
+		return fmt.Errorf("servers of %s pools must have a %s:// address", p.Mode, p.serverScheme())
+	}
+	if server.Address.Hostname() == "" || server.Address.Port() == "" {
+		return fmt.Errorf("server address must be %s://host:port", p.serverScheme())
+	}
+	if server.Condition != (common.Condition{}) {
+		return errors.New("conditions are not supported by " + p.Mode.String() + " pools")
+	}
+	if server.Protocol != "" {
+		return errors.New("protocol is not supported by " + p.Mode.String() + " pools")
+	}
+	if server.HealthCheckPath != "" && !strings.HasPrefix(server.HealthCheckPath, "tcp://") &&
+		!strings.HasPrefix(server.HealthCheckPath, "http://") && !strings.HasPrefix(server.HealthCheckPath, "https://") {
+		return errors.New("health check of " + p.Mode.String() + " servers must be empty or a tcp://, http:// or https:// URL")
+	}
+	return nil
+}
+
+/*
+startLayer4
+Opens the listen port of a layer 4 pool on the given address and starts forwarding traffic.
+The socket is handed over to the new process on restart, like the main listener.
+TLS pools have no socket, their connections are accepted by the listeners.
+*/
+func (p *Pool) startLayer4(bindAddress string) error {
+	if p.Mode == PoolMode_TLS {
+		p.layer4.Store(&layer4Listener{})
+		log.Printf("Pool %s - Forwarding TLS connections with SNI %s\n", p.Hostname, p.Hostname)
+		return nil
+	}
+	address := net.JoinHostPort(bindAddress, fmt.Sprint(p.ListenPort))
+	l4 := &layer4Listener{address: address, sessions: map[string]*udpSession{}}
+	if p.Mode == PoolMode_TCP {
+		listener, err := handoff.Listen(address)
+		if err != nil {
+			return err
+		}
+		l4.listener = listener
+		go p.serveTCP(l4)
+	} else {
+		conn, err := handoff.ListenPacket(address)
+		if err != nil {
+			return err
+		}
+		l4.packetConn = conn
+		go p.serveUDP(l4)
+	}
+	p.layer4.Store(l4)
+	log.Printf("Pool %s - Forwarding %s traffic received on %s\n", p.Hostname, p.Mode, address)
+	return nil
+}
+
+/*
+stopLayer4
+Closes the listen port of a layer 4 pool. Established TCP connections are left open, UDP sessions are closed
+since their replies can't be sent anymore.
+*/
+func (p *Pool) stopLayer4() {
+	l4 := p.layer4.Load()
+	if l4 == nil || !l4.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if l4.listener != nil {
+		handoff.Forget(l4.address)
+		_ = l4.listener.Close()
+	}
+	if l4.packetConn != nil {
+		handoff.ForgetPacket(l4.address)
+		_ = l4.packetConn.Close()
+		l4.sessionsMux.Lock()
+		for _, session := range l4.sessions {
+			_ = session.backend.Close()
+		}
+		l4.sessionsMux.Unlock()
+	}
+}
+
+/*
+waitLayer4
+Waits for the TCP connections of a layer 4 pool to complete, until the context expires.
+*/
+func (p *Pool) waitLayer4(ctx context.Context) {
+	l4 := p.layer4.Load()
+	if l4 == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		l4.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (p *Pool) serveTCP(l4 *layer4Listener) {
+	for {
+		conn, err := l4.listener.Accept()
+		if err != nil {
+			if l4.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Pool %s - Error accepting connection: %v\n", p.Hostname, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		l4.connections.Add(1)
+		go func() {
+			defer l4.connections.Done()
+			p.proxyTCP(conn)
+		}()
+	}
+}
+
+func (p *Pool) proxyTCP(conn net.Conn) {
+	server, err := p.chooseLayer4Server(remoteHost(conn.RemoteAddr().String()))
+	if err != nil {
+		log.Printf("Pool %s - No server available for connection from %s\n", p.Hostname, conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	backend, err := p.dialTCP(server, conn)
+	if err != nil {
+		log.Printf("Pool %s - Error connecting to server %s: %v\n", p.Hostname, server.Address.String(), err)
+		server.NotOkResponsesStats.Add(1)
+		_ = conn.Close()
+		return
+	}
+	server.OkResponsesStats.Add(1)
+	pipeConnections(server.trackUpgraded(conn), backend)
+}
+
+/*
+dialTCP
+Connects to a server of a TCP pool, sending a PROXY protocol header with the client address if enabled.
+*/
+func (p *Pool) dialTCP(server *ServerHost, client net.Conn) (net.Conn, error) {
+	timeout := p.GetTransportOptions().DialTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_LAYER4_DIAL_TIMEOUT
+	}
+	backend, err := net.DialTimeout("tcp", server.Address.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if version := p.GetBackendProxyProtocol(); version != 0 {
+		var src, dst *net.TCPAddr
+		if client != nil {
+			src, _ = client.RemoteAddr().(*net.TCPAddr)
+			dst, _ = client.LocalAddr().(*net.TCPAddr)
+		}
+		if err := writeProxyProtocolHeader(backend, version, src, dst); err != nil {
+			_ = backend.Close()
+			return nil, err
+		}
+	}
+	return backend, nil
+}
+
+/*
+pipeConnections
+Copies data both ways until both sides are done. A side reaching EOF is half closed so that the other side
+can finish sending, an error closes both connections.
+*/
+func pipeConnections(client, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	forward := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); err == nil && ok && cw.CloseWrite() == nil {
+			done <- struct{}{}
+			return
+		}
+		_ = client.Close()
+		_ = backend.Close()
+		done <- struct{}{}
+	}
+	go forward(backend, client)
+	go forward(client, backend)
+	<-done
+	<-done
+	_ = client.Close()
+	_ = backend.Close()
+}
+
+func (p *Pool) serveUDP(l4 *layer4Listener) {
+	buffer := make([]byte, UDP_BUFFER_SIZE)
+	for {
+		n, clientAddr, err := l4.packetConn.ReadFromUDP(buffer)
+		if err != nil {
+			if l4.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		session := p.udpSession(l4, clientAddr)
+		if session == nil {
+			continue
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err := session.backend.Write(buffer[:n]); err != nil {
+			session.server.NotOkResponsesStats.Add(1)
+		}
+	}
+}
+
+/*
+udpSession
+Returns the session of a client, creating it on its first datagram: a socket connected to the chosen server,
+whose replies are sent back to the client until the session is idle for longer than the timeout.
+*/
+func (p *Pool) udpSession(l4 *layer4Listener, clientAddr *net.UDPAddr) *udpSession {
+	key := clientAddr.String()
+	l4.sessionsMux.Lock()
+	defer l4.sessionsMux.Unlock()
+	if session, exists := l4.sessions[key]; exists {
+		return session
+	}
+	server, err := p.chooseLayer4Server(clientAddr.IP.String())
+	if err != nil {
+		log.Printf("Pool %s - No server available for datagram from %s\n", p.Hostname, clientAddr)
+		return nil
+	}
+	backend, err := net.Dial("udp", server.Address.Host)
+	if err != nil {
+		log.Printf("Pool %s - Error connecting to server %s: %v\n", p.Hostname, server.Address.String(), err)
+		server.NotOkResponsesStats.Add(1)
+		return nil
+	}
+	server.OkResponsesStats.Add(1)
+	session := &udpSession{client: clientAddr, backend: server.trackUpgraded(backend), server: server}
+	session.lastActive.Store(time.Now().UnixNano())
+	l4.sessions[key] = session
+	go p.forwardUDPReplies(l4, key, session)
+	return session
+}
+
+func (p *Pool) forwardUDPReplies(l4 *layer4Listener, key string, session *udpSession) {
+	defer func() {
+		_ = session.backend.Close()
+		l4.sessionsMux.Lock()
+		if l4.sessions[key] == session {
+			delete(l4.sessions, key)
+		}
+		l4.sessionsMux.Unlock()
+	}()
+	buffer := make([]byte, UDP_BUFFER_SIZE)
+	for {
+		timeout := p.udpSessionTimeout()
+		_ = session.backend.SetReadDeadline(time.Now().Add(timeout))
+		n, err := session.backend.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, session.lastActive.Load())) < timeout {
+				continue
+			}
+			return
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err := l4.packetConn.WriteToUDP(buffer[:n], session.client); err != nil && l4.closed.Load() {
+			return
+		}
+	}
+}
+
+func (p *Pool) udpSessionTimeout() time.Duration {
+	if timeout := time.Duration(p.UpgradeIdleTimeout.Load()); timeout > 0 {
+		return timeout
+	}
+	return DEFAULT_UDP_SESSION_TIMEOUT
+}
+
+/*
+chooseLayer4Server
+Picks a healthy server for a client of a layer 4 pool, the same one for a given IP with sticky sessions.
+*/
+func (p *Pool) chooseLayer4Server(clientIP string) (*ServerHost, error) {
+	sticky := p.stickySettings().Enabled
+	if sticky {
+		stickyServer := p.getIPStickyServer(clientIP)
+		if stickyServer != nil && stickyServer.ServerStatus.Load() == uint32(Healthy) {
+			return stickyServer, nil
+		}
+	}
+	p.RequestCounter.Add(1)
+	p.serverListMutex.RLock()
+	healthyServers := []*ServerHost{}
+	for _, server := range p.UnconditionalServers {
+		if server.ServerStatus.Load() == uint32(Healthy) {
+			healthyServers = append(healthyServers, server)
+		}
+	}
+	p.serverListMutex.RUnlock()
+	if len(healthyServers) == 0 {
+		return nil, errors.New("no healthy servers available in pool")
+	}
+	server := healthyServers[p.RequestCounter.Load()%uint64(len(healthyServers))]
+	if sticky {
+		p.createIPStickySession(clientIP, server)
+	}
+	return server, nil
+}
+
+func (p *Pool) getIPStickyServer(clientIP string) *ServerHost {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	session, exists := p.stickySessions.get(clientIP)
+	if !exists || !p.CheckIfServerExists(session.ServerHost) || p.isSessionExpired(session) {
+		return nil
+	}
+	p.stickySessions.touch(clientIP)
+	return session.ServerHost
+}
+
+func (p *Pool) createIPStickySession(clientIP string, server *ServerHost) {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	p.stickySessions.set(clientIP, Session{
+		ServerHost: server,
+		CreatedAt:  time.Now(),
+	})
+}
+
+/*
+checkLayer4
+Health check of a server of a layer 4 pool, see ValidateServer.
+*/
+func (p *Pool) checkLayer4(server *ServerHost) bool {
+	timeout := time.Duration(p.HealthCheckTimeout.Load())
+	target := server.HealthCheckPath
+	switch {
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		resp, err := (&http.Client{Timeout: timeout}).Get(target)
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	case strings.HasPrefix(target, "tcp://"):
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(target, "tcp://"), timeout)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	case p.Mode == PoolMode_TCP || p.Mode == PoolMode_TLS:
+		conn, err := net.DialTimeout("tcp", server.Address.Host, timeout)
+		if err != nil {
+			return false
+		}
+		if version := p.GetBackendProxyProtocol(); version != 0 {
+			_ = writeProxyProtocolHeader(conn, version, nil, nil)
+		}
+		_ = conn.Close()
+		return true
+	}
+	return checkUDP(server.Address.Host, timeout)
+}
+
+/*
+checkUDP
+UDP has no connection: an empty datagram is sent and the server is considered healthy unless the port is
+reported unreachable (ICMP) before the timeout.
+*/
+func checkUDP(address string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{}); err != nil {
+		return false
+	}
+	buffer := make([]byte, 1)
+	if _, err := conn.Read(buffer); err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package loadbalancer
+
+import (
+	"continuity/common"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T, network string) int {
+	if network == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func tcpEchoServer(t *testing.T, prefix string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write(append([]byte(prefix), buffer[:n]...))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func udpEchoServer(t *testing.T, prefix string) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte(prefix), buffer[:n]...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newLayer4TestPool(t *testing.T, pool *Pool, mode PoolMode, addresses ...string) (*LoadBalancer, *Pool) {
+	lb := &LoadBalancer{
+		Listeners: map[string]*Listener{DEFAULT_LISTENER: {Name: DEFAULT_LISTENER, Address: "127.0.0.1"}},
+		Pools:     map[string]*Pool{},
+	}
+	pool.UpgradeGracePeriod.Store(0)
+	require.NoError(t, pool.SetLayer4(mode, freePort(t, mode.String())))
+	for _, address := range addresses {
+		server, err := NewServerHost(mode.String()+"://"+address, "", common.Condition{})
+		require.NoError(t, err)
+		require.NoError(t, pool.ValidateServer(server))
+		server.SetHealty()
+		pool.AddServer(server)
+	}
+	require.NoError(t, lb.AddPool(pool))
+	t.Cleanup(func() { _ = lb.RemovePool(pool.Hostname) })
+	return lb, pool
+}
+
+func exchange(t *testing.T, conn net.Conn, message string) string {
+	_, err := conn.Write([]byte(message))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buffer := make([]byte, 1024)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	return string(buffer[:n])
+}
+
+func TestSetLayer4_Invalid(t *testing.T) {
+	pool := NewPool("l4.lab", time.Second, time.Second, time.Second, 1, 1)
+	assert.Error(t, pool.SetLayer4(PoolMode_HTTP, 5432))
+	assert.Error(t, pool.SetLayer4(PoolMode_TCP, 0))
+	assert.Error(t, pool.SetLayer4(PoolMode_TCP, 70000))
+
+	sticky := NewPoolWithStickySession("l4.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	assert.EqualError(t, sticky.SetLayer4(PoolMode_TCP, 5432), "only the IP sticky method is supported by tcp pools")
+	ipSticky := NewPoolWithIPStickySessions("l4.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	assert.NoError(t, ipSticky.SetLayer4(PoolMode_TCP, 5432))
+
+	require.NoError(t, pool.SetBackendProxyProtocol(2))
+	assert.Error(t, pool.SetLayer4(PoolMode_UDP, 5432))
+	assert.NoError(t, pool.SetLayer4(PoolMode_TCP, 5432))
+	assert.True(t, pool.IsLayer4())
+
+	tls := NewPool("secure.lab", time.Second, time.Second, time.Second, 1, 1)
+	assert.Error(t, tls.SetLayer4(PoolMode_TLS, 443))
+	assert.NoError(t, tls.SetLayer4(PoolMode_TLS, 0))
+}
+
+func TestValidateServer(t *testing.T) {
+	httpPool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	tcpPool := NewPool("db.lab", time.Second, time.Second, time.Second, 1, 1)
+	require.NoError(t, tcpPool.SetLayer4(PoolMode_TCP, 5432))
+	tlsPool := NewPool("secure.lab", time.Second, time.Second, time.Second, 1, 1)
+	require.NoError(t, tlsPool.SetLayer4(PoolMode_TLS, 0))
+	testCases := []struct {
+		pool        *Pool
+		address     string
+		healthCheck string
+		condition   common.Condition
+		valid       bool
+	}{
+		{httpPool, "http://10.0.0.1:8080", "/health", common.Condition{}, true},
+		{httpPool, "http://10.0.0.1:8080", "", common.Condition{}, false},
+		{httpPool, "tcp://10.0.0.1:5432", "/health", common.Condition{}, false},
+		{tcpPool, "tcp://10.0.0.1:5432", "", common.Condition{}, true},
+		{tcpPool, "tcp://10.0.0.1:5432", "http://10.0.0.1:8080/health", common.Condition{}, true},
+		{tcpPool, "tcp://10.0.0.1:5432", "tcp://10.0.0.1:5433", common.Condition{}, true},
+		{tcpPool, "tcp://10.0.0.1:5432", "/health", common.Condition{}, false},
+		{tcpPool, "tcp://10.0.0.1", "", common.Condition{}, false},
+		{tcpPool, "udp://10.0.0.1:5432", "", common.Condition{}, false},
+		{tcpPool, "http://10.0.0.1:5432", "", common.Condition{}, false},
+		{tcpPool, "tcp://10.0.0.1:5432", "", common.Condition{Header: "X-Version", Value: "2"}, false},
+		{tlsPool, "tcp://10.0.0.1:443", "", common.Condition{}, true},
+		{tlsPool, "https://10.0.0.1:443", "", common.Condition{}, false},
+	}
+	for _, tc := range testCases {
+		server, err := NewServerHost(tc.address, tc.healthCheck, tc.condition)
+		require.NoError(t, err)
+		err = tc.pool.ValidateServer(server)
+		assert.Equal(t, tc.valid, err == nil, "%s %s: %v", tc.address, tc.healthCheck, err)
+	}
+}
+
+func TestTCPPool_ForwardsAndClosesOnServerRemoval(t *testing.T) {
+	lb, pool := newLayer4TestPool(t, NewPool("l4.lab", time.Second, time.Second, time.Second, 1, 1),
+		PoolMode_TCP, tcpEchoServer(t, "a:"))
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(pool.ListenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:hello", exchange(t, conn, "hello"))
+	server := pool.UnconditionalServers[0]
+	assert.Equal(t, 1, server.UpgradedConnections())
+	assert.Equal(t, uint64(1), server.OkResponsesStats.Load())
+
+	// the listen port can't be shared, and HTTP requests are not routed to layer 4 pools
+	other := NewPool("other.lab", time.Second, time.Second, time.Second, 1, 1)
+	require.NoError(t, other.SetLayer4(PoolMode_TCP, pool.ListenPort))
+	assert.Error(t, lb.AddPool(other))
+
+	_, err = pool.RemoveServer(server.Id)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = conn.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return server.UpgradedConnections() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestTCPPool_IPStickySessions(t *testing.T) {
+	_, pool := newLayer4TestPool(t, NewPoolWithIPStickySessions("l4.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1),
+		PoolMode_TCP, tcpEchoServer(t, "a:"), tcpEchoServer(t, "b:"))
+
+	replies := map[string]bool{}
+	for range 4 {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(pool.ListenPort))
+		require.NoError(t, err)
+		replies[exchange(t, conn, "x")] = true
+		_ = conn.Close()
+	}
+	assert.Len(t, replies, 1)
+}
+
+func TestUDPPool_ForwardsReplies(t *testing.T) {
+	lb, pool := newLayer4TestPool(t, NewPool("l4.lab", time.Second, time.Second, time.Second, 1, 1),
+		PoolMode_UDP, udpEchoServer(t, "a:"))
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(pool.ListenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:ping", exchange(t, conn, "ping"))
+	assert.Equal(t, "a:pong", exchange(t, conn, "pong"))
+	assert.Equal(t, 1, pool.UnconditionalServers[0].UpgradedConnections())
+
+	require.NoError(t, lb.RemovePool(pool.Hostname))
+	assert.Eventually(t, func() bool { return pool.UnconditionalServers[0].UpgradedConnections() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestCheckLayer4(t *testing.T) {
+	tcpPool := NewPool("db.lab", 300*time.Millisecond, time.Second, time.Second, 1, 1)
+	require.NoError(t, tcpPool.SetLayer4(PoolMode_TCP, 5432))
+	udpPool := NewPool("dns.lab", 300*time.Millisecond, time.Second, time.Second, 1, 1)
+	require.NoError(t, udpPool.SetLayer4(PoolMode_UDP, 5353))
+	closedTCP := "127.0.0.1:" + strconv.Itoa(freePort(t, "tcp"))
+	closedUDP := "127.0.0.1:" + strconv.Itoa(freePort(t, "udp"))
+	testCases := []struct {
+		pool        *Pool
+		address     string
+		healthCheck string
+		healthy     bool
+	}{
+		{tcpPool, "tcp://" + tcpEchoServer(t, ""), "", true},
+		{tcpPool, "tcp://" + closedTCP, "", false},
+		{udpPool, "udp://" + udpEchoServer(t, ""), "", true},
+		{udpPool, "udp://" + closedUDP, "", false},
+		{udpPool, "udp://" + closedUDP, "tcp://" + tcpEchoServer(t, ""), true},
+	}
+	for _, tc := range testCases {
+		server, err := NewServerHost(tc.address, tc.healthCheck, common.Condition{})
+		require.NoError(t, err)
+		assert.Equal(t, tc.healthy, tc.pool.checkLayer4(server), "%s %s", tc.address, tc.healthCheck)
+	}
+}
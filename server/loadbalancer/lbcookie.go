@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MIN_LB_COOKIE_SECRET_LENGTH keeps the secrets of LB cookies from being guessed
+const MIN_LB_COOKIE_SECRET_LENGTH = 16
+
+var lbCookieSameSite = map[string]http.SameSite{
+	"Lax":    http.SameSiteLaxMode,
+	"Strict": http.SameSiteStrictMode,
+	"None":   http.SameSiteNoneMode,
+}
+
+/*
+LbCookieOptions
+Settings of the cookie set by the load balancer with the LBCookie sticky method.
+The cookie value is the Id of the server signed with the secret, or encrypted with it when Opaque is set, so
+that clients can neither forge it to reach another server nor, when opaque, learn the server Id.
+*/
+type LbCookieOptions struct {
+	Secret   string
+	Opaque   bool
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite string
+}
+
+/*
+DefaultLbCookieOptions
+The options of pools configured without any: a signed cookie for the whole host, not readable from JavaScript
+and not sent with cross-site requests. The secret is generated.
+*/
+func DefaultLbCookieOptions() LbCookieOptions {
+	return LbCookieOptions{Path: "/", HttpOnly: true, SameSite: "Lax"}
+}
+
+/*
+lbCookie
+The LB cookie of a pool with the keys derived from its secret, rebuilt when the sticky session settings change.
+With a sliding expiry the cookie is set on every response so that its Max-Age follows the session.
+*/
+type lbCookie struct {
+	name     string
+	hostname string
+	options  LbCookieOptions
+	sameSite http.SameSite
+	maxAge   time.Duration
+	sliding  bool
+	signKey  []byte
+	aead     cipher.AEAD
+}
+
+func newLbCookie(name string, hostname string, options LbCookieOptions, maxAge time.Duration, sliding bool) (*lbCookie, error) {
+	key := sha256.Sum256([]byte(options.Secret))
+	block, err := aes.NewCipher(deriveKey(key[:], "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &lbCookie{
+		name:     name,
+		hostname: hostname,
+		options:  options,
+		sameSite: lbCookieSameSite[options.SameSite],
+		maxAge:   maxAge,
+		sliding:  sliding,
+		signKey:  deriveKey(key[:], "sign"),
+		aead:     aead,
+	}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+/*
+encode
+Returns the cookie value of the server: its Id and a signature, or the encrypted Id when opaque. The hostname of
+the pool is part of the signature, a cookie of a pool is not valid for another one sharing the secret.
+*/
+func (c *lbCookie) encode(serverId uuid.UUID) string {
+	if c.options.Opaque {
+		nonce := make([]byte, c.aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, serverId[:], []byte(c.hostname)))
+	}
+	return serverId.String() + "." + base64.RawURLEncoding.EncodeToString(c.sign(serverId))
+}
+
+/*
+decode
+Returns the server Id of a cookie value, false if it was not issued with the secret of the pool.
+*/
+func (c *lbCookie) decode(value string) (uuid.UUID, bool) {
+	if c.options.Opaque {
+		sealed, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(sealed) < c.aead.NonceSize() {
+			return uuid.Nil, false
+		}
+		plain, err := c.aead.Open(nil, sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():], []byte(c.hostname))
+		if err != nil {
+			return uuid.Nil, false
+		}
+		serverId, err := uuid.FromBytes(plain)
+		return serverId, err == nil
+	}
+	id, signature, found := strings.Cut(value, ".")
+	if !found {
+		return uuid.Nil, false
+	}
+	serverId, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, c.sign(serverId)) {
+		return uuid.Nil, false
+	}
+	return serverId, true
+}
+
+func (c *lbCookie) sign(serverId uuid.UUID) []byte {
+	mac := hmac.New(sha256.New, c.signKey)
+	mac.Write([]byte(c.hostname))
+	mac.Write(serverId[:])
+	return mac.Sum(nil)
+}
+
+/*
+serverId
+Returns the server Id of the LB cookie of the request, false if there is none or it's not valid.
+*/
+func (c *lbCookie) serverId(req *http.Request) (uuid.UUID, bool) {
+	cookie, err := req.Cookie(c.name)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return c.decode(cookie.Value)
+}
+
+func (c *lbCookie) cookie(serverId uuid.UUID) *http.Cookie {
+	return &http.Cookie{
+		Name:     c.name,
+		Value:    c.encode(serverId),
+		Path:     c.options.Path,
+		Domain:   c.options.Domain,
+		MaxAge:   int(c.maxAge / time.Second),
+		Secure:   c.options.Secure,
+		HttpOnly: c.options.HttpOnly,
+		SameSite: c.sameSite,
+	}
+}
+
+/*
+SetLbCookieOptions
+Sets the options of the cookie of the LBCookie sticky method. An empty secret generates a random one, which
+GetLbCookieOptions returns so that it can be saved.
+*/
+func (p *Pool) SetLbCookieOptions(options LbCookieOptions) error {
+	generated := false
+	if options.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		options.Secret = base64.RawURLEncoding.EncodeToString(secret)
+		generated = true
+	}
+	if len(options.Secret) < MIN_LB_COOKIE_SECRET_LENGTH {
+		return fmt.Errorf("sticky cookie secret must be at least %d characters", MIN_LB_COOKIE_SECRET_LENGTH)
+	}
+	if _, valid := lbCookieSameSite[options.SameSite]; !valid && options.SameSite != "" {
+		return errors.New("sticky cookie samesite must be one of Lax, Strict or None")
+	}
+	if options.SameSite == "None" && !options.Secure {
+		return errors.New("sticky cookie samesite None requires secure")
+	}
+	if options.Path == "" {
+		options.Path = "/"
+	}
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	p.lbCookieOptions = options
+	p.lbCookieSecretGenerated = generated
+	return p.updateLbCookie()
+}
+
+func (p *Pool) GetLbCookieOptions() LbCookieOptions {
+	p.stickySessionMutex.RLock()
+	defer p.stickySessionMutex.RUnlock()
+	return p.lbCookieOptions
+}
+
+/*
+LbCookieChanged
+Returns whether the LB cookie options of the given pool differ from the ones of this pool. A generated secret,
+of a pool configured without one, is not a change.
+*/
+func (p *Pool) LbCookieChanged(settings *Pool) bool {
+	options := settings.GetLbCookieOptions()
+	current := p.GetLbCookieOptions()
+	if settings.lbCookieSecretGenerated {
+		options.Secret = current.Secret
+	}
+	return options != current
+}
+
+/*
+updateLbCookie
+Rebuilds the LB cookie after a change of its options or of the sticky session settings, and sets it on the
+servers of the pool. stickySessionMutex must be held.
+*/
+func (p *Pool) updateLbCookie() error {
+	settings := p.stickySettings()
+	cookie, err := newLbCookie(settings.CookieName, p.Hostname, p.lbCookieOptions, settings.Timeout, settings.SlidingExpiry)
+	if err != nil {
+		return err
+	}
+	p.lbCookie.Store(cookie)
+	p.serverListMutex.RLock()
+	defer p.serverListMutex.RUnlock()
+	for _, server := range append(append([]*ServerHost{}, p.ConditionalServers...), p.UnconditionalServers...) {
+		p.configureStickySessions(server)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package loadbalancer
+
+import (
+	"continuity/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLbCookie(t *testing.T, hostname string, options LbCookieOptions) *lbCookie {
+	pool := NewPoolWithStickySession(hostname, time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	require.NoError(t, pool.SetLbCookieOptions(options))
+	return pool.lbCookie.Load()
+}
+
+func TestLbCookie_Signed(t *testing.T) {
+	options := DefaultLbCookieOptions()
+	options.Secret = "0123456789abcdef"
+	cookie := newTestLbCookie(t, "app.lab", options)
+	serverId := uuid.New()
+
+	value := cookie.encode(serverId)
+	assert.True(t, strings.HasPrefix(value, serverId.String()+"."))
+	decoded, valid := cookie.decode(value)
+	assert.True(t, valid)
+	assert.Equal(t, serverId, decoded)
+
+	// forged, plain and other pools cookies are rejected
+	_, valid = cookie.decode(uuid.New().String() + strings.TrimPrefix(value, serverId.String()))
+	assert.False(t, valid)
+	_, valid = cookie.decode(serverId.String())
+	assert.False(t, valid)
+	_, valid = newTestLbCookie(t, "other.lab", options).decode(value)
+	assert.False(t, valid)
+
+	httpCookie := cookie.cookie(serverId)
+	assert.Equal(t, LB_COOKIE_NAME, httpCookie.Name)
+	assert.Equal(t, "/", httpCookie.Path)
+	assert.Equal(t, 60, httpCookie.MaxAge)
+	assert.True(t, httpCookie.HttpOnly)
+	assert.False(t, httpCookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, httpCookie.SameSite)
+}
+
+func TestLbCookie_Opaque(t *testing.T) {
+	options := LbCookieOptions{Secret: "0123456789abcdef", Opaque: true, Domain: "lab", Secure: true, SameSite: "None"}
+	cookie := newTestLbCookie(t, "app.lab", options)
+	serverId := uuid.New()
+
+	value := cookie.encode(serverId)
+	assert.NotContains(t, value, serverId.String())
+	assert.NotEqual(t, value, cookie.encode(serverId))
+	decoded, valid := cookie.decode(value)
+	assert.True(t, valid)
+	assert.Equal(t, serverId, decoded)
+	options.Secret = "fedcba9876543210"
+	_, valid = newTestLbCookie(t, "app.lab", options).decode(value)
+	assert.False(t, valid)
+	_, valid = cookie.decode(serverId.String())
+	assert.False(t, valid)
+
+	httpCookie := cookie.cookie(serverId)
+	assert.Equal(t, "/", httpCookie.Path)
+	assert.Equal(t, "lab", httpCookie.Domain)
+	assert.True(t, httpCookie.Secure)
+	assert.False(t, httpCookie.HttpOnly)
+	assert.Equal(t, http.SameSiteNoneMode, httpCookie.SameSite)
+}
+
+func TestSetLbCookieOptions(t *testing.T) {
+	pool := NewPoolWithStickySession("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	generated := pool.GetLbCookieOptions()
+	assert.GreaterOrEqual(t, len(generated.Secret), MIN_LB_COOKIE_SECRET_LENGTH)
+	assert.Equal(t, DefaultLbCookieOptions().SameSite, generated.SameSite)
+
+	assert.EqualError(t, pool.SetLbCookieOptions(LbCookieOptions{Secret: "short"}), "sticky cookie secret must be at least 16 characters")
+	assert.EqualError(t, pool.SetLbCookieOptions(LbCookieOptions{SameSite: "Loose"}), "sticky cookie samesite must be one of Lax, Strict or None")
+	assert.EqualError(t, pool.SetLbCookieOptions(LbCookieOptions{SameSite: "None"}), "sticky cookie samesite None requires secure")
+	assert.Equal(t, generated, pool.GetLbCookieOptions())
+
+	// a generated secret is not a change, it's kept when the settings are applied
+	settings := NewPoolWithStickySession("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	assert.False(t, pool.LbCookieChanged(settings))
+	pool.UpdateStickySessions(settings)
+	assert.Equal(t, generated.Secret, pool.GetLbCookieOptions().Secret)
+	require.NoError(t, settings.SetLbCookieOptions(LbCookieOptions{Secret: "0123456789abcdef"}))
+	assert.True(t, pool.LbCookieChanged(settings))
+	pool.UpdateStickySessions(settings)
+	assert.Equal(t, "0123456789abcdef", pool.GetLbCookieOptions().Secret)
+}
+
+func TestServeRequest_LbCookie(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	lb := &LoadBalancer{Pools: map[string]*Pool{}}
+	pool := NewPoolWithStickySession("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, httptest.NewRequest("GET", "http://app.lab/", nil))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	serverId, valid := pool.lbCookie.Load().decode(cookies[0].Value)
+	assert.True(t, valid)
+	assert.Equal(t, server.Id, serverId)
+
+	// the cookie is not set again while it's valid
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+	assert.Empty(t, w.Result().Cookies())
+
+	// a forged cookie is replaced
+	req = httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.AddCookie(&http.Cookie{Name: LB_COOKIE_NAME, Value: server.Id.String()})
+	w = httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+	assert.Len(t, w.Result().Cookies(), 1)
+
+	// with a sliding expiry the cookie is set again so that its Max-Age follows the session
+	pool.SetStickySlidingExpiry(true)
+	req = httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+	assert.Len(t, w.Result().Cookies(), 1)
+}
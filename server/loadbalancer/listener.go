@@ -0,0 +1,389 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/server/handoff"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_LISTENER is the name of the listener of configuration files with a single address and port
+const DEFAULT_LISTENER = "default"
+
+var ErrListenerNotFound = errors.New("listener not found")
+
+/*
+Listener
+A frontend address accepting client requests, with its own TLS, PROXY protocol and timeout settings.
+Pools are reachable on every listener, unless they are bound to some of them by name.
+*/
+type Listener struct {
+	Name    string
+	Address string
+	Port    int
+	Options ListenerOptions
+	server  *http.Server
+	// socket is the bound socket, which a replacement listener on the same address takes over
+	socket *net.TCPListener
+	sni    *sniListener
+}
+
+type listenerContextKey struct{}
+
+func NewListener(name string, address string, port int, options ListenerOptions) (*Listener, error) {
+	if name == "" {
+		return nil, errors.New("listener name is required")
+	}
+	if port < 0 || port > 65535 {
+		return nil, errors.New("listener port must be between 0 and 65535")
+	}
+	return &Listener{Name: name, Address: address, Port: port, Options: options}, nil
+}
+
+/*
+BindAddress
+Returns the address:port the listener is bound to, as configured.
+*/
+func (l *Listener) BindAddress() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+/*
+Addr
+Returns the address the listener is accepting connections on, which has the actual port if it was 0.
+*/
+func (l *Listener) Addr() string {
+	if l.server == nil {
+		return l.BindAddress()
+	}
+	return l.server.Addr
+}
+
+/*
+SameSettings
+Returns whether two listeners have the same address, port and options.
+*/
+func (l *Listener) SameSettings(other *Listener) bool {
+	return l.Address == other.Address && l.Port == other.Port && l.Options == other.Options
+}
+
+func (l *Listener) start(lb *LoadBalancer) error {
+	// the certificate is loaded before binding, so that an invalid one doesn't leave the address bound
+	server, err := lb.newFrontendServer(l.Options)
+	if err != nil {
+		return err
+	}
+	log.Println("Starting listener", l.Name, "on", l.BindAddress())
+	socket, err := handoff.Listen(l.BindAddress())
+	if err != nil {
+		return err
+	}
+	l.serve(lb, server, socket)
+	return nil
+}
+
+/*
+serve
+Serves the connections accepted on the socket with the frontend server.
+*/
+func (l *Listener) serve(lb *LoadBalancer, server *http.Server, socket net.Listener) {
+	l.socket, _ = socket.(*net.TCPListener)
+	listener := socket
+	if l.Options.ProxyProtocol {
+		log.Println("PROXY protocol enabled on", l.BindAddress())
+		listener = newProxyProtocolListener(listener, lb)
+	}
+	// TLS connections for TLS pools are taken before the server, so that they are not decrypted
+	l.sni = newSniListener(listener, lb, l)
+	listener = l.sni
+	server.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerContextKey{}, l)
+	}
+	server.Addr = listener.Addr().String()
+	l.server = server
+	go func() {
+		var serveErr error
+		if server.TLSConfig != nil {
+			serveErr = server.ServeTLS(listener, "", "")
+		} else {
+			serveErr = server.Serve(listener)
+		}
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			log.Fatal("Listener ", l.Name, " stopped serving requests: ", serveErr)
+		}
+	}()
+	log.Println("Listener", l.Name, "is listening on", server.Addr)
+}
+
+/*
+stop
+Stops accepting connections and waits for in-flight requests to complete, until the context expires.
+*/
+func (l *Listener) stop(ctx context.Context) error {
+	if l.server == nil {
+		return nil
+	}
+	handoff.Forget(l.BindAddress())
+	return l.server.Shutdown(ctx)
+}
+
+/*
+shutdown
+Stops accepting connections on a replaced listener, whose socket may be used by its replacement. Its in-flight
+requests are given the timeout to complete in the background.
+*/
+func (l *Listener) shutdown(timeout time.Duration) {
+	if l.server == nil {
+		return
+	}
+	closed := make(chan struct{})
+	l.server.RegisterOnShutdown(func() {
+		close(closed)
+	})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := l.server.Shutdown(ctx); err != nil {
+			log.Println("Error stopping replaced listener", l.Name, ":", err)
+		}
+	}()
+	<-closed
+	// a connection accepted while closing would be dropped
+	<-l.sni.stopped
+}
+
+/*
+SetListeners
+Binds the pool to the listeners with the given names, an empty list makes it reachable on every listener.
+*/
+func (p *Pool) SetListeners(names []string) {
+	listeners := append([]string{}, names...)
+	sort.Strings(listeners)
+	p.listeners.Store(&listeners)
+}
+
+func (p *Pool) GetListeners() []string {
+	if listeners := p.listeners.Load(); listeners != nil {
+		return *listeners
+	}
+	return []string{}
+}
+
+/*
+IsOnListener
+Returns whether the pool is reachable on the listener.
+*/
+func (p *Pool) IsOnListener(name string) bool {
+	listeners := p.GetListeners()
+	if len(listeners) == 0 {
+		return true
+	}
+	for _, listener := range listeners {
+		if listener == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+requestListener
+Returns the listener that received the request, nil if the request didn't come from a listener.
+*/
+func requestListener(req *http.Request) *Listener {
+	listener, _ := req.Context().Value(listenerContextKey{}).(*Listener)
+	return listener
+}
+
+func withListener(req *http.Request, listener *Listener) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), listenerContextKey{}, listener))
+}
+
+/*
+AddListener
+Starts a listener and adds it to the load balancer. Names and bound addresses are unique.
+*/
+func (lb *LoadBalancer) AddListener(listener *Listener) error {
+	lb.listenerMutex.Lock()
+	defer lb.listenerMutex.Unlock()
+	if lb.Listeners == nil {
+		lb.Listeners = map[string]*Listener{}
+	}
+	if _, exists := lb.Listeners[listener.Name]; exists {
+		return fmt.Errorf("listener %s already exists", listener.Name)
+	}
+	for _, existing := range lb.Listeners {
+		if listener.Port != 0 && existing.BindAddress() == listener.BindAddress() {
+			return fmt.Errorf("address %s already used by listener %s", listener.BindAddress(), existing.Name)
+		}
+	}
+	if err := listener.start(lb); err != nil {
+		return err
+	}
+	lb.Listeners[listener.Name] = listener
+	return nil
+}
+
+/*
+RemoveListener
+Stops a listener, waiting for its in-flight requests until the context expires. Listeners used by a pool and the
+last listener can't be removed.
+*/
+func (lb *LoadBalancer) RemoveListener(ctx context.Context, name string) error {
+	lb.listenerMutex.Lock()
+	listener, exists := lb.Listeners[name]
+	if !exists {
+		lb.listenerMutex.Unlock()
+		return ErrListenerNotFound
+	}
+	if len(lb.Listeners) == 1 {
+		lb.listenerMutex.Unlock()
+		return errors.New("the last listener can't be removed")
+	}
+	for _, pool := range lb.GetPools() {
+		for _, poolListener := range pool.GetListeners() {
+			if poolListener == name {
+				lb.listenerMutex.Unlock()
+				return fmt.Errorf("listener %s is used by pool %s", name, pool.Hostname)
+			}
+		}
+	}
+	delete(lb.Listeners, name)
+	lb.listenerMutex.Unlock()
+	return listener.stop(ctx)
+}
+
+/*
+ReplaceListener
+Replaces a listener with another one with the same name and different settings. On the same address the new
+listener takes the bound socket over, so that no connection is refused; otherwise it's started before the old one
+is stopped, unless the addresses overlap. The in-flight requests of the old listener are given the shutdown timeout
+to complete, in the background.
+*/
+func (lb *LoadBalancer) ReplaceListener(listener *Listener) error {
+	lb.listenerMutex.Lock()
+	defer lb.listenerMutex.Unlock()
+	existing, exists := lb.Listeners[listener.Name]
+	if !exists {
+		return ErrListenerNotFound
+	}
+	// an invalid certificate doesn't stop the running listener
+	server, err := lb.newFrontendServer(listener.Options)
+	if err != nil {
+		return err
+	}
+	switch {
+	case existing.socket != nil && existing.BindAddress() == listener.BindAddress():
+		socket, err := handoff.Share(listener.BindAddress(), existing.socket)
+		if err != nil {
+			return err
+		}
+		log.Println("Replacing listener", listener.Name, "on", listener.BindAddress())
+		// the connections received until the new listener serves wait on the socket
+		existing.shutdown(lb.GetShutdownTimeout())
+		listener.serve(lb, server, socket)
+	case listener.start(lb) == nil:
+		handoff.Forget(existing.BindAddress())
+		existing.shutdown(lb.GetShutdownTimeout())
+	default:
+		// the addresses overlap, e.g. 0.0.0.0 and 127.0.0.1 on the same port
+		return lb.restartListener(existing, listener)
+	}
+	lb.Listeners[listener.Name] = listener
+	return nil
+}
+
+/*
+restartListener
+Stops a listener, waiting for its in-flight requests until the shutdown timeout, and starts its replacement.
+If the replacement can't be started the old listener is started again. listenerMutex must be held.
+*/
+func (lb *LoadBalancer) restartListener(existing *Listener, listener *Listener) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lb.GetShutdownTimeout())
+	defer cancel()
+	if err := existing.stop(ctx); err != nil {
+		log.Println("Error stopping listener", existing.Name, ":", err)
+	}
+	if err := listener.start(lb); err != nil {
+		restored := &Listener{Name: existing.Name, Address: existing.Address, Port: existing.Port, Options: existing.Options}
+		if restoreErr := restored.start(lb); restoreErr != nil {
+			delete(lb.Listeners, existing.Name)
+			return fmt.Errorf("%w, and the previous listener can't be restarted: %v", err, restoreErr)
+		}
+		lb.Listeners[existing.Name] = restored
+		return err
+	}
+	lb.Listeners[listener.Name] = listener
+	return nil
+}
+
+func (lb *LoadBalancer) GetListener(name string) (*Listener, error) {
+	lb.listenerMutex.RLock()
+	defer lb.listenerMutex.RUnlock()
+	if listener, exists := lb.Listeners[name]; exists {
+		return listener, nil
+	}
+	return nil, ErrListenerNotFound
+}
+
+/*
+GetListeners
+Returns the listeners sorted by name.
+*/
+func (lb *LoadBalancer) GetListeners() []*Listener {
+	lb.listenerMutex.RLock()
+	defer lb.listenerMutex.RUnlock()
+	listeners := make([]*Listener, 0, len(lb.Listeners))
+	for _, listener := range lb.Listeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].Name < listeners[j].Name
+	})
+	return listeners
+}
+
+/*
+checkPoolListeners
+Checks that the listeners a pool is bound to exist.
+*/
+func (lb *LoadBalancer) checkPoolListeners(pool *Pool) error {
+	lb.listenerMutex.RLock()
+	defer lb.listenerMutex.RUnlock()
+	for _, name := range pool.GetListeners() {
+		if _, exists := lb.Listeners[name]; !exists {
+			return fmt.Errorf("listener %s of pool %s does not exist", name, pool.Hostname)
+		}
+	}
+	return nil
+}
+
+/*
+layer4Address
+Returns the address layer 4 pools listen on: the address of the first listener they are bound to,
+otherwise of the default listener or of the first listener by name.
+*/
+func (lb *LoadBalancer) layer4Address(pool *Pool) string {
+	names := pool.GetListeners()
+	listeners := lb.GetListeners()
+	lb.listenerMutex.RLock()
+	defer lb.listenerMutex.RUnlock()
+	for _, name := range names {
+		if listener, exists := lb.Listeners[name]; exists {
+			return listener.Address
+		}
+	}
+	if listener, exists := lb.Listeners[DEFAULT_LISTENER]; exists {
+		return listener.Address
+	}
+	if len(listeners) > 0 {
+		return listeners[0].Address
+	}
+	return ""
+}
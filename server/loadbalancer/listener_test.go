@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, address string, host string) (int, string) {
+	req, err := http.NewRequest("GET", "http://"+address+"/", nil)
+	require.NoError(t, err)
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestListeners_PoolBinding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := newLoadBalancer([]*Listener{
+		{Name: "public", Address: "127.0.0.1"},
+		{Name: "internal", Address: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+	defer lb.Shutdown(context.Background())
+
+	public := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	admin := NewPool("admin.lab", time.Second, time.Second, time.Second, 1, 1)
+	admin.SetListeners([]string{"internal"})
+	for _, pool := range []*Pool{public, admin} {
+		server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+		require.NoError(t, err)
+		server.SetHealty()
+		pool.AddServer(server)
+		require.NoError(t, lb.AddPool(pool))
+	}
+	unknown := NewPool("other.lab", time.Second, time.Second, time.Second, 1, 1)
+	unknown.SetListeners([]string{"missing"})
+	assert.EqualError(t, lb.AddPool(unknown), "listener missing of pool other.lab does not exist")
+
+	publicAddress := lb.Listeners["public"].Addr()
+	internalAddress := lb.Listeners["internal"].Addr()
+	_, body := get(t, publicAddress, "app.lab")
+	assert.Equal(t, "ok", body)
+	_, body = get(t, internalAddress, "app.lab")
+	assert.Equal(t, "ok", body)
+	_, body = get(t, internalAddress, "admin.lab")
+	assert.Equal(t, "ok", body)
+	_, body = get(t, publicAddress, "admin.lab")
+	assert.Empty(t, body)
+
+	// a listener added at runtime serves the pools right away
+	extra := &Listener{Name: "extra", Address: "127.0.0.1"}
+	require.NoError(t, lb.AddListener(extra))
+	_, body = get(t, extra.Addr(), "app.lab")
+	assert.Equal(t, "ok", body)
+	assert.Error(t, lb.AddListener(&Listener{Name: "extra", Address: "127.0.0.1"}))
+
+	assert.EqualError(t, lb.RemoveListener(context.Background(), "internal"), "listener internal is used by pool admin.lab")
+	assert.ErrorIs(t, lb.RemoveListener(context.Background(), "missing"), ErrListenerNotFound)
+	require.NoError(t, lb.RemoveListener(context.Background(), "extra"))
+	_, err = http.Get("http://" + extra.Addr() + "/")
+	assert.Error(t, err)
+	assert.Len(t, lb.GetListeners(), 2)
+}
+
+func TestListeners_ReplaceAndLast(t *testing.T) {
+	lb, err := newLoadBalancer([]*Listener{{Name: DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	defer lb.Shutdown(context.Background())
+
+	assert.EqualError(t, lb.RemoveListener(context.Background(), DEFAULT_LISTENER), "the last listener can't be removed")
+
+	replacement := &Listener{Name: DEFAULT_LISTENER, Address: "127.0.0.1", Options: ListenerOptions{MaxHeaderBytes: 4096}}
+	require.NoError(t, lb.ReplaceListener(replacement))
+	listener, err := lb.GetListener(DEFAULT_LISTENER)
+	require.NoError(t, err)
+	assert.Same(t, replacement, listener)
+
+	// an invalid certificate keeps the listener running
+	invalid := &Listener{Name: DEFAULT_LISTENER, Address: "127.0.0.1", Options: ListenerOptions{TlsCertificate: "missing.pem", TlsKey: "missing.key"}}
+	assert.Error(t, lb.ReplaceListener(invalid))
+	listener, err = lb.GetListener(DEFAULT_LISTENER)
+	require.NoError(t, err)
+	assert.True(t, listener.SameSettings(replacement))
+	status, _ := get(t, listener.Addr(), "unknown.lab")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestListeners_ReplaceKeepsSocket(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := newLoadBalancer([]*Listener{{Name: DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	defer lb.Shutdown(context.Background())
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+	address := lb.Listeners[DEFAULT_LISTENER].Addr()
+
+	slow := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+address+"/slow", nil)
+		req.Host = "app.lab"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	// the in-flight request doesn't hold the replacement, which takes the socket over
+	replaced := make(chan error)
+	replacement := &Listener{Name: DEFAULT_LISTENER, Address: "127.0.0.1", Options: ListenerOptions{MaxHeaderBytes: 4096}}
+	go func() { replaced <- lb.ReplaceListener(replacement) }()
+	select {
+	case err := <-replaced:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replacing the listener waited for the in-flight request")
+	}
+	assert.Equal(t, address, replacement.Addr())
+	_, body := get(t, address, "app.lab")
+	assert.Equal(t, "ok", body)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+}
@@ -1,40 +1,112 @@
 package loadbalancer
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LoadBalancer struct {
-	BindAddress string
-	BindPort    int
-	Pools       map[string]*Pool
-	poolMutex   sync.RWMutex
+	Listeners           map[string]*Listener
+	Pools               map[string]*Pool
+	TrustedProxies      []string
+	listenerMutex       sync.RWMutex
+	poolMutex           sync.RWMutex
+	trustedProxies      []*net.IPNet
+	trustedProxiesMutex sync.RWMutex
+	stopHealthChecks    chan struct{}
+	stopOnce            sync.Once
+	shutdownTimeout     atomic.Int64
 }
 
-func newLoadBalancer(bindAddress string, bindPort int) (*LoadBalancer, error) {
+type ListenerOptions struct {
+	// ProxyProtocol requires every connection to start with a PROXY protocol v1 or v2 header
+	ProxyProtocol bool
+	// TlsCertificate and TlsKey enable TLS (with HTTP/2) on the listener
+	TlsCertificate string
+	TlsKey         string
+	// H2C accepts HTTP/2 without TLS (prior knowledge) besides HTTP/1.1
+	H2C bool
+	// Timeouts of client connections, zero disables them. ReadHeaderTimeout defaults to
+	// DEFAULT_READ_HEADER_TIMEOUT so that slow clients can't hold connections open forever
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxHeaderBytes defaults to http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// MaxRequestBodyBytes is the default request body limit of the pools, 0 for no limit
+	MaxRequestBodyBytes int64
+}
+
+const DEFAULT_READ_HEADER_TIMEOUT = 10 * time.Second
+
+// DEFAULT_SHUTDOWN_TIMEOUT is the time given to in-flight requests to complete when a listener is stopped
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+/*
+newLoadBalancer
+Starts a load balancer accepting requests on the given listeners.
+*/
+func newLoadBalancer(listeners []*Listener) (*LoadBalancer, error) {
 	lb := &LoadBalancer{
-		BindAddress: bindAddress,
-		BindPort:    bindPort,
-		Pools:       make(map[string]*Pool),
+		Listeners:        make(map[string]*Listener),
+		Pools:            make(map[string]*Pool),
+		stopHealthChecks: make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		if err := lb.AddListener(listener); err != nil {
+			_ = lb.Shutdown(context.Background())
+			return nil, err
+		}
 	}
-	http.HandleFunc("/", lb.ServeRequest)
-	log.Println("Starting load balancer on", bindAddress+":"+fmt.Sprint(bindPort))
-	go func() {
-		_ = http.ListenAndServe(bindAddress+":"+fmt.Sprint(bindPort), nil)
-	}()
-
-	log.Println("Load balancer is listening on", bindAddress+":"+fmt.Sprint(bindPort))
 	go lb.healthCheckLoop()
+	go lb.stickySessionSweepLoop()
 	return lb, nil
 }
 
 var NewLoadBalancer = newLoadBalancer
 
+/*
+newFrontendServer
+Creates the HTTP server accepting client requests: HTTP/1.1, HTTP/2 when TLS is enabled and h2c if requested.
+Timeouts and header size limits protect the listener from slow or misbehaving clients.
+*/
+func (lb *LoadBalancer) newFrontendServer(options ListenerOptions) (*http.Server, error) {
+	server := &http.Server{
+		Handler:           http.HandlerFunc(lb.ServeRequest),
+		Protocols:         &http.Protocols{},
+		ReadTimeout:       options.ReadTimeout,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		IdleTimeout:       options.IdleTimeout,
+		MaxHeaderBytes:    options.MaxHeaderBytes,
+	}
+	if server.ReadHeaderTimeout == 0 {
+		server.ReadHeaderTimeout = DEFAULT_READ_HEADER_TIMEOUT
+	}
+	server.Protocols.SetHTTP1(true)
+	if options.TlsCertificate != "" || options.TlsKey != "" {
+		certificate, err := tls.LoadX509KeyPair(options.TlsCertificate, options.TlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		server.Protocols.SetHTTP2(true)
+	}
+	if options.H2C {
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server, nil
+}
+
 func (lb *LoadBalancer) healthCheckLoop() {
 	log.Println("Starting health-checks loop for load balancer")
 
@@ -45,18 +117,113 @@ func (lb *LoadBalancer) healthCheckLoop() {
 			pool.RunHealthChecks()
 		}
 		lb.poolMutex.RUnlock()
-		time.Sleep(1 * time.Second)
+		select {
+		case <-lb.stopHealthChecks:
+			log.Println("Stopped health-checks loop for load balancer")
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+/*
+stickySessionSweepLoop
+Evicts the expired sticky sessions of the pools every STICKY_SESSION_SWEEP_INTERVAL, they are otherwise only
+checked when read. It stops with the health checks.
+*/
+func (lb *LoadBalancer) stickySessionSweepLoop() {
+	for {
+		select {
+		case <-lb.stopHealthChecks:
+			return
+		case <-time.After(STICKY_SESSION_SWEEP_INTERVAL):
+		}
+		for _, pool := range lb.GetPools() {
+			pool.evictExpiredSessions()
+		}
+	}
+}
+
+/*
+SetShutdownTimeout
+Sets the time given to in-flight requests to complete when a listener is replaced at runtime.
+*/
+func (lb *LoadBalancer) SetShutdownTimeout(timeout time.Duration) {
+	lb.shutdownTimeout.Store(int64(timeout))
+}
+
+func (lb *LoadBalancer) GetShutdownTimeout() time.Duration {
+	if timeout := lb.shutdownTimeout.Load(); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return DEFAULT_SHUTDOWN_TIMEOUT
+}
+
+/*
+Shutdown
+Stops accepting new connections on every listener and waits for in-flight requests to complete, until the context expires.
+Layer 4 pools stop accepting too and their connections are waited for as well. Health checks are stopped and
+upgraded connections (which are not tracked by the http server) are closed.
+*/
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	lb.stopOnce.Do(func() {
+		if lb.stopHealthChecks != nil {
+			close(lb.stopHealthChecks)
+		}
+	})
+	pools := lb.GetPools()
+	for _, pool := range pools {
+		pool.stopLayer4()
+		pool.stopDynamicServers()
+	}
+	listeners := lb.GetListeners()
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = listener.stop(ctx)
+		}()
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	for _, pool := range pools {
+		pool.waitLayer4(ctx)
+	}
+	for _, pool := range pools {
+		pool.closeUpgradedConnectionsNow()
 	}
+	return err
 }
 
 func (lb *LoadBalancer) AddPool(pool *Pool) error {
+	// listeners are looked up before locking the pools, RemoveListener locks them in the opposite order
+	if err := lb.checkPoolListeners(pool); err != nil {
+		return err
+	}
+	layer4Address := ""
+	if pool.ListenPort != 0 {
+		layer4Address = lb.layer4Address(pool)
+	}
 	lb.poolMutex.Lock()
 	defer lb.poolMutex.Unlock()
 	_, ok := lb.Pools[pool.Hostname]
 	if ok {
 		return errors.New("Pool already exists")
 	}
+	if pool.IsLayer4() {
+		for _, existing := range lb.Pools {
+			if pool.ListenPort != 0 && existing.Mode == pool.Mode && existing.ListenPort == pool.ListenPort {
+				return fmt.Errorf("listen port %d/%s already used by pool %s", pool.ListenPort, pool.Mode, existing.Hostname)
+			}
+		}
+		if err := pool.startLayer4(layer4Address); err != nil {
+			return err
+		}
+	}
 	lb.Pools[pool.Hostname] = pool
+	pool.startDynamicServers()
 	return nil
 }
 
@@ -70,6 +237,9 @@ func (lb *LoadBalancer) GetPool(hostname string) (*Pool, error) {
 }
 
 func (lb *LoadBalancer) UpdatePool(pool *Pool) error {
+	if err := lb.checkPoolListeners(pool); err != nil {
+		return err
+	}
 	lb.poolMutex.Lock()
 	defer lb.poolMutex.Unlock()
 	existingPool, exists := lb.Pools[pool.Hostname]
@@ -82,14 +252,72 @@ func (lb *LoadBalancer) UpdatePool(pool *Pool) error {
 	existingPool.HealthCheck_numOk.Store(pool.HealthCheck_numOk.Load())
 	existingPool.HealthCheck_numFail.Store(pool.HealthCheck_numFail.Load())
 	existingPool.client.Timeout = time.Duration(pool.HealthCheckTimeout.Load())
+	existingPool.requestIdHeader.Store(pool.requestIdHeader.Load())
+	existingPool.UpgradeGracePeriod.Store(pool.UpgradeGracePeriod.Load())
+	existingPool.UpgradeIdleTimeout.Store(pool.UpgradeIdleTimeout.Load())
+	existingPool.MaxRequestBodyBytes.Store(pool.MaxRequestBodyBytes.Load())
+	existingPool.registrationToken.Store(pool.registrationToken.Load())
+	existingPool.LeaseTtl.Store(pool.LeaseTtl.Load())
+	existingPool.SetListeners(pool.GetListeners())
 	return nil
 }
 
+/*
+UpdateLayer4
+Applies the mode and listen port of the given pool to the existing pool with the same hostname. Only its layer 4
+listener is restarted, servers keep their health state and sticky sessions. If the new listen port can't be
+opened the previous one is opened again.
+*/
+func (lb *LoadBalancer) UpdateLayer4(pool *Pool) error {
+	// listeners are looked up before locking the pools, like in AddPool
+	layer4Address := ""
+	if pool.ListenPort != 0 {
+		layer4Address = lb.layer4Address(pool)
+	}
+	lb.poolMutex.Lock()
+	defer lb.poolMutex.Unlock()
+	existingPool, exists := lb.Pools[pool.Hostname]
+	if !exists {
+		return errors.New("Pool does not exist")
+	}
+	if pool.IsLayer4() && pool.ListenPort != 0 {
+		for _, existing := range lb.Pools {
+			if existing != existingPool && existing.Mode == pool.Mode && existing.ListenPort == pool.ListenPort {
+				return fmt.Errorf("listen port %d/%s already used by pool %s", pool.ListenPort, pool.Mode, existing.Hostname)
+			}
+		}
+	}
+	previousAddress := ""
+	if l4 := existingPool.layer4.Load(); l4 != nil {
+		previousAddress, _, _ = net.SplitHostPort(l4.address)
+	}
+	previousMode, previousPort := existingPool.Mode, existingPool.ListenPort
+	existingPool.stopLayer4()
+	existingPool.layer4.Store(nil)
+	existingPool.Mode = pool.Mode
+	existingPool.ListenPort = pool.ListenPort
+	if !existingPool.IsLayer4() {
+		return nil
+	}
+	err := existingPool.startLayer4(layer4Address)
+	if err != nil {
+		existingPool.Mode = previousMode
+		existingPool.ListenPort = previousPort
+		if existingPool.IsLayer4() {
+			_ = existingPool.startLayer4(previousAddress)
+		}
+	}
+	return err
+}
+
 func (lb *LoadBalancer) RemovePool(hostname string) error {
 	lb.poolMutex.Lock()
 	defer lb.poolMutex.Unlock()
-	if _, exists := lb.Pools[hostname]; exists {
+	if pool, exists := lb.Pools[hostname]; exists {
 		delete(lb.Pools, hostname)
+		pool.stopLayer4()
+		pool.stopDynamicServers()
+		pool.CloseUpgradedConnections()
 		return nil
 	}
 	return errors.New("pool not found")
@@ -99,17 +327,54 @@ func (lb *LoadBalancer) ServeRequest(rw http.ResponseWriter, r *http.Request) {
 	lb.poolMutex.RLock()
 	pool, exists := lb.Pools[r.Host]
 	lb.poolMutex.RUnlock()
-	if !exists {
+	listener := requestListener(r)
+	if !exists || pool.IsLayer4() || (listener != nil && !pool.IsOnListener(listener.Name)) {
 		log.Println("No pool found for host:", r.Host)
 		return
 	}
+	start := time.Now()
+	clientIP, trusted := lb.resolveClientIP(r)
+	r = withClientIP(r, clientIP)
+	requestId := pool.requestId(r)
+	r = withRequestId(r, pool.GetRequestIdHeader(), requestId)
+	r.Header.Set(pool.GetRequestIdHeader(), requestId)
+	rw.Header().Set(pool.GetRequestIdHeader(), requestId)
+	recorder := &responseRecorder{ResponseWriter: rw}
+
+	if limit := maxRequestBodyBytes(pool, listener); limit > 0 {
+		if r.ContentLength > limit {
+			log.Println("Request body too large for host:", r.Host, "request_id:", requestId)
+			http.Error(recorder, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			logAccess(pool, nil, r, recorder, start)
+			return
+		}
+		// chunked bodies are checked while they are streamed to the server, see ServerHost ErrorHandler
+		r.Body = http.MaxBytesReader(recorder, r.Body, limit)
+	}
 	server, err := pool.ChooseServer(r)
 	if err != nil {
-		log.Println("No server available for request to host:", r.Host)
-		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		log.Println("No server available for request to host:", r.Host, "request_id:", requestId)
+		http.Error(recorder, "Service Unavailable", http.StatusServiceUnavailable)
+		logAccess(pool, nil, r, recorder, start)
 		return
 	}
-	server.ServeHTTP(rw, r)
+	setForwardedHeaders(r, clientIP, trusted)
+	server.ServeHTTP(recorder, r)
+	logAccess(pool, server, r, recorder, start)
+}
+
+/*
+maxRequestBodyBytes
+Returns the request body limit of the pool, falling back to the default of the listener.
+*/
+func maxRequestBodyBytes(pool *Pool, listener *Listener) int64 {
+	if limit := pool.MaxRequestBodyBytes.Load(); limit > 0 {
+		return limit
+	}
+	if listener == nil {
+		return 0
+	}
+	return listener.Options.MaxRequestBodyBytes
 }
 
 func (lb *LoadBalancer) GetPools() []*Pool {
@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"context"
+	"continuity/common"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeRequest_MaxRequestBodyBytes(t *testing.T) {
+	var received int
+	lb, pool := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received++
+		_, _ = w.Write(body)
+	})
+	pool.MaxRequestBodyBytes.Store(10)
+
+	testCases := []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+		reachesServer bool
+	}{
+		{"within limit", "0123456789", 10, http.StatusOK, true},
+		{"content length over limit", "0123456789abc", 13, http.StatusRequestEntityTooLarge, false},
+		{"chunked body over limit", "0123456789abc", -1, http.StatusRequestEntityTooLarge, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			received = 0
+			req := httptest.NewRequest("POST", "http://app.lab/", strings.NewReader(tc.body))
+			req.ContentLength = tc.contentLength
+			w := httptest.NewRecorder()
+			lb.ServeRequest(w, req)
+			assert.Equal(t, tc.status, w.Code)
+			if !tc.reachesServer {
+				assert.Equal(t, 0, received)
+			}
+		})
+	}
+}
+
+func TestServeRequest_MaxRequestBodyBytesListenerDefault(t *testing.T) {
+	lb, pool := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {})
+	listener := &Listener{Name: DEFAULT_LISTENER, Options: ListenerOptions{MaxRequestBodyBytes: 5}}
+
+	req := withListener(httptest.NewRequest("POST", "http://app.lab/", strings.NewReader("0123456789")), listener)
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// the pool override wins over the listener default
+	pool.MaxRequestBodyBytes.Store(100)
+	req = withListener(httptest.NewRequest("POST", "http://app.lab/", strings.NewReader("0123456789")), listener)
+	w = httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestNewFrontendServer_Timeouts(t *testing.T) {
+	lb := &LoadBalancer{}
+	server, err := lb.newFrontendServer(ListenerOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, DEFAULT_READ_HEADER_TIMEOUT, server.ReadHeaderTimeout)
+	assert.Zero(t, server.WriteTimeout)
+
+	server, err = lb.newFrontendServer(ListenerOptions{
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 2 * time.Second,
+		IdleTimeout:       time.Minute,
+		MaxHeaderBytes:    8192,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, 30*time.Second, server.ReadTimeout)
+	assert.Equal(t, time.Minute, server.IdleTimeout)
+	assert.Equal(t, 8192, server.MaxHeaderBytes)
+}
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	lb, err := newLoadBalancer([]*Listener{{Name: DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+	address := lb.Listeners[DEFAULT_LISTENER].Addr()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+address+"/", nil)
+		req.Host = "app.lab"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, lb.Shutdown(ctx))
+
+	res := <-results
+	require.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err)
+}
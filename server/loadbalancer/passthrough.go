@@ -0,0 +1,230 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// recordTypeHandshake is the first byte of a TLS connection, the record carrying the ClientHello
+const recordTypeHandshake = 0x16
+
+var errClientHelloRead = errors.New("client hello read")
+
+/*
+sniListener
+Wraps a listener to forward the TLS connections whose SNI matches a TLS pool to its servers, without decrypting
+them. The other connections are returned by Accept, with the bytes read to find the SNI replayed.
+Connections are inspected in their own goroutine, so that a slow client cannot block Accept.
+*/
+type sniListener struct {
+	net.Listener
+	lb        *LoadBalancer
+	listener  *Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	// stopped is closed once the listener no longer accepts connections
+	stopped chan struct{}
+}
+
+func newSniListener(listener net.Listener, lb *LoadBalancer, l *Listener) *sniListener {
+	sni := &sniListener{
+		Listener: listener,
+		lb:       lb,
+		listener: l,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go sni.acceptLoop()
+	return sni
+}
+
+func (l *sniListener) acceptLoop() {
+	defer close(l.stopped)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+/*
+route
+Reads the SNI of a TLS connection and forwards it to the matching TLS pool, otherwise returns it to Accept.
+Nothing is read when there are no TLS pools.
+*/
+func (l *sniListener) route(conn net.Conn) {
+	if !l.lb.hasPassthroughPools() {
+		l.deliver(conn)
+		return
+	}
+	timeout := l.listener.Options.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_READ_HEADER_TIMEOUT
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	peeked := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := peeked.reader.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	serverName := ""
+	if first[0] == recordTypeHandshake {
+		serverName = readServerName(io.TeeReader(peeked.reader, &peeked.buffer))
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if pool := l.lb.passthroughPool(serverName, l.listener); pool != nil {
+		if !pool.servePassthrough(peeked) {
+			_ = conn.Close()
+		}
+		return
+	}
+	l.deliver(peeked)
+}
+
+func (l *sniListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+/*
+readServerName
+Returns the SNI of the ClientHello read from the reader, empty if there is none or it can't be parsed.
+The handshake is aborted as soon as the ClientHello is parsed, nothing is written to the client.
+*/
+func readServerName(reader io.Reader) string {
+	serverName := ""
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}
+	_ = tls.Server(readOnlyConn{reader: reader}, config).Handshake()
+	return serverName
+}
+
+/*
+peekedConn
+A connection whose first bytes were read to find the SNI, they are replayed before the rest of the stream.
+*/
+type peekedConn struct {
+	net.Conn
+	buffer bytes.Buffer
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if c.buffer.Len() > 0 {
+		return c.buffer.Read(b)
+	}
+	return c.reader.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+/*
+readOnlyConn
+The connection the ClientHello is parsed from, writes are discarded.
+*/
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (lb *LoadBalancer) hasPassthroughPools() bool {
+	lb.poolMutex.RLock()
+	defer lb.poolMutex.RUnlock()
+	for _, pool := range lb.Pools {
+		if pool.Mode == PoolMode_TLS {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+passthroughPool
+Returns the TLS pool whose hostname is the SNI and which is reachable on the listener, nil if there is none.
+*/
+func (lb *LoadBalancer) passthroughPool(serverName string, listener *Listener) *Pool {
+	if serverName == "" {
+		return nil
+	}
+	lb.poolMutex.RLock()
+	pool, exists := lb.Pools[serverName]
+	lb.poolMutex.RUnlock()
+	if !exists || pool.Mode != PoolMode_TLS || !pool.IsOnListener(listener.Name) {
+		return nil
+	}
+	return pool
+}
+
+/*
+servePassthrough
+Forwards a TLS connection to a server of the pool, returns false if the pool is being removed.
+*/
+func (p *Pool) servePassthrough(conn net.Conn) bool {
+	l4 := p.layer4.Load()
+	if l4 == nil || l4.closed.Load() {
+		return false
+	}
+	l4.connections.Add(1)
+	defer l4.connections.Done()
+	p.proxyTCP(conn)
+	return true
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"continuity/common"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPool_ForwardsBySNI(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := newLoadBalancer([]*Listener{{Name: DEFAULT_LISTENER, Address: "127.0.0.1"}})
+	require.NoError(t, err)
+	defer lb.Shutdown(context.Background())
+
+	app := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	app.AddServer(server)
+	require.NoError(t, lb.AddPool(app))
+
+	pool := NewPool("secure.lab", time.Second, time.Second, time.Second, 1, 1)
+	require.NoError(t, pool.SetLayer4(PoolMode_TLS, 0))
+	server, err = NewServerHost("tcp://"+strings.TrimPrefix(secure.URL, "https://"), "", common.Condition{})
+	require.NoError(t, err)
+	require.NoError(t, pool.ValidateServer(server))
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+
+	address := lb.Listeners[DEFAULT_LISTENER].Addr()
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "secure.lab", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	// the certificate is the one of the server, the connection was not decrypted
+	assert.True(t, conn.ConnectionState().PeerCertificates[0].Equal(secure.Certificate()))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: secure.lab\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "secure", string(body))
+	assert.Equal(t, uint64(1), server.OkResponsesStats.Load())
+
+	// plain HTTP requests are still served by the listener
+	_, text := get(t, address, "app.lab")
+	assert.Equal(t, "ok", text)
+
+	// TLS connections for other names are left to the listener, which doesn't terminate TLS here
+	conn, err = tls.Dial("tcp", address, &tls.Config{ServerName: "other.lab", InsecureSkipVerify: true})
+	if err == nil {
+		_ = conn.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestReadServerName(t *testing.T) {
+	assert.Equal(t, "", readServerName(strings.NewReader("GET / HTTP/1.1\r\n\r\n")))
+	assert.Equal(t, "", readServerName(strings.NewReader("\x16\x03\x01")))
+}
@@ -2,10 +2,12 @@ package loadbalancer
 
 import (
 	"continuity/common"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"log"
 	"net/http"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,30 +24,98 @@ type Pool struct {
 	HealthCheck_numFail     atomic.Uint32
 	ConditionalServers      []*ServerHost
 	UnconditionalServers    []*ServerHost
-	StickySessions          bool
-	StickyMethod            StickyMethod
-	StickySessionTimeout    time.Duration
-	stickyCookieName        string
-	stickySessionMap        map[string]Session
-	stickySessionMutex      *sync.RWMutex
-	serverListMutex         *sync.RWMutex
+	BackendProxyProtocol    int
+	TransportOptions        TransportOptions
+	tlsConfig               *tls.Config
+	transportMutex          sync.RWMutex
+	sticky                  atomic.Pointer[StickySettings]
+	lbCookie                atomic.Pointer[lbCookie]
+	lbCookieOptions         LbCookieOptions
+	lbCookieSecretGenerated bool
+	stickySessions          *sessionStore
+	stickySessionMutex      sync.RWMutex
+	serverListMutex         sync.RWMutex
 	client                  *http.Client
 	RequestCounter          atomic.Uint64
+	requestIdHeader         atomic.Pointer[string]
+	UpgradeGracePeriod      atomic.Uint64
+	UpgradeIdleTimeout      atomic.Uint64
+	MaxRequestBodyBytes     atomic.Int64
+	Mode                    PoolMode
+	ListenPort              int
+	layer4                  atomic.Pointer[layer4Listener]
+	listeners               atomic.Pointer[[]string]
+	dynamicServers          []*DynamicServer
+	dynamicRunning          bool
+	dynamicMutex            sync.Mutex
+	registrationToken       atomic.Pointer[string]
+	LeaseTtl                atomic.Uint64
+}
+
+/*
+StickySettings
+The sticky session settings of a pool. They are replaced as a whole when they change, while requests are served,
+so that a request never sees a mix of old and new settings.
+*/
+type StickySettings struct {
+	Enabled       bool
+	Method        StickyMethod
+	Timeout       time.Duration
+	SlidingExpiry bool
+	CookieName    string
+	HeaderName    string
+}
+
+func (p *Pool) GetStickySettings() StickySettings {
+	return *p.stickySettings()
+}
+
+func (p *Pool) stickySettings() *StickySettings {
+	if settings := p.sticky.Load(); settings != nil {
+		return settings
+	}
+	return &StickySettings{}
+}
+
+/*
+setStickySettings
+Replaces the sticky session settings with a modified copy. Once the pool is serving, stickySessionMutex must be
+held, so that the sessions are consistent with the settings.
+*/
+func (p *Pool) setStickySettings(update func(settings *StickySettings)) {
+	settings := *p.stickySettings()
+	update(&settings)
+	p.sticky.Store(&settings)
 }
 
 type Session struct {
 	ServerHost *ServerHost
 	CreatedAt  time.Time
+	LastUsed   time.Time
 }
 
-func (s Session) isExpired(sessionDuration time.Duration) bool {
-	return time.Since(s.CreatedAt) > sessionDuration
+/*
+isExpired
+Sessions expire sessionDuration after they were created, or after they were last used with a sliding expiry.
+*/
+func (s Session) isExpired(sessionDuration time.Duration, sliding bool) bool {
+	start := s.CreatedAt
+	if sliding && s.LastUsed.After(start) {
+		start = s.LastUsed
+	}
+	return time.Since(start) > sessionDuration
+}
+
+func (p *Pool) isSessionExpired(s Session) bool {
+	settings := p.stickySettings()
+	return s.isExpired(settings.Timeout, settings.SlidingExpiry)
 }
 
 const (
 	StickyMethod_IP StickyMethod = iota
 	StickyMethod_AppCookie
 	StickyMethod_LBCookie
+	StickyMethod_Header
 )
 
 const LB_COOKIE_NAME = "x-continuity-sticky"
@@ -56,6 +126,7 @@ var StickyMethodName = map[StickyMethod]string{
 	StickyMethod_IP:        "IP",
 	StickyMethod_AppCookie: "AppCookie",
 	StickyMethod_LBCookie:  "LBCookie",
+	StickyMethod_Header:    "Header",
 }
 
 func (s StickyMethod) String() string {
@@ -78,9 +149,7 @@ func NewPool(hostname string,
 		Hostname:             hostname,
 		ConditionalServers:   []*ServerHost{},
 		UnconditionalServers: []*ServerHost{},
-		stickySessionMap:     map[string]Session{},
-		stickySessionMutex:   &sync.RWMutex{},
-		serverListMutex:      &sync.RWMutex{},
+		stickySessions:       newSessionStore(DEFAULT_MAX_STICKY_SESSIONS),
 		client: &http.Client{
 			Timeout: healthCheckTimeout,
 		},
@@ -90,6 +159,7 @@ func NewPool(hostname string,
 	pool.HealthCheckInitialDelay.Store(uint64(healthCheckInitialDelay))
 	pool.HealthCheck_numOk.Store(numOk)
 	pool.HealthCheck_numFail.Store(numFail)
+	pool.UpgradeGracePeriod.Store(uint64(DEFAULT_UPGRADE_GRACE_PERIOD))
 	return pool
 }
 
@@ -110,10 +180,13 @@ func NewPoolWithStickySession(hostname string,
 		healthCheckInitialDelay,
 		numOk,
 		numFail)
-	pool.StickySessions = true
-	pool.StickyMethod = StickyMethod_LBCookie
-	pool.stickyCookieName = LB_COOKIE_NAME
-	pool.StickySessionTimeout = stickySessionTimeout
+	pool.setStickySettings(func(settings *StickySettings) {
+		settings.Enabled = true
+		settings.Method = StickyMethod_LBCookie
+		settings.CookieName = LB_COOKIE_NAME
+		settings.Timeout = stickySessionTimeout
+	})
+	_ = pool.SetLbCookieOptions(DefaultLbCookieOptions())
 	return pool
 }
 
@@ -140,8 +213,10 @@ func NewPoolWithStickySessionCustomCookie(hostname string,
 		stickySessionTimeout,
 		numOk,
 		numFail)
-	pool.StickyMethod = StickyMethod_AppCookie
-	pool.stickyCookieName = cookieName
+	pool.setStickySettings(func(settings *StickySettings) {
+		settings.Method = StickyMethod_AppCookie
+		settings.CookieName = cookieName
+	})
 	return pool, nil
 }
 
@@ -164,18 +239,124 @@ func NewPoolWithIPStickySessions(hostname string,
 		stickySessionTimeout,
 		numOk,
 		numFail)
-	pool.StickyMethod = StickyMethod_IP
+	pool.setStickySettings(func(settings *StickySettings) {
+		settings.Method = StickyMethod_IP
+	})
 	return pool
 }
 
-func (p *Pool) AddServer(server *ServerHost) {
-	if p.StickySessions && p.StickyMethod == StickyMethod_LBCookie {
-		server.setLbCookie(p.stickyCookieName)
+/*
+NewPoolWithHeaderStickySessions
+Creates a new Pool with Sticky Sessions enabled using the value of a request header, like an auth token or
+a tenant Id. Requests without the header are balanced without affinity.
+*/
+func NewPoolWithHeaderStickySessions(hostname string,
+	healthCheckTimeout,
+	interval,
+	healthCheckInitialDelay,
+	stickySessionTimeout time.Duration,
+	numOk,
+	numFail uint32,
+	headerName string) (*Pool, error) {
+	if headerName == "" {
+		return nil, errors.New("header name cannot be empty")
 	}
-	if p.StickySessions && p.StickyMethod == StickyMethod_AppCookie {
-		server.setAppCookieInterceptor(p.stickyCookieName, func(cookieValue string) {
-			p.createStickySession(nil, server, cookieValue)
-		})
+	pool := NewPoolWithStickySession(hostname,
+		healthCheckTimeout,
+		interval,
+		healthCheckInitialDelay,
+		stickySessionTimeout,
+		numOk,
+		numFail)
+	pool.setStickySettings(func(settings *StickySettings) {
+		settings.Method = StickyMethod_Header
+		settings.HeaderName = http.CanonicalHeaderKey(headerName)
+	})
+	return pool, nil
+}
+
+/*
+SetBackendProxyProtocol
+Makes the pool send a PROXY protocol header (version 1 or 2, 0 to disable) to its servers, both when
+proxying requests and for health checks. It must be called before servers are added to the pool.
+*/
+func (p *Pool) SetBackendProxyProtocol(version int) error {
+	if version < 0 || version > 2 {
+		return errors.New("backend PROXY protocol version must be 0 (disabled), 1 or 2")
+	}
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	p.BackendProxyProtocol = version
+	return nil
+}
+
+func (p *Pool) GetBackendProxyProtocol() int {
+	p.transportMutex.RLock()
+	defer p.transportMutex.RUnlock()
+	return p.BackendProxyProtocol
+}
+
+/*
+SetTransportOptions
+Sets timeouts, connection pooling and TLS settings used to reach the servers of the pool, both when proxying
+requests and for health checks. It must be called before servers are added to the pool.
+*/
+func (p *Pool) SetTransportOptions(options TransportOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return err
+	}
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	p.TransportOptions = options
+	p.tlsConfig = tlsConfig
+	return nil
+}
+
+func (p *Pool) GetTransportOptions() TransportOptions {
+	p.transportMutex.RLock()
+	defer p.transportMutex.RUnlock()
+	return p.TransportOptions
+}
+
+/*
+UpdateTransport
+Changes the transport options and backend PROXY protocol version of a pool that is serving. The transport of
+every server is rebuilt in place, servers keep their health state and sticky sessions.
+*/
+func (p *Pool) UpdateTransport(options TransportOptions, proxyProtocolVersion int) error {
+	if proxyProtocolVersion < 0 || proxyProtocolVersion > 2 {
+		return errors.New("backend PROXY protocol version must be 0 (disabled), 1 or 2")
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return err
+	}
+	// servers being added wait for the new settings, so that none keeps the previous transport
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	p.TransportOptions = options
+	p.tlsConfig = tlsConfig
+	p.BackendProxyProtocol = proxyProtocolVersion
+	for _, server := range p.GetServers() {
+		server.setTransport(options, tlsConfig, proxyProtocolVersion)
+	}
+	return nil
+}
+
+func (p *Pool) AddServer(server *ServerHost) {
+	p.transportMutex.RLock()
+	defer p.transportMutex.RUnlock()
+	server.setTransport(p.TransportOptions, p.tlsConfig, p.BackendProxyProtocol)
+	p.configureStickySessions(server)
+	server.upgradeIdleTimeout = func() time.Duration {
+		return time.Duration(p.UpgradeIdleTimeout.Load())
 	}
 	p.serverListMutex.Lock()
 	defer p.serverListMutex.Unlock()
@@ -186,7 +367,105 @@ func (p *Pool) AddServer(server *ServerHost) {
 	}
 }
 
+func (p *Pool) configureStickySessions(server *ServerHost) {
+	server.setLbCookie(nil)
+	server.setAppCookieInterceptor("", nil)
+	settings := p.stickySettings()
+	if settings.Enabled && settings.Method == StickyMethod_LBCookie {
+		server.setLbCookie(p.lbCookie.Load())
+	}
+	if settings.Enabled && settings.Method == StickyMethod_AppCookie {
+		server.setAppCookieInterceptor(settings.CookieName, func(cookieValue string) {
+			p.createStickySession(nil, server, cookieValue)
+		})
+	}
+}
+
+/*
+UpdateStickySessions
+Applies the sticky session settings of the given pool to this pool and its servers.
+Existing sessions are kept unless the sticky method, cookie or header changes.
+*/
+func (p *Pool) UpdateStickySessions(settings *Pool) {
+	maxSessions := settings.GetMaxStickySessions()
+	options := settings.GetLbCookieOptions()
+	updated := settings.GetStickySettings()
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	current := p.stickySettings()
+	if !updated.Enabled || current.Method != updated.Method || current.CookieName != updated.CookieName ||
+		current.HeaderName != updated.HeaderName {
+		p.stickySessions = newSessionStore(maxSessions)
+	}
+	p.stickySessions.maxSessions = maxSessions
+	p.stickySessions.evictAbove(maxSessions)
+	p.sticky.Store(&updated)
+	// a generated secret would make the cookies of the clients invalid
+	if !settings.lbCookieSecretGenerated || p.lbCookieOptions.Secret == "" {
+		p.lbCookieOptions = options
+		p.lbCookieSecretGenerated = settings.lbCookieSecretGenerated
+	} else {
+		options.Secret = p.lbCookieOptions.Secret
+		p.lbCookieOptions = options
+	}
+	if cookie, err := newLbCookie(updated.CookieName, p.Hostname, p.lbCookieOptions, updated.Timeout, updated.SlidingExpiry); err == nil {
+		p.lbCookie.Store(cookie)
+	}
+	p.serverListMutex.RLock()
+	defer p.serverListMutex.RUnlock()
+	for _, server := range append(append([]*ServerHost{}, p.ConditionalServers...), p.UnconditionalServers...) {
+		p.configureStickySessions(server)
+	}
+}
+
+/*
+GetServers
+Returns a copy of the list of servers of the pool, conditional servers first.
+*/
+func (p *Pool) GetServers() []*ServerHost {
+	p.serverListMutex.RLock()
+	defer p.serverListMutex.RUnlock()
+	return append(append([]*ServerHost{}, p.ConditionalServers...), p.UnconditionalServers...)
+}
+
 func (p *Pool) RemoveServer(uuid uuid.UUID) (*ServerHost, error) {
+	server, err := p.removeServer(uuid)
+	if err != nil {
+		return nil, err
+	}
+	go server.CloseUpgradedConnections(time.Duration(p.UpgradeGracePeriod.Load()))
+	return server, nil
+}
+
+/*
+DrainServer
+Stops sending new requests and connections to the server, it's removed from the pool once its requests are
+done and its upgraded connections closed, or after the upgrade grace period.
+*/
+func (p *Pool) DrainServer(uuid uuid.UUID) (*ServerHost, error) {
+	for _, server := range p.GetServers() {
+		if server.Id == uuid {
+			server.ServerStatus.Store(uint32(Draining))
+			go p.drain(server)
+			return server, nil
+		}
+	}
+	return nil, errors.New("server not found in pool")
+}
+
+func (p *Pool) drain(server *ServerHost) {
+	deadline := time.Now().Add(time.Duration(p.UpgradeGracePeriod.Load()))
+	for time.Now().Before(deadline) && (server.activeRequests.Load() > 0 || server.UpgradedConnections() > 0) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := p.removeServer(server.Id); err != nil {
+		return
+	}
+	log.Printf("Pool %s - Server %s drained and removed\n", p.Hostname, server.Address.String())
+	server.CloseUpgradedConnections(0)
+}
+
+func (p *Pool) removeServer(uuid uuid.UUID) (*ServerHost, error) {
 	p.serverListMutex.Lock()
 	defer p.serverListMutex.Unlock()
 	for i, server := range p.ConditionalServers {
@@ -204,10 +483,39 @@ func (p *Pool) RemoveServer(uuid uuid.UUID) (*ServerHost, error) {
 	return nil, errors.New("server not found in pool")
 }
 
-func (p *Pool) Transaction(serverToAdd *ServerHost, serverToRemove uuid.UUID) error {
+/*
+CloseUpgradedConnections
+Closes the upgraded connections of every server of the pool after the pool grace period, used when
+the whole pool is removed.
+*/
+func (p *Pool) CloseUpgradedConnections() {
+	p.serverListMutex.RLock()
+	servers := append(append([]*ServerHost{}, p.ConditionalServers...), p.UnconditionalServers...)
+	p.serverListMutex.RUnlock()
+	for _, server := range servers {
+		go server.CloseUpgradedConnections(time.Duration(p.UpgradeGracePeriod.Load()))
+	}
+}
+
+func (p *Pool) closeUpgradedConnectionsNow() {
+	p.serverListMutex.RLock()
+	servers := append(append([]*ServerHost{}, p.ConditionalServers...), p.UnconditionalServers...)
+	p.serverListMutex.RUnlock()
+	for _, server := range servers {
+		server.CloseUpgradedConnections(0)
+	}
+}
+
+/*
+Transaction
+Adds a server and removes another one once the new server is healthy, or removes the new server if it doesn't get
+healthy. With migrateSessions the sticky sessions of the removed server are moved to the new one.
+*/
+func (p *Pool) Transaction(serverToAdd *ServerHost, serverToRemove uuid.UUID, migrateSessions bool) error {
 	p.AddServer(serverToAdd)
 	timeoutChan := time.After(time.Duration(p.HealthCheckInitialDelay.Load()) + time.Duration(p.HealthCheckTimeout.Load())*time.Duration(p.HealthCheck_numOk.Load()*2) + 1*time.Second)
 	timedOut := false
+wait:
 	for {
 		if serverToAdd.ServerStatus.Load() != uint32(Pending) {
 			break
@@ -215,12 +523,18 @@ func (p *Pool) Transaction(serverToAdd *ServerHost, serverToRemove uuid.UUID) er
 		select {
 		case <-timeoutChan:
 			timedOut = true
-			break
+			break wait
 		default:
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
 	if serverToAdd.ServerStatus.Load() == uint32(Healthy) {
+		// sessions are moved while the old server is still in the pool, otherwise its clients could be balanced
+		// again in between
+		if migrateSessions && p.stickySettings().Enabled {
+			moved := p.MigrateStickySessions(serverToRemove, serverToAdd)
+			log.Printf("Pool %s - %d sticky sessions migrated to server %s\n", p.Hostname, moved, serverToAdd.Address.String())
+		}
 		_, _ = p.RemoveServer(serverToRemove)
 		return nil
 	} else {
@@ -234,7 +548,8 @@ func (p *Pool) Transaction(serverToAdd *ServerHost, serverToRemove uuid.UUID) er
 }
 
 func (p *Pool) ChooseServer(req *http.Request) (*ServerHost, error) {
-	if p.StickySessions {
+	sticky := p.stickySettings().Enabled
+	if sticky {
 		stickyServer := p.getStickyServer(req)
 		if stickyServer != nil && stickyServer.ServerStatus.Load() == uint32(Healthy) {
 			log.Println("Pool", p.Hostname, "- Sticky session hit for server", stickyServer.Address.String())
@@ -246,7 +561,7 @@ func (p *Pool) ChooseServer(req *http.Request) (*ServerHost, error) {
 	defer p.serverListMutex.RUnlock()
 	for _, server := range p.ConditionalServers {
 		if server.ServerStatus.Load() == uint32(Healthy) && server.CheckCondition(req) {
-			if p.StickySessions {
+			if sticky {
 				p.createStickySession(req, server, "")
 			}
 			return server, nil
@@ -264,7 +579,7 @@ func (p *Pool) ChooseServer(req *http.Request) (*ServerHost, error) {
 
 	if len(healtyServers) > 0 {
 		server := healtyServers[p.RequestCounter.Load()%uint64(len(healtyServers))]
-		if p.StickySessions {
+		if sticky {
 			p.createStickySession(req, server, "")
 		}
 		return server, nil
@@ -273,44 +588,64 @@ func (p *Pool) ChooseServer(req *http.Request) (*ServerHost, error) {
 }
 
 func (p *Pool) getStickyServer(req *http.Request) *ServerHost {
-	p.stickySessionMutex.RLock()
-	defer p.stickySessionMutex.RUnlock()
+	// the session is moved to the front of the LRU order, which needs the write lock
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	settings := p.stickySettings()
 	var stickySession Session
-	switch p.StickyMethod {
+	var key string
+	switch settings.Method {
 	case StickyMethod_IP:
-		stickySession = p.stickySessionMap[getHostFromRequest(req)]
+		key = getHostFromRequest(req)
+		stickySession, _ = p.stickySessions.get(key)
 		break
 	case StickyMethod_LBCookie:
-		fallthrough
+		// cookies that were not issued by the load balancer are ignored, clients can't pick their server
+		if cookie := p.lbCookie.Load(); cookie != nil {
+			if serverId, valid := cookie.serverId(req); valid {
+				key = serverId.String()
+				stickySession, _ = p.stickySessions.get(key)
+			}
+		}
+		break
 	case StickyMethod_AppCookie:
-		cookie, err := req.Cookie(p.stickyCookieName)
+		cookie, err := req.Cookie(settings.CookieName)
 		if err == nil {
-			stickySession = p.stickySessionMap[cookie.Value]
+			key = cookie.Value
+			stickySession, _ = p.stickySessions.get(key)
 		}
 		break
+	case StickyMethod_Header:
+		if key = p.headerSessionKey(req); key != "" {
+			stickySession, _ = p.stickySessions.get(key)
+		}
 	}
 	if stickySession != (Session{}) && (!p.CheckIfServerExists(stickySession.ServerHost) ||
-		stickySession.isExpired(p.StickySessionTimeout)) {
+		p.isSessionExpired(stickySession)) {
 		return nil
 	}
+	if stickySession != (Session{}) {
+		p.stickySessions.touch(key)
+	}
 	return stickySession.ServerHost
 }
 
-//TODO evict expired sessions periodically
-
 func (p *Pool) checkIfStickySessionExists(req *http.Request, server *ServerHost, appCookieValue string) bool {
 	p.stickySessionMutex.RLock()
 	defer p.stickySessionMutex.RUnlock()
-	switch p.StickyMethod {
+	switch p.stickySettings().Method {
 	case StickyMethod_IP:
-		v, ok := p.stickySessionMap[getHostFromRequest(req)]
-		return ok && !v.isExpired(p.StickySessionTimeout)
+		v, ok := p.stickySessions.get(getHostFromRequest(req))
+		return ok && !p.isSessionExpired(v)
 	case StickyMethod_LBCookie:
-		v, ok := p.stickySessionMap[server.Id.String()]
-		return ok && !v.isExpired(p.StickySessionTimeout)
+		v, ok := p.stickySessions.get(server.Id.String())
+		return ok && !p.isSessionExpired(v)
 	case StickyMethod_AppCookie:
-		v, ok := p.stickySessionMap[appCookieValue]
-		return ok && !v.isExpired(p.StickySessionTimeout)
+		v, ok := p.stickySessions.get(appCookieValue)
+		return ok && !p.isSessionExpired(v)
+	case StickyMethod_Header:
+		v, ok := p.stickySessions.get(p.headerSessionKey(req))
+		return ok && !p.isSessionExpired(v)
 	}
 	return false
 }
@@ -321,28 +656,50 @@ func (p *Pool) createStickySession(req *http.Request, server *ServerHost, appCoo
 	}
 	p.stickySessionMutex.Lock()
 	defer p.stickySessionMutex.Unlock()
-	switch p.StickyMethod {
+	switch p.stickySettings().Method {
 	case StickyMethod_IP:
 
-		p.stickySessionMap[getHostFromRequest(req)] = Session{
+		p.stickySessions.set(getHostFromRequest(req), Session{
 			ServerHost: server,
 			CreatedAt:  time.Now(),
-		}
+		})
 
 		break
 	case StickyMethod_LBCookie:
-		p.stickySessionMap[server.Id.String()] = Session{
+		p.stickySessions.set(server.Id.String(), Session{
 			ServerHost: server,
 			CreatedAt:  time.Now(),
-		}
+		})
 	case StickyMethod_AppCookie:
-		p.stickySessionMap[appCookieValue] = Session{
+		p.stickySessions.set(appCookieValue, Session{
 			ServerHost: server,
 			CreatedAt:  time.Now(),
+		})
+	case StickyMethod_Header:
+		// requests without the header have no affinity
+		if key := p.headerSessionKey(req); key != "" {
+			p.stickySessions.set(key, Session{
+				ServerHost: server,
+				CreatedAt:  time.Now(),
+			})
 		}
 	}
 }
 
+/*
+headerSessionKey
+Returns the sticky session key of the sticky header of the request, empty if it's missing. The value is hashed
+so that tokens are not kept, listed or saved in clear.
+*/
+func (p *Pool) headerSessionKey(req *http.Request) string {
+	value := req.Header.Get(p.stickySettings().HeaderName)
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
 func (p *Pool) GetStats() map[string]ServerStats {
 	stats := make(map[string]ServerStats)
 	log.Printf("Pool %s Stats:\n", p.Hostname)
@@ -350,8 +707,9 @@ func (p *Pool) GetStats() map[string]ServerStats {
 	defer p.serverListMutex.RUnlock()
 	for _, server := range append(p.ConditionalServers, p.UnconditionalServers...) {
 		stats[server.Address.String()] = ServerStats{
-			OkResponses:    server.OkResponsesStats.Load(),
-			NotOkResponses: server.NotOkResponsesStats.Load(),
+			OkResponses:         server.OkResponsesStats.Load(),
+			NotOkResponses:      server.NotOkResponsesStats.Load(),
+			UpgradedConnections: server.UpgradedConnections(),
 		}
 	}
 	return stats
@@ -370,14 +728,14 @@ func (p *Pool) RunHealthChecks() {
 }
 
 func (p *Pool) check(server *ServerHost) {
-	resp, err := p.client.Get(server.Address.String() + server.HealthCheckPath)
-	defer func() {
-		if err == nil {
-			_ = resp.Body.Close()
-		}
-	}()
+	var healthy bool
+	if p.IsLayer4() {
+		healthy = p.checkLayer4(server)
+	} else {
+		healthy = p.checkHTTP(server)
+	}
 	serverStatus := (ServerStatus)(server.ServerStatus.Load())
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if !healthy {
 		if serverStatus == Healthy || serverStatus == Pending {
 			server.UnHealthyResponses.Add(1)
 			if server.UnHealthyResponses.Load() >= p.HealthCheck_numFail.Load() {
@@ -397,6 +755,20 @@ func (p *Pool) check(server *ServerHost) {
 	server.LastChecked.Store(time.Now().Unix())
 }
 
+func (p *Pool) checkHTTP(server *ServerHost) bool {
+	// health checks go through the server transport: same protocol, TLS settings and PROXY protocol header
+	client := &http.Client{
+		Timeout:   p.client.Timeout,
+		Transport: server.proxy.Load().Transport,
+	}
+	resp, err := client.Get(server.Address.String() + server.HealthCheckPath)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
 func (p *Pool) CheckIfServerExists(host *ServerHost) bool {
 	p.serverListMutex.RLock()
 	defer p.serverListMutex.RUnlock()
@@ -409,11 +781,18 @@ func (p *Pool) CheckIfServerExists(host *ServerHost) bool {
 }
 
 func getHostFromRequest(req *http.Request) string {
-	return strings.Split(req.RemoteAddr, ":")[0]
+	if clientIP, ok := req.Context().Value(clientIPContextKey{}).(string); ok {
+		return clientIP
+	}
+	return remoteHost(req.RemoteAddr)
 }
 
 func (p *Pool) GetStickyCookieName() string {
-	return p.stickyCookieName
+	return p.stickySettings().CookieName
+}
+
+func (p *Pool) GetStickyHeaderName() string {
+	return p.stickySettings().HeaderName
 }
 
 func (p *Pool) CheckServerUUID(serverUUID uuid.UUID) bool {
@@ -0,0 +1,282 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyProtocolHeaderTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/*
+proxyProtocolListener
+Wraps a listener expecting every connection to start with a PROXY protocol v1 or v2 header.
+The header is read lazily on the first Read / RemoteAddr call, so a slow client cannot block Accept.
+*/
+type proxyProtocolListener struct {
+	net.Listener
+	lb *LoadBalancer
+}
+
+func newProxyProtocolListener(listener net.Listener, lb *LoadBalancer) net.Listener {
+	return &proxyProtocolListener{Listener: listener, lb: lb}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), lb: l.lb}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	lb         *LoadBalancer
+	once       sync.Once
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+		src, dst, err := readProxyProtocolHeader(c.reader)
+		if err != nil {
+			c.err = err
+			_ = c.Conn.Close()
+			return
+		}
+		// The header is honoured only if it comes from a trusted proxy, or if no trusted proxies are configured
+		// at all: enabling PROXY protocol on the listener is then the statement of trust.
+		peer := net.ParseIP(remoteHost(c.Conn.RemoteAddr().String()))
+		if src != nil && (len(c.lb.GetTrustedProxies()) == 0 || c.lb.isTrustedProxy(peer)) {
+			c.remoteAddr = src
+			c.localAddr = dst
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+/*
+readProxyProtocolHeader
+Reads a PROXY protocol v1 or v2 header. Source and destination are nil for LOCAL / UNKNOWN connections.
+*/
+func readProxyProtocolHeader(reader *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY protocol header: %w", err)
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(reader)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyProtocolV1(reader)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY protocol v1 header: %w", err)
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	src, err := parseProxyProtocolAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyProtocolAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyProtocolAddr(ip string, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if parsedIP == nil || err != nil {
+		return nil, errors.New("invalid address in PROXY protocol header: " + ip + ":" + port)
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY protocol v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.New("unsupported PROXY protocol version")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY protocol v2 addresses: %w", err)
+	}
+	// LOCAL command: health checks from the proxy itself, keep the real peer address
+	if header[12]&0x0F == 0 {
+		return nil, nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, nil, errors.New("invalid PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))},
+			nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, nil, errors.New("invalid PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))},
+			nil
+	}
+	// AF_UNSPEC / AF_UNIX: nothing we can use
+	return nil, nil, nil
+}
+
+/*
+writeProxyProtocolHeader
+Writes a PROXY protocol header of the given version. If src or dst are nil a LOCAL (v2) or UNKNOWN (v1)
+header is sent, as used for health checks.
+*/
+func writeProxyProtocolHeader(w io.Writer, version int, src, dst *net.TCPAddr) error {
+	switch version {
+	case 1:
+		if src == nil || dst == nil {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP4"
+		if src.IP.To4() == nil || dst.IP.To4() == nil {
+			family = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, src.IP.String(), dst.IP.String(), src.Port, dst.Port)
+		return err
+	case 2:
+		header := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+		if src == nil || dst == nil {
+			header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			_, err := w.Write(header.Bytes())
+			return err
+		}
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			header.Write([]byte{0x21, 0x11, 0x00, 12})
+			header.Write(src.IP.To4())
+			header.Write(dst.IP.To4())
+		} else {
+			header.Write([]byte{0x21, 0x21, 0x00, 36})
+			header.Write(src.IP.To16())
+			header.Write(dst.IP.To16())
+		}
+		header.Write(ports)
+		_, err := w.Write(header.Bytes())
+		return err
+	}
+	return fmt.Errorf("unsupported PROXY protocol version %d", version)
+}
+
+/*
+clientAddr
+Returns the address of the client that originated the request, as resolved by the load balancer.
+The port is known only when the client is the directly connected peer.
+*/
+func clientAddr(req *http.Request) *net.TCPAddr {
+	ip := net.ParseIP(getHostFromRequest(req))
+	if ip == nil {
+		return nil
+	}
+	addr := &net.TCPAddr{IP: ip}
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil && net.ParseIP(host).Equal(ip) {
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return addr
+}
+
+type proxyProtocolAddrsContextKey struct{}
+
+type proxyProtocolAddrs struct {
+	src *net.TCPAddr
+	dst *net.TCPAddr
+}
+
+func withProxyProtocolAddrs(req *http.Request) *http.Request {
+	addrs := proxyProtocolAddrs{src: clientAddr(req)}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs.dst, _ = net.ResolveTCPAddr("tcp", local.String())
+	}
+	return req.WithContext(context.WithValue(req.Context(), proxyProtocolAddrsContextKey{}, addrs))
+}
+
+/*
+proxyProtocolDialer
+Returns a DialContext function sending a PROXY protocol header right after the connection is established.
+Addresses are taken from the request context, a LOCAL / UNKNOWN header is sent when they are not available.
+*/
+func proxyProtocolDialer(version int, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, _ := ctx.Value(proxyProtocolAddrsContextKey{}).(proxyProtocolAddrs)
+		if err := writeProxyProtocolHeader(conn, version, addrs.src, addrs.dst); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocolV1_Parse(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 1.2.3.4 10.0.0.1 51000 80\r\nGET / HTTP/1.1\r\n"))
+	src, dst, err := readProxyProtocolHeader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4:51000", src.String())
+	assert.Equal(t, "10.0.0.1:80", dst.String())
+	rest, _ := io.ReadAll(reader)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+}
+
+func TestProxyProtocolV1_Unknown(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n"))
+	src, dst, err := readProxyProtocolHeader(reader)
+	require.NoError(t, err)
+	assert.Nil(t, src)
+	assert.Nil(t, dst)
+}
+
+func TestProxyProtocol_MissingHeader(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	_, _, err := readProxyProtocolHeader(reader)
+	assert.Error(t, err)
+}
+
+func TestProxyProtocol_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		name    string
+		version int
+		src     *net.TCPAddr
+		dst     *net.TCPAddr
+	}{
+		{"v1 IPv4", 1, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 80}},
+		{"v1 IPv6", 1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{"v2 IPv4", 2, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 80}},
+		{"v2 IPv6", 2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{"v2 LOCAL", 2, nil, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			require.NoError(t, writeProxyProtocolHeader(buffer, tc.version, tc.src, tc.dst))
+			buffer.WriteString("payload")
+			reader := bufio.NewReader(buffer)
+			src, dst, err := readProxyProtocolHeader(reader)
+			require.NoError(t, err)
+			if tc.src == nil {
+				assert.Nil(t, src)
+			} else {
+				assert.Equal(t, tc.src.String(), src.String())
+				assert.Equal(t, tc.dst.String(), dst.String())
+			}
+			rest, _ := io.ReadAll(reader)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener_RemoteAddr(t *testing.T) {
+	lb := &LoadBalancer{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	listener = newProxyProtocolListener(listener, lb)
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\nhello"))
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "203.0.113.7:40000", conn.RemoteAddr().String())
+	data := make([]byte, 5)
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestProxyProtocolListener_UntrustedPeer(t *testing.T) {
+	lb := &LoadBalancer{}
+	require.NoError(t, lb.SetTrustedProxies([]string{"10.0.0.0/8"}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	listener = newProxyProtocolListener(listener, lb)
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\n"))
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", remoteHost(conn.RemoteAddr().String()))
+}
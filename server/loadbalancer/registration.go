@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// REGISTRATION is the ManagedBy of the servers that registered themselves with a lease
+const REGISTRATION = "registration"
+
+const DEFAULT_LEASE_TTL = 30 * time.Second
+
+// MIN_REGISTRATION_TOKEN_LENGTH keeps registration tokens from being guessed
+const MIN_REGISTRATION_TOKEN_LENGTH = 16
+
+/*
+SetRegistration
+Allows servers to register themselves in the pool with the token, their lease expires after leaseTtl without a
+heartbeat. An empty token disables registration, a zero leaseTtl uses DEFAULT_LEASE_TTL.
+*/
+func (p *Pool) SetRegistration(token string, leaseTtl time.Duration) error {
+	if token != "" && len(token) < MIN_REGISTRATION_TOKEN_LENGTH {
+		return fmt.Errorf("registration token must be at least %d characters", MIN_REGISTRATION_TOKEN_LENGTH)
+	}
+	if token == "" && leaseTtl != 0 {
+		return errors.New("lease ttl is only applicable with a registration token")
+	}
+	if leaseTtl == 0 {
+		leaseTtl = DEFAULT_LEASE_TTL
+	}
+	p.registrationToken.Store(&token)
+	p.LeaseTtl.Store(uint64(leaseTtl))
+	return nil
+}
+
+func (p *Pool) GetRegistrationToken() string {
+	if token := p.registrationToken.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+/*
+CheckRegistrationToken
+Returns whether the token allows registering servers in the pool. Always false when registration is disabled.
+*/
+func (p *Pool) CheckRegistrationToken(token string) bool {
+	expected := p.GetRegistrationToken()
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+func (p *Pool) GetLeaseTtl() time.Duration {
+	if ttl := time.Duration(p.LeaseTtl.Load()); ttl != 0 {
+		return ttl
+	}
+	return DEFAULT_LEASE_TTL
+}
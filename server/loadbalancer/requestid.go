@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const DEFAULT_REQUEST_ID_HEADER = "X-Request-ID"
+
+const maxRequestIdLength = 128
+
+type requestIdContextKey struct{}
+
+type requestIdContext struct {
+	header    string
+	requestId string
+}
+
+/*
+SetRequestIdHeader
+Sets the name of the header used to propagate the request ID to the servers and back to the client.
+An empty name restores the default (DEFAULT_REQUEST_ID_HEADER).
+*/
+func (p *Pool) SetRequestIdHeader(name string) error {
+	if name == "" {
+		name = DEFAULT_REQUEST_ID_HEADER
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.New("invalid request ID header name: " + name)
+		}
+	}
+	p.requestIdHeader.Store(&name)
+	return nil
+}
+
+func (p *Pool) GetRequestIdHeader() string {
+	if name := p.requestIdHeader.Load(); name != nil {
+		return *name
+	}
+	return DEFAULT_REQUEST_ID_HEADER
+}
+
+/*
+requestId
+Returns the request ID sent by the client if it's valid, otherwise a new one is generated.
+*/
+func (p *Pool) requestId(req *http.Request) string {
+	requestId := req.Header.Get(p.GetRequestIdHeader())
+	if isValidRequestId(requestId) {
+		return requestId
+	}
+	return uuid.NewString()
+}
+
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=' || c == '@') {
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestId(req *http.Request, header string, requestId string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIdContextKey{}, requestIdContext{header: header, requestId: requestId}))
+}
+
+func getRequestId(req *http.Request) string {
+	value, _ := req.Context().Value(requestIdContextKey{}).(requestIdContext)
+	return value.requestId
+}
+
+/*
+removeRequestIdHeader
+Removes the request ID header from the response of a server, the one set by the load balancer is sent to the
+client. The proxy adds the headers of the server to the response, a server echoing the request ID would send
+it twice.
+*/
+func removeRequestIdHeader(response *http.Response) {
+	if value, ok := response.Request.Context().Value(requestIdContextKey{}).(requestIdContext); ok {
+		response.Header.Del(value.header)
+	}
+}
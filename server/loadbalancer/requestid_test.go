@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"continuity/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoadBalancer(t *testing.T, handler http.HandlerFunc) (*LoadBalancer, *Pool) {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	lb := &LoadBalancer{Pools: map[string]*Pool{}}
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+	return lb, pool
+}
+
+func TestServeRequest_GeneratesRequestId(t *testing.T) {
+	var received string
+	lb, _ := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(DEFAULT_REQUEST_ID_HEADER)
+	})
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, received)
+	assert.Equal(t, received, w.Header().Get(DEFAULT_REQUEST_ID_HEADER))
+}
+
+func TestServeRequest_KeepsValidRequestId(t *testing.T) {
+	var received string
+	lb, pool := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Correlation-Id")
+	})
+	require.NoError(t, pool.SetRequestIdHeader("X-Correlation-Id"))
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.Header.Set("X-Correlation-Id", "abc-123")
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+
+	assert.Equal(t, "abc-123", received)
+	assert.Equal(t, "abc-123", w.Header().Get("X-Correlation-Id"))
+}
+
+func TestServeRequest_RequestIdEchoedByServer(t *testing.T) {
+	lb, _ := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(DEFAULT_REQUEST_ID_HEADER, r.Header.Get(DEFAULT_REQUEST_ID_HEADER))
+	})
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.Header.Set(DEFAULT_REQUEST_ID_HEADER, "abc-123")
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+
+	assert.Equal(t, []string{"abc-123"}, w.Header().Values(DEFAULT_REQUEST_ID_HEADER))
+}
+
+func TestServeRequest_ReplacesInvalidRequestId(t *testing.T) {
+	var received string
+	lb, _ := newTestLoadBalancer(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(DEFAULT_REQUEST_ID_HEADER)
+	})
+
+	req := httptest.NewRequest("GET", "http://app.lab/", nil)
+	req.Header.Set(DEFAULT_REQUEST_ID_HEADER, "<script>alert(1)</script>")
+	w := httptest.NewRecorder()
+	lb.ServeRequest(w, req)
+
+	assert.NotEqual(t, "<script>alert(1)</script>", received)
+	assert.True(t, isValidRequestId(received))
+}
+
+func TestSetRequestIdHeader_Invalid(t *testing.T) {
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	assert.Error(t, pool.SetRequestIdHeader("X Request: Id"))
+	assert.Equal(t, DEFAULT_REQUEST_ID_HEADER, pool.GetRequestIdHeader())
+}
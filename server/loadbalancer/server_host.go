@@ -2,10 +2,13 @@ package loadbalancer
 
 import (
 	"continuity/common"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -29,8 +32,9 @@ var serverStatusName = map[ServerStatus]string{
 }
 
 type ServerStats struct {
-	OkResponses    uint64
-	NotOkResponses uint64
+	OkResponses         uint64
+	NotOkResponses      uint64
+	UpgradedConnections int
 }
 
 func (ss ServerStatus) String() string {
@@ -38,22 +42,37 @@ func (ss ServerStatus) String() string {
 }
 
 type InterceptAppCookieCallback func(cookieValue string)
+
+// appCookieInterceptor is replaced as a whole, the sticky sessions of a pool are updated while it serves requests
+type appCookieInterceptor struct {
+	cookieName string
+	callback   InterceptAppCookieCallback
+}
+
 type ServerHost struct {
-	Id                         uuid.UUID
-	Address                    *url.URL
-	Condition                  common.Condition
-	ServerStatus               atomic.Uint32
-	HealthCheckPath            string
-	LastChecked                atomic.Int64
-	HealthyResponses           atomic.Uint32
-	UnHealthyResponses         atomic.Uint32
-	OkResponsesStats           atomic.Uint64
-	NotOkResponsesStats        atomic.Uint64
-	proxy                      *httputil.ReverseProxy
-	CreatedAt                  int64
-	lbCookieName               string
-	appCookieName              string
-	interceptAppCookieCallback InterceptAppCookieCallback
+	Id                   uuid.UUID
+	Address              *url.URL
+	Condition            common.Condition
+	Protocol             string
+	ManagedBy            string
+	ServerStatus         atomic.Uint32
+	HealthCheckPath      string
+	LastChecked          atomic.Int64
+	HealthyResponses     atomic.Uint32
+	UnHealthyResponses   atomic.Uint32
+	OkResponsesStats     atomic.Uint64
+	NotOkResponsesStats  atomic.Uint64
+	proxy                atomic.Pointer[httputil.ReverseProxy]
+	proxyProtocol        atomic.Int32
+	transportOptions     TransportOptions
+	tlsConfig            *tls.Config
+	CreatedAt            int64
+	lbCookie             atomic.Pointer[lbCookie]
+	appCookieInterceptor atomic.Pointer[appCookieInterceptor]
+	upgradedConns        map[*upgradedConn]struct{}
+	upgradedMutex        sync.Mutex
+	upgradeIdleTimeout   func() time.Duration
+	activeRequests       atomic.Int64
 }
 
 func (sh *ServerHost) String() string {
@@ -79,30 +98,37 @@ func NewServerHost(address string, healtCheckPath string, condition common.Condi
 		HealthCheckPath: healtCheckPath,
 		CreatedAt:       time.Now().Unix(),
 	}
-	server.createProxy(parsed)
+	server.proxy.Store(server.newProxy(nil))
 	server.ServerStatus.Store(uint32(Pending))
 	return server, nil
 }
 
-func (sh *ServerHost) createProxy(parsed *url.URL) {
-	newProxy := httputil.NewSingleHostReverseProxy(parsed)
+func (sh *ServerHost) newProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	newProxy := httputil.NewSingleHostReverseProxy(sh.Address)
+	newProxy.Transport = transport
 	newProxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-		log.Println("Error proxying request to", request.Host, ":", e)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(e, &maxBytesError) {
+			log.Println("Request body too large for", request.Host, ": limit", maxBytesError.Limit, "bytes, request_id:", getRequestId(request))
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println("Error proxying request to", request.Host, ":", e, "request_id:", getRequestId(request))
 		writer.WriteHeader(http.StatusBadGateway)
 		sh.NotOkResponsesStats.Add(1)
 	}
 	newProxy.ModifyResponse = func(response *http.Response) error {
-		if sh.lbCookieName != "" {
-			cookie := &http.Cookie{
-				Name:  sh.lbCookieName,
-				Value: sh.Id.String(),
+		removeRequestIdHeader(response)
+		if cookie := sh.lbCookie.Load(); cookie != nil {
+			// clients already having a valid cookie for this server don't get it again, unless it slides
+			if serverId, valid := cookie.serverId(response.Request); !valid || serverId != sh.Id || cookie.sliding {
+				response.Header.Add("Set-Cookie", cookie.cookie(sh.Id).String())
 			}
-			response.Header.Add("Set-Cookie", cookie.String())
 		}
-		if sh.interceptAppCookieCallback != nil {
+		if interceptor := sh.appCookieInterceptor.Load(); interceptor != nil {
 			for _, cookie := range response.Cookies() {
-				if cookie.Name == sh.appCookieName {
-					sh.interceptAppCookieCallback(cookie.Value)
+				if cookie.Name == interceptor.cookieName {
+					interceptor.callback(cookie.Value)
 					break
 				}
 			}
@@ -110,7 +136,7 @@ func (sh *ServerHost) createProxy(parsed *url.URL) {
 		sh.OkResponsesStats.Add(1)
 		return nil
 	}
-	sh.proxy = newProxy
+	return newProxy
 }
 
 func (sh *ServerHost) CheckCondition(req *http.Request) bool {
@@ -130,18 +156,55 @@ func (sh *ServerHost) SetUnHealty() {
 }
 
 func (sh *ServerHost) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	sh.proxy.ServeHTTP(rw, r)
+	sh.activeRequests.Add(1)
+	defer sh.activeRequests.Add(-1)
+	if sh.proxyProtocol.Load() != 0 {
+		r = withProxyProtocolAddrs(r)
+	}
+	sh.proxy.Load().ServeHTTP(&upgradeTracker{ResponseWriter: rw, server: sh}, r)
 }
 
 func (sh *ServerHost) isReady(initialDelay time.Duration) bool {
 	return !(sh.ServerStatus.Load() == (uint32)(Pending) && time.Since(time.Unix(sh.CreatedAt, 0)) < initialDelay)
 }
 
-func (sh *ServerHost) setLbCookie(name string) {
-	sh.lbCookieName = name
+func (sh *ServerHost) setLbCookie(cookie *lbCookie) {
+	sh.lbCookie.Store(cookie)
 }
 
 func (sh *ServerHost) setAppCookieInterceptor(cookie string, callback InterceptAppCookieCallback) {
-	sh.interceptAppCookieCallback = callback
-	sh.appCookieName = cookie
+	if callback == nil {
+		sh.appCookieInterceptor.Store(nil)
+		return
+	}
+	sh.appCookieInterceptor.Store(&appCookieInterceptor{cookieName: cookie, callback: callback})
+}
+
+/*
+SetProtocol
+Sets the protocol used to talk to the server: http1, h2c (HTTP/2 without TLS, e.g. for gRPC) or h2.
+It must be called before the server is added to a pool.
+*/
+func (sh *ServerHost) SetProtocol(protocol string) error {
+	if err := validateProtocol(protocol, sh.Address.Scheme); err != nil {
+		return err
+	}
+	sh.Protocol = protocol
+	sh.proxy.Store(sh.newProxy(newBackendTransport(sh.transportOptions, sh.tlsConfig, int(sh.proxyProtocol.Load()), sh.Protocol)))
+	return nil
+}
+
+/*
+setTransport
+Applies the transport settings of the pool the server is added to. The server keeps serving while its transport
+is replaced: requests in flight complete on the previous transport, whose idle connections are closed.
+*/
+func (sh *ServerHost) setTransport(options TransportOptions, tlsConfig *tls.Config, proxyProtocolVersion int) {
+	sh.transportOptions = options
+	sh.tlsConfig = tlsConfig
+	sh.proxyProtocol.Store(int32(proxyProtocolVersion))
+	previous := sh.proxy.Swap(sh.newProxy(newBackendTransport(options, tlsConfig, proxyProtocolVersion, sh.Protocol)))
+	if transport, ok := previous.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
 }
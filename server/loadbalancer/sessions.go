@@ -0,0 +1,343 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DEFAULT_MAX_STICKY_SESSIONS bounds the memory used by the sticky sessions of a pool
+const DEFAULT_MAX_STICKY_SESSIONS = 100000
+
+// STICKY_SESSION_SWEEP_INTERVAL is how often expired sticky sessions are evicted
+const STICKY_SESSION_SWEEP_INTERVAL = 30 * time.Second
+
+/*
+SessionInfo
+A sticky session of a pool, as listed by GetStickySessions.
+*/
+type SessionInfo struct {
+	Key        string
+	ServerHost *ServerHost
+	CreatedAt  time.Time
+	LastUsed   time.Time
+}
+
+/*
+StoredSession
+A sticky session as saved to disk, its server is referenced by Id so that it can be restored after a restart.
+*/
+type StoredSession struct {
+	Key       string    `json:"key"`
+	ServerId  uuid.UUID `json:"server_id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+type sessionEntry struct {
+	key     string
+	session Session
+}
+
+/*
+sessionStore
+The sticky sessions of a pool, by key: client IP or cookie value depending on the sticky method.
+Sessions are kept in least recently used order, the oldest ones are evicted when there are more than
+maxSessions. The store is guarded by the stickySessionMutex of the pool.
+*/
+type sessionStore struct {
+	entries     map[string]*list.Element
+	order       *list.List
+	maxSessions int
+}
+
+func newSessionStore(maxSessions int) *sessionStore {
+	return &sessionStore{
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		maxSessions: maxSessions,
+	}
+}
+
+func (s *sessionStore) get(key string) (Session, bool) {
+	element, exists := s.entries[key]
+	if !exists {
+		return Session{}, false
+	}
+	return element.Value.(*sessionEntry).session, true
+}
+
+/*
+touch
+Marks the session as the most recently used one.
+*/
+func (s *sessionStore) touch(key string) {
+	if element, exists := s.entries[key]; exists {
+		element.Value.(*sessionEntry).session.LastUsed = time.Now()
+		s.order.MoveToFront(element)
+	}
+}
+
+/*
+set
+Adds or replaces a session, evicting the least recently used ones above maxSessions.
+*/
+func (s *sessionStore) set(key string, session Session) {
+	session.LastUsed = time.Now()
+	s.put(key, session)
+}
+
+func (s *sessionStore) put(key string, session Session) {
+	if element, exists := s.entries[key]; exists {
+		element.Value = &sessionEntry{key: key, session: session}
+		s.order.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.order.PushFront(&sessionEntry{key: key, session: session})
+	s.evictAbove(s.maxSessions)
+}
+
+/*
+evictAbove
+Evicts the least recently used sessions until there are at most maxSessions, zero meaning no limit.
+*/
+func (s *sessionStore) evictAbove(maxSessions int) {
+	for maxSessions > 0 && s.order.Len() > maxSessions {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *sessionStore) delete(key string) bool {
+	element, exists := s.entries[key]
+	if exists {
+		s.remove(element)
+	}
+	return exists
+}
+
+func (s *sessionStore) remove(element *list.Element) {
+	delete(s.entries, element.Value.(*sessionEntry).key)
+	s.order.Remove(element)
+}
+
+func (s *sessionStore) len() int {
+	return s.order.Len()
+}
+
+/*
+removeIf
+Removes the sessions matching the predicate, returning how many were removed.
+*/
+func (s *sessionStore) removeIf(predicate func(Session) bool) int {
+	removed := 0
+	for element := s.order.Front(); element != nil; {
+		next := element.Next()
+		if predicate(element.Value.(*sessionEntry).session) {
+			s.remove(element)
+			removed++
+		}
+		element = next
+	}
+	return removed
+}
+
+/*
+moveSessions
+Points the sessions of the server with the given Id to another server, returning how many were moved.
+*/
+func (s *sessionStore) moveSessions(from uuid.UUID, to *ServerHost) int {
+	moved := 0
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*sessionEntry)
+		if entry.session.ServerHost != nil && entry.session.ServerHost.Id == from {
+			entry.session.ServerHost = to
+			moved++
+		}
+	}
+	return moved
+}
+
+/*
+list
+Returns the sessions matching the predicate, most recently used first.
+*/
+func (s *sessionStore) list(predicate func(Session) bool) []SessionInfo {
+	sessions := []SessionInfo{}
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*sessionEntry)
+		if !predicate(entry.session) {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			Key:        entry.key,
+			ServerHost: entry.session.ServerHost,
+			CreatedAt:  entry.session.CreatedAt,
+			LastUsed:   entry.session.LastUsed,
+		})
+	}
+	return sessions
+}
+
+/*
+SetMaxStickySessions
+Sets the maximum number of sticky sessions of the pool, the least recently used ones are evicted above it.
+Zero restores the default (DEFAULT_MAX_STICKY_SESSIONS).
+*/
+func (p *Pool) SetMaxStickySessions(maxSessions int) error {
+	if maxSessions < 0 {
+		return errors.New("max sticky sessions cannot be negative")
+	}
+	if maxSessions == 0 {
+		maxSessions = DEFAULT_MAX_STICKY_SESSIONS
+	}
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	p.stickySessions.maxSessions = maxSessions
+	p.stickySessions.evictAbove(maxSessions)
+	return nil
+}
+
+func (p *Pool) GetMaxStickySessions() int {
+	p.stickySessionMutex.RLock()
+	defer p.stickySessionMutex.RUnlock()
+	return p.stickySessions.maxSessions
+}
+
+/*
+SetStickySlidingExpiry
+Makes sticky sessions expire StickySessionTimeout after they were last used instead of after they were created,
+so that active clients are not balanced again in the middle of their session.
+*/
+func (p *Pool) SetStickySlidingExpiry(sliding bool) {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	p.setStickySettings(func(settings *StickySettings) {
+		settings.SlidingExpiry = sliding
+	})
+	_ = p.updateLbCookie()
+}
+
+/*
+GetStickySessions
+Returns the sticky sessions of the pool that are not expired, most recently used first.
+*/
+func (p *Pool) GetStickySessions() []SessionInfo {
+	p.stickySessionMutex.RLock()
+	defer p.stickySessionMutex.RUnlock()
+	return p.stickySessions.list(func(session Session) bool {
+		return !p.isSessionExpired(session)
+	})
+}
+
+/*
+FlushStickySession
+Removes the sticky session with the given key, the next request of the client is balanced again.
+*/
+func (p *Pool) FlushStickySession(key string) error {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	if !p.stickySessions.delete(key) {
+		return errors.New("sticky session not found")
+	}
+	return nil
+}
+
+/*
+FlushStickySessions
+Removes every sticky session of the pool, returning how many were removed.
+*/
+func (p *Pool) FlushStickySessions() int {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	flushed := p.stickySessions.len()
+	p.stickySessions = newSessionStore(p.stickySessions.maxSessions)
+	return flushed
+}
+
+/*
+evictExpiredSessions
+Removes the sticky sessions that expired or whose server is no longer in the pool.
+*/
+func (p *Pool) evictExpiredSessions() {
+	servers := p.serversById()
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	evicted := p.stickySessions.removeIf(func(session Session) bool {
+		return p.isSessionExpired(session) || servers[session.ServerHost.Id] == nil
+	})
+	if evicted > 0 {
+		log.Printf("Pool %s - %d expired sticky sessions evicted\n", p.Hostname, evicted)
+	}
+}
+
+/*
+ExportStickySessions
+Returns the sticky sessions of the pool that are not expired to be saved to disk, least recently used first so
+that RestoreStickySessions rebuilds the same order.
+*/
+func (p *Pool) ExportStickySessions() []StoredSession {
+	sessions := p.GetStickySessions()
+	stored := make([]StoredSession, 0, len(sessions))
+	for i := len(sessions) - 1; i >= 0; i-- {
+		stored = append(stored, StoredSession{
+			Key:       sessions[i].Key,
+			ServerId:  sessions[i].ServerHost.Id,
+			CreatedAt: sessions[i].CreatedAt,
+			LastUsed:  sessions[i].LastUsed,
+		})
+	}
+	return stored
+}
+
+/*
+RestoreStickySessions
+Adds sticky sessions saved by ExportStickySessions to the pool, returning how many were restored.
+Sessions that expired or whose server is no longer in the pool are skipped.
+*/
+func (p *Pool) RestoreStickySessions(sessions []StoredSession) int {
+	if !p.stickySettings().Enabled {
+		return 0
+	}
+	servers := p.serversById()
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	restored := 0
+	for _, stored := range sessions {
+		session := Session{ServerHost: servers[stored.ServerId], CreatedAt: stored.CreatedAt, LastUsed: stored.LastUsed}
+		if session.ServerHost == nil || stored.Key == "" || p.isSessionExpired(session) {
+			continue
+		}
+		p.stickySessions.put(stored.Key, session)
+		restored++
+	}
+	return restored
+}
+
+/*
+MigrateStickySessions
+Moves the sticky sessions of a server to another one, e.g. when a transaction replaces it, so that its clients
+keep their affinity. Returns how many sessions were moved.
+*/
+func (p *Pool) MigrateStickySessions(from uuid.UUID, to *ServerHost) int {
+	p.stickySessionMutex.Lock()
+	defer p.stickySessionMutex.Unlock()
+	moved := p.stickySessions.moveSessions(from, to)
+	if moved > 0 && p.stickySettings().Method == StickyMethod_LBCookie {
+		// the responses of the new server set its Id as cookie value
+		if _, exists := p.stickySessions.get(to.Id.String()); !exists {
+			p.stickySessions.set(to.Id.String(), Session{ServerHost: to, CreatedAt: time.Now()})
+		}
+	}
+	return moved
+}
+
+func (p *Pool) serversById() map[uuid.UUID]*ServerHost {
+	servers := map[uuid.UUID]*ServerHost{}
+	for _, server := range p.GetServers() {
+		servers[server.Id] = server
+	}
+	return servers
+}
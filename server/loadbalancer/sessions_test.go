@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"continuity/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionKeys(sessions []SessionInfo) []string {
+	keys := []string{}
+	for _, session := range sessions {
+		keys = append(keys, session.Key)
+	}
+	return keys
+}
+
+func TestStickySessions_LRUEviction(t *testing.T) {
+	pool := NewPoolWithIPStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	require.NoError(t, pool.SetMaxStickySessions(2))
+	server, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	pool.AddServer(server)
+
+	pool.createIPStickySession("10.0.0.1", server)
+	pool.createIPStickySession("10.0.0.2", server)
+	// reading a session makes it the most recently used one
+	assert.Equal(t, server, pool.getIPStickyServer("10.0.0.1"))
+	pool.createIPStickySession("10.0.0.3", server)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.1"}, sessionKeys(pool.GetStickySessions()))
+	assert.Nil(t, pool.getIPStickyServer("10.0.0.2"))
+
+	require.NoError(t, pool.SetMaxStickySessions(1))
+	assert.Equal(t, []string{"10.0.0.3"}, sessionKeys(pool.GetStickySessions()))
+	assert.Error(t, pool.SetMaxStickySessions(-1))
+	require.NoError(t, pool.SetMaxStickySessions(0))
+	assert.Equal(t, DEFAULT_MAX_STICKY_SESSIONS, pool.GetMaxStickySessions())
+}
+
+func TestStickySessions_EvictAndFlush(t *testing.T) {
+	pool := NewPoolWithIPStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	server, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	removed, err := NewServerHost("http://127.0.0.2:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	pool.AddServer(server)
+	pool.AddServer(removed)
+
+	pool.createIPStickySession("10.0.0.1", server)
+	pool.createIPStickySession("10.0.0.2", removed)
+	pool.stickySessionMutex.Lock()
+	pool.stickySessions.set("10.0.0.3", Session{ServerHost: server, CreatedAt: time.Now().Add(-2 * time.Minute)})
+	pool.stickySessionMutex.Unlock()
+	_, err = pool.RemoveServer(removed.Id)
+	require.NoError(t, err)
+
+	// expired sessions are not listed, but stay until they are evicted
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, sessionKeys(pool.GetStickySessions()))
+	pool.evictExpiredSessions()
+	assert.Equal(t, []string{"10.0.0.1"}, sessionKeys(pool.GetStickySessions()))
+	assert.Equal(t, 1, pool.stickySessions.len())
+
+	assert.EqualError(t, pool.FlushStickySession("10.0.0.9"), "sticky session not found")
+	require.NoError(t, pool.FlushStickySession("10.0.0.1"))
+	assert.Nil(t, pool.getIPStickyServer("10.0.0.1"))
+
+	pool.createIPStickySession("10.0.0.1", server)
+	pool.createIPStickySession("10.0.0.4", server)
+	assert.Equal(t, 2, pool.FlushStickySessions())
+	assert.Empty(t, pool.GetStickySessions())
+}
+
+func TestStickySessions_ExportAndRestore(t *testing.T) {
+	pool := NewPoolWithIPStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	server, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	pool.AddServer(server)
+	pool.createIPStickySession("10.0.0.1", server)
+	pool.createIPStickySession("10.0.0.2", server)
+	stored := pool.ExportStickySessions()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, []string{stored[0].Key, stored[1].Key})
+	assert.Equal(t, server.Id, stored[0].ServerId)
+
+	// the pool of the restarted server has the same servers, loaded from the configuration file
+	restarted := NewPoolWithIPStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	loaded, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	loaded.Id = server.Id
+	restarted.AddServer(loaded)
+	expired := StoredSession{Key: "10.0.0.3", ServerId: server.Id, CreatedAt: time.Now().Add(-2 * time.Minute)}
+	unknown := StoredSession{Key: "10.0.0.4", ServerId: uuid.New(), CreatedAt: time.Now()}
+	assert.Equal(t, 2, restarted.RestoreStickySessions(append(stored, expired, unknown)))
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, sessionKeys(restarted.GetStickySessions()))
+	assert.Equal(t, loaded, restarted.getIPStickyServer("10.0.0.1"))
+	assert.Equal(t, stored[0].CreatedAt, restarted.GetStickySessions()[0].CreatedAt)
+
+	withoutSessions := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	withoutSessions.AddServer(loaded)
+	assert.Equal(t, 0, withoutSessions.RestoreStickySessions(stored))
+}
+
+func TestStickySessions_Migrate(t *testing.T) {
+	pool := NewPoolWithStickySession("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	old, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	other, err := NewServerHost("http://127.0.0.2:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	replacement, err := NewServerHost("http://127.0.0.3:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	for _, server := range []*ServerHost{old, other, replacement} {
+		pool.AddServer(server)
+	}
+	pool.createStickySession(nil, old, "")
+	pool.createStickySession(nil, other, "")
+	_, err = pool.RemoveServer(old.Id)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, pool.MigrateStickySessions(old.Id, replacement))
+	// clients with the cookie of the removed server go to the new one, which then sets its own cookie
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(pool.lbCookie.Load().cookie(old.Id))
+	assert.Equal(t, replacement, pool.getStickyServer(req))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(pool.lbCookie.Load().cookie(replacement.Id))
+	assert.Equal(t, replacement, pool.getStickyServer(req))
+	assert.Len(t, pool.GetStickySessions(), 3)
+	assert.Equal(t, 0, pool.MigrateStickySessions(old.Id, replacement))
+}
+
+func TestStickySessions_SlidingExpiry(t *testing.T) {
+	pool := NewPoolWithIPStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1)
+	server, err := NewServerHost("http://127.0.0.1:8080", "/health", common.Condition{})
+	require.NoError(t, err)
+	pool.AddServer(server)
+	pool.stickySessionMutex.Lock()
+	pool.stickySessions.put("10.0.0.1", Session{ServerHost: server, CreatedAt: time.Now().Add(-2 * time.Minute), LastUsed: time.Now()})
+	pool.stickySessions.put("10.0.0.2", Session{ServerHost: server, CreatedAt: time.Now().Add(-3 * time.Minute), LastUsed: time.Now().Add(-2 * time.Minute)})
+	pool.stickySessionMutex.Unlock()
+
+	// without a sliding expiry sessions expire after their creation, even when used
+	assert.Nil(t, pool.getIPStickyServer("10.0.0.1"))
+	pool.SetStickySlidingExpiry(true)
+	assert.Equal(t, server, pool.getIPStickyServer("10.0.0.1"))
+	assert.Nil(t, pool.getIPStickyServer("10.0.0.2"))
+	assert.Equal(t, []string{"10.0.0.1"}, sessionKeys(pool.GetStickySessions()))
+}
+
+func TestStickySessions_Header(t *testing.T) {
+	_, err := NewPoolWithHeaderStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1, "")
+	assert.EqualError(t, err, "header name cannot be empty")
+	pool, err := NewPoolWithHeaderStickySessions("app.lab", time.Second, time.Second, time.Second, time.Minute, 1, 1, "x-tenant-id")
+	require.NoError(t, err)
+	assert.Equal(t, "X-Tenant-Id", pool.GetStickyHeaderName())
+	for _, address := range []string{"http://127.0.0.1:8080", "http://127.0.0.2:8080"} {
+		server, err := NewServerHost(address, "/health", common.Condition{})
+		require.NoError(t, err)
+		server.SetHealty()
+		pool.AddServer(server)
+	}
+
+	request := func(tenant string) *http.Request {
+		req := httptest.NewRequest("GET", "http://app.lab/", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		return req
+	}
+	first, err := pool.ChooseServer(request("tenant-a"))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		server, err := pool.ChooseServer(request("tenant-a"))
+		require.NoError(t, err)
+		assert.Equal(t, first, server)
+	}
+	// requests without the header are balanced without creating a session
+	_, err = pool.ChooseServer(request(""))
+	require.NoError(t, err)
+	sessions := pool.GetStickySessions()
+	require.Len(t, sessions, 1)
+	assert.NotContains(t, sessions[0].Key, "tenant-a")
+	assert.Equal(t, first, sessions[0].ServerHost)
+}
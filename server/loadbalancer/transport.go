@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	PROTOCOL_HTTP1 = "http1"
+	PROTOCOL_H2C   = "h2c"
+	PROTOCOL_H2    = "h2"
+)
+
+/*
+validateProtocol
+Checks the protocol used to talk to a server against its address: h2c is HTTP/2 without TLS (prior knowledge),
+h2 is HTTP/2 over TLS. An empty protocol negotiates HTTP/2 over TLS and uses HTTP/1.1 otherwise.
+*/
+func validateProtocol(protocol string, scheme string) error {
+	switch protocol {
+	case "", PROTOCOL_HTTP1:
+		return nil
+	case PROTOCOL_H2C:
+		if scheme != "http" {
+			return errors.New("h2c protocol requires an http:// server address")
+		}
+		return nil
+	case PROTOCOL_H2:
+		if scheme != "https" {
+			return errors.New("h2 protocol requires an https:// server address")
+		}
+		return nil
+	}
+	return errors.New("invalid protocol " + protocol + ", possible values are: " + PROTOCOL_HTTP1 + ", " + PROTOCOL_H2C + ", " + PROTOCOL_H2)
+}
+
+/*
+TransportOptions
+Settings of the connections towards the servers of a pool. Zero values keep the defaults of http.DefaultTransport.
+*/
+type TransportOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	// CaFile is a PEM bundle used instead of the system roots to verify https:// servers
+	CaFile string
+	// ClientCertificate and ClientKey are presented to servers requiring mTLS
+	ClientCertificate string
+	ClientKey         string
+	// ServerName overrides the SNI and the name verified in the server certificate
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+/*
+tlsConfig
+Builds the TLS configuration described by the options, loading CA bundle and client certificate from disk.
+Returns nil if the defaults are fine.
+*/
+func (o TransportOptions) tlsConfig() (*tls.Config, error) {
+	if o.CaFile == "" && o.ClientCertificate == "" && o.ClientKey == "" && o.ServerName == "" && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CaFile != "" {
+		pem, err := os.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates found in CA bundle " + o.CaFile)
+		}
+	}
+	if o.ClientCertificate != "" || o.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(o.ClientCertificate, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func (o TransportOptions) validate() error {
+	if o.DialTimeout < 0 || o.TLSHandshakeTimeout < 0 || o.ResponseHeaderTimeout < 0 || o.IdleConnTimeout < 0 {
+		return errors.New("transport timeouts cannot be negative")
+	}
+	if o.MaxIdleConns < 0 || o.MaxIdleConnsPerHost < 0 {
+		return errors.New("transport max idle connections cannot be negative")
+	}
+	return nil
+}
+
+/*
+newBackendTransport
+Creates the transport used to reach the servers of a pool, both for proxying and health checks.
+*/
+func newBackendTransport(options TransportOptions, tlsConfig *tls.Config, proxyProtocolVersion int, protocol string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if options.DialTimeout != 0 {
+		dialer.Timeout = options.DialTimeout
+	}
+	transport.DialContext = dialer.DialContext
+	if options.TLSHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+	if options.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	}
+	if options.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	if options.MaxIdleConns != 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	switch protocol {
+	case PROTOCOL_HTTP1:
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP1(true)
+	case PROTOCOL_H2C:
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case PROTOCOL_H2:
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP2(true)
+	}
+	if proxyProtocolVersion != 0 {
+		transport.DialContext = proxyProtocolDialer(proxyProtocolVersion, dialer.DialContext)
+		// every connection carries the address of a single client, so it can't be reused for others
+		transport.DisableKeepAlives = true
+	}
+	return transport
+}
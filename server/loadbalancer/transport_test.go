@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"continuity/common"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateProtocol(t *testing.T) {
+	assert.NoError(t, validateProtocol("", "http"))
+	assert.NoError(t, validateProtocol(PROTOCOL_HTTP1, "https"))
+	assert.NoError(t, validateProtocol(PROTOCOL_H2C, "http"))
+	assert.NoError(t, validateProtocol(PROTOCOL_H2, "https"))
+	assert.Error(t, validateProtocol(PROTOCOL_H2C, "https"))
+	assert.Error(t, validateProtocol(PROTOCOL_H2, "http"))
+	assert.Error(t, validateProtocol("spdy", "http"))
+}
+
+func TestServeRequest_H2CEndToEnd(t *testing.T) {
+	// gRPC-like backend: HTTP/2 only, answers with trailers
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Backend-Proto", r.Proto)
+		_, _ = io.Copy(w, r.Body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = &http.Protocols{}
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	lb := &LoadBalancer{Pools: map[string]*Pool{}}
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	require.NoError(t, server.SetProtocol(PROTOCOL_H2C))
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+
+	frontendServer, err := lb.newFrontendServer(ListenerOptions{H2C: true})
+	require.NoError(t, err)
+	frontend := httptest.NewUnstartedServer(frontendServer.Handler)
+	frontend.Config = frontendServer
+	frontend.Start()
+	defer frontend.Close()
+
+	transport := &http.Transport{Protocols: &http.Protocols{}}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest("POST", frontend.URL+"/service/Method", http.NoBody)
+	require.NoError(t, err)
+	req.Host = "app.lab"
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, _ = io.ReadAll(resp.Body)
+
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Backend-Proto"))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestSetProtocol_InvalidForScheme(t *testing.T) {
+	server, err := NewServerHost("https://127.0.0.1:8443", "/health", common.Condition{})
+	require.NoError(t, err)
+	assert.Error(t, server.SetProtocol(PROTOCOL_H2C))
+	assert.NoError(t, server.SetProtocol(PROTOCOL_H2))
+	assert.Equal(t, PROTOCOL_H2, server.Protocol)
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	file, err := os.CreateTemp(t.TempDir(), "*.pem")
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}))
+	return file.Name()
+}
+
+func newTestClientCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "continuity"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return writePEM(t, "CERTIFICATE", der), writePEM(t, "EC PRIVATE KEY", keyDer)
+}
+
+func TestTransportOptions_CustomCAAndClientCertificate(t *testing.T) {
+	var clientCertificates int
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertificates = len(r.TLS.PeerCertificates)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+	caFile := writePEM(t, "CERTIFICATE", backend.Certificate().Raw)
+	certFile, keyFile := newTestClientCertificate(t)
+
+	// without the CA the backend certificate is not trusted
+	untrusted := NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	untrusted.AddServer(server)
+	untrusted.check(server)
+	assert.Equal(t, uint32(Unhealthy), server.ServerStatus.Load())
+
+	pool := NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	require.NoError(t, pool.SetTransportOptions(TransportOptions{
+		ResponseHeaderTimeout: time.Second,
+		CaFile:                caFile,
+		ClientCertificate:     certFile,
+		ClientKey:             keyFile,
+		ServerName:            "example.com",
+	}))
+	server, err = NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	pool.AddServer(server)
+	pool.check(server)
+	assert.Equal(t, uint32(Healthy), server.ServerStatus.Load())
+	assert.Equal(t, 1, clientCertificates)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "http://app.lab/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSetTransportOptions_Invalid(t *testing.T) {
+	pool := NewPool("app.lab", time.Second, time.Second, 0, 1, 1)
+	assert.Error(t, pool.SetTransportOptions(TransportOptions{DialTimeout: -time.Second}))
+	assert.Error(t, pool.SetTransportOptions(TransportOptions{CaFile: "/does/not/exist.pem"}))
+	assert.Error(t, pool.SetTransportOptions(TransportOptions{ClientCertificate: "/does/not/exist.pem"}))
+	assert.Equal(t, TransportOptions{}, pool.TransportOptions)
+}
+
+func TestUpdateTransport_WhileServing(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	lb := &LoadBalancer{Pools: map[string]*Pool{}}
+	pool := NewPool("app.lab", time.Second, time.Second, time.Second, 1, 1)
+	server, err := NewServerHost(backend.URL, "/health", common.Condition{})
+	require.NoError(t, err)
+	server.SetHealty()
+	pool.AddServer(server)
+	require.NoError(t, lb.AddPool(pool))
+
+	stop := make(chan struct{})
+	failed := atomic.Int32{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				recorder := httptest.NewRecorder()
+				lb.ServeRequest(recorder, httptest.NewRequest("GET", "http://app.lab/", nil))
+				if recorder.Code != http.StatusOK {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, pool.UpdateTransport(TransportOptions{ResponseHeaderTimeout: time.Duration(i) * time.Second}, 0))
+	}
+	close(stop)
+	wg.Wait()
+	assert.Zero(t, failed.Load())
+	assert.Equal(t, 10*time.Second, pool.GetTransportOptions().ResponseHeaderTimeout)
+	assert.Equal(t, 10*time.Second, server.proxy.Load().Transport.(*http.Transport).ResponseHeaderTimeout)
+	assert.Same(t, server, pool.GetServers()[0])
+	assert.Equal(t, uint32(Healthy), server.ServerStatus.Load())
+
+	// invalid settings change nothing
+	assert.Error(t, pool.UpdateTransport(TransportOptions{}, 3))
+	assert.Error(t, pool.UpdateTransport(TransportOptions{CaFile: "/does/not/exist.pem"}, 0))
+	assert.Equal(t, 10*time.Second, pool.GetTransportOptions().ResponseHeaderTimeout)
+}
@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DEFAULT_UPGRADE_GRACE_PERIOD = 30 * time.Second
+
+/*
+upgradeTracker
+Wraps the ResponseWriter passed to the reverse proxy: the proxy hijacks the client connection when the server
+switches protocol (e.g. WebSocket), so every hijacked connection is registered on the ServerHost.
+*/
+type upgradeTracker struct {
+	http.ResponseWriter
+	server *ServerHost
+}
+
+func (ut *upgradeTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(ut.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ut.server.trackUpgraded(conn), brw, nil
+}
+
+func (ut *upgradeTracker) Unwrap() http.ResponseWriter {
+	return ut.ResponseWriter
+}
+
+type upgradedConn struct {
+	net.Conn
+	server      *ServerHost
+	idleTimeout time.Duration
+	closeOnce   sync.Once
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	c.extendDeadline()
+	return c.Conn.Read(b)
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	c.extendDeadline()
+	return c.Conn.Write(b)
+}
+
+func (c *upgradedConn) extendDeadline() {
+	if c.idleTimeout > 0 {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *upgradedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.server.untrackUpgraded(c)
+	})
+	return c.Conn.Close()
+}
+
+func (sh *ServerHost) trackUpgraded(conn net.Conn) net.Conn {
+	tracked := &upgradedConn{Conn: conn, server: sh}
+	if sh.upgradeIdleTimeout != nil {
+		tracked.idleTimeout = sh.upgradeIdleTimeout()
+	}
+	// deadlines set by the frontend server for the HTTP exchange don't apply to the upgraded connection
+	_ = conn.SetDeadline(time.Time{})
+	tracked.extendDeadline()
+	sh.upgradedMutex.Lock()
+	defer sh.upgradedMutex.Unlock()
+	if sh.upgradedConns == nil {
+		sh.upgradedConns = map[*upgradedConn]struct{}{}
+	}
+	sh.upgradedConns[tracked] = struct{}{}
+	return tracked
+}
+
+func (sh *ServerHost) untrackUpgraded(conn *upgradedConn) {
+	sh.upgradedMutex.Lock()
+	defer sh.upgradedMutex.Unlock()
+	delete(sh.upgradedConns, conn)
+}
+
+func (sh *ServerHost) UpgradedConnections() int {
+	sh.upgradedMutex.Lock()
+	defer sh.upgradedMutex.Unlock()
+	return len(sh.upgradedConns)
+}
+
+/*
+CloseUpgradedConnections
+Closes the upgraded connections (WebSockets and other protocol switches) of the server once the grace period
+has elapsed, giving clients the time to finish their work and reconnect to another server.
+*/
+func (sh *ServerHost) CloseUpgradedConnections(gracePeriod time.Duration) {
+	if sh.UpgradedConnections() == 0 {
+		return
+	}
+	time.Sleep(gracePeriod)
+	sh.upgradedMutex.Lock()
+	conns := make([]*upgradedConn, 0, len(sh.upgradedConns))
+	for conn := range sh.upgradedConns {
+		conns = append(conns, conn)
+	}
+	sh.upgradedMutex.Unlock()
+	if len(conns) > 0 {
+		log.Printf("Closing %d upgraded connections to server %s\n", len(conns), sh.Address.String())
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
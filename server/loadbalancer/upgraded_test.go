@@ -0,0 +1,123 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoUpgradeHandler switches to an "echo" protocol and sends back whatever it receives
+func echoUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	_ = brw.Flush()
+	_, _ = io.Copy(conn, brw)
+}
+
+func dialUpgraded(t *testing.T, lb *LoadBalancer) (net.Conn, *bufio.Reader) {
+	frontend := httptest.NewServer(http.HandlerFunc(lb.ServeRequest))
+	t.Cleanup(frontend.Close)
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: app.lab\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return conn, reader
+}
+
+func TestUpgradedConnections_TrackedAndClosedOnRemoval(t *testing.T) {
+	lb, pool := newTestLoadBalancer(t, echoUpgradeHandler)
+	pool.UpgradeGracePeriod.Store(0)
+	server := pool.UnconditionalServers[0]
+
+	conn, reader := dialUpgraded(t, lb)
+	_, err := conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	assert.Equal(t, 1, server.UpgradedConnections())
+	assert.Equal(t, 1, pool.GetStats()[server.Address.String()].UpgradedConnections)
+
+	_, err = pool.RemoveServer(server.Id)
+	require.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool { return server.UpgradedConnections() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestUpgradedConnections_IdleTimeout(t *testing.T) {
+	lb, pool := newTestLoadBalancer(t, echoUpgradeHandler)
+	pool.UpgradeIdleTimeout.Store(uint64(200 * time.Millisecond))
+	server := pool.UnconditionalServers[0]
+
+	conn, reader := dialUpgraded(t, lb)
+	assert.Equal(t, 1, server.UpgradedConnections())
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool { return server.UpgradedConnections() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestUpgradedConnections_ClosedOnPoolRemoval(t *testing.T) {
+	lb, pool := newTestLoadBalancer(t, echoUpgradeHandler)
+	pool.UpgradeGracePeriod.Store(0)
+
+	conn, reader := dialUpgraded(t, lb)
+	require.NoError(t, lb.RemovePool(pool.Hostname))
+	_, err := lb.GetPool(pool.Hostname)
+	assert.Error(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDrainServer(t *testing.T) {
+	lb, pool := newTestLoadBalancer(t, echoUpgradeHandler)
+	pool.UpgradeGracePeriod.Store(uint64(500 * time.Millisecond))
+	server := pool.UnconditionalServers[0]
+	conn, reader := dialUpgraded(t, lb)
+
+	_, err := pool.DrainServer(server.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(Draining), server.ServerStatus.Load())
+	_, err = pool.ChooseServer(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Error(t, err)
+	// the upgraded connection keeps working until the grace period ends
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	assert.True(t, pool.CheckServerUUID(server.Id))
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, pool.CheckServerUUID(server.Id))
+
+	_, err = pool.DrainServer(server.Id)
+	assert.EqualError(t, err, "server not found in pool")
+}